@@ -38,6 +38,9 @@ func main() {
 		SesModU2d:     make(chan *pfcpiface.SesModU2dMsg, 100),
 		SesDelU2d:     make(chan *pfcpiface.SesDelU2dMsg, 100),
 		ResetSessions: make(chan struct{}, 100),
+		NodeReportD2u: make(chan *pfcpiface.NodeReportD2uMsg, 100),
+		SMFPathU2d:    make(chan *pfcpiface.SMFPathU2dMsg, 100),
+		SesReportD2u:  make(chan *pfcpiface.SesReportD2uMsg, 100),
 	}
 
 	// Read and parse json startup file.
@@ -53,13 +56,13 @@ func main() {
 	upaPfcpi := pfcpiface.NewPFCPIface(conf, pfcpiface.Up)
 	dpaPfcpi := pfcpiface.NewPFCPIface(conf, pfcpiface.Down)
 
-	go func(conf *pfcpiface.Conf) {
+	go func() {
 		time.Sleep(20 * time.Second)
-		err = pfcpiface.RunUPFs(conf)
+		err := dpaPfcpi.RunUPFs()
 		if err != nil {
 			log.Fatalln("Error creating UPFs:", err)
 		}
-	}(&conf)
+	}()
 
 	// blocking
 	//fmt.Println("parham log: calling upaPfcpi.Run for up")
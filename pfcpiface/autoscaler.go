@@ -0,0 +1,571 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright 2022-present Open Networking Foundation
+
+package pfcpiface
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Built-in scaling signals, conf.Autoscaler.Signals[].Name. Any other name is
+// a custom signal, read from the reader registered for it or else the metric
+// of that name of the metrics source.
+const (
+	signalSessions = "sessions" // sessions per UPF
+	signalCPU      = "cpu"      // millicores per UPF
+	signalBitRate  = "bitrate"  // bytes per second received per UPF
+)
+
+type scalingDecision int
+
+const (
+	scaleNone scalingDecision = iota
+	scaleOut
+	scaleIn
+)
+
+func (d scalingDecision) String() string {
+	switch d {
+	case scaleOut:
+		return "scale-out"
+	case scaleIn:
+		return "scale-in"
+	default:
+		return "none"
+	}
+}
+
+// scalingPool is the pool of UPFs the autoscaler measures and resizes.
+type scalingPool interface {
+	// size returns the number of UPFs serving sessions.
+	size() int
+	// signal returns the average value of a signal per UPF.
+	signal(name string) (float64, error)
+	// scaleInAllowed reports whether UPFs may be removed at all, e.g. not
+	// while the sessions of an SMF may be released.
+	scaleInAllowed() bool
+	// scaleOut adds a UPF and returns its name. On a dry run, it returns the
+	// name of the UPF it would add, and adds none.
+	scaleOut(dryRun bool) (string, error)
+	// scaleIn removes a UPF and returns its name, or just returns it on a dry run.
+	scaleIn(dryRun bool) (string, error)
+}
+
+// scalingSignal is a signal and the per UPF values it calls for more UPFs
+// above and fewer below. The gap between the two is the signal's hysteresis.
+type scalingSignal struct {
+	name          string
+	scaleOutAbove float64
+	scaleInBelow  float64
+}
+
+// autoscaler resizes the pool from all its signals, making at most one decision
+// per cycle: out when any signal is above its target, in when all are below
+// theirs, even with one UPF less. A decision must hold for its stabilization
+// window and wait for its cooldown before it is carried out. Every cycle that
+// calls for a scaling is audited, carried out or not.
+type autoscaler struct {
+	mu               sync.Mutex
+	signals          []scalingSignal
+	minUPFs, maxUPFs int
+	allowOut         bool
+	allowIn          bool
+	interval         time.Duration
+	outCooldown      time.Duration // since the last scale-out, before the next one
+	inCooldown       time.Duration // since the last scaling, before a scale-in
+	outWindow        time.Duration
+	inWindow         time.Duration
+	outSince         time.Time // since when scale-out is called for, zero if it isn't
+	inSince          time.Time
+	lastOut          time.Time
+	lastIn           time.Time
+	forecaster       *sessionForecaster // nil unless scale-out is predictive
+	sessionsLimit    float64            // per UPF, for the forecast
+	last             scalingDecision
+	lastAt           time.Time
+	lastAhead        bool // the last decision was called for by the forecast only
+	schedules        *scalingScheduler
+	profile          scalingProfile         // followed in the last cycle
+	baseSignals      []scalingSignal        // configured, before the profile's max sessions
+	onProfile        func(p scalingProfile) // called when the profile changes
+	dryRun           bool                   // decide, but leave the pool as is
+	external         bool                   // an external scaler resizes the pool, from the signals published
+	audit            *scalingAudit
+	published        poolSignals // in the last cycle
+	now              func() time.Time
+}
+
+// autoscalerStatus is the last decision of the autoscaler and forecast.
+type autoscalerStatus struct {
+	LastDecision   string           `json:"last_decision"`
+	LastDecisionAt time.Time        `json:"last_decision_at"`
+	Ahead          bool             `json:"ahead"` // of the load, from the forecast
+	Forecast       *sessionForecast `json:"forecast,omitempty"`
+	Profile        scalingProfile   `json:"profile"`
+	DryRun         bool             `json:"dry_run"`
+	External       bool             `json:"external"`
+}
+
+func newAutoscaler(conf *Conf) *autoscaler {
+	a := &autoscaler{
+		minUPFs:     int(conf.MinUPFs),
+		maxUPFs:     int(conf.MaxUPFs),
+		allowOut:    conf.AutoScaleOut,
+		allowIn:     conf.AutoScaleIn,
+		interval:    durationOrDefault(conf.Autoscaler.Interval, time.Duration(conf.ReconciliationInterval)*time.Second),
+		outCooldown: durationOrDefault(conf.Autoscaler.ScaleOutCooldown, 0),
+		inCooldown:  durationOrDefault(conf.Autoscaler.ScaleInCooldown, 0),
+		outWindow:   durationOrDefault(conf.Autoscaler.ScaleOutWindow, 0),
+		inWindow:    durationOrDefault(conf.Autoscaler.ScaleInWindow, 0),
+		dryRun:      conf.Autoscaler.DryRun,
+		external:    conf.Autoscaler.External,
+		now:         time.Now,
+	}
+
+	if conf.Autoscaler.AuditSize > 0 {
+		a.audit = newScalingAudit(conf.Autoscaler.AuditSize)
+	} else {
+		a.audit = newScalingAudit(scalingAuditSizeDefault)
+	}
+
+	for _, s := range conf.Autoscaler.Signals {
+		a.baseSignals = append(a.baseSignals, scalingSignal{name: s.Name, scaleOutAbove: s.ScaleOutAbove, scaleInBelow: s.ScaleInBelow})
+	}
+
+	var err error
+
+	a.schedules, err = newScalingScheduler(conf)
+	if err != nil {
+		log.Errorln("Scaling schedules ignored:", err)
+	}
+
+	a.followProfile(a.schedules.profile(a.now()))
+
+	if conf.Autoscaler.Predictive.Enable {
+		a.forecaster = newSessionForecaster(conf.Autoscaler.Predictive)
+	}
+
+	return a
+}
+
+// followProfile sets the bounds and thresholds of the profile. A profile with
+// other max sessions than the defaults scales the sessions signal by their
+// ratio, keeping its tolerance and hysteresis proportional.
+func (a *autoscaler) followProfile(p scalingProfile) {
+	a.minUPFs, a.maxUPFs = p.MinUPFs, p.MaxUPFs
+	a.sessionsLimit = float64(p.MaxSessions)
+	a.signals = make([]scalingSignal, 0, len(a.baseSignals))
+
+	for _, s := range a.baseSignals {
+		if s.name == signalSessions {
+			// Relative to the default max sessions, so the configured
+			// tolerance is kept
+			base := float64(a.schedules.defaults.MaxSessions)
+			if base == 0 {
+				base = s.scaleOutAbove
+			}
+
+			if p.MaxSessions != a.schedules.defaults.MaxSessions && base > 0 {
+				ratio := float64(p.MaxSessions) / base
+				s.scaleOutAbove, s.scaleInBelow = s.scaleOutAbove*ratio, s.scaleInBelow*ratio
+			}
+
+			a.sessionsLimit = s.scaleOutAbove
+		}
+
+		a.signals = append(a.signals, s)
+	}
+
+	if p != a.profile {
+		log.Infoln("Autoscaler follows", p)
+
+		a.profile = p
+		if a.onProfile != nil {
+			a.onProfile(p)
+		}
+	}
+}
+
+// recommend returns what the signals call for with n UPFs, why, and the
+// signals read.
+func (a *autoscaler) recommend(pool scalingPool, n int) (scalingDecision, string, []signalReading) {
+	readings := make([]signalReading, 0, len(a.signals))
+	outReason, in := "", n > 1
+
+	for _, s := range a.signals {
+		r := signalReading{Name: s.name, ScaleOutAbove: s.scaleOutAbove, ScaleInBelow: s.scaleInBelow}
+
+		v, err := pool.signal(s.name)
+		if err != nil {
+			log.Debugln("Autoscaler can't read signal", s.name, err)
+
+			r.Error = err.Error()
+			readings = append(readings, r)
+			in = false
+
+			continue
+		}
+
+		r.Value = v
+		readings = append(readings, r)
+
+		if v > s.scaleOutAbove && outReason == "" {
+			outReason = fmt.Sprintf("%s %g above %g", s.name, v, s.scaleOutAbove)
+		}
+
+		// The remaining UPFs must not call for a scale-out right away
+		if v >= s.scaleInBelow || n <= 1 || v*float64(n)/float64(n-1) > s.scaleOutAbove {
+			in = false
+		}
+	}
+
+	switch {
+	case n < a.minUPFs:
+		return scaleOut, fmt.Sprintf("%d UPFs below min_upfs %d", n, a.minUPFs), readings
+	case n > a.maxUPFs:
+		return scaleIn, fmt.Sprintf("%d UPFs above max_upfs %d", n, a.maxUPFs), readings
+	case len(a.signals) == 0:
+		return scaleNone, "", readings
+	case outReason != "":
+		return scaleOut, outReason, readings
+	case in:
+		return scaleIn, "all signals below scale_in_below, also with a UPF less", readings
+	default:
+		return scaleNone, "", readings
+	}
+}
+
+// step makes the decision of one cycle, carries it out unless on a dry run or
+// scaled externally, audits it and publishes the signals of the pool.
+func (a *autoscaler) step(pool scalingPool) scalingDecision {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := a.now()
+	a.followProfile(a.schedules.profile(now))
+
+	n := pool.size()
+	rec, reason, readings := a.recommend(pool, n)
+	recommended := rec
+	ahead := false
+	held := ""
+
+	var forecast *sessionForecast
+
+	// The sessions forecast over the boot time of a UPF scales out ahead of
+	// the load, and holds back a scale-in the load would soon undo
+	if a.forecaster != nil {
+		if perUPF, err := pool.signal(signalSessions); err == nil {
+			fc := a.forecaster.observe(now, int(math.Round(perUPF*float64(n))), n, a.sessionsLimit)
+			forecast = &fc
+
+			switch {
+			case rec == scaleNone && fc.ScaleOutAhead:
+				rec, ahead = scaleOut, true
+				recommended = rec
+				reason = fmt.Sprintf("%.0f sessions forecast per UPF within the boot time, above %g", fc.ForecastPerUPF, a.sessionsLimit)
+			case rec == scaleIn && fc.ScaleInBlocked && n <= a.maxUPFs:
+				rec = scaleNone
+				held = "the sessions forecast needs the UPFs"
+			}
+		}
+	}
+
+	if rec != scaleOut {
+		a.outSince = time.Time{}
+	} else if a.outSince.IsZero() {
+		a.outSince = now
+	}
+
+	if rec != scaleIn {
+		a.inSince = time.Time{}
+	} else if a.inSince.IsZero() {
+		a.inSince = now
+	}
+
+	decision := scaleNone
+
+	switch rec {
+	case scaleOut:
+		switch {
+		case !a.allowOut:
+			held = "scale-out disabled"
+		case n >= a.maxUPFs:
+			held = "at max_upfs"
+		case now.Sub(a.outSince) < a.outWindow:
+			held = "within the scale-out window"
+		case !a.lastOut.IsZero() && now.Sub(a.lastOut) < a.outCooldown:
+			held = "within the scale-out cooldown"
+		default:
+			decision = scaleOut
+		}
+	case scaleIn:
+		lastScaling := a.lastOut
+		if a.lastIn.After(lastScaling) {
+			lastScaling = a.lastIn
+		}
+
+		switch {
+		case !a.allowIn:
+			held = "scale-in disabled"
+		case n <= a.minUPFs:
+			held = "at min_upfs"
+		case !pool.scaleInAllowed():
+			held = "scale-in not allowed by the pool"
+		case now.Sub(a.inSince) < a.inWindow:
+			held = "within the scale-in window"
+		case !lastScaling.IsZero() && now.Sub(lastScaling) < a.inCooldown:
+			held = "within the scale-in cooldown"
+		default:
+			decision = scaleIn
+		}
+	}
+
+	a.published = a.publish(pool, now, n, rec, readings, forecast)
+
+	if recommended == scaleNone {
+		return scaleNone
+	}
+
+	dryRun := a.dryRun || a.external
+
+	r := scalingRecord{
+		At:          now,
+		Recommended: recommended.String(),
+		Decision:    decision.String(),
+		Reason:      reason,
+		Held:        held,
+		UPFs:        n,
+		MinUPFs:     a.minUPFs,
+		MaxUPFs:     a.maxUPFs,
+		Signals:     readings,
+		Forecast:    forecast,
+		DryRun:      dryRun,
+	}
+
+	var err error
+
+	switch decision {
+	case scaleOut:
+		r.UPF, err = pool.scaleOut(dryRun)
+		a.lastOut, a.outSince = now, time.Time{}
+	case scaleIn:
+		r.UPF, err = pool.scaleIn(dryRun)
+		a.lastIn, a.inSince = now, time.Time{}
+	}
+
+	if err != nil {
+		r.Error = err.Error()
+	}
+
+	a.audit.add(r)
+
+	if decision != scaleNone {
+		a.last, a.lastAt, a.lastAhead = decision, now, ahead
+	}
+
+	return decision
+}
+
+// setDryRun switches the dry run on or off.
+func (a *autoscaler) setDryRun(dryRun bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.dryRun != dryRun {
+		log.Infoln("Autoscaler dry run:", dryRun)
+	}
+
+	a.dryRun = dryRun
+}
+
+// status returns the last decision, and forecast if scale-out is predictive.
+func (a *autoscaler) status() autoscalerStatus {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	st := autoscalerStatus{LastDecision: a.last.String(), LastDecisionAt: a.lastAt, Ahead: a.lastAhead, Profile: a.profile, DryRun: a.dryRun, External: a.external}
+
+	if a.forecaster != nil {
+		fc := a.forecaster.status()
+		st.Forecast = &fc
+	}
+
+	return st
+}
+
+// run makes a decision every interval, forever.
+func (a *autoscaler) run(pool scalingPool) {
+	ticker := time.NewTicker(a.interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		a.step(pool)
+	}
+}
+
+// signalReader returns the value of a custom signal for a UPF.
+type signalReader func(u *Upf) (float64, error)
+
+// nodeScalingPool is the pool of UPFs registered with the LB.
+type nodeScalingPool struct {
+	node    *PFCPNode
+	comCh   CommunicationChannel
+	now     func() time.Time
+	rxBytes map[string]rxSample     // last bytes received by each UPF, by name
+	custom  map[string]signalReader // readers of the custom signals, by name
+}
+
+type rxSample struct {
+	bytes uint64
+	at    time.Time
+}
+
+func newNodeScalingPool(node *PFCPNode, comCh CommunicationChannel) *nodeScalingPool {
+	return &nodeScalingPool{
+		node:    node,
+		comCh:   comCh,
+		now:     time.Now,
+		rxBytes: make(map[string]rxSample),
+		custom:  make(map[string]signalReader),
+	}
+}
+
+// serving returns the UPFs of the pool not being drained.
+func (p *nodeScalingPool) serving() []*Upf {
+	var serving []*Upf
+
+	for _, u := range p.node.upf.peersUPF {
+		if p.node.upf.drains == nil || !p.node.upf.drains.draining(u) {
+			serving = append(serving, u)
+		}
+	}
+
+	return serving
+}
+
+func (p *nodeScalingPool) size() int {
+	return len(p.serving())
+}
+
+func (p *nodeScalingPool) scaleInAllowed() bool {
+	return p.node.scaleInAllowed()
+}
+
+func (p *nodeScalingPool) signal(name string) (float64, error) {
+	peers := p.serving()
+	if len(peers) == 0 {
+		return 0, ErrNotFound("UPF")
+	}
+
+	// Including those of the UPFs being drained, soon on the others
+	if name == signalSessions {
+		sessions := 0
+		for _, u := range p.node.upf.peersUPF {
+			sessions += len(u.upfsSessions)
+		}
+
+		return float64(sessions) / float64(len(peers)), nil
+	}
+
+	var (
+		sum   float64
+		count int
+	)
+
+	for _, u := range peers {
+		v, err := p.upfSignal(name, u)
+		if err != nil {
+			log.Debugln("Unable to read", name, "of", u.Hostname, err)
+			continue
+		}
+
+		sum += v
+		count++
+	}
+
+	if count == 0 {
+		return 0, ErrNotFoundWithParam("signal value", "name", name)
+	}
+
+	return sum / float64(count), nil
+}
+
+// upfSignal returns the value of a signal for a UPF.
+func (p *nodeScalingPool) upfSignal(name string, u *Upf) (float64, error) {
+	switch name {
+	case signalCPU:
+		return p.node.upfMetric(u.Hostname, metricCPU)
+	case signalBitRate:
+		v, err := p.node.upfMetric(u.Hostname, metricRxBytes)
+		if err != nil {
+			return 0, err
+		}
+
+		rx := uint64(v)
+		now := p.now()
+		last, ok := p.rxBytes[u.Hostname]
+		p.rxBytes[u.Hostname] = rxSample{bytes: rx, at: now}
+
+		// The first sample, or the counter was reset by a restart
+		if !ok || rx < last.bytes || !now.After(last.at) {
+			return 0, ErrNotFoundWithParam("bitrate", "UPF", u.Hostname)
+		}
+
+		return float64(rx-last.bytes) / now.Sub(last.at).Seconds(), nil
+	default:
+		if read, ok := p.custom[name]; ok {
+			return read(u)
+		}
+
+		// Custom signals are metrics of the UPFs, unless read otherwise
+		return p.node.upfMetric(u.Hostname, name)
+	}
+}
+
+func (p *nodeScalingPool) scaleOut(dryRun bool) (string, error) {
+	// Without asking the orchestrator either
+	if dryRun {
+		var names []string
+		for _, u := range p.node.upf.peersUPF {
+			names = append(names, u.Hostname)
+		}
+
+		return p.node.upf.names.peek(names)
+	}
+
+	return p.node.scaleOutUPF()
+}
+
+// scaleIn drains the UPF with the fewest sessions in the background, and
+// deletes it once empty.
+func (p *nodeScalingPool) scaleIn(dryRun bool) (string, error) {
+	var victim *Upf
+
+	for _, u := range p.serving() {
+		if victim == nil || len(u.upfsSessions) < len(victim.upfsSessions) {
+			victim = u
+		}
+	}
+
+	if victim == nil {
+		return "", ErrNotFound("UPF")
+	}
+
+	if dryRun {
+		return victim.Hostname, nil
+	}
+
+	go func() {
+		if err := p.node.drainAndDelete(victim, p.comCh); err != nil {
+			log.Errorln("Scale-in kept UPF", victim.Hostname, err)
+		}
+	}()
+
+	return victim.Hostname, nil
+}
@@ -0,0 +1,252 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright 2022-present Open Networking Foundation
+
+package pfcpiface
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeScalingPool is a pool whose signals are set by the test.
+type fakeScalingPool struct {
+	upfs      int
+	values    map[string]float64
+	inAllowed bool
+	outs, ins int
+}
+
+func (p *fakeScalingPool) size() int { return p.upfs }
+
+func (p *fakeScalingPool) signal(name string) (float64, error) {
+	v, ok := p.values[name]
+	if !ok {
+		return 0, ErrNotFound(name)
+	}
+
+	return v, nil
+}
+
+func (p *fakeScalingPool) scaleInAllowed() bool { return p.inAllowed }
+
+func (p *fakeScalingPool) scaleOut(dryRun bool) (string, error) {
+	name := fmt.Sprintf("upf%d", 101+p.upfs)
+	if !dryRun {
+		p.outs++
+		p.upfs++
+	}
+
+	return name, nil
+}
+
+func (p *fakeScalingPool) scaleIn(dryRun bool) (string, error) {
+	name := fmt.Sprintf("upf%d", 100+p.upfs)
+	if !dryRun {
+		p.ins++
+		p.upfs--
+	}
+
+	return name, nil
+}
+
+func newTestAutoscaler(now *time.Time, signals ...ScalingSignalInfo) *autoscaler {
+	a := newAutoscaler(&Conf{
+		MinUPFs:      2,
+		MaxUPFs:      4,
+		AutoScaleOut: true,
+		AutoScaleIn:  true,
+		Autoscaler: AutoscalerInfo{
+			ScaleOutCooldown: "1m",
+			ScaleInCooldown:  "5m",
+			ScaleOutWindow:   "20s",
+			ScaleInWindow:    "2m",
+			Signals:          signals,
+		},
+	})
+	a.now = func() time.Time { return *now }
+
+	return a
+}
+
+func TestAutoscalerScaleOut(t *testing.T) {
+	now := time.Unix(0, 0)
+	a := newTestAutoscaler(&now,
+		ScalingSignalInfo{Name: signalSessions, ScaleOutAbove: 100, ScaleInBelow: 20},
+		ScalingSignalInfo{Name: signalCPU, ScaleOutAbove: 800, ScaleInBelow: 200})
+	pool := &fakeScalingPool{upfs: 2, values: map[string]float64{signalSessions: 50, signalCPU: 900}, inAllowed: true}
+
+	require.Equal(t, scaleNone, a.step(pool), "cpu calls for scale-out, not for long enough yet")
+
+	now = now.Add(10 * time.Second)
+	pool.values[signalCPU] = 500
+	require.Equal(t, scaleNone, a.step(pool), "the window restarts")
+
+	pool.values[signalCPU] = 900
+
+	for i := 0; i < 2; i++ {
+		require.Equal(t, scaleNone, a.step(pool))
+		now = now.Add(10 * time.Second)
+	}
+
+	require.Equal(t, scaleOut, a.step(pool), "any signal above its target is enough")
+	require.Equal(t, 3, pool.upfs)
+
+	now = now.Add(30 * time.Second)
+	require.Equal(t, scaleNone, a.step(pool), "cooling down")
+
+	now = now.Add(30 * time.Second)
+	require.Equal(t, scaleOut, a.step(pool))
+	require.Equal(t, 4, pool.upfs)
+
+	now = now.Add(5 * time.Minute)
+	require.Equal(t, scaleNone, a.step(pool), "at max_upfs")
+	require.Equal(t, 2, pool.outs)
+}
+
+func TestAutoscalerScaleIn(t *testing.T) {
+	now := time.Unix(0, 0)
+	a := newTestAutoscaler(&now,
+		ScalingSignalInfo{Name: signalSessions, ScaleOutAbove: 100, ScaleInBelow: 20},
+		ScalingSignalInfo{Name: signalBitRate, ScaleOutAbove: 1e6, ScaleInBelow: 1e5})
+	pool := &fakeScalingPool{upfs: 4, values: map[string]float64{signalSessions: 10}, inAllowed: true}
+
+	for i := 0; i < 20; i++ {
+		require.Equal(t, scaleNone, a.step(pool), "the bitrate is unknown")
+		now = now.Add(10 * time.Second)
+	}
+
+	pool.values[signalBitRate] = 5e5
+	require.Equal(t, scaleNone, a.step(pool), "all signals must be below their target")
+
+	pool.values[signalBitRate] = 5e4
+	require.Equal(t, scaleNone, a.step(pool))
+
+	now = now.Add(2 * time.Minute)
+	require.Equal(t, scaleIn, a.step(pool))
+	require.Equal(t, 3, pool.upfs)
+
+	now = now.Add(4 * time.Minute)
+	require.Equal(t, scaleNone, a.step(pool), "cooling down")
+
+	now = now.Add(time.Minute)
+	pool.inAllowed = false
+	require.Equal(t, scaleNone, a.step(pool), "scale-in held")
+
+	now = now.Add(time.Minute)
+	pool.inAllowed = true
+	require.Equal(t, scaleIn, a.step(pool), "called for since the cooldown began, 2 minutes ago")
+	require.Equal(t, 2, pool.upfs)
+
+	now = now.Add(time.Hour)
+	require.Equal(t, scaleNone, a.step(pool), "at min_upfs")
+}
+
+func TestAutoscalerHysteresis(t *testing.T) {
+	now := time.Unix(0, 0)
+	a := newTestAutoscaler(&now, ScalingSignalInfo{Name: signalSessions, ScaleOutAbove: 100, ScaleInBelow: 70})
+	pool := &fakeScalingPool{upfs: 3, values: map[string]float64{signalSessions: 68}, inAllowed: true}
+
+	for i := 0; i < 30; i++ {
+		require.Equal(t, scaleNone, a.step(pool), "2 UPFs would carry 102 sessions each")
+		now = now.Add(10 * time.Second)
+	}
+
+	pool.values[signalSessions] = 60
+	require.Equal(t, scaleNone, a.step(pool))
+
+	now = now.Add(2 * time.Minute)
+	require.Equal(t, scaleIn, a.step(pool), "2 UPFs carry 90 sessions each")
+}
+
+func TestAutoscalerBounds(t *testing.T) {
+	now := time.Unix(0, 0)
+	a := newTestAutoscaler(&now)
+	a.outWindow = 0
+
+	pool := &fakeScalingPool{upfs: 1, inAllowed: true}
+	require.Equal(t, scaleOut, a.step(pool), "below min_upfs, without any signal")
+
+	now = now.Add(time.Hour)
+	require.Equal(t, scaleNone, a.step(pool))
+}
+
+func TestNodeScalingPoolBitRate(t *testing.T) {
+	now := time.Unix(0, 0)
+	u1 := &Upf{Hostname: "upf101", upfsSessions: []uint64{1, 2, 3}}
+	u2 := &Upf{Hostname: "upf102", upfsSessions: []uint64{4}}
+	m := newStaticMetricsSource(map[string]map[string]float64{
+		"upf101": {metricRxBytes: 0},
+		"upf102": {metricRxBytes: 0},
+	})
+	node := &PFCPNode{upf: &Upf{metrics: m, peersUPF: []*Upf{u1, u2}}}
+
+	p := newNodeScalingPool(node, CommunicationChannel{})
+	p.now = func() time.Time { return now }
+
+	sessions, err := p.signal(signalSessions)
+	require.NoError(t, err)
+	require.Equal(t, 2.0, sessions)
+
+	_, err = p.signal(signalBitRate)
+	require.Error(t, err, "a rate takes two samples")
+
+	now = now.Add(10 * time.Second)
+	m.set("upf101", metricCPU, 300)
+	m.set("upf101", metricRxBytes, 1000)
+	m.set("upf102", metricCPU, 100)
+	m.set("upf102", metricRxBytes, 3000)
+
+	rate, err := p.signal(signalBitRate)
+	require.NoError(t, err)
+	require.Equal(t, 200.0, rate)
+
+	cpu, err := p.signal(signalCPU)
+	require.NoError(t, err)
+	require.Equal(t, 200.0, cpu)
+
+	p.custom["queue"] = func(u *Upf) (float64, error) { return float64(len(u.upfsSessions)) * 10, nil }
+
+	queue, err := p.signal("queue")
+	require.NoError(t, err)
+	require.Equal(t, 20.0, queue)
+
+	m.set("upf102", "jitter", 40)
+
+	jitter, err := p.signal("jitter")
+	require.NoError(t, err)
+	require.Equal(t, 40.0, jitter, "a metric of the source, of the UPFs that report it")
+
+	_, err = p.signal("unknown")
+	require.Error(t, err)
+}
+
+func TestRebalanceLimit(t *testing.T) {
+	u := &Upf{MaxSessionsThreshold: 100, peersUPF: []*Upf{
+		{upfsSessions: make([]uint64, 50)},
+		{upfsSessions: make([]uint64, 49)},
+		{},
+	}}
+	require.Equal(t, 33, u.rebalanceLimit(), "the fair share")
+
+	u.MaxSessionsThreshold = 20
+	require.Equal(t, 20, u.rebalanceLimit())
+}
+
+func TestLegacyScalingSignals(t *testing.T) {
+	signals := legacyScalingSignals(Conf{
+		ScaleBySession:       true,
+		ScaleByCPU:           true,
+		MaxSessionsThreshold: 100,
+		MaxSessionstolerance: 0.5,
+		MinSessionsThreshold: 10,
+		MaxCPUThreshold:      2000,
+		MinCPUThreshold:      100,
+	})
+	require.Equal(t, []ScalingSignalInfo{
+		{Name: signalSessions, ScaleOutAbove: 150, ScaleInBelow: 10},
+		{Name: signalCPU, ScaleOutAbove: 2000, ScaleInBelow: 100},
+	}, signals)
+}
@@ -0,0 +1,205 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright 2022-present Open Networking Foundation
+
+package pfcpiface
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// canaryRouter splits new sessions between the stable UPFs and the canary ones,
+// the UPFs registered with the canary's labels, e.g. {"version": "1.4.0"}.
+type canaryRouter struct {
+	mu      sync.Mutex
+	active  bool
+	labels  map[string]string // labels of the canary UPFs
+	percent uint32            // share of new sessions sent to the canary
+	stable  map[string]string // labels of the stable UPFs, any UPF if empty
+	// sessions routed since the canary started, and how many went to it
+	routed   uint64
+	toCanary uint64
+}
+
+// CanaryStatus is the state of the canary returned by the /canary API.
+type CanaryStatus struct {
+	Active   bool              `json:"active"`
+	Labels   map[string]string `json:"labels,omitempty"`
+	Percent  uint32            `json:"percent"`
+	Stable   map[string]string `json:"stable,omitempty"`
+	Routed   uint64            `json:"routed"`
+	ToCanary uint64            `json:"to_canary"`
+}
+
+func newCanaryRouter(conf CanaryInfo) *canaryRouter {
+	c := &canaryRouter{}
+
+	if len(conf.Labels) > 0 {
+		c.start(conf.Labels, conf.Percent)
+	}
+
+	return c
+}
+
+// hasLabels reports whether labels contains all of selector.
+func hasLabels(labels, selector map[string]string) bool {
+	for k, v := range selector {
+		if labels[k] != v {
+			return false
+		}
+	}
+
+	return true
+}
+
+// start sends percent of the new sessions to the UPFs with labels.
+func (c *canaryRouter) start(labels map[string]string, percent uint32) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.active = true
+	c.labels = labels
+	c.percent = percent
+	c.routed, c.toCanary = 0, 0
+}
+
+// promote makes the canary UPFs the stable ones, all new sessions go to them.
+func (c *canaryRouter) promote() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.active {
+		return ErrNotFound("canary")
+	}
+
+	c.active = false
+	c.stable = c.labels
+	c.labels = nil
+
+	return nil
+}
+
+// abort stops sending new sessions to the canary and returns its labels.
+func (c *canaryRouter) abort() (map[string]string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.active {
+		return nil, ErrNotFound("canary")
+	}
+
+	labels := c.labels
+	c.active = false
+	c.labels = nil
+
+	return labels, nil
+}
+
+// pick routes a new session to the canary or the stable UPFs among peers and
+// returns the set it was routed to. The set is empty if none of peers is in it.
+// Without router, the set is every UPF.
+func (c *canaryRouter) pick(peers []*Upf) func(*Upf) bool {
+	if c == nil {
+		return func(*Upf) bool { return true }
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	canaryUp := false
+
+	for _, u := range peers {
+		if c.active && hasLabels(u.labels, c.labels) {
+			canaryUp = true
+			break
+		}
+	}
+
+	if canaryUp {
+		c.routed++
+
+		if uint64(c.percent)*c.routed > c.toCanary*100 {
+			c.toCanary++
+
+			labels := c.labels
+
+			return func(u *Upf) bool { return hasLabels(u.labels, labels) }
+		}
+	}
+
+	active, labels, stable := c.active, c.labels, c.stable
+
+	return func(u *Upf) bool {
+		if active && hasLabels(u.labels, labels) {
+			return false
+		}
+
+		return hasLabels(u.labels, stable)
+	}
+}
+
+// status returns the state of the canary.
+func (c *canaryRouter) status() CanaryStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return CanaryStatus{
+		Active:   c.active,
+		Labels:   c.labels,
+		Percent:  c.percent,
+		Stable:   c.stable,
+		Routed:   c.routed,
+		ToCanary: c.toCanary,
+	}
+}
+
+// abortCanary stops the canary and drains its UPFs into the stable ones. It
+// returns once the canary UPFs are empty, or an error naming the sessions left
+// on them.
+func (node *PFCPNode) abortCanary(comCh CommunicationChannel) error {
+	labels, err := node.upf.canary.abort()
+	if err != nil {
+		return err
+	}
+
+	var jobs []*drainJob
+
+	stable := node.stableUPFs(labels)
+
+	node.upf.placementMu.Lock()
+	for _, u := range node.upf.peersUPF {
+		if hasLabels(u.labels, labels) {
+			jobs = append(jobs, node.drainUPFInto(u, stable, comCh))
+		}
+	}
+	node.upf.placementMu.Unlock()
+
+	var left []string
+
+	for _, j := range jobs {
+		if err := j.wait(); err != nil {
+			node.upf.placementMu.Lock()
+			left = append(left, fmt.Sprint("sessions ", j.upf.upfsSessions, " on ", j.upf.NodeID, ": ", err))
+			node.upf.placementMu.Unlock()
+		}
+	}
+
+	if len(left) > 0 {
+		return ErrOperationFailedWithReason("canary abort", strings.Join(left, "; "))
+	}
+
+	return nil
+}
+
+// stableUPFs returns whether a UPF is stable, not labeled as the canary.
+func (node *PFCPNode) stableUPFs(canary map[string]string) func(*Upf) bool {
+	c := node.upf.canary
+	c.mu.Lock()
+	stable := c.stable
+	c.mu.Unlock()
+
+	return func(u *Upf) bool {
+		return !hasLabels(u.labels, canary) && hasLabels(u.labels, stable)
+	}
+}
@@ -0,0 +1,94 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright 2022-present Open Networking Foundation
+
+package pfcpiface
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCanaryRouterSplit(t *testing.T) {
+	stable := &Upf{NodeID: "upf1", labels: map[string]string{"version": "1.3.0"}}
+	canary := &Upf{NodeID: "upf2", labels: map[string]string{"version": "1.4.0", "zone": "a"}}
+	peers := []*Upf{stable, canary}
+
+	c := newCanaryRouter(CanaryInfo{Labels: map[string]string{"version": "1.4.0"}, Percent: 20})
+
+	toCanary := 0
+
+	for i := 0; i < 100; i++ {
+		inSet := c.pick(peers)
+		require.NotEqual(t, inSet(stable), inSet(canary), "a session goes to either set")
+
+		if inSet(canary) {
+			toCanary++
+		}
+	}
+
+	require.Equal(t, 20, toCanary)
+	require.Equal(t, CanaryStatus{
+		Active:   true,
+		Labels:   map[string]string{"version": "1.4.0"},
+		Percent:  20,
+		Routed:   100,
+		ToCanary: 20,
+	}, c.status())
+
+	inSet := c.pick([]*Upf{stable})
+	require.True(t, inSet(stable), "sessions stay stable while no canary UPF is up")
+	require.Equal(t, uint64(100), c.status().Routed)
+
+	require.NoError(t, c.promote())
+	require.Error(t, c.promote())
+
+	inSet = c.pick(peers)
+	require.True(t, inSet(canary))
+	require.False(t, inSet(stable), "once promoted, only the canary's version is stable")
+
+	_, err := c.abort()
+	require.Error(t, err, "no canary to abort")
+}
+
+func TestLightestUPFCanary(t *testing.T) {
+	u := &Upf{
+		gtpuPaths:  newGTPUPathMonitor(),
+		migrations: newMigrationTable(),
+		canary:     newCanaryRouter(CanaryInfo{Labels: map[string]string{"version": "1.4.0"}, Percent: 50}),
+	}
+	u1 := &Upf{NodeID: "upf1", upfsSessions: []uint64{1, 2}}
+	u2 := &Upf{NodeID: "upf2", upfsSessions: []uint64{3}, labels: map[string]string{"version": "1.4.0"}}
+	u3 := &Upf{NodeID: "upf3", upfsSessions: []uint64{4, 5, 6}}
+	u.peersUPF = []*Upf{u1, u2, u3}
+	node := &PFCPNode{upf: u}
+
+	require.Equal(t, 1, node.lightestUPF(nil))
+	require.Equal(t, 0, node.lightestUPF(nil), "the stable half goes to the lightest stable UPF")
+	require.Equal(t, 1, node.lightestUPF(nil))
+
+	stable := node.stableUPFs(map[string]string{"version": "1.4.0"})
+	require.True(t, stable(u1))
+	require.False(t, stable(u2))
+}
+
+func TestAbortCanary(t *testing.T) {
+	node := newDrainTestNode(nil, "1h", func(seid uint64, src, dst *Upf) bool {
+		return seid != 4 && landAt(seid, src, dst)
+	})
+	node.upf.canary = newCanaryRouter(CanaryInfo{Labels: map[string]string{"version": "1.4.0"}, Percent: 50})
+	canary := &Upf{Hostname: "upf103", NodeID: "upf103", upfsSessions: []uint64{1, 2, 3}, labels: map[string]string{"version": "1.4.0"}}
+	node.upf.peersUPF = append(node.upf.peersUPF, canary)
+
+	require.NoError(t, node.abortCanary(CommunicationChannel{}))
+	require.Empty(t, canary.upfsSessions)
+	require.ElementsMatch(t, []uint64{1, 2, 3}, append(node.upf.peersUPF[0].upfsSessions, node.upf.peersUPF[1].upfsSessions...))
+	require.Error(t, node.abortCanary(CommunicationChannel{}), "no canary")
+
+	canary.upfsSessions = []uint64{4}
+	node.upf.canary.start(map[string]string{"version": "1.4.0"}, 50)
+
+	err := node.abortCanary(CommunicationChannel{})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "sessions [4] on upf103")
+}
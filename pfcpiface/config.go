@@ -4,8 +4,6 @@
 package pfcpiface
 
 import (
-	"fmt"
-	"strconv"
 	"strings"
 
 	"github.com/omec-project/upf-epc/internal/p4constants"
@@ -25,6 +23,46 @@ const (
 	respTimeoutDefault   = 2 * time.Second
 	hbIntervalDefault    = 5 * time.Second
 	readTimeoutDefault   = 15 * time.Second
+
+	smfHBIntervalDefault  = 5 * time.Second
+	smfN1Default          = 3
+	smfT1Default          = 2 * time.Second
+	smfGracePeriodDefault = 60 * time.Second
+
+	upfResolveIntervalDefault = 10 * time.Second
+
+	teidRangeSizeDefault = 1 << 16
+
+	upfNamespaceDefault   = "omec"
+	upfMetricsPortDefault = "8080"
+
+	upfTemplateDirDefault = "/upfs/templates"
+	upfImageDefault       = "omecproject/upf-epc-bess:master-9a4d86c"
+	upfAgentImageDefault  = "parhamds/upfs-pfcpiface:v0.0.98"
+	upfAccessIPDefault    = "192.168.252.3/24"
+	upfCoreIPDefault      = "192.168.250.3/24"
+	upfLBServiceDefault   = "upf-lb"
+	upfLBHTTPPortDefault  = "8081"
+
+	upfNameTemplateDefault = "upf%d"
+	upfFirstIDDefault      = 101
+	upfLastIDDefault       = 999
+
+	scaleOutCooldownDefault = 60 * time.Second
+	scaleInCooldownDefault  = 5 * time.Minute
+	scaleInWindowDefault    = 2 * time.Minute
+	scalingAuditSizeDefault = 256
+
+	upfBootTimeDefault   = 60 * time.Second
+	forecastAlphaDefault = 0.5
+	forecastBetaDefault  = 0.3
+
+	drainRateDefault     = 50
+	drainDeadlineDefault = 10 * time.Minute
+
+	staticRetryIntervalDefault    = time.Second
+	staticMaxRetryIntervalDefault = time.Minute
+	discoveryIntervalDefault      = 10 * time.Second
 )
 
 // Conf : Json conf struct.
@@ -68,6 +106,22 @@ type Conf struct {
 	MinUPFs                uint32           `json:"min_upfs"`
 	MaxUPFs                uint32           `json:"max_upfs"`
 	Ueransim               bool             `json:"ueransim"`
+	VirtualUPF             VirtualUPFInfo   `json:"virtual_upf"`
+	SMFPath                SMFPathInfo      `json:"smf_path"`
+	UPFResolveInterval     string           `json:"upf_resolve_interval"`
+	TEIDAlloc              TEIDAllocInfo    `json:"teid_alloc"`
+	UEIPAlloc              UEIPAllocInfo    `json:"ue_ip_alloc"`
+	HotStandby             HotStandbyInfo   `json:"hot_standby"`
+	Canary                 CanaryInfo       `json:"canary"`
+	ShadowUPF              ShadowUPFInfo    `json:"shadow_upf"`
+	Orchestrator           OrchestratorInfo `json:"orchestrator"`
+	UPFTemplate            UPFTemplateInfo  `json:"upf_template"`
+	UPFNames               UPFNamesInfo     `json:"upf_names"`
+	Autoscaler             AutoscalerInfo   `json:"autoscaler"`
+	Metrics                MetricsInfo      `json:"metrics"`
+	Drain                  DrainInfo        `json:"drain"`
+	StaticPool             StaticPoolInfo   `json:"static_pool"`
+	Discovery              DiscoveryInfo    `json:"discovery"`
 }
 
 // QciQosConfig : Qos configured attributes.
@@ -110,6 +164,192 @@ type CPIfaceInfo struct {
 	UEIPPool        string   `json:"ue_ip_pool"`
 }
 
+// VirtualUPFInfo : identity advertised to the SMF while no UPF has registered with the LB.
+type VirtualUPFInfo struct {
+	AccessIP        string `json:"access_ip"`
+	AccessIPv6      string `json:"access_ipv6"`
+	Dnn             string `json:"dnn"`
+	EnableUeIPAlloc bool   `json:"enable_ue_ip_alloc"`
+	EnableEndMarker bool   `json:"enable_end_marker"`
+}
+
+// SMFPathInfo : heartbeat and path supervision settings towards the SMF.
+type SMFPathInfo struct {
+	HeartBeatInterval string `json:"heart_beat_interval"`
+	N1                *uint8 `json:"n1"`           // heartbeat retransmissions, 0 for none
+	T1                string `json:"t1"`           // heartbeat response timeout
+	GracePeriod       string `json:"grace_period"` // how long a lost SMF keeps its sessions
+}
+
+// TEIDAllocInfo : allocation of CHOOSE F-TEIDs by the LB on behalf of the pool.
+type TEIDAllocInfo struct {
+	Enable    bool   `json:"enable"`
+	RangeSize uint32 `json:"range_size"` // TEIDs reserved for each UPF
+}
+
+// UEIPAllocInfo : allocation of UE IP addresses by the LB on behalf of the pool.
+type UEIPAllocInfo struct {
+	Enable bool              `json:"enable"`
+	Pools  map[string]string `json:"pools"` // UE subnet by DNN
+}
+
+// HotStandbyInfo : sessions mirrored to a standby UPF taking over when their UPF fails.
+type HotStandbyInfo struct {
+	Enable bool     `json:"enable"`
+	Dnns   []string `json:"dnns"` // DNNs or slice network instances mirrored, all if empty
+}
+
+// CanaryInfo : share of new sessions sent to the UPFs registered with labels.
+type CanaryInfo struct {
+	Labels  map[string]string `json:"labels"` // no canary if empty
+	Percent uint32            `json:"percent"`
+}
+
+// ShadowUPFInfo : UPF mirrored every session request, whose answers are compared
+// with the primary's but never returned to the SMF.
+type ShadowUPFInfo struct {
+	NodeID string `json:"node_id"` // also set by registering a UPF with "shadow": true
+}
+
+// OrchestratorInfo : how the LB creates and deletes the UPFs it scales.
+type OrchestratorInfo struct {
+	Kind      string `json:"kind"`      // "kubernetes", "fake" or "none"
+	Namespace string `json:"namespace"` // of the UPFs
+}
+
+// StaticPoolInfo : UPFs the LB associates with on its own, e.g. on bare metal,
+// rather than waiting for them to register over HTTP. A failed association is
+// retried, and a lost one redone, after a backoff doubling up to MaxRetryInterval.
+type StaticPoolInfo struct {
+	UPFs             []StaticUPFInfo `json:"upfs"` // and cpiface.peers, without metadata
+	RetryInterval    string          `json:"retry_interval"`
+	MaxRetryInterval string          `json:"max_retry_interval"`
+}
+
+// StaticUPFInfo : a UPF of the static pool, what it would register with otherwise.
+type StaticUPFInfo struct {
+	Address  string            `json:"address"`   // IP or FQDN of its N4 interface
+	Hostname string            `json:"hostname"`  // its name in the pool, Address if empty
+	NodeID   string            `json:"node_id"`   // learnt on association if empty
+	AccessIP string            `json:"access_ip"` // N3
+	CoreIP   string            `json:"core_ip"`   // N6
+	Dnn      string            `json:"dnn"`       // cpiface.dnn if empty
+	Labels   map[string]string `json:"labels"`
+}
+
+// DiscoveryInfo : UPFs found by resolving a DNS SRV record or the name of a
+// Kubernetes headless service every interval, associated with like those of
+// the static pool, and drained once no longer found.
+type DiscoveryInfo struct {
+	SRV      string `json:"srv"`     // e.g. "_pfcp._udp.upf.omec.svc.cluster.local", a UPF per target
+	Service  string `json:"service"` // e.g. "upf.omec.svc.cluster.local", a UPF per address
+	Interval string `json:"interval"`
+}
+
+// DrainInfo : how the sessions of a UPF are moved off it before it is deleted.
+type DrainInfo struct {
+	Rate     float64 `json:"rate"`     // sessions moved per second
+	Deadline string  `json:"deadline"` // to empty the UPF, which is kept otherwise
+}
+
+// MetricsInfo : where the usage of the UPFs the LB scales is read from. Sources
+// are asked in order, until one measures the metric.
+type MetricsInfo struct {
+	Sources     []string                      `json:"sources"`      // "kubernetes", "prometheus" or "static"
+	ExporterURL string                        `json:"exporter_url"` // of a UPF's Prometheus metrics, formatted with its name
+	Series      map[string]string             `json:"series"`       // Prometheus series of each metric, summed
+	Static      map[string]map[string]float64 `json:"static"`       // values of each metric, by UPF
+}
+
+// UPFTemplateInfo : values the UPF manifests are rendered with from the templates
+// of TemplateDir, along with the slice meter, QoS and ueransim settings.
+type UPFTemplateInfo struct {
+	TemplateDir string       `json:"template_dir"`
+	Image       string       `json:"image"`
+	AgentImage  string       `json:"agent_image"`
+	Resources   UPFResources `json:"resources"`
+	AccessIP    string       `json:"access_ip"`
+	CoreIP      string       `json:"core_ip"`
+	// Next hops of the routes of a UPF towards the gNBs and the core, its
+	// routes are left out if empty. They differ between UPFs, set in UPFs.
+	AccessGateway string `json:"access_gateway"`
+	CoreGateway   string `json:"core_gateway"`
+	// /pre-stop of the LB called by the pre-stop hook of a UPF pod, which is
+	// given drain.deadline to complete
+	PreStopURL string                   `json:"pre_stop_url"`
+	UPFs       map[string]UPFValuesInfo `json:"upfs"` // values of a UPF, by name, overriding the above
+}
+
+// AutoscalerInfo : one scaling decision per interval from all the signals, held
+// for a stabilization window and spaced by cooldowns.
+type AutoscalerInfo struct {
+	Interval         string                `json:"interval"` // reconciliation_interval if empty
+	ScaleOutCooldown string                `json:"scale_out_cooldown"`
+	ScaleInCooldown  string                `json:"scale_in_cooldown"` // since any scaling
+	ScaleOutWindow   string                `json:"scale_out_window"`  // scale-out must be called for this long
+	ScaleInWindow    string                `json:"scale_in_window"`
+	Signals          []ScalingSignalInfo   `json:"signals"` // from scalebysession, scalebycpu and scalebybitrate if empty
+	Predictive       PredictiveScalingInfo `json:"predictive"`
+	Timezone         string                `json:"timezone"`   // of the schedules, e.g. "Europe/Paris", local if empty
+	Schedules        []ScalingScheduleInfo `json:"schedules"`  // the first active one applies
+	DryRun           bool                  `json:"dry_run"`    // record the decisions without carrying them out
+	AuditSize        int                   `json:"audit_size"` // decisions kept for /autoscaler/decisions
+	// External leaves the pool to an external scaler, e.g. HPA or KEDA, fed by
+	// /scaling/metrics: the autoscaler decides as on a dry run and no UPF is
+	// created at start.
+	External bool `json:"external"`
+}
+
+// ScalingScheduleInfo : bounds and max sessions of the pool from Start to End on
+// Days, overriding min_upfs, max_upfs and max_sessions_threshold where set.
+type ScalingScheduleInfo struct {
+	Name                 string   `json:"name"`
+	Days                 []string `json:"days"`  // "mon" to "sun", every day if empty
+	Start                string   `json:"start"` // "HH:MM"
+	End                  string   `json:"end"`   // exclusive, the next day if before Start
+	MinUPFs              uint32   `json:"min_upfs"`
+	MaxUPFs              uint32   `json:"max_upfs"`
+	MaxSessionsThreshold uint32   `json:"max_sessions_threshold"`
+}
+
+// PredictiveScalingInfo : scale out ahead of the sessions forecast over the boot
+// time of a UPF, from the trend of the sessions smoothed by Holt's method.
+type PredictiveScalingInfo struct {
+	Enable   bool    `json:"enable"`
+	BootTime string  `json:"boot_time"` // until a new UPF serves sessions, the horizon of the forecast
+	Alpha    float64 `json:"alpha"`     // smoothing of the level, in (0, 1]
+	Beta     float64 `json:"beta"`      // smoothing of the trend, in (0, 1]
+}
+
+// ScalingSignalInfo : per UPF values of a signal calling for more UPFs above,
+// fewer below. Name is sessions, cpu (millicores), bitrate (bytes/s) or a custom one.
+type ScalingSignalInfo struct {
+	Name          string  `json:"name"`
+	ScaleOutAbove float64 `json:"scale_out_above"`
+	ScaleInBelow  float64 `json:"scale_in_below"`
+}
+
+// UPFNamesInfo : names given to the UPFs created on scale-out, Template formatted
+// with an ID from FirstID to LastID.
+type UPFNamesInfo struct {
+	Template   string `json:"template"` // e.g. "upf%d"
+	FirstID    uint32 `json:"first_id"`
+	LastID     uint32 `json:"last_id"`
+	Reuse      string `json:"reuse"`       // "lowest" free ID or "next" one after the last allocated
+	ReuseAfter string `json:"reuse_after"` // since the UPF of a name was deleted
+}
+
+// UPFValuesInfo : values of a single UPF, those left empty are the pool's.
+type UPFValuesInfo struct {
+	Image         string       `json:"image"`
+	AgentImage    string       `json:"agent_image"`
+	Resources     UPFResources `json:"resources"`
+	AccessIP      string       `json:"access_ip"`
+	CoreIP        string       `json:"core_ip"`
+	AccessGateway string       `json:"access_gateway"`
+	CoreGateway   string       `json:"core_gateway"`
+}
+
 // IfaceType : Gateway interface struct.
 type IfaceType struct {
 	IfName string `json:"ifname"`
@@ -170,6 +410,16 @@ func validateConf(conf Conf) error {
 		}
 	}
 
+	if conf.VirtualUPF.AccessIP != "" && net.ParseIP(conf.VirtualUPF.AccessIP) == nil {
+		return ErrInvalidArgumentWithReason("conf.VirtualUPF.AccessIP", conf.VirtualUPF.AccessIP, "invalid IP")
+	}
+
+	if conf.VirtualUPF.AccessIPv6 != "" {
+		if ip := net.ParseIP(conf.VirtualUPF.AccessIPv6); ip == nil || ip.To4() != nil {
+			return ErrInvalidArgumentWithReason("conf.VirtualUPF.AccessIPv6", conf.VirtualUPF.AccessIPv6, "invalid IPv6")
+		}
+	}
+
 	if _, err := time.ParseDuration(conf.RespTimeout); err != nil {
 		return ErrInvalidArgumentWithReason("conf.RespTimeout", conf.RespTimeout, "invalid duration")
 	}
@@ -188,6 +438,183 @@ func validateConf(conf Conf) error {
 		}
 	}
 
+	if d, err := time.ParseDuration(conf.SMFPath.HeartBeatInterval); err != nil || d <= 0 {
+		return ErrInvalidArgumentWithReason("conf.SMFPath.HeartBeatInterval", conf.SMFPath.HeartBeatInterval, "invalid duration")
+	}
+
+	if d, err := time.ParseDuration(conf.SMFPath.T1); err != nil || d <= 0 {
+		return ErrInvalidArgumentWithReason("conf.SMFPath.T1", conf.SMFPath.T1, "invalid duration")
+	}
+
+	if d, err := time.ParseDuration(conf.SMFPath.GracePeriod); err != nil || d < 0 {
+		return ErrInvalidArgumentWithReason("conf.SMFPath.GracePeriod", conf.SMFPath.GracePeriod, "invalid duration")
+	}
+
+	if d, err := time.ParseDuration(conf.UPFResolveInterval); err != nil || d <= 0 {
+		return ErrInvalidArgumentWithReason("conf.UPFResolveInterval", conf.UPFResolveInterval, "invalid duration")
+	}
+
+	for dnn, subnet := range conf.UEIPAlloc.Pools {
+		if _, _, err := net.ParseCIDR(subnet); err != nil {
+			return ErrInvalidArgumentWithReason("conf.UEIPAlloc.Pools["+dnn+"]", subnet, err.Error())
+		}
+	}
+
+	if conf.UEIPAlloc.Enable && len(conf.UEIPAlloc.Pools) == 0 {
+		return ErrInvalidArgumentWithReason("conf.UEIPAlloc.Pools", conf.UEIPAlloc.Pools, "no UE IP pool")
+	}
+
+	if conf.Orchestrator.Kind != orchestratorKubernetes && conf.Orchestrator.Kind != orchestratorFake &&
+		conf.Orchestrator.Kind != orchestratorNone {
+		return ErrInvalidArgumentWithReason("conf.Orchestrator.Kind", conf.Orchestrator.Kind, "kubernetes, fake or none")
+	}
+
+	hostnames := make(map[string]bool)
+
+	for _, u := range conf.StaticPool.UPFs {
+		if u.Address == "" || hostnames[u.Hostname] {
+			return ErrInvalidArgumentWithReason("conf.StaticPool.UPFs", u, "address and unique hostname")
+		}
+
+		hostnames[u.Hostname] = true
+
+		for _, ip := range []string{u.AccessIP, u.CoreIP} {
+			if ip != "" && net.ParseIP(ip) == nil {
+				return ErrInvalidArgumentWithReason("conf.StaticPool.UPFs", ip, "invalid IP")
+			}
+		}
+	}
+
+	if conf.Discovery.SRV != "" && conf.Discovery.Service != "" {
+		return ErrInvalidArgumentWithReason("conf.Discovery", conf.Discovery, "srv or service, not both")
+	}
+
+	for _, d := range []string{conf.StaticPool.RetryInterval, conf.StaticPool.MaxRetryInterval, conf.Discovery.Interval} {
+		if v, err := time.ParseDuration(d); d != "" && (err != nil || v <= 0) {
+			return ErrInvalidArgumentWithReason("conf.StaticPool", d, "invalid or non-positive duration")
+		}
+	}
+
+	if durationOrDefault(conf.StaticPool.RetryInterval, 0) > durationOrDefault(conf.StaticPool.MaxRetryInterval, 0) {
+		return ErrInvalidArgumentWithReason("conf.StaticPool.RetryInterval", conf.StaticPool.RetryInterval, "above max_retry_interval")
+	}
+
+	for _, kind := range conf.Metrics.Sources {
+		if kind != metricsSourceKubernetes && kind != metricsSourcePrometheus && kind != metricsSourceStatic {
+			return ErrInvalidArgumentWithReason("conf.Metrics.Sources", kind, "kubernetes, prometheus or static")
+		}
+	}
+
+	if !strings.Contains(conf.Metrics.ExporterURL, "%s") {
+		return ErrInvalidArgumentWithReason("conf.Metrics.ExporterURL", conf.Metrics.ExporterURL, "no %s for the UPF name")
+	}
+
+	for metric, series := range conf.Metrics.Series {
+		if _, _, err := parsePromSeries(series); err != nil {
+			return ErrInvalidArgumentWithReason("conf.Metrics.Series", metric, err.Error())
+		}
+	}
+
+	for name, upf := range conf.UPFTemplate.UPFs {
+		for _, cidr := range []string{upf.AccessIP, upf.CoreIP} {
+			if _, _, err := net.ParseCIDR(cidr); cidr != "" && err != nil {
+				return ErrInvalidArgumentWithReason("conf.UPFTemplate.UPFs."+name, cidr, err.Error())
+			}
+		}
+
+		for _, ip := range []string{upf.AccessGateway, upf.CoreGateway} {
+			if ip != "" && net.ParseIP(ip) == nil {
+				return ErrInvalidArgumentWithReason("conf.UPFTemplate.UPFs."+name, ip, "invalid gateway")
+			}
+		}
+	}
+
+	for _, ip := range []string{conf.UPFTemplate.AccessGateway, conf.UPFTemplate.CoreGateway} {
+		if ip != "" && net.ParseIP(ip) == nil {
+			return ErrInvalidArgumentWithReason("conf.UPFTemplate", ip, "invalid gateway")
+		}
+	}
+
+	for _, cidr := range []string{conf.UPFTemplate.AccessIP, conf.UPFTemplate.CoreIP} {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return ErrInvalidArgumentWithReason("conf.UPFTemplate", cidr, err.Error())
+		}
+	}
+
+	if strings.Count(conf.UPFNames.Template, "%") != 1 || !strings.Contains(conf.UPFNames.Template, "%d") {
+		return ErrInvalidArgumentWithReason("conf.UPFNames.Template", conf.UPFNames.Template, "a single %d for the ID")
+	}
+
+	if conf.UPFNames.FirstID > conf.UPFNames.LastID {
+		return ErrInvalidArgumentWithReason("conf.UPFNames.FirstID", conf.UPFNames.FirstID, "above last_id")
+	}
+
+	if conf.UPFNames.Reuse != upfNameReuseLowest && conf.UPFNames.Reuse != upfNameReuseNext {
+		return ErrInvalidArgumentWithReason("conf.UPFNames.Reuse", conf.UPFNames.Reuse, "lowest or next")
+	}
+
+	if v, err := time.ParseDuration(conf.UPFNames.ReuseAfter); conf.UPFNames.ReuseAfter != "" && (err != nil || v < 0) {
+		return ErrInvalidArgumentWithReason("conf.UPFNames.ReuseAfter", conf.UPFNames.ReuseAfter, "invalid duration")
+	}
+
+	// Of a ticker
+	if v, err := time.ParseDuration(conf.Autoscaler.Interval); conf.Autoscaler.Interval != "" && (err != nil || v <= 0) {
+		return ErrInvalidArgumentWithReason("conf.Autoscaler.Interval", conf.Autoscaler.Interval, "invalid or non-positive duration")
+	}
+
+	for _, d := range []string{conf.Autoscaler.ScaleOutCooldown, conf.Autoscaler.ScaleInCooldown,
+		conf.Autoscaler.ScaleOutWindow, conf.Autoscaler.ScaleInWindow, conf.Autoscaler.Predictive.BootTime} {
+		if v, err := time.ParseDuration(d); d != "" && (err != nil || v < 0) {
+			return ErrInvalidArgumentWithReason("conf.Autoscaler", d, "invalid duration")
+		}
+	}
+
+	for _, signal := range conf.Autoscaler.Signals {
+		if signal.Name == "" || signal.ScaleInBelow >= signal.ScaleOutAbove {
+			return ErrInvalidArgumentWithReason("conf.Autoscaler.Signals", signal, "scale_in_below must be under scale_out_above")
+		}
+	}
+
+	if conf.Autoscaler.AuditSize < 0 {
+		return ErrInvalidArgumentWithReason("conf.Autoscaler.AuditSize", conf.Autoscaler.AuditSize, "number of decisions")
+	}
+
+	if conf.Drain.Rate < 0 {
+		return ErrInvalidArgumentWithReason("conf.Drain.Rate", conf.Drain.Rate, "sessions per second")
+	}
+
+	if v, err := time.ParseDuration(conf.Drain.Deadline); conf.Drain.Deadline != "" && (err != nil || v < 0) {
+		return ErrInvalidArgumentWithReason("conf.Drain.Deadline", conf.Drain.Deadline, "invalid duration")
+	}
+
+	if _, err := newScalingScheduler(&conf); err != nil {
+		return err
+	}
+
+	for _, f := range []float64{conf.Autoscaler.Predictive.Alpha, conf.Autoscaler.Predictive.Beta} {
+		if f < 0 || f > 1 {
+			return ErrInvalidArgumentWithReason("conf.Autoscaler.Predictive", f, "alpha and beta must be in (0, 1]")
+		}
+	}
+
+	if conf.Canary.Percent > 100 {
+		return ErrInvalidArgumentWithReason("conf.Canary.Percent", conf.Canary.Percent, "at most 100")
+	}
+
+	// The SMF keeps sending to the F-TEIDs of the primary after a failover
+	if conf.HotStandby.Enable && !conf.TEIDAlloc.Enable {
+		return ErrInvalidArgumentWithReason("conf.HotStandby.Enable", conf.HotStandby.Enable, "requires conf.TEIDAlloc.Enable")
+	}
+
+	// The SMF can't be told of new F-TEIDs, they must stay valid on every UPF
+	if conf.TEIDAlloc.Enable && conf.VirtualUPF.AccessIP == "" && conf.VirtualUPF.AccessIPv6 == "" {
+		return ErrInvalidArgumentWithReason("conf.TEIDAlloc.Enable", conf.TEIDAlloc.Enable, "requires conf.VirtualUPF.AccessIP shared by the pool")
+	}
+
+	if conf.TEIDAlloc.RangeSize > 1<<31 {
+		return ErrInvalidArgumentWithReason("conf.TEIDAlloc.RangeSize", conf.TEIDAlloc.RangeSize, "at most 2^31")
+	}
+
 	return nil
 }
 
@@ -266,59 +693,228 @@ func LoadConfigFile(filepath string) (Conf, error) {
 		}
 	}
 
+	if conf.SMFPath.HeartBeatInterval == "" {
+		conf.SMFPath.HeartBeatInterval = smfHBIntervalDefault.String()
+	}
+
+	if conf.SMFPath.N1 == nil {
+		n1 := uint8(smfN1Default)
+		conf.SMFPath.N1 = &n1
+	}
+
+	if conf.SMFPath.T1 == "" {
+		conf.SMFPath.T1 = smfT1Default.String()
+	}
+
+	if conf.SMFPath.GracePeriod == "" {
+		conf.SMFPath.GracePeriod = smfGracePeriodDefault.String()
+	}
+
+	if conf.UPFResolveInterval == "" {
+		conf.UPFResolveInterval = upfResolveIntervalDefault.String()
+	}
+
+	// The cpiface pool serves its DNN unless pools are given
+	if conf.UEIPAlloc.Enable && len(conf.UEIPAlloc.Pools) == 0 && conf.CPIface.UEIPPool != "" {
+		conf.UEIPAlloc.Pools = map[string]string{conf.CPIface.Dnn: conf.CPIface.UEIPPool}
+	}
+
+	if conf.TEIDAlloc.RangeSize == 0 {
+		conf.TEIDAlloc.RangeSize = teidRangeSizeDefault
+	}
+
+	for _, peer := range conf.CPIface.Peers {
+		conf.StaticPool.UPFs = append(conf.StaticPool.UPFs, StaticUPFInfo{Address: peer})
+	}
+
+	for i := range conf.StaticPool.UPFs {
+		u := &conf.StaticPool.UPFs[i]
+
+		if u.Hostname == "" {
+			u.Hostname = u.Address
+		}
+
+		if u.Dnn == "" {
+			u.Dnn = conf.CPIface.Dnn
+		}
+	}
+
+	if conf.StaticPool.RetryInterval == "" {
+		conf.StaticPool.RetryInterval = staticRetryIntervalDefault.String()
+	}
+
+	if conf.StaticPool.MaxRetryInterval == "" {
+		conf.StaticPool.MaxRetryInterval = staticMaxRetryIntervalDefault.String()
+	}
+
+	if conf.Discovery.Interval == "" {
+		conf.Discovery.Interval = discoveryIntervalDefault.String()
+	}
+
+	// Static UPFs are neither created nor deleted by the LB
+	if conf.Orchestrator.Kind == "" {
+		conf.Orchestrator.Kind = orchestratorKubernetes
+		if len(conf.StaticPool.UPFs) > 0 {
+			conf.Orchestrator.Kind = orchestratorNone
+		}
+	}
+
+	if conf.Orchestrator.Namespace == "" {
+		conf.Orchestrator.Namespace = upfNamespaceDefault
+	}
+
+	if len(conf.Metrics.Sources) == 0 {
+		conf.Metrics.Sources = []string{metricsSourceKubernetes, metricsSourcePrometheus}
+		switch conf.Orchestrator.Kind {
+		case orchestratorFake:
+			conf.Metrics.Sources = []string{metricsSourceStatic}
+		case orchestratorNone:
+			conf.Metrics.Sources = []string{metricsSourcePrometheus}
+		}
+	}
+
+	if conf.UPFTemplate.PreStopURL == "" {
+		conf.UPFTemplate.PreStopURL = "http://" + net.JoinHostPort(upfLBServiceDefault+"."+conf.Orchestrator.Namespace, upfLBHTTPPortDefault) + "/pre-stop"
+	}
+
+	if conf.Metrics.ExporterURL == "" {
+		conf.Metrics.ExporterURL = "http://" + net.JoinHostPort("%s-http."+conf.Orchestrator.Namespace, upfMetricsPortDefault) + "/metrics"
+	}
+
+	// The built-in metrics are scraped from their default series unless given
+	for metric, series := range defaultMetricSeries {
+		if _, ok := conf.Metrics.Series[metric]; !ok {
+			if conf.Metrics.Series == nil {
+				conf.Metrics.Series = make(map[string]string)
+			}
+
+			conf.Metrics.Series[metric] = series
+		}
+	}
+
+	if conf.UPFTemplate.TemplateDir == "" {
+		conf.UPFTemplate.TemplateDir = upfTemplateDirDefault
+	}
+
+	if conf.UPFTemplate.Image == "" {
+		conf.UPFTemplate.Image = upfImageDefault
+	}
+
+	if conf.UPFTemplate.AgentImage == "" {
+		conf.UPFTemplate.AgentImage = upfAgentImageDefault
+	}
+
+	if conf.UPFTemplate.AccessIP == "" {
+		conf.UPFTemplate.AccessIP = upfAccessIPDefault
+	}
+
+	if conf.UPFTemplate.CoreIP == "" {
+		conf.UPFTemplate.CoreIP = upfCoreIPDefault
+	}
+
+	if conf.UPFNames.Template == "" {
+		conf.UPFNames.Template = upfNameTemplateDefault
+	}
+
+	if conf.UPFNames.FirstID == 0 {
+		conf.UPFNames.FirstID = upfFirstIDDefault
+	}
+
+	if conf.UPFNames.LastID == 0 {
+		conf.UPFNames.LastID = upfLastIDDefault
+	}
+
+	if conf.UPFNames.Reuse == "" {
+		conf.UPFNames.Reuse = upfNameReuseLowest
+	}
+
+	if conf.Autoscaler.ScaleOutCooldown == "" {
+		conf.Autoscaler.ScaleOutCooldown = scaleOutCooldownDefault.String()
+	}
+
+	if conf.Autoscaler.ScaleInCooldown == "" {
+		conf.Autoscaler.ScaleInCooldown = scaleInCooldownDefault.String()
+	}
+
+	if conf.Autoscaler.ScaleInWindow == "" {
+		conf.Autoscaler.ScaleInWindow = scaleInWindowDefault.String()
+	}
+
+	if len(conf.Autoscaler.Signals) == 0 {
+		conf.Autoscaler.Signals = legacyScalingSignals(conf)
+	}
+
+	if conf.Autoscaler.AuditSize == 0 {
+		conf.Autoscaler.AuditSize = scalingAuditSizeDefault
+	}
+
+	if conf.Drain.Rate == 0 {
+		conf.Drain.Rate = drainRateDefault
+	}
+
+	if conf.Drain.Deadline == "" {
+		conf.Drain.Deadline = drainDeadlineDefault.String()
+	}
+
+	if conf.Autoscaler.Predictive.BootTime == "" {
+		conf.Autoscaler.Predictive.BootTime = upfBootTimeDefault.String()
+	}
+
+	if conf.Autoscaler.Predictive.Alpha == 0 {
+		conf.Autoscaler.Predictive.Alpha = forecastAlphaDefault
+	}
+
+	if conf.Autoscaler.Predictive.Beta == 0 {
+		conf.Autoscaler.Predictive.Beta = forecastBetaDefault
+	}
+
 	// Perform basic validation.
 	err = validateConf(conf)
 	if err != nil {
 		return Conf{}, err
 	}
 
-	changeUPFResources(conf)
 	return conf, nil
 }
 
-func changeUPFResources(conf Conf) {
-	N3BurstBytesStr := strconv.FormatUint(uint64(conf.SliceMeterConfig.N3BurstBytes), 10)
-	N3RateBpsStr := strconv.FormatUint(uint64(conf.SliceMeterConfig.N3RateBps), 10)
-	N6BurstBytesStr := strconv.FormatUint(uint64(conf.SliceMeterConfig.N6BurstBytes), 10)
-	N6RateBpsStr := strconv.FormatUint(uint64(conf.SliceMeterConfig.N6RateBps), 10)
-	N3RateBpsPH := `$(n3_bps)`
-	N3BurstBytesPH := `$(n3_burst_bytes)`
-	N6RateBpsPH := `$(n6_bps)`
-	N6BurstBytesPH := `$(n6_burst_bytes)`
-	ueransimPH := `$(ueransim)`
-
-	var upfName string
-
-	for i := 1; i <= int(conf.MaxUPFs); i++ {
-		if i < 10 {
-			upfName = fmt.Sprint("upf10", i)
-		} else if i < 100 {
-			upfName = fmt.Sprint("upf1", i)
-		} else if i >= 100 {
-			upfName = fmt.Sprint("upf", i)
-		}
-		upfFile := fmt.Sprint("/upfs/", upfName, ".yaml")
+// legacyScalingSignals returns the signals of the scalebysession, scalebycpu
+// and scalebybitrate settings.
+func legacyScalingSignals(conf Conf) []ScalingSignalInfo {
+	var signals []ScalingSignalInfo
+
+	if conf.ScaleBySession {
+		signals = append(signals, ScalingSignalInfo{
+			Name:          signalSessions,
+			ScaleOutAbove: float64(conf.MaxSessionsThreshold) * float64(1+conf.MaxSessionstolerance),
+			ScaleInBelow:  float64(conf.MinSessionsThreshold) * float64(1-conf.MinSessionstolerance),
+		})
+	}
 
-		content, err := os.ReadFile(upfFile)
-		if err != nil {
-			panic(err)
-		}
+	if conf.ScaleByCPU {
+		signals = append(signals, ScalingSignalInfo{
+			Name:          signalCPU,
+			ScaleOutAbove: float64(conf.MaxCPUThreshold),
+			ScaleInBelow:  float64(conf.MinCPUThreshold),
+		})
+	}
 
-		fileContent := string(content)
+	if conf.ScaleByBitRate {
+		signals = append(signals, ScalingSignalInfo{
+			Name:          signalBitRate,
+			ScaleOutAbove: float64(conf.MaxBitRateThreshold),
+			ScaleInBelow:  float64(conf.MinBitRateThreshold),
+		})
+	}
 
-		updatedContent := strings.Replace(fileContent, N3BurstBytesPH, N3BurstBytesStr, -1)
-		updatedContent = strings.Replace(updatedContent, N3RateBpsPH, N3RateBpsStr, -1)
-		updatedContent = strings.Replace(updatedContent, N6BurstBytesPH, N6BurstBytesStr, -1)
-		updatedContent = strings.Replace(updatedContent, N6RateBpsPH, N6RateBpsStr, -1)
-		if conf.Ueransim {
-			updatedContent = strings.Replace(updatedContent, ueransimPH, "true", -1)
-		} else {
-			updatedContent = strings.Replace(updatedContent, ueransimPH, "false", -1)
-		}
+	return signals
+}
 
-		err = os.WriteFile(upfFile, []byte(updatedContent), 0644)
-		if err != nil {
-			panic(err)
-		}
+// durationOrDefault parses s as a duration, falling back to d when s is empty,
+// invalid or not positive.
+func durationOrDefault(s string, d time.Duration) time.Duration {
+	if v, err := time.ParseDuration(s); err == nil && v > 0 {
+		return v
 	}
+
+	return d
 }
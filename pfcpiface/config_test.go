@@ -7,6 +7,7 @@ import (
 	"io/fs"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -79,6 +80,30 @@ func TestLoadConfigFile(t *testing.T) {
 		//require.Equal(t, conf.LogLevel, log.InfoLevel)
 	})
 
+	t.Run("static pool from cpiface peers", func(t *testing.T) {
+		s := `{
+			"mode": "dpdk",
+			"cpiface": {
+				"dnn": "internet",
+				"peers": ["10.0.0.2"]
+			},
+			"static_pool": {
+				"upfs": [{"address": "upf1.example", "hostname": "upf1", "dnn": "ims"}]
+			}
+		}`
+		confPath := t.TempDir() + "/conf.json"
+		mustWriteStringToDisk(s, confPath)
+
+		conf, err := LoadConfigFile(confPath)
+		require.NoError(t, err)
+		require.Equal(t, []StaticUPFInfo{
+			{Address: "upf1.example", Hostname: "upf1", Dnn: "ims"},
+			{Address: "10.0.0.2", Hostname: "10.0.0.2", Dnn: "internet"},
+		}, conf.StaticPool.UPFs)
+		require.Equal(t, orchestratorNone, conf.Orchestrator.Kind)
+		require.Equal(t, []string{metricsSourcePrometheus}, conf.Metrics.Sources)
+	})
+
 	t.Run("all sample configs must be valid", func(t *testing.T) {
 		paths := []string{
 			"../conf/upf.json",
@@ -91,3 +116,56 @@ func TestLoadConfigFile(t *testing.T) {
 		}
 	})
 }
+
+func TestNonPositiveDurations(t *testing.T) {
+	for _, s := range []string{
+		`{"mode": "dpdk", "autoscaler": {"interval": "0s"}}`,
+		`{"mode": "dpdk", "autoscaler": {"scale_in_cooldown": "-1m"}}`,
+		`{"mode": "dpdk", "discovery": {"interval": "-10s"}}`,
+	} {
+		confPath := t.TempDir() + "/conf.json"
+		mustWriteStringToDisk(s, confPath)
+
+		_, err := LoadConfigFile(confPath)
+		require.Error(t, err, s)
+	}
+
+	require.Equal(t, time.Minute, durationOrDefault("0s", time.Minute), "as if unset")
+	require.Equal(t, time.Minute, durationOrDefault("-1s", time.Minute))
+	require.Equal(t, time.Second, durationOrDefault("1s", time.Minute))
+}
+
+func TestSMFPathSettings(t *testing.T) {
+	confPath := t.TempDir() + "/conf.json"
+	mustWriteStringToDisk(`{"mode": "dpdk", "smf_path": {"grace_period": "-1s"}}`, confPath)
+
+	_, err := LoadConfigFile(confPath)
+	require.Error(t, err)
+
+	mustWriteStringToDisk(`{"mode": "dpdk", "smf_path": {"n1": 0, "grace_period": "0s"}}`, confPath)
+
+	conf, err := LoadConfigFile(confPath)
+	require.NoError(t, err)
+
+	require.Zero(t, *conf.SMFPath.N1, "no retransmission")
+	require.Equal(t, "0s", conf.SMFPath.GracePeriod, "released at once")
+
+	mustWriteStringToDisk(`{"mode": "dpdk"}`, confPath)
+
+	conf, err = LoadConfigFile(confPath)
+	require.NoError(t, err)
+	require.Equal(t, uint8(smfN1Default), *conf.SMFPath.N1)
+}
+
+func TestTEIDAllocRequiresVirtualAccessIP(t *testing.T) {
+	confPath := t.TempDir() + "/conf.json"
+	mustWriteStringToDisk(`{"mode": "dpdk", "teid_alloc": {"enable": true}}`, confPath)
+
+	_, err := LoadConfigFile(confPath)
+	require.Error(t, err, "F-TEIDs would point to the N3 address of a single UPF")
+
+	mustWriteStringToDisk(`{"mode": "dpdk", "teid_alloc": {"enable": true}, "virtual_upf": {"access_ip": "10.0.0.9"}}`, confPath)
+
+	_, err = LoadConfigFile(confPath)
+	require.NoError(t, err)
+}
@@ -28,6 +28,11 @@ const (
 // Timeout : connection timeout.
 var Timeout = 1000 * time.Millisecond
 
+// upfPFCPAddr returns the address of a UPF's PFCP endpoint, IPv6 literals are bracketed.
+func upfPFCPAddr(peerIP string) string {
+	return net.JoinHostPort(peerIP, DownPFCPPort)
+}
+
 type sequenceNumber struct {
 	seq uint32
 	mux sync.Mutex
@@ -35,9 +40,37 @@ type sequenceNumber struct {
 
 type recoveryTS struct {
 	local  time.Time
+	mu     sync.Mutex // guards remote, learnt by the Serve and heartbeat goroutines
 	remote time.Time
 }
 
+// learnRemote records the peer's recovery timestamp ts, if newer than the
+// known one, and reports whether it replaced a known one.
+func (r *recoveryTS) learnRemote(ts time.Time) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.remote.IsZero() {
+		r.remote = ts
+		return false
+	}
+
+	if !ts.After(r.remote) {
+		return false
+	}
+
+	r.remote = ts
+
+	return true
+}
+
+func (r *recoveryTS) getRemote() time.Time {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.remote
+}
+
 type nodeID struct {
 	localIE *ie.IE
 	local   string
@@ -73,6 +106,11 @@ type PFCPConn struct {
 	hbCtxCancel context.CancelFunc
 
 	pendingReqs sync.Map
+
+	// CP Function Features announced by the SMF in its Association Setup Request
+	cpFeatures uint8
+	// supervision of the path towards the SMF, nil on Down
+	smfPath *smfPath
 }
 
 func (pConn *PFCPConn) startHeartBeatMonitor(comCh CommunicationChannel) {
@@ -122,10 +160,6 @@ func (node *PFCPNode) NewPFCPConn(lAddr, rAddr string, buf []byte, comCh Communi
 		log.Errorln("dial socket failed", err)
 	}
 
-	ts := recoveryTS{
-		local: time.Now(),
-	}
-
 	// TODO: Get SEID range from PFCPNode for this PFCPConn
 	//log.infoln("Created PFCPConn from:", conn.LocalAddr(), "to:", conn.RemoteAddr())
 
@@ -134,7 +168,7 @@ func (node *PFCPNode) NewPFCPConn(lAddr, rAddr string, buf []byte, comCh Communi
 	var p = &PFCPConn{
 		ctx:        node.ctx,
 		Conn:       conn,
-		ts:         ts,
+		ts:         recoveryTS{local: time.Now()},
 		rng:        rng,
 		maxRetries: 100,
 		//localtoSMFstore: NewInMemoryStore(),
@@ -209,6 +243,12 @@ func (pConn *PFCPConn) Serve(comCh CommunicationChannel, node *PFCPNode, pos Pos
 
 			n, err := pConn.Read(recvBuf)
 			if err != nil {
+				if netErr, ok := err.(net.Error); ok && netErr.Timeout() && pConn.smfPath != nil {
+					// Give the SMF a grace period instead of releasing its sessions right away
+					pConn.smfPath.lost()
+					continue
+				}
+
 				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
 					//log.infof("Read timeout for connection %v<->%v, is the SMF still alive?",
 					//pConn.LocalAddr(), pConn.RemoteAddr())
@@ -224,6 +264,10 @@ func (pConn *PFCPConn) Serve(comCh CommunicationChannel, node *PFCPNode, pos Pos
 				continue
 			}
 
+			if pConn.smfPath != nil {
+				pConn.smfPath.alive()
+			}
+
 			buf := append([]byte{}, recvBuf[:n]...)
 			//fmt.Println("parham log: calling HandlePFCPMsg from Serve func")
 			pConn.HandlePFCPMsg(buf, comCh, node)
@@ -261,6 +305,10 @@ func (pConn *PFCPConn) Serve(comCh CommunicationChannel, node *PFCPNode, pos Pos
 
 // Shutdown stops connection backing PFCPConn.
 func (pConn *PFCPConn) Shutdown(comCh CommunicationChannel) {
+	if pConn.smfPath != nil {
+		pConn.smfPath.stop()
+	}
+
 	close(pConn.shutdown)
 
 	if pConn.hbCtxCancel != nil {
@@ -288,56 +336,75 @@ func (pConn *PFCPConn) Shutdown(comCh CommunicationChannel) {
 
 }
 
-func (node *PFCPNode) handleDeadUpf(upfIndex int) {
+// handleDeadUpf removes the UPF at upfIndex from the pool and returns its
+// sessions placed on another UPF.
+func (node *PFCPNode) handleDeadUpf(upfIndex int) map[uint64]bool {
 	//fmt.Println("parham log : start handling dead upf")
 	//fmt.Println("parham log : node.upf.lbmap before reloadbalance = ", node.upf.lbmap)
 	//fmt.Println("parham log : node.upf.upfsSessions before reloadbalance = ", node.upf.upfsSessions)
+	node.upf.placementMu.Lock()
+	defer node.upf.placementMu.Unlock()
+
+	placed := make(map[uint64]bool)
+	dead := node.upf.peersUPF[upfIndex]
+
 	if len(node.upf.peersUPF) > 1 {
 		//for i := 0; i < len(node.upf.peersUPF)-1; i++ {
-		sessions := node.upf.peersUPF[upfIndex].upfsSessions
-		node.reloadbalance(sessions, upfIndex)
+		placed = node.reloadbalance(dead.upfsSessions, upfIndex)
 		//}
 	}
 
+	// Those no UPF can take are lost
+	for _, seid := range dead.upfsSessions {
+		if !placed[seid] {
+			node.forgetSession(seid)
+		}
+	}
+
 	node.upf.peersUPF = append(node.upf.peersUPF[:upfIndex], node.upf.peersUPF[upfIndex+1:]...)
 	for k, v := range node.upf.lbmap {
 		if v > upfIndex {
 			node.upf.lbmap[k] = v - 1
 		}
 	}
+
+	if node.upf.teids != nil {
+		node.upf.teids.retire(dead)
+	}
 	//fmt.Println("parham log : node.upf.lbmap after reloadbalance = ", node.upf.lbmap)
 	//fmt.Println("parham log : node.upf.upfsSessions after reloadbalance = ", node.upf.upfsSessions)
 	//fmt.Println("parham log : done handling dead upf")
+	return placed
 }
 
-func (node *PFCPNode) reloadbalance(sessions []uint64, deadUpf int) {
-	initupf := 0
-	if deadUpf == 0 {
-		initupf = 1
-	}
-	for _, v := range sessions {
+// reloadbalance places the sessions of the dead UPF on the lightest UPFs
+// their F-TEIDs stay valid on, and returns those placed.
+func (node *PFCPNode) reloadbalance(sessions []uint64, deadUpf int) map[uint64]bool {
+	placed := make(map[uint64]bool)
 
-		curUpf := initupf
-		minSessions := len(node.upf.peersUPF[curUpf].upfsSessions)
-		lightestUpf := curUpf
-		if len(node.upf.peersUPF) > 1 {
-			for i := 0; i < len(node.upf.peersUPF); i++ {
-				if i == deadUpf {
-					continue
-				}
-				if minSessions > len(node.upf.peersUPF[i].upfsSessions) {
-					minSessions = len(node.upf.peersUPF[i].upfsSessions)
-					lightestUpf = i
-				}
+	for _, v := range sessions {
+		lightestUpf := -1
+		for i, u := range node.upf.peersUPF {
+			if i == deadUpf || !node.fteidsValidOn(v, u) {
+				continue
 			}
+			if lightestUpf < 0 || len(u.upfsSessions) < len(node.upf.peersUPF[lightestUpf].upfsSessions) {
+				lightestUpf = i
+			}
+		}
+		if lightestUpf < 0 {
+			log.Warnln("No UPF to take session", v, "over, its F-TEIDs point to other N3 addresses")
+			continue
 		}
+
 		node.upf.lbmap[v] = lightestUpf
 		node.upf.peersUPF[lightestUpf].upfsSessions = append(node.upf.peersUPF[lightestUpf].upfsSessions, v)
+		placed[v] = true
 
 		sourceUpfIndex := deadUpf
 		destUpfIndex := lightestUpf
-		sourceAddr := node.upf.peersUPF[sourceUpfIndex].peersIP + ":" + DownPFCPPort
-		destAddr := node.upf.peersUPF[destUpfIndex].peersIP + ":" + DownPFCPPort
+		sourceAddr := upfPFCPAddr(node.upf.peersUPF[sourceUpfIndex].peersIP)
+		destAddr := upfPFCPAddr(node.upf.peersUPF[destUpfIndex].peersIP)
 		//fmt.Println("parham log : source upf ip = ", sourceAddr, " dest upf ip = ", destAddr)
 		sourcePconn, ok := node.pConns.Load(sourceAddr)
 		if !ok {
@@ -360,14 +427,39 @@ func (node *PFCPNode) reloadbalance(sessions []uint64, deadUpf int) {
 		//fmt.Println("parham log : puting to lightest upf")
 		dPconn.sessionStore.PutSession(sess)
 	}
+
+	return placed
+}
+
+// forgetSession drops what the LB knows of a session no UPF serves anymore.
+func (node *PFCPNode) forgetSession(seid uint64) {
+	delete(node.upf.lbmap, seid)
+	delete(node.upf.sesEstMsgStore, seid)
+	delete(node.upf.sesModMsgStore, seid)
+	delete(node.upf.sesURRs, seid)
+	node.releaseOnBehalf(seid)
 }
 
 // Shutdown stops connection backing PFCPConn.
 func (pConn *PFCPConn) ShutdownForDown(node *PFCPNode, comCh CommunicationChannel) {
+	node.upf.shadow.lost(pConn)
+
+	if recovered := node.upf.gtpuPaths.removeUPF(pConn.nodeID.remote); len(recovered) > 0 {
+		comCh.NodeReportD2u <- &NodeReportD2uMsg{recoveredPeers: recovered}
+	}
+
+	failedOver := make(map[uint64]bool)
+	placed := make(map[uint64]bool)
+	var orphaned []uint64
+
 	for i, u := range node.upf.peersUPF {
 		if u.NodeID == pConn.nodeID.remote {
+			if node.upf.standbys != nil {
+				failedOver = node.failoverToStandbys(pConn, i, comCh)
+				orphaned = node.upf.standbys.removeOn(u)
+			}
 
-			node.handleDeadUpf(i)
+			placed = node.handleDeadUpf(i)
 			break
 		}
 	}
@@ -385,8 +477,9 @@ func (pConn *PFCPConn) ShutdownForDown(node *PFCPNode, comCh CommunicationChanne
 	// Cleanup all sessions in this conn
 	for _, sess := range pConn.sessionStore.GetAllSessions() {
 		//pConn.upf.SendMsgToUPF(upfMsgTypeDel, sess.PacketForwardingRules, PacketForwardingRules{})
+		// Only those placed on a UPF their F-TEIDs stay valid on are replayed
 		estMsg, ok := node.upf.sesEstMsgStore[sess.localSEID]
-		if ok {
+		if ok && placed[sess.localSEID] {
 			sesEstMsg := SesEstU2dMsg{
 				msg:       estMsg,
 				upSeid:    sess.localSEID,
@@ -398,6 +491,15 @@ func (pConn *PFCPConn) ShutdownForDown(node *PFCPNode, comCh CommunicationChanne
 		pConn.RemoveSession(sess)
 	}
 
+	// Sessions that lost their standby get a new one
+	for seid := range failedOver {
+		node.installStandby(seid, comCh)
+	}
+
+	for _, seid := range orphaned {
+		node.installStandby(seid, comCh)
+	}
+
 	rAddr := pConn.RemoteAddr().String()
 	pConn.done <- rAddr
 
@@ -0,0 +1,134 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright 2022-present Open Networking Foundation
+
+package pfcpiface
+
+import (
+	"net"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// lookupSRV and lookupAddr are replaced in tests.
+var (
+	lookupSRV  = net.LookupSRV
+	lookupAddr = net.LookupAddr
+)
+
+// upfDiscovery finds the UPFs of the pool in DNS: the targets of an SRV record,
+// or the addresses of a headless service.
+type upfDiscovery struct {
+	srv      string
+	service  string
+	dnn      string
+	interval time.Duration
+}
+
+func newUPFDiscovery(conf *Conf) *upfDiscovery {
+	return &upfDiscovery{
+		srv:      conf.Discovery.SRV,
+		service:  conf.Discovery.Service,
+		dnn:      conf.CPIface.Dnn,
+		interval: durationOrDefault(conf.Discovery.Interval, discoveryIntervalDefault),
+	}
+}
+
+// lookup returns the UPFs found. An SRV target is named after its first label,
+// e.g. upf-0 for upf-0.upf.omec.svc.cluster.local, the name of its pod, and
+// re-resolved like a UPF registered by FQDN; the port of the record is ignored
+// for that of PFCP. An address of the service is named the same way after the
+// name its PTR record points to, which is stable only for pods with a hostname
+// and a subdomain, e.g. those of a StatefulSet. Without a PTR record the UPF is
+// named after its address: the name doesn't match its pod, and the UPF is
+// drained and found as a new one when its pod restarts with another address.
+func (d *upfDiscovery) lookup() ([]StaticUPFInfo, error) {
+	var upfs []StaticUPFInfo
+
+	if d.srv != "" {
+		_, srvs, err := lookupSRV("", "", d.srv)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, srv := range srvs {
+			target := canonicalNodeID(srv.Target)
+			name := strings.SplitN(target, ".", 2)[0]
+			upfs = append(upfs, StaticUPFInfo{Address: target, Hostname: name, Dnn: d.dnn})
+		}
+
+		return upfs, nil
+	}
+
+	addrs, err := lookupHost(d.service)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, addr := range addrs {
+		upfs = append(upfs, d.byAddr(canonicalIP(addr)))
+	}
+
+	return upfs, nil
+}
+
+// byAddr returns the UPF of the service at ip, named after its PTR record.
+func (d *upfDiscovery) byAddr(ip string) StaticUPFInfo {
+	names, err := lookupAddr(ip)
+	if err != nil || len(names) == 0 {
+		log.Warnln("No PTR record of discovered UPF", ip, ", naming it after its address:", err)
+		return StaticUPFInfo{Address: ip, Hostname: ip, Dnn: d.dnn}
+	}
+
+	target := canonicalNodeID(names[0])
+
+	return StaticUPFInfo{Address: target, Hostname: strings.SplitN(target, ".", 2)[0], Dnn: d.dnn}
+}
+
+// discover updates the static pool with the UPFs found: the new ones are
+// associated with, and those no longer found are drained for good. A failed
+// lookup keeps the UPFs found so far.
+func (node *PFCPNode) discover(comCh CommunicationChannel) {
+	found, err := node.upf.discovery.lookup()
+	if err != nil {
+		log.Warnln("UPF discovery failed, keeping the UPFs found so far:", err)
+		return
+	}
+
+	added, vanished := node.upf.staticPool.sync(found)
+
+	for _, name := range added {
+		log.Infoln("Discovered UPF", name)
+
+		// Back before it went away, e.g. a DNS glitch
+		node.upf.drains.forget(name)
+	}
+
+	for _, name := range vanished {
+		u := node.upf.peerByHostname(name)
+		if u == nil {
+			log.Infoln("UPF", name, "no longer discovered")
+			continue
+		}
+
+		log.Infoln("UPF", name, "no longer discovered, draining it")
+		node.retireUPF(u, comCh)
+	}
+}
+
+// runDiscovery discovers the UPFs every interval, until the node stops.
+func (node *PFCPNode) runDiscovery(comCh CommunicationChannel) {
+	ticker := time.NewTicker(node.upf.discovery.interval)
+	defer ticker.Stop()
+
+	for {
+		node.discover(comCh)
+
+		select {
+		case <-node.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
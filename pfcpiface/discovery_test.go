@@ -0,0 +1,110 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright 2022-present Open Networking Foundation
+
+package pfcpiface
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiscoverySRV(t *testing.T) {
+	defer func(orig func(string, string, string) (string, []*net.SRV, error)) { lookupSRV = orig }(lookupSRV)
+
+	var (
+		targets []string
+		fail    bool
+	)
+
+	lookupSRV = func(service, proto, name string) (string, []*net.SRV, error) {
+		require.Equal(t, "_pfcp._udp.upf.omec.svc.cluster.local", name)
+
+		if fail {
+			return "", nil, ErrNotFound(name)
+		}
+
+		var srvs []*net.SRV
+		for _, target := range targets {
+			srvs = append(srvs, &net.SRV{Target: target, Port: 8805})
+		}
+
+		return name, srvs, nil
+	}
+
+	conf := &Conf{
+		CPIface:    CPIfaceInfo{Dnn: "internet"},
+		StaticPool: StaticPoolInfo{UPFs: []StaticUPFInfo{{Address: "10.0.0.1", Hostname: "upf1"}}},
+		Discovery:  DiscoveryInfo{SRV: "_pfcp._udp.upf.omec.svc.cluster.local"},
+	}
+
+	node := newDrainTestNode([]uint64{1, 2}, "5s", landAt)
+	node.upf.discovery = newUPFDiscovery(conf)
+	node.upf.staticPool = newStaticPool(conf)
+	src := node.upf.peersUPF[0]
+
+	hostnames := func() []string {
+		var names []string
+		for _, p := range node.upf.staticPool.peers {
+			names = append(names, p.info.Hostname)
+		}
+
+		return names
+	}
+
+	targets = []string{"upf101.upf.omec.svc.cluster.local.", "UPF102.upf.omec.svc.cluster.local."}
+	node.discover(CommunicationChannel{})
+	require.Equal(t, []string{"upf1", "upf101", "upf102"}, hostnames())
+	require.Equal(t, StaticUPFInfo{Address: "upf101.upf.omec.svc.cluster.local", Hostname: "upf101", Dnn: "internet"},
+		node.upf.staticPool.peers[1].info)
+
+	fail = true
+	node.discover(CommunicationChannel{})
+	require.Equal(t, []string{"upf1", "upf101", "upf102"}, hostnames(), "kept on a failed lookup")
+
+	fail, targets = false, targets[1:]
+	node.discover(CommunicationChannel{})
+	require.Equal(t, []string{"upf1", "upf102"}, hostnames(), "the configured UPF stays")
+
+	node.upf.drains.mu.Lock()
+	job := node.upf.drains.jobs["upf101"]
+	node.upf.drains.mu.Unlock()
+
+	require.NotNil(t, job)
+	require.NoError(t, job.wait())
+	require.Empty(t, src.upfsSessions, "drained once no longer found")
+	require.True(t, node.upf.drains.draining(src))
+
+	targets = append(targets, "upf101.upf.omec.svc.cluster.local.")
+	node.discover(CommunicationChannel{})
+	require.Equal(t, []string{"upf1", "upf102", "upf101"}, hostnames())
+	require.False(t, node.upf.drains.draining(src), "takes sessions again")
+}
+
+func TestDiscoveryService(t *testing.T) {
+	defer func(orig func(string) ([]string, error)) { lookupHost = orig }(lookupHost)
+	defer func(orig func(string) ([]string, error)) { lookupAddr = orig }(lookupAddr)
+
+	lookupHost = func(host string) ([]string, error) {
+		require.Equal(t, "upf.omec.svc.cluster.local", host)
+		return []string{"10.0.0.2", "10.0.0.3"}, nil
+	}
+
+	lookupAddr = func(addr string) ([]string, error) {
+		if addr == "10.0.0.2" {
+			return []string{"upf-0.upf.omec.svc.cluster.local."}, nil
+		}
+
+		return nil, ErrNotFound(addr)
+	}
+
+	d := newUPFDiscovery(&Conf{Discovery: DiscoveryInfo{Service: "upf.omec.svc.cluster.local"}})
+
+	upfs, err := d.lookup()
+	require.NoError(t, err)
+	require.Equal(t, []StaticUPFInfo{
+		{Address: "upf-0.upf.omec.svc.cluster.local", Hostname: "upf-0"},
+		{Address: "10.0.0.3", Hostname: "10.0.0.3"},
+	}, upfs, "named after the pod, or the address without a PTR record")
+}
@@ -0,0 +1,399 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright 2022-present Open Networking Foundation
+
+package pfcpiface
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// drainPollInterval paces a drain waiting for its sessions in flight to land.
+const drainPollInterval = 200 * time.Millisecond
+
+// States of a drain job.
+const (
+	drainRunning = "running"
+	drainDone    = "done"    // the UPF is empty
+	drainAborted = "aborted" // cancelled, or the pool can't take the sessions left
+	drainFailed  = "failed"  // the deadline passed
+)
+
+// drainStatus is the progress of a drain job.
+type drainStatus struct {
+	UPF       string    `json:"upf"`
+	State     string    `json:"state"`
+	Reason    string    `json:"reason,omitempty"`
+	Started   time.Time `json:"started"`
+	Finished  time.Time `json:"finished"`
+	Sessions  int       `json:"sessions"`  // on the UPF when the drain started
+	Moves     int       `json:"moves"`     // migrations started
+	Remaining int       `json:"remaining"` // sessions still on the UPF
+}
+
+// drainJob moves the sessions of a UPF to the others in the background, at a
+// bounded rate, until the UPF is verified empty.
+type drainJob struct {
+	mu     sync.Mutex
+	upf    *Upf
+	status drainStatus
+	retire bool            // the UPF goes away: once drained, it takes no session until it has left
+	into   func(*Upf) bool // the UPFs its sessions may move to, any if nil
+	cancel chan struct{}
+	done   chan struct{}
+	// UPFs each session could not be moved to, only used by the drain goroutine
+	refused map[uint64]map[*Upf]bool
+}
+
+// wait blocks until the drain ends and returns why it didn't empty the UPF.
+func (j *drainJob) wait() error {
+	<-j.done
+
+	st := j.snapshot()
+	if st.State != drainDone {
+		return ErrOperationFailedWithReason("drain of "+st.UPF, st.State+": "+st.Reason)
+	}
+
+	return nil
+}
+
+func (j *drainJob) snapshot() drainStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return j.status
+}
+
+func (j *drainJob) running() bool {
+	return j.snapshot().State == drainRunning
+}
+
+// excludes reports whether the UPF of j takes no new session.
+func (j *drainJob) excludes() bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return j.status.State == drainRunning || (j.retire && j.status.State == drainDone)
+}
+
+// drainer runs the drain jobs of the pool, one per UPF.
+type drainer struct {
+	mu       sync.Mutex
+	interval time.Duration // between two moves
+	deadline time.Duration
+	jobs     map[string]*drainJob // the last one of each UPF, by name
+	// move starts migrating seid from the UPF src to dst, false if it can't.
+	// Sessions are migrated make-before-break unless set.
+	move func(seid uint64, src, dst *Upf) bool
+}
+
+func newDrainer(conf DrainInfo) *drainer {
+	d := &drainer{
+		deadline: durationOrDefault(conf.Deadline, 0),
+		jobs:     make(map[string]*drainJob),
+	}
+
+	if conf.Rate > 0 {
+		d.interval = time.Duration(float64(time.Second) / conf.Rate)
+	}
+
+	return d
+}
+
+// draining reports whether the UPF is being drained, or was to go away, and so
+// takes no new session.
+func (d *drainer) draining(u *Upf) bool {
+	d.mu.Lock()
+	j, ok := d.jobs[u.Hostname]
+	d.mu.Unlock()
+
+	return ok && j.upf == u && j.excludes()
+}
+
+// list returns the status of the drain jobs, by UPF name.
+func (d *drainer) list() []drainStatus {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	statuses := make([]drainStatus, 0, len(d.jobs))
+	for _, j := range d.jobs {
+		statuses = append(statuses, j.snapshot())
+	}
+
+	sort.Slice(statuses, func(i, k int) bool { return statuses[i].UPF < statuses[k].UPF })
+
+	return statuses
+}
+
+// stop aborts the drain of the UPF name, false if none is running.
+func (d *drainer) stop(name string) bool {
+	d.mu.Lock()
+	j, ok := d.jobs[name]
+	d.mu.Unlock()
+
+	if !ok || !j.running() {
+		return false
+	}
+
+	select {
+	case j.cancel <- struct{}{}:
+	case <-j.done:
+	}
+
+	return true
+}
+
+// forget aborts the drain of the UPF name and forgets it, so that a UPF it
+// retired takes sessions again.
+func (d *drainer) forget(name string) {
+	d.stop(name)
+
+	d.mu.Lock()
+	delete(d.jobs, name)
+	d.mu.Unlock()
+}
+
+// drainUPF starts draining u, or returns its drain already running.
+func (node *PFCPNode) drainUPF(u *Upf, comCh CommunicationChannel) *drainJob {
+	return node.drainUPFInto(u, nil, comCh)
+}
+
+// drainUPFInto starts draining u into the UPFs into accepts, or returns its
+// drain already running.
+func (node *PFCPNode) drainUPFInto(u *Upf, into func(*Upf) bool, comCh CommunicationChannel) *drainJob {
+	d := node.upf.drains
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if j, ok := d.jobs[u.Hostname]; ok && j.upf == u && j.running() {
+		return j
+	}
+
+	j := &drainJob{
+		upf:  u,
+		into: into,
+		status: drainStatus{
+			UPF:      u.Hostname,
+			State:    drainRunning,
+			Started:  time.Now(),
+			Sessions: len(u.upfsSessions),
+		},
+		cancel:  make(chan struct{}),
+		done:    make(chan struct{}),
+		refused: make(map[uint64]map[*Upf]bool),
+	}
+	d.jobs[u.Hostname] = j
+
+	log.Infoln("Draining", len(u.upfsSessions), "sessions of UPF", u.Hostname)
+
+	move := d.move
+	if move == nil {
+		move = func(seid uint64, src, dst *Upf) bool {
+			return node.migrateForDrain(seid, src, dst, comCh)
+		}
+	}
+
+	go node.runDrain(j, move)
+
+	return j
+}
+
+// drainDestinations returns the UPFs other than j's that j may move sessions
+// into, are not draining and have room for a session, least loaded first, and
+// the sessions those have room for.
+func (node *PFCPNode) drainDestinations(j *drainJob) ([]*Upf, int) {
+	var (
+		dests []*Upf
+		loads = make(map[*Upf]int)
+		room  int
+	)
+
+	max := node.upf.maxSessions()
+
+	for _, p := range node.upf.peersUPF {
+		if p == j.upf || (j.into != nil && !j.into(p)) || node.upf.drains.draining(p) {
+			continue
+		}
+
+		load := len(p.upfsSessions) + node.upf.migrations.incoming(p)
+		if load >= max {
+			continue
+		}
+
+		room += max - load
+		loads[p] = load
+		dests = append(dests, p)
+	}
+
+	sort.SliceStable(dests, func(i, k int) bool { return loads[dests[i]] < loads[dests[k]] })
+
+	return dests, room
+}
+
+// nextToDrain returns the last session of j's UPF not migrating yet that some
+// of dests didn't refuse, with the first of those, and how many sessions are
+// left to migrate. dest is nil if none of them can move.
+func (node *PFCPNode) nextToDrain(j *drainJob, dests []*Upf) (seid uint64, dest *Upf, left int) {
+	for _, s := range j.upf.upfsSessions {
+		if node.upf.migrations.migrating(s) {
+			continue
+		}
+
+		left++
+
+		for _, d := range dests {
+			if !j.refused[s][d] {
+				seid, dest = s, d
+				break
+			}
+		}
+	}
+
+	return seid, dest, left
+}
+
+// runDrain moves the sessions of j's UPF one at a time, each once the previous
+// one was started interval ago, until none is left on the UPF or leaving it.
+// A session that can't move to a UPF is tried on the others, then skipped.
+// It aborts if cancelled, if the rest of the pool can't take the sessions left
+// or if none of them can move, and fails past the deadline. Migrations in
+// flight then complete or abort on their own.
+func (node *PFCPNode) runDrain(j *drainJob, move func(seid uint64, src, dst *Upf) bool) {
+	d := node.upf.drains
+	u := j.upf
+	deadline := time.NewTimer(d.deadline)
+
+	defer deadline.Stop()
+
+	end := func(state, reason string) {
+		j.mu.Lock()
+		j.status.State, j.status.Reason, j.status.Finished = state, reason, time.Now()
+		j.mu.Unlock()
+
+		close(j.done)
+
+		if state == drainDone {
+			log.Infoln("UPF", u.Hostname, "drained")
+		} else {
+			log.Warnln("Drain of UPF", u.Hostname, state, ":", reason)
+		}
+	}
+
+	for {
+		node.upf.placementMu.Lock()
+		inPool := node.upfIndex(u) >= 0
+		remaining := len(u.upfsSessions)
+		dests, room := node.drainDestinations(j)
+		seid, dest, left := node.nextToDrain(j, dests)
+		node.upf.placementMu.Unlock()
+
+		if !inPool {
+			end(drainAborted, "the UPF left the pool")
+			return
+		}
+
+		j.mu.Lock()
+		j.status.Remaining = remaining
+		j.mu.Unlock()
+
+		// Empty once the sessions moved off were also deleted from it
+		if remaining == 0 && node.upf.migrations.outgoing(u) == 0 {
+			end(drainDone, "")
+			return
+		}
+
+		wait := drainPollInterval
+
+		if left > 0 {
+			if len(dests) == 0 || room < left {
+				end(drainAborted, "the pool has no room for the sessions left")
+				return
+			}
+
+			// Those still migrating may land, the others are stuck
+			if dest == nil && node.upf.migrations.outgoing(u) == 0 {
+				end(drainAborted, strconv.Itoa(left)+" sessions can't move to any UPF")
+				return
+			}
+
+			switch {
+			case dest == nil:
+			case move(seid, u, dest):
+				j.mu.Lock()
+				j.status.Moves++
+				j.mu.Unlock()
+
+				wait = d.interval
+			default:
+				if j.refused[seid] == nil {
+					j.refused[seid] = make(map[*Upf]bool)
+				}
+
+				j.refused[seid][dest] = true
+				wait = 0
+			}
+		}
+
+		select {
+		case <-j.cancel:
+			end(drainAborted, "cancelled")
+			return
+		case <-deadline.C:
+			end(drainFailed, "deadline of "+d.deadline.String()+" passed")
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// migrateForDrain starts migrating seid from src to dst.
+func (node *PFCPNode) migrateForDrain(seid uint64, src, dst *Upf, comCh CommunicationChannel) bool {
+	sUPFid, dUPFid := node.upfIndex(src), node.upfIndex(dst)
+	if sUPFid < 0 || dUPFid < 0 {
+		return false
+	}
+
+	sPconn, ok := node.pConns.Load(upfPFCPAddr(src.peersIP))
+	if !ok {
+		return false
+	}
+
+	dPconn, ok := node.pConns.Load(upfPFCPAddr(dst.peersIP))
+	if !ok {
+		return false
+	}
+
+	if !node.migrateSession(seid, sPconn.(*PFCPConn), dPconn.(*PFCPConn), sUPFid, dUPFid, comCh) {
+		log.Warnln("Can not move session", seid, "off draining UPF", src.Hostname)
+		return false
+	}
+
+	return true
+}
+
+// retireUPF drains u for good: once empty, it takes no new session until it
+// leaves the pool.
+func (node *PFCPNode) retireUPF(u *Upf, comCh CommunicationChannel) *drainJob {
+	j := node.drainUPF(u, comCh)
+
+	j.mu.Lock()
+	j.retire = true
+	j.mu.Unlock()
+
+	return j
+}
+
+// drainAndDelete drains u and deletes it once empty. A UPF that could not be
+// drained is kept.
+func (node *PFCPNode) drainAndDelete(u *Upf, comCh CommunicationChannel) error {
+	if err := node.retireUPF(u, comCh).wait(); err != nil {
+		return err
+	}
+
+	return node.deleteUPF(u.Hostname)
+}
@@ -0,0 +1,158 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright 2022-present Open Networking Foundation
+
+package pfcpiface
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/wmnsk/go-pfcp/ie"
+	"github.com/wmnsk/go-pfcp/message"
+)
+
+// newDrainTestNode returns a node of two UPFs, upf101 with sessions and an
+// empty upf102, whose drains move sessions with move.
+func newDrainTestNode(sessions []uint64, deadline string, move func(seid uint64, src, dst *Upf) bool) *PFCPNode {
+	node := &PFCPNode{upf: &Upf{
+		MaxSessionsThreshold: 100,
+		migrations:           newMigrationTable(),
+		drains:               newDrainer(DrainInfo{Rate: 1000, Deadline: deadline}),
+		peersUPF:             []*Upf{{Hostname: "upf101", upfsSessions: sessions}, {Hostname: "upf102"}},
+	}}
+	node.upf.drains.move = move
+
+	return node
+}
+
+// landAt moves seid from src to dst right away, as a migration that succeeded.
+func landAt(seid uint64, src, dst *Upf) bool {
+	for i, s := range src.upfsSessions {
+		if s == seid {
+			src.upfsSessions = append(src.upfsSessions[:i], src.upfsSessions[i+1:]...)
+			dst.upfsSessions = append(dst.upfsSessions, seid)
+
+			return true
+		}
+	}
+
+	return false
+}
+
+func TestDrainUPF(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	first := true
+
+	var node *PFCPNode
+	node = newDrainTestNode([]uint64{1, 2, 3, 4, 5}, "5s", func(seid uint64, src, dst *Upf) bool {
+		if first {
+			first = false
+			close(started)
+			<-release
+		}
+
+		return landAt(seid, src, dst)
+	})
+	src, dst := node.upf.peersUPF[0], node.upf.peersUPF[1]
+
+	job := node.drainUPF(src, CommunicationChannel{})
+	<-started
+
+	require.True(t, node.upf.drains.draining(src))
+	require.False(t, node.upfEligible(0, nil), "no new session on a draining UPF")
+	require.True(t, node.upfEligible(1, nil))
+	require.Equal(t, job, node.drainUPF(src, CommunicationChannel{}), "one drain per UPF")
+
+	close(release)
+	require.NoError(t, job.wait())
+
+	require.Empty(t, src.upfsSessions)
+	require.ElementsMatch(t, []uint64{1, 2, 3, 4, 5}, dst.upfsSessions)
+	require.False(t, node.upf.drains.draining(src))
+
+	st := node.upf.drains.list()
+	require.Len(t, st, 1)
+	require.Equal(t, drainDone, st[0].State)
+	require.Equal(t, 5, st[0].Sessions)
+	require.Equal(t, 5, st[0].Moves)
+	require.Zero(t, st[0].Remaining)
+}
+
+func TestDrainWithoutRoom(t *testing.T) {
+	f := newFakeOrchestrator()
+	node := newDrainTestNode([]uint64{1, 2, 3, 4, 5}, "5s", landAt)
+	node.upf.orchestrator = f
+	node.upf.MaxSessionsThreshold = 3
+
+	require.NoError(t, f.CreateUPF("upf101"))
+
+	err := node.drainAndDelete(node.upf.peersUPF[0], CommunicationChannel{})
+	require.Error(t, err, "5 sessions, room for 3")
+	require.Len(t, node.upf.peersUPF[0].upfsSessions, 5, "moves nothing it can't finish")
+	require.Empty(t, f.deleted)
+	require.Equal(t, drainAborted, node.upf.drains.list()[0].State)
+
+	require.Error(t, node.deleteUPF("upf101"), "not drained")
+}
+
+func TestDrainDeadlineAndStop(t *testing.T) {
+	stuck := func(seid uint64, src, dst *Upf) bool { return true }
+
+	node := newDrainTestNode([]uint64{1}, "100ms", stuck)
+	require.Error(t, node.drainUPF(node.upf.peersUPF[0], CommunicationChannel{}).wait())
+	require.Equal(t, drainFailed, node.upf.drains.list()[0].State)
+
+	node = newDrainTestNode([]uint64{1}, "1h", stuck)
+	job := node.drainUPF(node.upf.peersUPF[0], CommunicationChannel{})
+
+	require.False(t, node.upf.drains.stop("upf102"))
+	require.True(t, node.upf.drains.stop("upf101"))
+	require.Error(t, job.wait())
+	require.Equal(t, "cancelled", job.snapshot().Reason)
+	require.True(t, node.upfEligible(0, nil), "takes sessions again")
+}
+
+func TestDrainSkipsStuckSessions(t *testing.T) {
+	// Session 3 can't go to upf102, session 4 can't move at all
+	node := newDrainTestNode([]uint64{1, 2, 3, 4, 5}, "1h", func(seid uint64, src, dst *Upf) bool {
+		if seid == 4 || (seid == 3 && dst.Hostname == "upf102") {
+			return false
+		}
+
+		return landAt(seid, src, dst)
+	})
+	node.upf.peersUPF = append(node.upf.peersUPF, &Upf{Hostname: "upf103"})
+	src := node.upf.peersUPF[0]
+
+	job := node.drainUPF(src, CommunicationChannel{})
+	require.Error(t, job.wait())
+
+	st := job.snapshot()
+	require.Equal(t, drainAborted, st.State)
+	require.Equal(t, "1 sessions can't move to any UPF", st.Reason)
+	require.Equal(t, []uint64{4}, src.upfsSessions, "the others moved past it")
+	require.Contains(t, node.upf.peersUPF[2].upfsSessions, uint64(3))
+}
+
+func TestRetiredUPFBackTakesSessions(t *testing.T) {
+	node := newDrainTestNode(nil, "1h", landAt)
+	src := node.upf.peersUPF[0]
+
+	require.NoError(t, node.retireUPF(src, CommunicationChannel{}).wait())
+	require.True(t, node.upf.drains.draining(src), "retired")
+
+	conn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 8805})
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// The pod restarted before its heartbeats expired, and registered again
+	pConn := &PFCPConn{Conn: conn}
+	asres := message.NewAssociationSetupResponse(1, ie.NewNodeID("", "", "upf101"),
+		ie.NewCause(ie.CauseRequestAccepted), ie.NewRecoveryTimeStamp(time.Now()))
+	require.NoError(t, pConn.handleAssociationSetupResponse(asres, PfcpInfo{Upf: src, rebind: true}, CommunicationChannel{}, node))
+
+	require.False(t, node.upf.drains.draining(src))
+	require.Empty(t, node.upf.drains.list())
+}
@@ -0,0 +1,221 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright 2022-present Open Networking Foundation
+
+package pfcpiface
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+)
+
+// poolSignals are the signals of the pool an external scaler, e.g. HPA or
+// KEDA, sizes the UPFs from, as of the last cycle of the autoscaler.
+type poolSignals struct {
+	At             time.Time `json:"at"`
+	UPFs           int       `json:"upfs"`         // serving sessions
+	DesiredUPFs    int       `json:"desired_upfs"` // called for by the scaling policy
+	SessionsPerUPF float64   `json:"sessions_per_upf"`
+	BitratePerUPF  float64   `json:"bitrate_per_upf"` // bytes received per second, 0 if unknown
+}
+
+// publish returns the signals of the pool of n UPFs, for which the autoscaler
+// recommends rec.
+func (a *autoscaler) publish(pool scalingPool, now time.Time, n int, rec scalingDecision,
+	readings []signalReading, fc *sessionForecast) poolSignals {
+	read := func(name string) float64 {
+		for _, r := range readings {
+			if r.Name == name {
+				return r.Value
+			}
+		}
+
+		// Signals the policy doesn't read, e.g. bitrate, are read once per cycle too
+		v, err := pool.signal(name)
+		if err != nil {
+			log.Debugln("Unable to publish signal", name, err)
+		}
+
+		return v
+	}
+
+	return poolSignals{
+		At:             now,
+		UPFs:           n,
+		DesiredUPFs:    a.desiredUPFs(n, rec, readings, fc),
+		SessionsPerUPF: read(signalSessions),
+		BitratePerUPF:  read(signalBitRate),
+	}
+}
+
+// desiredUPFs returns the UPFs the policy calls for with n, rec recommended:
+// on scale-out, enough for each signal to fall under its scale_out_above and
+// to serve the sessions forecast; on scale-in, one less. Windows and cooldowns
+// are left to the external scaler.
+func (a *autoscaler) desiredUPFs(n int, rec scalingDecision, readings []signalReading, fc *sessionForecast) int {
+	desired := n
+
+	switch rec {
+	case scaleOut:
+		desired = n + 1
+
+		for _, r := range readings {
+			if r.Error != "" || r.ScaleOutAbove <= 0 {
+				continue
+			}
+
+			if need := int(math.Ceil(r.Value * float64(n) / r.ScaleOutAbove)); need > desired {
+				desired = need
+			}
+		}
+
+		if fc != nil && fc.Ready && fc.PredictedUPFs > desired {
+			desired = fc.PredictedUPFs
+		}
+	case scaleIn:
+		desired = n - 1
+	}
+
+	if desired > a.maxUPFs {
+		desired = a.maxUPFs
+	}
+
+	if desired < a.minUPFs {
+		desired = a.minUPFs
+	}
+
+	return desired
+}
+
+// poolSignals returns the signals published in the last cycle.
+func (a *autoscaler) poolSignals() poolSignals {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return a.published
+}
+
+// poolSignalsCollector exports the signals of the pool to Prometheus, for
+// the Prometheus adapter of HPA or the Prometheus scaler of KEDA.
+type poolSignalsCollector struct {
+	autoscaler     *autoscaler
+	upfs           *prometheus.Desc
+	desiredUPFs    *prometheus.Desc
+	sessionsPerUPF *prometheus.Desc
+	bitratePerUPF  *prometheus.Desc
+}
+
+func newPoolSignalsCollector(a *autoscaler) *poolSignalsCollector {
+	return &poolSignalsCollector{
+		autoscaler: a,
+		upfs: prometheus.NewDesc(prometheus.BuildFQName("upf_lb", "pool", "upfs"),
+			"Shows the number of UPFs serving sessions",
+			nil, nil,
+		),
+		desiredUPFs: prometheus.NewDesc(prometheus.BuildFQName("upf_lb", "pool", "desired_upfs"),
+			"Shows the number of UPFs the scaling policy of the LB calls for",
+			nil, nil,
+		),
+		sessionsPerUPF: prometheus.NewDesc(prometheus.BuildFQName("upf_lb", "pool", "sessions_per_upf"),
+			"Shows the average number of sessions per UPF",
+			nil, nil,
+		),
+		bitratePerUPF: prometheus.NewDesc(prometheus.BuildFQName("upf_lb", "pool", "bitrate_per_upf"),
+			"Shows the average bytes received per second per UPF",
+			nil, nil,
+		),
+	}
+}
+
+func (col *poolSignalsCollector) Describe(ch chan<- *prometheus.Desc) {
+	prometheus.DescribeByCollect(col, ch)
+}
+
+func (col *poolSignalsCollector) Collect(ch chan<- prometheus.Metric) {
+	s := col.autoscaler.poolSignals()
+	if s.At.IsZero() {
+		return
+	}
+
+	ch <- prometheus.MustNewConstMetric(col.upfs, prometheus.GaugeValue, float64(s.UPFs))
+	ch <- prometheus.MustNewConstMetric(col.desiredUPFs, prometheus.GaugeValue, float64(s.DesiredUPFs))
+	ch <- prometheus.MustNewConstMetric(col.sessionsPerUPF, prometheus.GaugeValue, s.SessionsPerUPF)
+	ch <- prometheus.MustNewConstMetric(col.bitratePerUPF, prometheus.GaugeValue, s.BitratePerUPF)
+}
+
+// newScalingMetricsHandler returns the handler of /scaling/metrics: the signals
+// of the pool in the Prometheus text format, on a registry of their own.
+func newScalingMetricsHandler(a *autoscaler) (http.Handler, error) {
+	reg := prometheus.NewRegistry()
+	if err := reg.Register(newPoolSignalsCollector(a)); err != nil {
+		return nil, err
+	}
+
+	return promhttp.HandlerFor(reg, promhttp.HandlerOpts{}), nil
+}
+
+// scalingSignalsHandler returns the signals of the pool as JSON, for the
+// metrics API scaler of KEDA, e.g. with valueLocation desired_upfs.
+func scalingSignalsHandler(w http.ResponseWriter, r *http.Request, node *PFCPNode) {
+	if node.upf.autoscaler == nil {
+		sendHTTPResp(http.StatusNotFound, w)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		w.Header().Set("Content-Type", "application/json")
+
+		if err := json.NewEncoder(w).Encode(node.upf.autoscaler.poolSignals()); err != nil {
+			log.Errorln("http response write failed : ", err)
+		}
+	default:
+		sendHTTPResp(http.StatusMethodNotAllowed, w)
+	}
+}
+
+// preStopHandler drains the UPF ?upf= before it is stopped, e.g. by the pre-stop
+// hooks of its pod when an external scaler scales the pool in. It answers once
+// the UPF is empty, or at the latest after drain.deadline, within the grace
+// period of the pod, and takes no new session from then on. Calls for a UPF
+// being drained wait for the same drain. A UPF unknown to the LB has nothing to
+// drain.
+func preStopHandler(w http.ResponseWriter, r *http.Request, node *PFCPNode, comCh CommunicationChannel) {
+	switch r.Method {
+	case "GET", "POST":
+		name := r.URL.Query().Get("upf")
+		if name == "" {
+			sendHTTPResp(http.StatusBadRequest, w)
+			return
+		}
+
+		u := node.upf.peerByHostname(name)
+		if u == nil {
+			log.Infoln("Pre-stop of UPF", name, "not registered, nothing to drain")
+			w.WriteHeader(http.StatusOK)
+
+			return
+		}
+
+		job := node.retireUPF(u, comCh)
+		err := job.wait()
+
+		w.Header().Set("Content-Type", "application/json")
+
+		if err != nil {
+			log.Errorln("UPF", name, "stops with sessions:", err)
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+
+		if err := json.NewEncoder(w).Encode(job.snapshot()); err != nil {
+			log.Errorln("http response write failed : ", err)
+		}
+	default:
+		sendHTTPResp(http.StatusMethodNotAllowed, w)
+	}
+}
@@ -0,0 +1,89 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright 2022-present Open Networking Foundation
+
+package pfcpiface
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAutoscalerExternal(t *testing.T) {
+	now := time.Unix(0, 0)
+	a := newTestAutoscaler(&now,
+		ScalingSignalInfo{Name: signalSessions, ScaleOutAbove: 100, ScaleInBelow: 20},
+		ScalingSignalInfo{Name: signalCPU, ScaleOutAbove: 800, ScaleInBelow: 200})
+	a.external = true
+	a.schedules.defaults.MaxUPFs = 10
+	pool := &fakeScalingPool{upfs: 2, values: map[string]float64{signalSessions: 250, signalCPU: 900, signalBitRate: 1e6}, inAllowed: true}
+
+	a.step(pool)
+	now = now.Add(time.Hour)
+	require.Equal(t, scaleOut, a.step(pool))
+	now = now.Add(time.Hour)
+	a.step(pool)
+
+	require.Equal(t, 2, pool.upfs, "left to the external scaler")
+	require.True(t, a.audit.list(2)[0].DryRun)
+	require.Equal(t, poolSignals{At: time.Unix(7200, 0), UPFs: 2, DesiredUPFs: 5, SessionsPerUPF: 250, BitratePerUPF: 1e6},
+		a.poolSignals(), "500 sessions take 5 UPFs")
+
+	pool.values[signalSessions], pool.values[signalCPU] = 10, 100
+	pool.upfs = 3
+	a.step(pool)
+	require.Equal(t, 2, a.poolSignals().DesiredUPFs, "one less")
+
+	pool.values[signalSessions] = 60
+	a.step(pool)
+	require.Equal(t, 3, a.poolSignals().DesiredUPFs)
+
+	a.schedules.defaults.MaxUPFs = 4
+	pool.values[signalSessions] = 1000
+	a.step(pool)
+	require.Equal(t, 4, a.poolSignals().DesiredUPFs, "within max_upfs")
+
+	h, err := newScalingMetricsHandler(a)
+	require.NoError(t, err)
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/scaling/metrics", nil))
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.Contains(t, rr.Body.String(), "upf_lb_pool_desired_upfs 4\n")
+	require.Contains(t, rr.Body.String(), "upf_lb_pool_sessions_per_upf 1000\n")
+
+	rr = httptest.NewRecorder()
+	scalingSignalsHandler(rr, httptest.NewRequest(http.MethodGet, "/scaling/signals", nil), &PFCPNode{upf: &Upf{autoscaler: a}})
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.Contains(t, rr.Body.String(), `"desired_upfs":4`)
+}
+
+func TestPreStopHandler(t *testing.T) {
+	node := newDrainTestNode([]uint64{1, 2, 3}, "5s", landAt)
+	src := node.upf.peersUPF[0]
+
+	preStop := func(target string) int {
+		rr := httptest.NewRecorder()
+		preStopHandler(rr, httptest.NewRequest(http.MethodPost, target, nil), node, CommunicationChannel{})
+
+		return rr.Code
+	}
+
+	require.Equal(t, http.StatusBadRequest, preStop("/pre-stop"))
+	require.Equal(t, http.StatusOK, preStop("/pre-stop?upf=upf199"), "nothing to drain")
+
+	require.Equal(t, http.StatusOK, preStop("/pre-stop?upf=upf101"))
+	require.Empty(t, src.upfsSessions)
+	require.True(t, node.upf.drains.draining(src), "takes no session until it is gone")
+	require.False(t, node.upfEligible(0, nil))
+
+	// Back under the same name, as a new instance
+	node.upf.peersUPF[0] = &Upf{Hostname: "upf101"}
+	require.True(t, node.upfEligible(0, nil))
+
+	node = newDrainTestNode([]uint64{1}, "100ms", func(seid uint64, src, dst *Upf) bool { return false })
+	require.Equal(t, http.StatusServiceUnavailable, preStop("/pre-stop?upf=upf101"))
+}
@@ -0,0 +1,148 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright 2022-present Open Networking Foundation
+
+package pfcpiface
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// forecastMinSamples is the number of observations before the trend is trusted.
+const forecastMinSamples = 3
+
+// sessionForecaster forecasts the sessions of the pool over the boot time of a
+// UPF, with Holt's linear trend method: the level and the trend, in sessions
+// per second, are smoothed at every observation.
+type sessionForecaster struct {
+	mu          sync.Mutex
+	alpha       float64 // smoothing of the level
+	beta        float64 // smoothing of the trend
+	horizon     time.Duration
+	established uint64 // session establishments since the last observation
+	deleted     uint64
+	estRate     float64 // smoothed establishments per second
+	delRate     float64
+	level       float64 // smoothed sessions
+	trend       float64 // smoothed sessions per second
+	samples     int
+	lastAt      time.Time
+	last        sessionForecast
+}
+
+// sessionForecast is the state of the forecaster after an observation, and
+// what it calls for.
+type sessionForecast struct {
+	At             time.Time `json:"at"`
+	Sessions       int       `json:"sessions"`
+	EstablishRate  float64   `json:"establish_rate"` // per second
+	DeleteRate     float64   `json:"delete_rate"`
+	Level          float64   `json:"level"`
+	Trend          float64   `json:"trend"` // sessions per second
+	HorizonSeconds float64   `json:"horizon_seconds"`
+	Forecast       float64   `json:"forecast"` // sessions at the horizon
+	Ready          bool      `json:"ready"`    // enough observations to act on the forecast
+	UPFs           int       `json:"upfs"`
+	ForecastPerUPF float64   `json:"forecast_per_upf"`
+	SessionsPerUPF float64   `json:"sessions_per_upf"` // the most a UPF should serve
+	PredictedUPFs  int       `json:"predicted_upfs"`   // to serve the forecast
+	ScaleOutAhead  bool      `json:"scale_out_ahead"`
+	ScaleInBlocked bool      `json:"scale_in_blocked"`
+}
+
+func newSessionForecaster(conf PredictiveScalingInfo) *sessionForecaster {
+	return &sessionForecaster{
+		alpha:   conf.Alpha,
+		beta:    conf.Beta,
+		horizon: durationOrDefault(conf.BootTime, 0),
+	}
+}
+
+// recordEstablishment counts a session established by an SMF.
+func (f *sessionForecaster) recordEstablishment() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.established++
+}
+
+// recordDeletion counts a session deleted by an SMF.
+func (f *sessionForecaster) recordDeletion() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.deleted++
+}
+
+// observe smooths the sessions of the pool at now and the requests since the
+// last observation, and returns the forecast over the horizon and what it
+// calls for with n UPFs, each serving up to limit sessions.
+func (f *sessionForecaster) observe(now time.Time, sessions, n int, limit float64) sessionForecast {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	x := float64(sessions)
+
+	switch {
+	case f.samples == 0:
+		f.level = x
+	case now.After(f.lastAt):
+		dt := now.Sub(f.lastAt).Seconds()
+		est, del := float64(f.established)/dt, float64(f.deleted)/dt
+
+		level := f.alpha*x + (1-f.alpha)*(f.level+f.trend*dt)
+		f.trend = f.beta*(level-f.level)/dt + (1-f.beta)*f.trend
+		f.level = level
+
+		if f.samples == 1 {
+			f.estRate, f.delRate = est, del
+		} else {
+			f.estRate = f.alpha*est + (1-f.alpha)*f.estRate
+			f.delRate = f.alpha*del + (1-f.alpha)*f.delRate
+		}
+	}
+
+	f.samples++
+	f.lastAt = now
+	f.established, f.deleted = 0, 0
+
+	fc := sessionForecast{
+		At:             now,
+		Sessions:       sessions,
+		EstablishRate:  f.estRate,
+		DeleteRate:     f.delRate,
+		Level:          f.level,
+		Trend:          f.trend,
+		HorizonSeconds: f.horizon.Seconds(),
+		Forecast:       math.Max(0, f.level+f.trend*f.horizon.Seconds()),
+		Ready:          f.samples >= forecastMinSamples,
+		UPFs:           n,
+		SessionsPerUPF: limit,
+	}
+
+	if n > 0 {
+		fc.ForecastPerUPF = fc.Forecast / float64(n)
+	}
+
+	if limit > 0 {
+		fc.PredictedUPFs = int(math.Ceil(fc.Forecast / limit))
+
+		if fc.Ready {
+			fc.ScaleOutAhead = fc.ForecastPerUPF > limit
+			fc.ScaleInBlocked = n <= 1 || fc.Forecast/float64(n-1) > limit
+		}
+	}
+
+	f.last = fc
+
+	return fc
+}
+
+// status returns the last forecast.
+func (f *sessionForecaster) status() sessionForecast {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.last
+}
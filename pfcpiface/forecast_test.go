@@ -0,0 +1,84 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright 2022-present Open Networking Foundation
+
+package pfcpiface
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSessionForecasterTrend(t *testing.T) {
+	now := time.Unix(0, 0)
+	f := newSessionForecaster(PredictiveScalingInfo{BootTime: "60s", Alpha: 0.5, Beta: 0.3})
+
+	var fc sessionForecast
+
+	// 20 sessions per second, established and never deleted
+	for sessions := 0; sessions <= 1200; sessions += 200 {
+		for i := 0; i < 200 && sessions > 0; i++ {
+			f.recordEstablishment()
+		}
+
+		fc = f.observe(now, sessions, 2, 1000)
+		now = now.Add(10 * time.Second)
+	}
+
+	require.True(t, fc.Ready)
+	require.InDelta(t, 20, fc.EstablishRate, 0.01)
+	require.Zero(t, fc.DeleteRate)
+	require.InDelta(t, 20, fc.Trend, 2)
+	require.Greater(t, fc.Forecast, 2000.0, "1200 sessions and 1200 more within the boot time")
+	require.InDelta(t, fc.Forecast/2, fc.ForecastPerUPF, 1e-9)
+	require.True(t, fc.ScaleOutAhead, "600 sessions per UPF now, over 1000 at the horizon")
+	require.True(t, fc.ScaleInBlocked)
+	require.Equal(t, 3, fc.PredictedUPFs)
+
+	// The load levels off
+	for i := 0; i < 30; i++ {
+		fc = f.observe(now, 1200, 3, 1000)
+		now = now.Add(10 * time.Second)
+	}
+
+	require.InDelta(t, 0, fc.Trend, 0.5)
+	require.InDelta(t, 1200, fc.Forecast, 30)
+	require.False(t, fc.ScaleOutAhead)
+	require.False(t, fc.ScaleInBlocked, "2 UPFs serve the forecast")
+	require.Equal(t, fc, f.status())
+}
+
+func TestAutoscalerPredictive(t *testing.T) {
+	now := time.Unix(0, 0)
+	a := newTestAutoscaler(&now, ScalingSignalInfo{Name: signalSessions, ScaleOutAbove: 100, ScaleInBelow: 20})
+	a.forecaster = newSessionForecaster(PredictiveScalingInfo{BootTime: "60s", Alpha: 0.5, Beta: 0.3})
+	pool := &fakeScalingPool{upfs: 2, values: map[string]float64{signalSessions: 0}, inAllowed: true}
+
+	decision := scaleNone
+
+	// One session per second per UPF
+	for i := 0; decision == scaleNone; i++ {
+		require.Less(t, pool.values[signalSessions], 100.0, "scaled out before the UPFs are full")
+
+		decision = a.step(pool)
+		now = now.Add(10 * time.Second)
+		pool.values[signalSessions] += 10
+	}
+
+	require.Equal(t, scaleOut, decision)
+	require.Equal(t, 3, pool.upfs)
+
+	st := a.status()
+	require.Equal(t, "scale-out", st.LastDecision)
+	require.True(t, st.Ahead)
+	require.NotNil(t, st.Forecast)
+	require.True(t, st.Forecast.ScaleOutAhead)
+
+	rr := httptest.NewRecorder()
+	autoscalerHandler(rr, httptest.NewRequest(http.MethodGet, "/autoscaler", nil), &PFCPNode{upf: &Upf{autoscaler: a}})
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.Contains(t, rr.Body.String(), `"scale_out_ahead":true`)
+}
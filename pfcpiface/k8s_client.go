@@ -0,0 +1,109 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright 2022-present Open Networking Foundation
+
+package pfcpiface
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// serviceAccountDir holds the credentials Kubernetes mounts into pods.
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// k8sClient talks to the API server of the cluster the LB runs in, with the
+// credentials of its service account.
+type k8sClient struct {
+	apiServer string // https://host:port
+	tokenFile string
+	namespace string
+	client    *http.Client
+}
+
+// newK8sClient returns a client of the objects of namespace, or of the LB's
+// own namespace if empty.
+func newK8sClient(namespace string) (*k8sClient, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, ErrOperationFailedWithReason("kubernetes client", "not running in a cluster")
+	}
+
+	ca, err := os.ReadFile(filepath.Join(serviceAccountDir, "ca.crt"))
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, ErrOperationFailedWithReason("kubernetes client", "invalid cluster CA")
+	}
+
+	if namespace == "" {
+		ns, err := os.ReadFile(filepath.Join(serviceAccountDir, "namespace"))
+		if err != nil {
+			return nil, err
+		}
+
+		namespace = strings.TrimSpace(string(ns))
+	}
+
+	return &k8sClient{
+		apiServer: "https://" + net.JoinHostPort(host, port),
+		tokenFile: filepath.Join(serviceAccountDir, "token"),
+		namespace: namespace,
+		client: &http.Client{
+			Timeout:   30 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}},
+		},
+	}, nil
+}
+
+// do sends a request to the API server and returns the response body. A
+// missing object is reported as ErrNotFound.
+func (k *k8sClient) do(method, path, contentType string, body []byte) ([]byte, error) {
+	token, err := os.ReadFile(k.tokenFile)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(method, k.apiServer+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	req.Header.Set("Accept", "application/json")
+
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, ErrNotFound(path)
+	case resp.StatusCode >= 300:
+		return nil, ErrOperationFailedWithReason(method+" "+path, fmt.Sprint(resp.Status, ": ", string(respBody)))
+	}
+
+	return respBody, nil
+}
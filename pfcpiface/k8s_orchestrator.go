@@ -0,0 +1,201 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright 2022-present Open Networking Foundation
+
+package pfcpiface
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// k8sFieldManager identifies the LB as the owner of the fields it applies.
+const k8sFieldManager = "pfcpiface"
+
+// k8sManagedBy labels the objects of the UPFs the LB created.
+const k8sManagedBy = "app.kubernetes.io/managed-by=" + k8sFieldManager
+
+// k8sOrchestrator manages UPFs through the Kubernetes API of the cluster the
+// LB runs in. A UPF is the set of objects of its rendered manifest.
+type k8sOrchestrator struct {
+	*k8sClient
+	manifests *manifestRenderer
+	metrics   MetricsSource // the metrics API of the cluster
+}
+
+// k8sObject is an object of a UPF manifest, in JSON.
+type k8sObject struct {
+	apiVersion string
+	kind       string
+	name       string
+	body       []byte
+}
+
+func newK8sOrchestrator(conf *Conf) (*k8sOrchestrator, error) {
+	manifests, err := newManifestRenderer(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := newK8sClient(conf.Orchestrator.Namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	return &k8sOrchestrator{k8sClient: client, manifests: manifests, metrics: &k8sMetricsSource{client}}, nil
+}
+
+// k8sResource returns the resource name of kind, e.g. "statefulsets".
+func k8sResource(kind string) string {
+	resource := strings.ToLower(kind)
+
+	switch {
+	case strings.HasSuffix(resource, "s"):
+		return resource + "es"
+	case strings.HasSuffix(resource, "y"):
+		return strings.TrimSuffix(resource, "y") + "ies"
+	default:
+		return resource + "s"
+	}
+}
+
+// k8sCollection returns the path of the objects of kind in namespace.
+func k8sCollection(apiVersion, kind, namespace string) string {
+	group := "/apis/" + apiVersion
+	if apiVersion == "v1" {
+		group = "/api/v1"
+	}
+
+	return group + "/namespaces/" + namespace + "/" + k8sResource(kind)
+}
+
+// parseManifest returns the objects of a multi-document YAML manifest.
+func parseManifest(manifest []byte) ([]k8sObject, error) {
+	var objects []k8sObject
+
+	dec := yaml.NewDecoder(bytes.NewReader(manifest))
+
+	for {
+		var doc map[string]interface{}
+
+		err := dec.Decode(&doc)
+		if errors.Is(err, io.EOF) {
+			return objects, nil
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		if len(doc) == 0 {
+			continue
+		}
+
+		obj := k8sObject{}
+		obj.apiVersion, _ = doc["apiVersion"].(string)
+		obj.kind, _ = doc["kind"].(string)
+
+		if metadata, ok := doc["metadata"].(map[string]interface{}); ok {
+			obj.name, _ = metadata["name"].(string)
+		}
+
+		if obj.apiVersion == "" || obj.kind == "" || obj.name == "" {
+			return nil, ErrInvalidArgumentWithReason("manifest object", doc["kind"], "missing apiVersion, kind or name")
+		}
+
+		if obj.body, err = json.Marshal(doc); err != nil {
+			return nil, err
+		}
+
+		objects = append(objects, obj)
+	}
+}
+
+func (k *k8sOrchestrator) manifest(name string) ([]k8sObject, error) {
+	manifest, err := k.manifests.render(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseManifest(manifest)
+}
+
+// CreateUPF applies the objects of the UPF's manifest, like kubectl apply.
+func (k *k8sOrchestrator) CreateUPF(name string) error {
+	objects, err := k.manifest(name)
+	if err != nil {
+		return err
+	}
+
+	for _, obj := range objects {
+		path := k8sCollection(obj.apiVersion, obj.kind, k.namespace) + "/" + obj.name +
+			"?fieldManager=" + k8sFieldManager + "&force=true"
+
+		if _, err := k.do(http.MethodPatch, path, "application/apply-patch+yaml", obj.body); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// DeleteUPF deletes the objects of the UPF's manifest that exist.
+func (k *k8sOrchestrator) DeleteUPF(name string) error {
+	objects, err := k.manifest(name)
+	if err != nil {
+		return err
+	}
+
+	for _, obj := range objects {
+		path := k8sCollection(obj.apiVersion, obj.kind, k.namespace) + "/" + obj.name
+
+		_, err := k.do(http.MethodDelete, path, "application/json", []byte(`{"propagationPolicy":"Background"}`))
+		if err != nil && !errors.Is(err, errNotFound) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ListUPFs returns the StatefulSets of the namespace the LB created.
+func (k *k8sOrchestrator) ListUPFs() ([]string, error) {
+	path := k8sCollection("apps/v1", "StatefulSet", k.namespace) + "?labelSelector=" + url.QueryEscape(k8sManagedBy)
+
+	body, err := k.do(http.MethodGet, path, "", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var list struct {
+		Items []struct {
+			Metadata struct {
+				Name string `json:"name"`
+			} `json:"metadata"`
+		} `json:"items"`
+	}
+
+	if err := json.Unmarshal(body, &list); err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(list.Items))
+
+	for _, item := range list.Items {
+		names = append(names, item.Metadata.Name)
+	}
+
+	return names, nil
+}
+
+// GetUPFMetrics returns the usage the metrics API of the cluster reports for
+// the pods of the UPF.
+func (k *k8sOrchestrator) GetUPFMetrics(name string) (UPFMetrics, error) {
+	return upfMetricsFrom(k.metrics, name)
+}
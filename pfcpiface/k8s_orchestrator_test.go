@@ -0,0 +1,151 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright 2022-present Open Networking Foundation
+
+package pfcpiface
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const testUPFManifest = `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: {{ .Name }}-conf
+data:
+  upf.json: "{}"
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: {{ .Name }}-http
+spec:
+  ports:
+  - name: prometheus-exporter
+    port: 8080
+---
+apiVersion: apps/v1
+kind: StatefulSet
+metadata:
+  name: {{ .Name }}
+spec:
+  replicas: 1
+`
+
+// newTestK8sClient returns a client of the namespace "omec" talking to the
+// API server served by handler.
+func newTestK8sClient(t *testing.T, handler http.Handler) *k8sClient {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(tokenFile, []byte("secret\n"), 0o600))
+
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+
+	return &k8sClient{apiServer: srv.URL, tokenFile: tokenFile, namespace: "omec", client: srv.Client()}
+}
+
+// newTestK8sOrchestrator returns an orchestrator of the namespace "omec"
+// talking to the API server served by handler.
+func newTestK8sOrchestrator(t *testing.T, handler http.Handler) *k8sOrchestrator {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "upf.yaml"), []byte(testUPFManifest), 0o600))
+
+	manifests, err := newManifestRenderer(&Conf{UPFTemplate: UPFTemplateInfo{TemplateDir: dir}})
+	require.NoError(t, err)
+
+	return &k8sOrchestrator{k8sClient: newTestK8sClient(t, handler), manifests: manifests}
+}
+
+func TestK8sCollection(t *testing.T) {
+	require.Equal(t, "/api/v1/namespaces/omec/configmaps", k8sCollection("v1", "ConfigMap", "omec"))
+	require.Equal(t, "/apis/apps/v1/namespaces/omec/statefulsets", k8sCollection("apps/v1", "StatefulSet", "omec"))
+	require.Equal(t, "/apis/networking.k8s.io/v1/namespaces/omec/ingresses", k8sCollection("networking.k8s.io/v1", "Ingress", "omec"))
+	require.Equal(t, "/apis/policy/v1/namespaces/omec/poddisruptionbudgets", k8sCollection("policy/v1", "PodDisruptionBudget", "omec"))
+	require.Equal(t, "/apis/x/v1/namespaces/omec/networkpolicies", k8sCollection("x/v1", "NetworkPolicy", "omec"))
+}
+
+func TestParseManifest(t *testing.T) {
+	manifest := strings.ReplaceAll(testUPFManifest, "{{ .Name }}", "upf101")
+
+	objects, err := parseManifest([]byte(manifest))
+	require.NoError(t, err)
+	require.Len(t, objects, 3)
+
+	require.Equal(t, "StatefulSet", objects[2].kind)
+	require.Equal(t, "upf101", objects[2].name)
+
+	var body map[string]interface{}
+	require.NoError(t, json.Unmarshal(objects[1].body, &body), "objects are sent in JSON")
+
+	_, err = parseManifest([]byte("apiVersion: v1\nkind: Service\n"))
+	require.Error(t, err, "an object without a name can't be applied")
+}
+
+func TestK8sOrchestratorCreateDelete(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		requests []string
+	)
+
+	k := newTestK8sOrchestrator(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		require.Equal(t, "Bearer secret", r.Header.Get("Authorization"))
+
+		if r.Method == http.MethodPatch {
+			require.Equal(t, "application/apply-patch+yaml", r.Header.Get("Content-Type"))
+			require.Equal(t, "pfcpiface", r.URL.Query().Get("fieldManager"))
+
+			body, err := io.ReadAll(r.Body)
+			require.NoError(t, err)
+			require.True(t, json.Valid(body))
+		}
+
+		requests = append(requests, r.Method+" "+r.URL.Path)
+
+		// The exporter service was already deleted
+		if r.Method == http.MethodDelete && strings.HasSuffix(r.URL.Path, "/upf101-http") {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		_, _ = w.Write([]byte("{}"))
+	}))
+
+	require.NoError(t, k.CreateUPF("upf101"))
+	require.NoError(t, k.DeleteUPF("upf101"))
+
+	require.Equal(t, []string{
+		"PATCH /api/v1/namespaces/omec/configmaps/upf101-conf",
+		"PATCH /api/v1/namespaces/omec/services/upf101-http",
+		"PATCH /apis/apps/v1/namespaces/omec/statefulsets/upf101",
+		"DELETE /api/v1/namespaces/omec/configmaps/upf101-conf",
+		"DELETE /api/v1/namespaces/omec/services/upf101-http",
+		"DELETE /apis/apps/v1/namespaces/omec/statefulsets/upf101",
+	}, requests)
+}
+
+func TestK8sOrchestratorList(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/apis/apps/v1/namespaces/omec/statefulsets", func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "app.kubernetes.io/managed-by=pfcpiface", r.URL.Query().Get("labelSelector"))
+		_, _ = w.Write([]byte(`{"items": [{"metadata": {"name": "upf101"}}]}`))
+	})
+
+	k := newTestK8sOrchestrator(t, mux)
+
+	names, err := k.ListUPFs()
+	require.NoError(t, err)
+	require.Equal(t, []string{"upf101"}, names)
+}
@@ -0,0 +1,164 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright 2022-present Open Networking Foundation
+
+package pfcpiface
+
+import (
+	"net"
+
+	"github.com/wmnsk/go-pfcp/ie"
+)
+
+// upFunctionFeatures returns the UP Function Features octets of a single UPF.
+func upFunctionFeatures(upf *Upf) []uint8 {
+	features := make([]uint8, 4)
+
+	if upf.EnableUeIPAlloc {
+		setUeipFeature(features...)
+	}
+
+	if upf.EnableEndMarker {
+		setEndMarkerFeature(features...)
+	}
+
+	return features
+}
+
+// poolFunctionFeatures returns the UP Function Features supported by every UPF of the pool.
+// A feature is only advertised to the SMF if the LB can place a session on any UPF.
+func poolFunctionFeatures(upfs []*Upf) []uint8 {
+	features := make([]uint8, 4)
+	if len(upfs) == 0 {
+		return features
+	}
+
+	for i := range features {
+		features[i] = 0xff
+	}
+
+	for _, u := range upfs {
+		for i, f := range upFunctionFeatures(u) {
+			features[i] &= f
+		}
+	}
+
+	return features
+}
+
+// accessIPs returns the IPv4 and IPv6 N3 addresses of the UPF, nil when absent.
+// AccessIP may hold either family.
+func (u *Upf) accessIPs() (v4, v6 net.IP) {
+	for _, ip := range []net.IP{u.AccessIP, u.AccessIPv6} {
+		if ip == nil || ip.IsUnspecified() {
+			continue
+		}
+
+		if ip.To4() != nil {
+			if v4 == nil {
+				v4 = ip.To4()
+			}
+		} else if v6 == nil {
+			v6 = ip
+		}
+	}
+
+	return v4, v6
+}
+
+// poolIPResources returns one User Plane IP Resource Information IE per distinct
+// access IPs and network instance of the pool.
+func poolIPResources(upfs []*Upf) []*ie.IE {
+	type resourceKey struct {
+		v4  string
+		v6  string
+		dnn string
+	}
+
+	seen := make(map[resourceKey]struct{})
+	resources := make([]*ie.IE, 0)
+
+	for _, u := range upfs {
+		v4, v6 := u.accessIPs()
+		if v4 == nil && v6 == nil {
+			continue
+		}
+
+		key := resourceKey{v4: v4.String(), v6: v6.String(), dnn: u.Dnn}
+		if _, ok := seen[key]; ok {
+			continue
+		}
+
+		seen[key] = struct{}{}
+
+		resources = append(resources, newUserPlaneIPResource(v4, v6, u.Dnn))
+	}
+
+	return resources
+}
+
+// newUserPlaneIPResource builds a User Plane IP Resource Information IE for the
+// given access addresses, either of which may be nil.
+func newUserPlaneIPResource(v4, v6 net.IP, dnn string) *ie.IE {
+	// 0x40 = Spare (0) | Assoc Src Inst (1) | Assoc Net Inst (0) | Tied Range (000) | IPV6 (0) | IPV4 (0)
+	//      = 01000000
+	flags := uint8(0x40)
+	networkInstance := ""
+
+	var v4Str, v6Str string
+
+	if v4 != nil {
+		flags |= 0x01
+		v4Str = v4.String()
+	}
+
+	if v6 != nil {
+		flags |= 0x02
+		v6Str = v6.String()
+	}
+
+	if len(dnn) != 0 {
+		// add ASSONI flag to set network instance.
+		flags |= 0x20
+		networkInstance = string(ie.NewNetworkInstanceFQDN(dnn).Payload)
+	}
+
+	return ie.NewUserPlaneIPResourceInformation(flags, 0, v4Str, v6Str, networkInstance, ie.SrcInterfaceAccess)
+}
+
+// advertisedUPFs returns the UPFs the LB speaks for toward the SMF.
+// Before any UPF has registered, the configured virtual identity is used instead.
+func (u *Upf) advertisedUPFs() []*Upf {
+	if len(u.peersUPF) == 0 && u.virtualUPF != nil {
+		return []*Upf{u.virtualUPF}
+	}
+
+	return u.peersUPF
+}
+
+// newVirtualUPF returns the virtual identity of conf, nil if it has no access
+// address to advertise.
+func newVirtualUPF(conf *Conf) *Upf {
+	if conf.VirtualUPF.AccessIP == "" && conf.VirtualUPF.AccessIPv6 == "" {
+		return nil
+	}
+
+	v := &Upf{
+		EnableUeIPAlloc: conf.VirtualUPF.EnableUeIPAlloc,
+		EnableEndMarker: conf.VirtualUPF.EnableEndMarker,
+		Dnn:             conf.VirtualUPF.Dnn,
+	}
+
+	if v.Dnn == "" {
+		v.Dnn = conf.CPIface.Dnn
+	}
+
+	if conf.VirtualUPF.AccessIP != "" {
+		v.AccessIP = net.ParseIP(conf.VirtualUPF.AccessIP)
+	}
+
+	if conf.VirtualUPF.AccessIPv6 != "" {
+		v.AccessIPv6 = net.ParseIP(conf.VirtualUPF.AccessIPv6)
+	}
+
+	return v
+}
@@ -0,0 +1,114 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright 2022-present Open Networking Foundation
+
+package pfcpiface
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/wmnsk/go-pfcp/ie"
+	"github.com/wmnsk/go-pfcp/message"
+)
+
+func TestPoolFunctionFeatures(t *testing.T) {
+	t.Run("empty pool advertises nothing", func(t *testing.T) {
+		require.Equal(t, []uint8{0, 0, 0, 0}, poolFunctionFeatures(nil))
+	})
+
+	t.Run("features are intersected", func(t *testing.T) {
+		upfs := []*Upf{
+			{EnableUeIPAlloc: true, EnableEndMarker: true},
+			{EnableEndMarker: true},
+		}
+		features := poolFunctionFeatures(upfs)
+		require.Equal(t, uint8(0x01), features[1], "end marker is supported by all UPFs")
+		require.Equal(t, uint8(0x00), features[2], "UE IP allocation is not supported by all UPFs")
+	})
+}
+
+func TestPoolIPResources(t *testing.T) {
+	upfs := []*Upf{
+		{AccessIP: net.ParseIP("10.0.0.1"), Dnn: "internet"},
+		{AccessIP: net.ParseIP("10.0.0.1"), Dnn: "internet"},
+		{AccessIP: net.ParseIP("10.0.0.1"), Dnn: "ims"},
+		{AccessIP: net.ParseIP("10.0.0.2")},
+		{Dnn: "internet"},
+	}
+
+	resources := poolIPResources(upfs)
+	require.Len(t, resources, 3)
+
+	// The go-pfcp parser can't decode ASSONI together with ASSOSI, check the payload directly.
+	require.Equal(t, uint8(0x61), resources[1].Payload[0])
+	require.Equal(t, net.ParseIP("10.0.0.1").To4(), net.IP(resources[1].Payload[1:5]))
+	require.Contains(t, string(resources[1].Payload[5:]), "ims")
+
+	require.Equal(t, uint8(0x41), resources[2].Payload[0])
+	require.Equal(t, net.ParseIP("10.0.0.2").To4(), net.IP(resources[2].Payload[1:5]))
+}
+
+func TestPoolIPResourcesDualStack(t *testing.T) {
+	upfs := []*Upf{
+		{AccessIP: net.ParseIP("10.0.0.1"), AccessIPv6: net.ParseIP("2001:db8::1")},
+		{AccessIP: net.ParseIP("2001:db8::2")},
+	}
+
+	resources := poolIPResources(upfs)
+	require.Len(t, resources, 2)
+
+	dual, err := resources[0].UserPlaneIPResourceInformation()
+	require.NoError(t, err)
+	require.Equal(t, uint8(0x43), dual.Flags)
+	require.Equal(t, "10.0.0.1", dual.IPv4Address.String())
+	require.Equal(t, "2001:db8::1", dual.IPv6Address.String())
+
+	v6Only, err := resources[1].UserPlaneIPResourceInformation()
+	require.NoError(t, err)
+	require.Equal(t, uint8(0x42), v6Only.Flags)
+	require.Nil(t, v6Only.IPv4Address)
+	require.Equal(t, "2001:db8::2", v6Only.IPv6Address.String())
+}
+
+func TestAdvertisedUPFs(t *testing.T) {
+	conf := &Conf{
+		CPIface:    CPIfaceInfo{Dnn: "internet"},
+		VirtualUPF: VirtualUPFInfo{AccessIP: "10.0.0.100"},
+	}
+	u := &Upf{virtualUPF: newVirtualUPF(conf)}
+
+	advertised := u.advertisedUPFs()
+	require.Len(t, advertised, 1)
+	require.Equal(t, "internet", advertised[0].Dnn)
+	require.Equal(t, "10.0.0.100", advertised[0].AccessIP.String())
+
+	real := &Upf{AccessIP: net.ParseIP("10.0.0.1")}
+	u.peersUPF = []*Upf{real}
+	require.Equal(t, []*Upf{real}, u.advertisedUPFs())
+
+	require.Nil(t, newVirtualUPF(&Conf{CPIface: CPIfaceInfo{Dnn: "internet"}}), "no access address to advertise")
+}
+
+func TestAssociationWithoutUPF(t *testing.T) {
+	comCh := CommunicationChannel{ResetSessions: make(chan struct{}, 1)}
+	pConn := &PFCPConn{upf: &Upf{}, nodeID: nodeID{localIE: ie.NewNodeID("10.0.0.9", "", "")}}
+	asreq := message.NewAssociationSetupRequest(1, ie.NewNodeID("10.0.0.50", "", ""), ie.NewRecoveryTimeStamp(time.Now()))
+
+	reply, err := pConn.handleAssociationSetupRequest(asreq, comCh)
+	require.Error(t, err)
+
+	cause, err := reply.(*message.AssociationSetupResponse).Cause.Cause()
+	require.NoError(t, err)
+	require.Equal(t, ie.CauseNoResourcesAvailable, cause)
+	require.Empty(t, comCh.ResetSessions, "the sessions are kept")
+
+	pConn.upf.peersUPF = []*Upf{{AccessIP: net.ParseIP("10.0.0.1")}}
+	reply, err = pConn.handleAssociationSetupRequest(asreq, comCh)
+	require.NoError(t, err)
+
+	cause, err = reply.(*message.AssociationSetupResponse).Cause.Cause()
+	require.NoError(t, err)
+	require.Equal(t, ie.CauseRequestAccepted, cause)
+}
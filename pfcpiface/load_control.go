@@ -0,0 +1,306 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright 2022-present Open Networking Foundation
+
+package pfcpiface
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/wmnsk/go-pfcp/ie"
+)
+
+// CP Function Features flags, 3GPP TS 29.244 section 8.2.58.
+const (
+	cpFeatureLOAD = 0x01 // Load Control
+	cpFeatureOVRL = 0x02 // Overload Control
+)
+
+// loadControl holds the last Load Control and Overload Control Information
+// reported by a UPF, 3GPP TS 29.244 sections 6.2.6 and 6.2.7.
+type loadControl struct {
+	mu sync.Mutex
+
+	loadSeq     uint32
+	loadMetric  uint8
+	loadUpdated bool
+
+	overloadSeq        uint32
+	overloadReduction  uint8
+	overloadValidUntil time.Time
+}
+
+// updateLoad records a Load Control Information IE, ignoring outdated ones.
+func (l *loadControl) updateLoad(lci *ie.IE) error {
+	ies, err := lci.LoadControlInformation()
+	if err != nil {
+		return err
+	}
+
+	seq, metric, err := seqAndMetric(ies)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.loadUpdated && seq <= l.loadSeq {
+		return nil
+	}
+
+	l.loadSeq = seq
+	l.loadMetric = metric
+	l.loadUpdated = true
+
+	return nil
+}
+
+// updateOverload records an Overload Control Information IE, ignoring outdated ones.
+func (l *loadControl) updateOverload(oci *ie.IE, now time.Time) error {
+	ies, err := oci.OverloadControlInformation()
+	if err != nil {
+		return err
+	}
+
+	seq, metric, err := seqAndMetric(ies)
+	if err != nil {
+		return err
+	}
+
+	var validity time.Duration
+
+	for _, x := range ies {
+		if x.Type == ie.Timer {
+			validity, err = x.Timer()
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !l.overloadValidUntil.IsZero() && seq <= l.overloadSeq {
+		return nil
+	}
+
+	l.overloadSeq = seq
+	l.overloadReduction = metric
+	l.overloadValidUntil = now.Add(validity)
+
+	return nil
+}
+
+func seqAndMetric(ies []*ie.IE) (uint32, uint8, error) {
+	var (
+		seq, metric       uint32
+		hasSeq, hasMetric bool
+	)
+
+	for _, x := range ies {
+		switch x.Type {
+		case ie.SequenceNumber:
+			s, err := x.SequenceNumber()
+			if err != nil {
+				return 0, 0, err
+			}
+
+			seq, hasSeq = s, true
+		case ie.Metric:
+			m, err := x.Metric()
+			if err != nil {
+				return 0, 0, err
+			}
+
+			metric, hasMetric = uint32(m), true
+		}
+	}
+
+	if !hasSeq || !hasMetric {
+		return 0, 0, ErrNotFound("Sequence Number or Metric")
+	}
+
+	return seq, uint8(metric), nil
+}
+
+// load returns the last reported load metric, 0 if the UPF never reported one.
+func (l *loadControl) load() uint8 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.loadMetric
+}
+
+// reportedLoad returns the load metric and whether the UPF ever reported one.
+func (l *loadControl) reportedLoad() (uint8, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.loadMetric, l.loadUpdated
+}
+
+// overloaded reports whether the UPF asked for its traffic to be reduced and
+// the request is still valid. It also returns the requested reduction and the
+// remaining validity.
+func (l *loadControl) overloaded(now time.Time) (bool, uint8, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.overloadReduction == 0 || !now.Before(l.overloadValidUntil) {
+		return false, 0, 0
+	}
+
+	return true, l.overloadReduction, l.overloadValidUntil.Sub(now)
+}
+
+// peerByNodeID returns the registered UPF with the given NodeID, nil if none.
+func (u *Upf) peerByNodeID(nodeID string) *Upf {
+	for _, p := range u.peersUPF {
+		if p.NodeID == nodeID {
+			return p
+		}
+	}
+
+	return nil
+}
+
+// peerByHostname returns the registered UPF with the given hostname, nil if none.
+func (u *Upf) peerByHostname(hostname string) *Upf {
+	for _, p := range u.peersUPF {
+		if p.Hostname == hostname {
+			return p
+		}
+	}
+
+	return nil
+}
+
+// updatePeerLoad stores the LCI/OCI carried by a UPF response.
+func (pConn *PFCPConn) updatePeerLoad(lci, oci *ie.IE) {
+	if lci == nil && oci == nil {
+		return
+	}
+
+	peer := pConn.upf.peerByNodeID(pConn.nodeID.remote)
+	if peer == nil {
+		return
+	}
+
+	if lci != nil {
+		if err := peer.loadControl.updateLoad(lci); err != nil {
+			log.Warnln("Ignoring malformed Load Control Information from", pConn.nodeID.remote, err)
+		}
+	}
+
+	if oci != nil {
+		if err := peer.loadControl.updateOverload(oci, time.Now()); err != nil {
+			log.Warnln("Ignoring malformed Overload Control Information from", pConn.nodeID.remote, err)
+		}
+	}
+}
+
+// poolLoadSeq is the sequence number of the last LCI/OCI reported to the SMF.
+var poolLoadSeq uint32
+
+// nextPoolLoadSeq returns the sequence number of the LCI/OCI reported at now,
+// which must increase on every change, several within a second included. It is
+// the time in seconds unless that was already used, so it keeps increasing
+// across restarts of the LB as long as it reported less than once per second
+// on average.
+func nextPoolLoadSeq(now time.Time) uint32 {
+	for {
+		last := atomic.LoadUint32(&poolLoadSeq)
+
+		seq := uint32(now.Unix())
+		if seq <= last {
+			seq = last + 1
+		}
+
+		if atomic.CompareAndSwapUint32(&poolLoadSeq, last, seq) {
+			return seq
+		}
+	}
+}
+
+// poolLoadControlIEs returns the aggregate LCI and OCI the LB reports to the SMF.
+// The load metric is the average of the UPFs that reported theirs, no LCI if
+// none did. Overload is only reported when every UPF of the pool is overloaded,
+// with the smallest requested reduction.
+func poolLoadControlIEs(upfs []*Upf, now time.Time) (lci, oci *ie.IE) {
+	if len(upfs) == 0 {
+		return nil, nil
+	}
+
+	var (
+		totalLoad    uint32
+		reporting    uint32
+		minReduction uint8
+		minValidity  time.Duration
+	)
+
+	allOverloaded := true
+
+	for i, u := range upfs {
+		if load, ok := u.loadControl.reportedLoad(); ok {
+			totalLoad += uint32(load)
+			reporting++
+		}
+
+		overloaded, reduction, validity := u.loadControl.overloaded(now)
+		if !overloaded {
+			allOverloaded = false
+			continue
+		}
+
+		if i == 0 || reduction < minReduction {
+			minReduction = reduction
+		}
+
+		if i == 0 || validity < minValidity {
+			minValidity = validity
+		}
+	}
+
+	seq := nextPoolLoadSeq(now)
+
+	if reporting > 0 {
+		lci = ie.NewLoadControlInformation(
+			ie.NewSequenceNumber(seq),
+			ie.NewMetric(uint8(totalLoad/reporting)),
+		)
+	}
+
+	if allOverloaded {
+		oci = ie.NewOverloadControlInformation(
+			ie.NewSequenceNumber(seq),
+			ie.NewMetric(minReduction),
+			ie.NewTimer(minValidity),
+		)
+	}
+
+	return lci, oci
+}
+
+// smfLoadControlIEs returns the LCI/OCI to piggyback on a response to the SMF,
+// limited to what the SMF announced support for.
+func (pConn *PFCPConn) smfLoadControlIEs() (lci, oci *ie.IE) {
+	if pConn.cpFeatures&(cpFeatureLOAD|cpFeatureOVRL) == 0 {
+		return nil, nil
+	}
+
+	lci, oci = poolLoadControlIEs(pConn.upf.peersUPF, time.Now())
+
+	if pConn.cpFeatures&cpFeatureLOAD == 0 {
+		lci = nil
+	}
+
+	if pConn.cpFeatures&cpFeatureOVRL == 0 {
+		oci = nil
+	}
+
+	return lci, oci
+}
@@ -0,0 +1,120 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright 2022-present Open Networking Foundation
+
+package pfcpiface
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/wmnsk/go-pfcp/ie"
+)
+
+func newTestLCI(seq uint32, metric uint8) *ie.IE {
+	return ie.NewLoadControlInformation(ie.NewSequenceNumber(seq), ie.NewMetric(metric))
+}
+
+func newTestOCI(seq uint32, reduction uint8, validity time.Duration) *ie.IE {
+	return ie.NewOverloadControlInformation(
+		ie.NewSequenceNumber(seq),
+		ie.NewMetric(reduction),
+		ie.NewTimer(validity),
+	)
+}
+
+func TestLoadControl(t *testing.T) {
+	var l loadControl
+
+	now := time.Now()
+
+	require.NoError(t, l.updateLoad(newTestLCI(2, 40)))
+	require.Equal(t, uint8(40), l.load())
+
+	require.NoError(t, l.updateLoad(newTestLCI(1, 90)))
+	require.Equal(t, uint8(40), l.load(), "outdated sequence number must be ignored")
+
+	overloaded, _, _ := l.overloaded(now)
+	require.False(t, overloaded)
+
+	require.NoError(t, l.updateOverload(newTestOCI(1, 30, time.Minute), now))
+
+	overloaded, reduction, _ := l.overloaded(now)
+	require.True(t, overloaded)
+	require.Equal(t, uint8(30), reduction)
+
+	overloaded, _, _ = l.overloaded(now.Add(2 * time.Minute))
+	require.False(t, overloaded, "overload expires with its period of validity")
+
+	require.Error(t, l.updateLoad(ie.NewLoadControlInformation(ie.NewMetric(10))))
+}
+
+func TestPoolLoadControlIEs(t *testing.T) {
+	now := time.Now()
+	u1, u2 := &Upf{}, &Upf{}
+
+	require.NoError(t, u1.loadControl.updateLoad(newTestLCI(1, 20)))
+	require.NoError(t, u2.loadControl.updateLoad(newTestLCI(1, 60)))
+	require.NoError(t, u1.loadControl.updateOverload(newTestOCI(1, 50, time.Minute), now))
+
+	lci, oci := poolLoadControlIEs([]*Upf{u1, u2, {}}, now)
+	require.Nil(t, oci, "pool isn't overloaded while a UPF has capacity")
+
+	ies, err := lci.LoadControlInformation()
+	require.NoError(t, err)
+
+	_, metric, err := seqAndMetric(ies)
+	require.NoError(t, err)
+	require.Equal(t, uint8(40), metric, "the UPF that never reported its load is left out")
+
+	require.NoError(t, u2.loadControl.updateOverload(newTestOCI(1, 20, time.Minute), now))
+
+	lci2, oci := poolLoadControlIEs([]*Upf{u1, u2}, now)
+	require.NotNil(t, oci)
+
+	ies, err = oci.OverloadControlInformation()
+	require.NoError(t, err)
+
+	_, reduction, err := seqAndMetric(ies)
+	require.NoError(t, err)
+	require.Equal(t, uint8(20), reduction)
+
+	// The SMF drops information with a sequence number it already had
+	var smf loadControl
+	require.NoError(t, smf.updateLoad(lci))
+	seq := smf.loadSeq
+	require.NoError(t, smf.updateLoad(lci2))
+	require.Greater(t, smf.loadSeq, seq, "a change within the same second is taken")
+
+	lci, _ = poolLoadControlIEs([]*Upf{{}}, now)
+	require.Nil(t, lci, "no UPF reported its load")
+}
+
+func TestPoolLoadSeq(t *testing.T) {
+	defer func(orig uint32) { poolLoadSeq = orig }(poolLoadSeq)
+
+	now := time.Unix(1000, 0)
+	poolLoadSeq = 0
+
+	require.Equal(t, uint32(1000), nextPoolLoadSeq(now))
+	require.Equal(t, uint32(1001), nextPoolLoadSeq(now), "several within a second")
+	require.Equal(t, uint32(1002), nextPoolLoadSeq(now.Add(time.Second)))
+	require.Equal(t, uint32(1010), nextPoolLoadSeq(now.Add(10*time.Second)), "back to the time")
+}
+
+func TestLightestUPFSkipsOverloaded(t *testing.T) {
+	now := time.Now()
+	u := &Upf{gtpuPaths: newGTPUPathMonitor()}
+	u1 := &Upf{NodeID: "upf1"}
+	u2 := &Upf{NodeID: "upf2", upfsSessions: []uint64{1, 2}}
+	u3 := &Upf{NodeID: "upf3"}
+	u.peersUPF = []*Upf{u1, u2, u3}
+	node := &PFCPNode{upf: u}
+
+	require.NoError(t, u1.loadControl.updateOverload(newTestOCI(1, 50, time.Minute), now))
+	require.NoError(t, u3.loadControl.updateLoad(newTestLCI(1, 80)))
+	require.Equal(t, 1, node.lightestUPF(nil), "upf1 is overloaded and upf3 reports a higher load")
+
+	require.NoError(t, u2.loadControl.updateOverload(newTestOCI(1, 50, time.Minute), now))
+	require.Equal(t, 2, node.lightestUPF(nil))
+}
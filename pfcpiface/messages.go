@@ -97,12 +97,15 @@ func (pConn *PFCPConn) HandlePFCPMsg(buf []byte, comCh CommunicationChannel, nod
 	// Connection related messages
 	case message.MsgTypeHeartbeatRequest:
 		reply, err = pConn.handleHeartbeatRequest(msg)
+		if errors.Is(err, errSMFRestarted) {
+			defer pConn.shutdownRestartedSMF(comCh)
+		}
 	case message.MsgTypePFDManagementRequest:
 		reply, err = pConn.handlePFDMgmtRequest(msg)
 	case message.MsgTypeAssociationSetupRequest:
 		reply, err = pConn.handleAssociationSetupRequest(msg, comCh)
-		if reply != nil && err == nil && pConn.upf.enableHBTimer {
-			go pConn.startHeartBeatMonitor(comCh)
+		if reply != nil && err == nil {
+			pConn.superviseSMFPath(comCh)
 		}
 		// TODO: Cleanup sessions
 
@@ -119,7 +122,7 @@ func (pConn *PFCPConn) HandlePFCPMsg(buf []byte, comCh CommunicationChannel, nod
 	case message.MsgTypeSessionEstablishmentResponse:
 		pConn.handleSessionEstablishmentResponse(msg, comCh, node)
 	case message.MsgTypeSessionModificationResponse:
-		pConn.handleSessionModificationResponse(msg, comCh)
+		pConn.handleSessionModificationResponse(msg, comCh, node)
 	case message.MsgTypeSessionDeletionResponse:
 		pConn.handleSessionDeletionResponse(msg, comCh, node)
 	case message.MsgTypeSessionModificationRequest:
@@ -128,10 +131,13 @@ func (pConn *PFCPConn) HandlePFCPMsg(buf []byte, comCh CommunicationChannel, nod
 		reply, err = pConn.handleSessionDeletionRequest(msg, comCh)
 	case message.MsgTypeSessionReportResponse:
 		err = pConn.handleSessionReportResponse(msg)
+	case message.MsgTypeNodeReportRequest:
+		reply, err = pConn.handleNodeReportRequest(msg, comCh)
 
 	// Incoming response messages
 	// TODO: Session Report Request
-	case message.MsgTypeAssociationSetupResponse, message.MsgTypeHeartbeatResponse:
+	case message.MsgTypeAssociationSetupResponse, message.MsgTypeHeartbeatResponse,
+		message.MsgTypeNodeReportResponse:
 		pConn.handleIncomingResponse(msg)
 
 	default:
@@ -196,13 +202,19 @@ func (pConn *PFCPConn) SendPFCPMsg(msg message.Message) {
 }
 
 func (pConn *PFCPConn) sendPFCPRequestMessage(r *Request) (message.Message, bool) {
+	return pConn.sendPFCPRequestMessageWithRetries(r, pConn.upf.maxReqRetries, pConn.upf.respTimeout)
+}
+
+// sendPFCPRequestMessageWithRetries sends r and retransmits it up to maxRetries
+// times, every respTimeout, until a response is received.
+func (pConn *PFCPConn) sendPFCPRequestMessageWithRetries(r *Request, maxRetries uint8, respTimeout time.Duration) (message.Message, bool) {
 	pConn.pendingReqs.Store(r.msg.Sequence(), r)
 
 	pConn.SendPFCPMsg(r.msg)
-	retriesLeft := pConn.upf.maxReqRetries
+	retriesLeft := maxRetries
 
 	for {
-		if reply, rc := r.GetResponse(pConn.shutdown, pConn.upf.respTimeout); rc {
+		if reply, rc := r.GetResponse(pConn.shutdown, respTimeout); rc {
 			//log.traceln("Request Timeout, retriesLeft:", retriesLeft, " , time : ", pConn.upf.readTimeout)
 
 			if retriesLeft > 0 {
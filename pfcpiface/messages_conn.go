@@ -6,7 +6,6 @@ package pfcpiface
 import (
 	"errors"
 	"fmt"
-	"time"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/wmnsk/go-pfcp/ie"
@@ -16,11 +15,13 @@ import (
 var errFlowDescAbsent = errors.New("flow description not present")
 var errDatapathDown = errors.New("datapath down")
 var errReqRejected = errors.New("request rejected")
+var errNoUPF = errors.New("no UPF registered nor virtual UPF configured")
 
 func (pConn *PFCPConn) sendAssociationRequest(pfcpInfo PfcpInfo, comCh CommunicationChannel, node *PFCPNode) {
 	// Build request message
+	// Acting as CP function towards the UPF, ask for Load and Overload Control Information
 	asreq := message.NewAssociationSetupRequest(pConn.getSeqNum(),
-		pConn.associationIEs()...,
+		append(pConn.associationIEs(), ie.NewCPFunctionFeatures(cpFeatureLOAD|cpFeatureOVRL))...,
 	)
 
 	r := newRequest(asreq)
@@ -114,13 +115,15 @@ func (pConn *PFCPConn) handleHeartbeatRequest(msg message.Message) (message.Mess
 		}
 	}
 
-	// TODO: Check and update remote recovery timestamp
-
 	// Build response message
 	hbres := message.NewHeartbeatResponse(hbreq.SequenceNumber,
 		ie.NewRecoveryTimeStamp(pConn.ts.local), /* ts */
 	)
 
+	if pConn.smfPath != nil && pConn.remoteRestarted(hbreq.RecoveryTimeStamp) {
+		return hbres, errSMFRestarted
+	}
+
 	return hbres, nil
 }
 
@@ -135,18 +138,6 @@ func (pConn *PFCPConn) handleIncomingResponse(msg message.Message) {
 
 func (pConn *PFCPConn) associationIEs() []*ie.IE {
 	upf := pConn.upf
-	networkInstance := string(ie.NewNetworkInstanceFQDN(upf.Dnn).Payload)
-	//fmt.Println("parham log : networkInstance = ", networkInstance)
-	flags := uint8(0x41)
-	//fmt.Println("parham log : flags = ", flags)
-
-	if len(upf.Dnn) != 0 {
-		//log.infoln("Association Setup with DNN:", upf.Dnn)
-		//fmt.Println("parham log : upf.dnn = ", upf.Dnn)
-		// add ASSONI flag to set network instance.
-		flags = uint8(0x61)
-		//fmt.Println("parham log : flags = ", flags)
-	}
 
 	features := make([]uint8, 4)
 
@@ -161,12 +152,11 @@ func (pConn *PFCPConn) associationIEs() []*ie.IE {
 	}
 	//fmt.Println("parham log : upf.accessIP = ", upf.AccessIP)
 	//fmt.Println("parham log : upf.coreIP = ", upf.CoreIP)
+	accessIPv4, accessIPv6 := upf.accessIPs()
 	ies := []*ie.IE{
 		ie.NewRecoveryTimeStamp(pConn.ts.local),
 		pConn.nodeID.localIE,
-		// 0x41 = Spare (0) | Assoc Src Inst (1) | Assoc Net Inst (0) | Tied Range (000) | IPV6 (0) | IPV4 (1)
-		//      = 01000001
-		ie.NewUserPlaneIPResourceInformation(flags, 0, upf.AccessIP.String(), "", networkInstance, ie.SrcInterfaceAccess),
+		newUserPlaneIPResource(accessIPv4, accessIPv6, upf.Dnn),
 		// ie.NewUserPlaneIPResourceInformation(0x41, 0, coreIP, "", "", ie.SrcInterfaceCore),
 		ie.NewUPFunctionFeatures(features...),
 	}
@@ -174,52 +164,28 @@ func (pConn *PFCPConn) associationIEs() []*ie.IE {
 	return ies
 }
 
-func (pConn *PFCPConn) lbAssociationIEs(upf *Upf) []*ie.IE {
-	//upf := pConn.upf
-	networkInstance := string(ie.NewNetworkInstanceFQDN(upf.Dnn).Payload)
-	//fmt.Println("parham log : networkInstance = ", networkInstance)
-	flags := uint8(0x41)
-	//fmt.Println("parham log : flags = ", flags)
-
-	if len(upf.Dnn) != 0 {
-		//log.infoln("Association Setup with DNN:", upf.Dnn)
-		//fmt.Println("parham log : upf.dnn = ", upf.Dnn)
-		// add ASSONI flag to set network instance.
-		flags = uint8(0x61)
-		//fmt.Println("parham log : flags = ", flags)
-	}
-
-	features := make([]uint8, 4)
-
-	if upf.EnableUeIPAlloc {
-		setUeipFeature(features...)
-		//fmt.Println("parham log : upf.enableUeIPAlloc is enable and features = ", features)
-	}
-
-	if upf.EnableEndMarker {
-		setEndMarkerFeature(features...)
-		//fmt.Println("parham log : upf.enableUeIPAlloc is enable and features = ", features)
-	}
-	//fmt.Println("parham log : upf.accessIP = ", upf.AccessIP)
-	//fmt.Println("parham log : upf.coreIP = ", upf.CoreIP)
+// lbAssociationIEs builds the association IEs the LB advertises to the SMF on behalf
+// of the given UPFs: the intersection of their UP Function Features and the union
+// of their user plane IP resources.
+func (pConn *PFCPConn) lbAssociationIEs(upfs []*Upf) []*ie.IE {
 	ies := []*ie.IE{
 		ie.NewRecoveryTimeStamp(pConn.ts.local),
-		//ie.NewNodeID(upf.NodeID, "", ""),
 		pConn.nodeID.localIE,
-		// 0x41 = Spare (0) | Assoc Src Inst (1) | Assoc Net Inst (0) | Tied Range (000) | IPV6 (0) | IPV4 (1)
-		//      = 01000001
+	}
+	ies = append(ies, poolIPResources(upfs)...)
 
-		ie.NewUserPlaneIPResourceInformation(flags, 0, upf.AccessIP.String(), "", networkInstance, ie.SrcInterfaceAccess),
-		// ie.NewUserPlaneIPResourceInformation(0x41, 0, coreIP, "", "", ie.SrcInterfaceCore),
-		ie.NewUPFunctionFeatures(features...),
+	features := poolFunctionFeatures(upfs)
+	if pConn.upf.lbUEIPAlloc {
+		setUeipFeature(features...)
 	}
 
+	ies = append(ies, ie.NewUPFunctionFeatures(features...))
+
 	return ies
 }
 
 func (pConn *PFCPConn) handleAssociationSetupRequest(msg message.Message, comCh CommunicationChannel) (message.Message, error) {
 	//fmt.Println("!!!!! parham log : start handleAssociationSetupRequest !!!!!")
-	comCh.ResetSessions <- struct{}{}
 	//addr := pConn.RemoteAddr().String()
 	//fmt.Println("parham log : remote addr = ", addr)
 	//upf := pConn.upf
@@ -242,31 +208,38 @@ func (pConn *PFCPConn) handleAssociationSetupRequest(msg message.Message, comCh
 		return nil, errUnmarshal(err)
 	}
 	//fmt.Println("parham log : asreq.SequenceNumber = ", asreq.SequenceNumber)
-	// Build response message
-	if len(pConn.upf.peersUPF) == 0 {
-		return nil, errors.New("there is no real upf there yet ...")
+	// Nothing to speak for until a UPF registers, unless a virtual identity is configured
+	upfs := pConn.upf.advertisedUPFs()
+	if len(upfs) == 0 {
+		asres := message.NewAssociationSetupResponse(asreq.SequenceNumber,
+			ie.NewRecoveryTimeStamp(pConn.ts.local), pConn.nodeID.localIE, ie.NewCause(ie.CauseNoResourcesAvailable))
+
+		return asres, errProcess(errNoUPF)
 	}
-	realUPF := pConn.upf.peersUPF[0]
-	asres := message.NewAssociationSetupResponse(asreq.SequenceNumber,
-		pConn.lbAssociationIEs(realUPF)...)
+
+	comCh.ResetSessions <- struct{}{}
+
+	// Build response message
+	asres := message.NewAssociationSetupResponse(asreq.SequenceNumber, pConn.lbAssociationIEs(upfs)...)
 
 	//if !upf.isConnected() {
 	//	asres.Cause = ie.NewCause(ie.CauseRequestRejected)
 	//	return asres, errProcess(errDatapathDown)
 	//}
 
-	if pConn.ts.remote.IsZero() {
-		pConn.ts.remote = ts
-		//log.infoln("Association Setup Request from", addr,
-		//"with recovery timestamp:", ts)
-	} else if ts.After(pConn.ts.remote) {
-		//old := pConn.ts.remote
-		pConn.ts.remote = ts
-		//log.Warnln("Association Setup Request from", addr,
-		//	"with newer recovery timestamp:", ts, "older:", old)
-	}
+	pConn.ts.learnRemote(ts)
+	//log.infoln("Association Setup Request from", addr,
+	//"with recovery timestamp:", ts)
 
 	pConn.nodeID.remote = nodeID
+
+	pConn.cpFeatures = 0
+	if asreq.CPFunctionFeatures != nil {
+		if cpFeatures, err := asreq.CPFunctionFeatures.CPFunctionFeatures(); err == nil {
+			pConn.cpFeatures = cpFeatures
+		}
+	}
+
 	asres.Cause = ie.NewCause(ie.CauseRequestAccepted)
 
 	//log.infoln("Association setup done between nodes",
@@ -300,101 +273,64 @@ func (pConn *PFCPConn) handleAssociationSetupResponse(msg message.Message, pfcpI
 		return errUnmarshal(err)
 	}
 
-	ts, err := asres.RecoveryTimeStamp.RecoveryTimeStamp()
-	if err != nil {
+	if _, err := asres.RecoveryTimeStamp.RecoveryTimeStamp(); err != nil {
 		return errUnmarshal(err)
 	}
 
-	if pConn.ts.remote.IsZero() {
-		pConn.ts.remote = ts
-		//log.infoln("Association Setup Response from", addr,
-		//"with recovery timestamp:", ts)
-	} else if ts.After(pConn.ts.remote) {
-		//old := pConn.ts.remote
-		pConn.ts.remote = ts
-		//log.Warnln("Association Setup Response from", addr,
-		//	"with newer recovery timestamp:", ts, "older:", old)
-	}
+	restarted := pConn.remoteRestarted(asres.RecoveryTimeStamp)
 
-	pConn.nodeID.remote = nodeID
-	//log.infoln("Association setup done between nodes",
-	//"local:", pConn.nodeID.local, "remote:", pConn.nodeID.remote)
-	comCh.UpfD2u <- &pfcpInfo
-	pConn.makeUPFsLighter(node, comCh)
-	return nil
-}
+	pConn.nodeID.remote = canonicalNodeID(nodeID)
 
-func makeUPFEmpty(node *PFCPNode, sUPFIndex int, comCh CommunicationChannel) {
-	fmt.Println("parham log : start makeUPFEmpty")
-	if len(node.upf.peersUPF) <= 1 || sUPFIndex >= len(node.upf.peersUPF) {
-		fmt.Println("parham log : there is no other upf")
-		return
+	// A UPF configured without its Node ID, e.g. in the static pool, goes by the one it associated with
+	if pfcpInfo.Upf != nil && pfcpInfo.Upf.NodeID == "" {
+		pfcpInfo.Upf.NodeID = pConn.nodeID.remote
 	}
+	//log.infoln("Association setup done between nodes",
+	//"local:", pConn.nodeID.local, "remote:", pConn.nodeID.remote)
 
-	if sUPFIndex >= len(node.upf.peersUPF) {
-		fmt.Println("parham log : upf has been already made empty")
-		return
+	if pfcpInfo.Shadow {
+		node.upf.shadow.associated(pConn)
+		return nil
 	}
 
-	for len(node.upf.peersUPF[sUPFIndex].upfsSessions) > 0 {
-		dUPFIndex := 0
-		if sUPFIndex == 0 {
-			dUPFIndex = 1
-		}
-		for i := range node.upf.peersUPF {
-			if i != sUPFIndex && len(node.upf.peersUPF[i].upfsSessions) < len(node.upf.peersUPF[dUPFIndex].upfsSessions) {
-				dUPFIndex = i
-			}
+	if pfcpInfo.rebind {
+		// Back, e.g. restarted after a pre-stop drain retired it: it takes sessions again
+		if node.upf.drains != nil {
+			node.upf.drains.forget(pfcpInfo.Upf.Hostname)
 		}
 
-		sourceAddr := node.upf.peersUPF[sUPFIndex].peersIP + ":" + DownPFCPPort
-		destAddr := node.upf.peersUPF[dUPFIndex].peersIP + ":" + DownPFCPPort
-		//	fmt.Println("parham log : source upf ip = ", sourceAddr, " dest upf ip = ", destAddr)
-		sourcePconn, ok := node.pConns.Load(sourceAddr)
-		if !ok {
-			//		fmt.Println("parham log : can not find source Pconn in node.pConns.Load(sourceAddr)")
-			continue
-		}
-		destPconn, ok := node.pConns.Load(destAddr)
-		if !ok {
-			//		fmt.Println("parham log : can not find dest Pconn in node.pConns.Load(destAddr)")
-			continue
-		}
-		sPconn := sourcePconn.(*PFCPConn)
-		dPconn := destPconn.(*PFCPConn)
-		//	fmt.Println("parham log : geting session from dead upf")
-		sessIndex := len(node.upf.peersUPF[sUPFIndex].upfsSessions) - 1
-		SEID := node.upf.peersUPF[sUPFIndex].upfsSessions[sessIndex]
-		sess, ok := sPconn.sessionStore.GetSession(SEID)
-		if !ok {
-			fmt.Println("parham log : can not find session = ", SEID, "in sPconn.sessionStore.GetSession(v)")
-			continue
+		// Same UPF: no new peer to announce nor sessions to attract, unless it lost them
+		if restarted {
+			log.Warnln("UPF", pConn.nodeID.remote, "restarted, re-establishing its sessions")
+			pConn.reestablishSessions(node, comCh)
 		}
-		//	fmt.Println("parham log : puting to lightest upf")
-		dPconn.sessionStore.PutSession(sess)
 
-		//pConn.upf.SendMsgToUPF(upfMsgTypeDel, sess.PacketForwardingRules, PacketForwardingRules{})
-		node.upf.lbmap[SEID] = dUPFIndex
-
-		estMsg, ok := node.upf.sesEstMsgStore[SEID]
-
-		if ok {
-			sesEstMsg := SesEstU2dMsg{
-				msg:       estMsg,
-				upSeid:    SEID,
-				reforward: true,
-			}
-			comCh.SesEstU2d <- &sesEstMsg
-		}
+		return nil
+	}
 
-		sPconn.RemoveSession(sess)
+	comCh.UpfD2u <- &pfcpInfo
+	pConn.makeUPFsLighter(node, comCh)
+	return nil
+}
 
-		node.upf.peersUPF[dUPFIndex].upfsSessions = append(node.upf.peersUPF[dUPFIndex].upfsSessions, SEID)
+// rebalanceLimit returns how many sessions each UPF keeps when one joins the
+// pool: its fair share of the sessions, at most MaxSessionsThreshold.
+func (upf *Upf) rebalanceLimit() int {
+	if len(upf.peersUPF) == 0 {
+		return upf.maxSessions()
+	}
 
-		node.upf.peersUPF[sUPFIndex].upfsSessions = node.upf.peersUPF[sUPFIndex].upfsSessions[:sessIndex]
+	total := 0
+	for _, u := range upf.peersUPF {
+		total += len(u.upfsSessions)
+	}
 
+	limit := (total + len(upf.peersUPF) - 1) / len(upf.peersUPF)
+	if limit > upf.maxSessions() {
+		limit = upf.maxSessions()
 	}
 
+	return limit
 }
 
 func (pConn *PFCPConn) makeUPFsLighter(node *PFCPNode, comCh CommunicationChannel) {
@@ -410,7 +346,9 @@ func (pConn *PFCPConn) makeUPFsLighter(node *PFCPNode, comCh CommunicationChanne
 			break
 		}
 	}
-	for len(pConn.upf.peersUPF[destUpfIndex].upfsSessions) < int(pConn.upf.MaxSessionsThreshold) {
+	limit := pConn.upf.rebalanceLimit()
+	dest := pConn.upf.peersUPF[destUpfIndex]
+	for len(dest.upfsSessions)+pConn.upf.migrations.incoming(dest) < limit {
 		heaviestUpf := 0
 		if destUpfIndex == 0 {
 			heaviestUpf = 1
@@ -420,19 +358,24 @@ func (pConn *PFCPConn) makeUPFsLighter(node *PFCPNode, comCh CommunicationChanne
 				heaviestUpf = i
 			}
 		}
-		if len(pConn.upf.peersUPF[heaviestUpf].upfsSessions) <= int(pConn.upf.MaxSessionsThreshold) {
+		if len(pConn.upf.peersUPF[heaviestUpf].upfsSessions) <= limit {
 			fmt.Println("parham log : all upfs are light enough, no need to transfer any session")
 			return
 		}
 
 		totalSourceSessions := pConn.upf.peersUPF[heaviestUpf].upfsSessions
 		//fmt.Println("parham log : list of all excessed sessions : ", totalSourceSessions)
-		excessedSessions := totalSourceSessions[pConn.upf.MaxSessionsThreshold:]
-		if len(excessedSessions) > int(pConn.upf.MaxSessionsThreshold) {
-			excessedSessions = excessedSessions[len(excessedSessions)-int(pConn.upf.MaxSessionsThreshold):]
+		excessedSessions := totalSourceSessions[limit:]
+		if len(excessedSessions) > limit {
+			excessedSessions = excessedSessions[len(excessedSessions)-limit:]
 		}
 		//fmt.Println("parham log : list of excessed sessions that we want to transfer : ", excessedSessions)
+		before := len(dest.upfsSessions) + pConn.upf.migrations.incoming(dest)
 		transferSessions(heaviestUpf, destUpfIndex, excessedSessions, node, comCh, false)
+		// Sessions move once the destination accepted them, stop if none is on its way
+		if len(dest.upfsSessions)+pConn.upf.migrations.incoming(dest) <= before {
+			return
+		}
 	}
 	//fmt.Println("parham log : new upf received enough sessions")
 	//fmt.Println("parham log : done makeUPFsLighter")
@@ -445,12 +388,13 @@ func transferSessions(sUPFid, dUPFid int, sessions []uint64, node *PFCPNode, com
 	}
 	fmt.Println("parham log : start transferSessions")
 	for _, v := range sessions {
-		if len(node.upf.peersUPF[dUPFid].upfsSessions) > int(node.upf.MaxSessionsThreshold) && !ignoreTresh {
+		pending := node.upf.migrations.incoming(node.upf.peersUPF[dUPFid])
+		if len(node.upf.peersUPF[dUPFid].upfsSessions)+pending > node.upf.maxSessions() && !ignoreTresh {
 			fmt.Println("parham log : new upf is at its max threshold")
 			return
 		}
-		sourceAddr := node.upf.peersUPF[sUPFid].peersIP + ":" + DownPFCPPort
-		destAddr := node.upf.peersUPF[dUPFid].peersIP + ":" + DownPFCPPort
+		sourceAddr := upfPFCPAddr(node.upf.peersUPF[sUPFid].peersIP)
+		destAddr := upfPFCPAddr(node.upf.peersUPF[dUPFid].peersIP)
 		//	fmt.Println("parham log : source upf ip = ", sourceAddr, " dest upf ip = ", destAddr)
 		sourcePconn, ok := node.pConns.Load(sourceAddr)
 		if !ok {
@@ -464,57 +408,11 @@ func transferSessions(sUPFid, dUPFid int, sessions []uint64, node *PFCPNode, com
 		}
 		sPconn := sourcePconn.(*PFCPConn)
 		dPconn := destPconn.(*PFCPConn)
-		//	fmt.Println("parham log : geting session from dead upf")
-		sess, ok := sPconn.sessionStore.GetSession(v)
-		if !ok {
-			//		fmt.Println("parham log : can not find session = ", v, "in sPconn.sessionStore.GetSession(v)")
-			continue
-		}
-		//	fmt.Println("parham log : puting to lightest upf")
-		dPconn.sessionStore.PutSession(sess)
-
-		//pConn.upf.SendMsgToUPF(upfMsgTypeDel, sess.PacketForwardingRules, PacketForwardingRules{})
-		estMsg, ok := node.upf.sesEstMsgStore[sess.localSEID]
-		if ok {
-			sesEstMsg := SesEstU2dMsg{
-				msg:       estMsg,
-				upSeid:    sess.localSEID,
-				reforward: true,
-			}
-			comCh.SesEstU2d <- &sesEstMsg
-		}
-		go func(comCh CommunicationChannel) {
-			fmt.Println("session deletion dalay started")
-			time.Sleep(10 * time.Second)
-			delMsg := message.NewSessionDeletionRequest(0, 0, sess.localSEID, sPconn.getSeqNum(), 123,
-				nil,
-			)
-			sesDelMsg := SesDelU2dMsg{
-				msg:       delMsg,
-				upSeid:    sess.localSEID,
-				reforward: true,
-				upfIndex:  sUPFid,
-				pConn:     sPconn,
-			}
-			comCh.SesDelU2d <- &sesDelMsg
-			fmt.Println("sending ses del msg")
-		}(comCh)
-
-		sPconn.RemoveSession(sess)
-
-		node.upf.lbmap[v] = dUPFid
-		node.upf.peersUPF[dUPFid].upfsSessions = append(node.upf.peersUPF[dUPFid].upfsSessions, v)
-		var sessId int
 
-		for i := len(node.upf.peersUPF[sUPFid].upfsSessions) - 1; i >= 0; i-- {
-			if node.upf.peersUPF[sUPFid].upfsSessions[i] == v {
-				sessId = i
-				break
-			}
+		// The session stays on the source until the destination accepted it
+		if !node.migrateSession(v, sPconn, dPconn, sUPFid, dUPFid, comCh) {
+			log.Warnln("Can not migrate session", v, "from", sPconn.nodeID.remote, "to", dPconn.nodeID.remote)
 		}
-		node.upf.peersUPF[sUPFid].upfsSessions = append(node.upf.peersUPF[sUPFid].upfsSessions[:sessId], node.upf.peersUPF[sUPFid].upfsSessions[sessId+1:]...)
-		//	fmt.Println("parham log : Sessions with seid = ", sess.localSEID, " has beed transfered")
-
 	}
 	//fmt.Println("parham log : new pConn.upf.upfsSessions = ", pConn.upf.upfsSessions)
 	for i := 0; i < len(node.upf.peersUPF); i++ {
@@ -85,7 +85,7 @@ func (pConn *PFCPConn) handleSessionEstablishmentRequest(msg message.Message, co
 		return errProcessReply(ErrAllocateSession,
 			ie.CauseNoResourcesAvailable)
 	}
-	respch := make(chan *ie.IE, 10)
+	respch := make(chan *SesRespD2uMsg, 10)
 	sereqMsg := SesEstU2dMsg{
 		msg:    sereq,
 		upSeid: session.localSEID,
@@ -94,25 +94,18 @@ func (pConn *PFCPConn) handleSessionEstablishmentRequest(msg message.Message, co
 
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
-	defer close(respch)
 	comCh.SesEstU2d <- &sereqMsg
 	err = pConn.sessionStore.PutSession(session)
 	if err != nil {
 		log.Errorf("Failed to put PFCP session to store: %v", err)
 	}
 
-	var localFSEID *ie.IE
-
-	localIP := pConn.LocalAddr().(*net.UDPAddr).IP
-	if localIP.To4() != nil {
-		localFSEID = ie.NewFSEID(session.localSEID, localIP, nil)
-	} else {
-		localFSEID = ie.NewFSEID(session.localSEID, nil, localIP)
-	}
+	localFSEID := newFSEID(session.localSEID, pConn.LocalAddr().(*net.UDPAddr).IP)
 
 	// Build response message
 	select {
-	case respCause := <-respch:
+	case resp := <-respch:
+		respCause := resp.cause
 
 		causeValue, err := respCause.Cause()
 		fmt.Println("ses est resp received by up for upseid = ", session.localSEID, ", causeValue = ", causeValue)
@@ -132,6 +125,8 @@ func (pConn *PFCPConn) handleSessionEstablishmentRequest(msg message.Message, co
 			ie.NewCause(ie.CauseRequestAccepted), /* accept it blindly for the time being */
 			localFSEID,
 		)
+		seres.CreatedPDR = resp.createdPDR
+		seres.LoadControlInformation, seres.OverloadControlInformation = pConn.smfLoadControlIEs()
 		//time.Sleep(1 * time.Second)
 		return seres, nil
 	case <-ctx.Done():
@@ -142,9 +137,19 @@ func (pConn *PFCPConn) handleSessionEstablishmentRequest(msg message.Message, co
 
 }
 
-func sendResptoUp(resp *ie.IE, respCh chan *ie.IE, reforward bool) {
-	if !reforward {
-		respCh <- resp
+// sendResptoUp answers Up, unless the request was reforwarded by the LB itself.
+// createdPDR carries the Created PDRs reported to the SMF. Up never closes
+// respCh: an answer coming after Up stopped waiting stays in its buffer, or is
+// dropped once that is full.
+func sendResptoUp(cause *ie.IE, respCh chan *SesRespD2uMsg, reforward bool, createdPDR ...*ie.IE) {
+	if reforward {
+		return
+	}
+
+	select {
+	case respCh <- &SesRespD2uMsg{cause: cause, createdPDR: createdPDR}:
+	default:
+		log.Warnln("Up doesn't take the answer, dropping it")
 	}
 }
 
@@ -156,7 +161,9 @@ func (pConn *PFCPConn) handleSessionEstablishmentResponse(msg message.Message, c
 		return
 	}
 
-	var respCh chan *ie.IE
+	pConn.updatePeerLoad(seres.LoadControlInformation, seres.OverloadControlInformation)
+
+	var respCh chan *SesRespD2uMsg
 	reforward := true
 	if seres.Header.MessagePriority != 123 {
 		respCh = pConn.upf.seidToRespCh[seres.SEID()]
@@ -164,6 +171,11 @@ func (pConn *PFCPConn) handleSessionEstablishmentResponse(msg message.Message, c
 		reforward = false
 	}
 
+	// Answers of the shadow UPF are only compared with the primary's
+	if node.observe(pConn, reforward, seres.SEID(), seres) {
+		return
+	}
+
 	causeValue, err := seres.Cause.Cause()
 	if err != nil {
 		log.Errorln("can not extract response cause")
@@ -173,14 +185,48 @@ func (pConn *PFCPConn) handleSessionEstablishmentResponse(msg message.Message, c
 	if causeValue != ie.CauseRequestAccepted {
 		log.Errorln("session establishment not accepted by real pfcp")
 		sendResptoUp(ie.NewCause(ie.CauseRequestRejected), respCh, reforward)
+		if !reforward {
+			node.releaseOnBehalf(seres.SEID())
+		}
+		if reforward && node.upf.migrations.establishing(seres.SEID(), pConn) != nil {
+			node.abortMigration(seres.SEID(), comCh)
+		}
+		if reforward {
+			node.upf.migrations.forgetAborted(seres.SEID(), pConn)
+		}
+		if reforward && node.upf.standbys != nil && node.upf.standbys.installing(seres.SEID(), pConn) != nil {
+			log.Warnln("standby of session", seres.SEID(), "not accepted by", pConn.nodeID.remote)
+			node.upf.standbys.remove(seres.SEID())
+		}
 		return
 	}
 
 	//fmt.Println("parham log : real seid succesfully added to SMFtoRealstore, real seid = ", realSeid.SEID, " , smf = ", smfseid)
 	//c, err := seres.Cause.Cause()
 	//fmt.Println("parham log : send received msg's cause from real to up in down : ", c)
-	sendResptoUp(seres.Cause, respCh, reforward)
+	if !reforward {
+		sendResptoUp(seres.Cause, respCh, false, node.createdPDRs(seres.SEID(), seres.CreatedPDR)...)
+		node.installStandby(seres.SEID(), comCh)
+	}
+	// Accepted after its migration was aborted, the session stays on the source
+	if reforward && node.upf.migrations.forgetAborted(seres.SEID(), pConn) {
+		log.Warnln("Session", seres.SEID(), "accepted late by", pConn.nodeID.remote, ", deleting it there")
+		node.deleteFromDest(seres.SEID(), pConn, comCh)
+		return
+	}
+	if reforward && node.upf.standbys != nil && node.upf.standbys.accepted(seres.SEID(), pConn) {
+		node.mirrorToStandby(seres.SEID(), node.upf.sesModMsgStore[seres.SEID()], comCh)
+		return
+	}
 	if reforward {
+		m := node.upf.migrations.establishing(seres.SEID(), pConn)
+		if m != nil && !node.switchMigration(m) {
+			log.Errorln("can not hand session", seres.SEID(), "over to", pConn.nodeID.remote)
+			node.abortMigration(seres.SEID(), comCh)
+			node.deleteFromDest(seres.SEID(), pConn, comCh)
+			return
+		}
+
 		ModMsg, ok := node.upf.sesModMsgStore[seres.SEID()]
 		if ok {
 			sesModMsg := SesModU2dMsg{
@@ -190,10 +236,17 @@ func (pConn *PFCPConn) handleSessionEstablishmentResponse(msg message.Message, c
 			}
 			comCh.SesModU2d <- &sesModMsg
 		}
+
+		if m != nil {
+			node.completeMigration(m, comCh)
+		} else {
+			// Replayed after its UPF failed without a standby
+			node.installStandby(seres.SEID(), comCh)
+		}
 	}
 }
 
-func (pConn *PFCPConn) handleSessionModificationResponse(msg message.Message, comCh CommunicationChannel) {
+func (pConn *PFCPConn) handleSessionModificationResponse(msg message.Message, comCh CommunicationChannel, node *PFCPNode) {
 	//fmt.Println("parham log : handling SessionModificationResponse in down")
 	smres, ok := msg.(*message.SessionModificationResponse)
 	if !ok {
@@ -201,7 +254,10 @@ func (pConn *PFCPConn) handleSessionModificationResponse(msg message.Message, co
 		//fmt.Println("parham log : send received msg's cause from real to up in down : ", ie.CauseRequestRejected)
 		return
 	}
-	var respCh chan *ie.IE
+
+	pConn.updatePeerLoad(smres.LoadControlInformation, smres.OverloadControlInformation)
+
+	var respCh chan *SesRespD2uMsg
 	reforward := true
 	if smres.Header.MessagePriority != 123 {
 		respCh = pConn.upf.seidToRespCh[smres.SEID()]
@@ -209,9 +265,25 @@ func (pConn *PFCPConn) handleSessionModificationResponse(msg message.Message, co
 		reforward = false
 	}
 
+	// Answers of the shadow UPF are only compared with the primary's
+	if node.observe(pConn, reforward, smres.SEID(), smres) {
+		return
+	}
+
+	// Answer to the Query URR of a migrated session, its source can now be deleted
+	if reforward && node.upf.migrations.querying(smres.SEID(), pConn) != nil {
+		reportMigratedUsage(smres.SEID(), smres.UsageReport, comCh)
+		if m := node.upf.migrations.startDeleting(smres.SEID()); m != nil {
+			node.deleteFromSource(m, comCh)
+		}
+		return
+	}
+
 	//c, _ := smres.Cause.Cause()
 	//fmt.Println("parham log : send received msg's cause from real to up in down : ", c)
-	sendResptoUp(smres.Cause, respCh, reforward)
+	if !reforward {
+		sendResptoUp(smres.Cause, respCh, false, node.createdPDRs(smres.SEID(), smres.CreatedPDR)...)
+	}
 }
 
 func (pConn *PFCPConn) handleSessionModificationRequest(msg message.Message, comCh CommunicationChannel) (message.Message, error) {
@@ -241,7 +313,7 @@ func (pConn *PFCPConn) handleSessionModificationRequest(msg message.Message, com
 
 	localSEID := smreq.SEID()
 	//log.Traceln("localSEID = ", localSEID)
-	respch := make(chan *ie.IE, 10)
+	respch := make(chan *SesRespD2uMsg, 10)
 	smreqMsg := SesModU2dMsg{
 		msg:    smreq,
 		upSeid: localSEID,
@@ -251,7 +323,6 @@ func (pConn *PFCPConn) handleSessionModificationRequest(msg message.Message, com
 	//log.Traceln("ses est sent to down")
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
-	defer close(respch)
 	//log.Traceln("recovering session")
 	session, ok := pConn.sessionStore.GetSession(localSEID)
 	if !ok {
@@ -284,7 +355,8 @@ func (pConn *PFCPConn) handleSessionModificationRequest(msg message.Message, com
 		//log.Traceln("error while putting session in sessionStore")
 	}
 	select {
-	case respCause := <-respch:
+	case resp := <-respch:
+		respCause := resp.cause
 		//log.Traceln("resp recieved from down")
 		causeValue, err := respCause.Cause()
 		fmt.Println("ses mod resp received by up for upseid = ", session.localSEID, ", causeValue = ", causeValue)
@@ -306,6 +378,8 @@ func (pConn *PFCPConn) handleSessionModificationRequest(msg message.Message, com
 			0,                                    /* priority */
 			ie.NewCause(ie.CauseRequestAccepted), /* accept it blindly for the time being */
 		)
+		smres.CreatedPDR = resp.createdPDR
+		smres.LoadControlInformation, smres.OverloadControlInformation = pConn.smfLoadControlIEs()
 		//log.Traceln("smreq.SequenceNumber = ", smreq.SequenceNumber)
 		//endTime := time.Now()
 		//elapsedTime := endTime.Sub(startTime).Milliseconds()
@@ -340,7 +414,7 @@ func (pConn *PFCPConn) handleSessionDeletionRequest(msg message.Message, comCh C
 
 	/* retrieve sessionRecord */
 	localSEID := sdreq.SEID()
-	respch := make(chan *ie.IE, 10)
+	respch := make(chan *SesRespD2uMsg, 10)
 	sdreqMsg := SesDelU2dMsg{
 		msg:    sdreq,
 		upSeid: localSEID,
@@ -348,7 +422,6 @@ func (pConn *PFCPConn) handleSessionDeletionRequest(msg message.Message, comCh C
 	}
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
-	defer close(respch)
 	comCh.SesDelU2d <- &sdreqMsg
 	session, ok := pConn.sessionStore.GetSession(localSEID)
 	if !ok {
@@ -357,7 +430,8 @@ func (pConn *PFCPConn) handleSessionDeletionRequest(msg message.Message, comCh C
 
 	/* delete sessionRecord */
 	select {
-	case respCause := <-respch:
+	case resp := <-respch:
+		respCause := resp.cause
 
 		causeValue, err := respCause.Cause()
 		fmt.Println("ses del resp received by up for upseid = ", session.localSEID, ", causeValue = ", causeValue)
@@ -378,6 +452,7 @@ func (pConn *PFCPConn) handleSessionDeletionRequest(msg message.Message, comCh C
 			0,                                    /* priority */
 			ie.NewCause(ie.CauseRequestAccepted), /* accept it blindly for the time being */
 		)
+		smres.LoadControlInformation, smres.OverloadControlInformation = pConn.smfLoadControlIEs()
 
 		return smres, nil
 	case <-ctx.Done():
@@ -394,7 +469,10 @@ func (pConn *PFCPConn) handleSessionDeletionResponse(msg message.Message, comCh
 		//fmt.Println("parham log : send received msg's cause from real to up in down", ie.CauseRequestRejected)
 		return
 	}
-	var respCh chan *ie.IE
+
+	pConn.updatePeerLoad(sdres.LoadControlInformation, sdres.OverloadControlInformation)
+
+	var respCh chan *SesRespD2uMsg
 	reforward := true
 	if sdres.Header.MessagePriority != 123 {
 		respCh = pConn.upf.seidToRespCh[sdres.SEID()]
@@ -402,6 +480,17 @@ func (pConn *PFCPConn) handleSessionDeletionResponse(msg message.Message, comCh
 		reforward = false
 	}
 
+	// Answers of the shadow UPF are only compared with the primary's
+	if node.observe(pConn, reforward, sdres.SEID(), sdres) {
+		return
+	}
+
+	// The session already moved to its destination, whatever the source answers
+	if reforward && node.upf.migrations.deletingFrom(sdres.SEID(), pConn) {
+		reportMigratedUsage(sdres.SEID(), sdres.UsageReport, comCh)
+		defer node.upf.migrations.finish(sdres.SEID())
+	}
+
 	causeValue, err := sdres.Cause.Cause()
 	if err != nil {
 		log.Errorln("can not extract response cause")
@@ -431,6 +520,7 @@ func (pConn *PFCPConn) handleSessionDeletionResponse(msg message.Message, comCh
 			sendResptoUp(ie.NewCause(ie.CauseRequestRejected), respCh, reforward)
 			return
 		}
+		node.deleteStandby(downseid, comCh)
 	}
 	//fmt.Println("parham log : send received msg's cause from real to up in down for seid = ", sdres.SEID(), " resp cause = ", ie.CauseRequestAccepted)
 	sendResptoUp(sdres.Cause, respCh, reforward)
@@ -438,6 +528,9 @@ func (pConn *PFCPConn) handleSessionDeletionResponse(msg message.Message, comCh
 
 func (pConn *PFCPConn) pruneSession(node *PFCPNode, seid uint64) error {
 	//fmt.Println("parham log : start deleting session from everywhere")
+	node.upf.placementMu.Lock()
+	defer node.upf.placementMu.Unlock()
+
 	delete(node.upf.lbmap, seid)
 	var found bool
 	var upfIndex int
@@ -466,6 +559,8 @@ func (pConn *PFCPConn) pruneSession(node *PFCPNode, seid uint64) error {
 	node.upf.peersUPF[upfIndex].upfsSessions = append(node.upf.peersUPF[upfIndex].upfsSessions[:sessionIndex], node.upf.peersUPF[upfIndex].upfsSessions[sessionIndex+1:]...)
 	delete(node.upf.sesEstMsgStore, seid)
 	delete(node.upf.sesModMsgStore, seid)
+	delete(node.upf.sesURRs, seid)
+	node.releaseOnBehalf(seid)
 	//fmt.Println("parham log : done deleting session from everywhere")
 	return nil
 }
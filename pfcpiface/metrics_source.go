@@ -0,0 +1,375 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright 2022-present Open Networking Foundation
+
+package pfcpiface
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metrics sources, conf.Metrics.Sources.
+const (
+	metricsSourceKubernetes = "kubernetes" // the metrics API of the cluster
+	metricsSourcePrometheus = "prometheus" // the Prometheus exporter of each UPF
+	metricsSourceStatic     = "static"     // conf.Metrics.Static, for tests and to run without a cluster
+)
+
+// Built-in metrics of a UPF. Any other name is looked up in conf.Metrics.Series
+// or conf.Metrics.Static.
+const (
+	metricCPU     = "cpu"      // millicores used
+	metricRxBytes = "rx_bytes" // bytes received on the access interface so far
+)
+
+// defaultMetricSeries are the Prometheus series of the built-in metrics, as
+// exported by telemetry.go.
+var defaultMetricSeries = map[string]string{
+	metricRxBytes: `upf_bytes_count{dir="rx",iface="Access"}`,
+}
+
+// MetricsSource reports the usage of the UPFs, by name, e.g. "upf101".
+type MetricsSource interface {
+	// GetUPFMetric returns the current value of metric for the UPF. A source
+	// that doesn't measure metric returns ErrUnsupported.
+	GetUPFMetric(name, metric string) (float64, error)
+}
+
+// NewMetricsSource returns the sources of conf.Metrics.Sources, asked in order.
+func NewMetricsSource(conf *Conf) (MetricsSource, error) {
+	var sources metricsSources
+
+	for _, kind := range conf.Metrics.Sources {
+		switch kind {
+		case metricsSourceKubernetes:
+			client, err := newK8sClient(conf.Orchestrator.Namespace)
+			if err != nil {
+				return nil, err
+			}
+
+			sources = append(sources, &k8sMetricsSource{client})
+		case metricsSourcePrometheus:
+			p, err := newPrometheusMetricsSource(conf.Metrics)
+			if err != nil {
+				return nil, err
+			}
+
+			sources = append(sources, p)
+		case metricsSourceStatic:
+			sources = append(sources, newStaticMetricsSource(conf.Metrics.Static))
+		default:
+			return nil, ErrUnsupported("metrics source", kind)
+		}
+	}
+
+	if len(sources) == 1 {
+		return sources[0], nil
+	}
+
+	return sources, nil
+}
+
+// upfMetric returns the current value of metric for the UPF name.
+func (node *PFCPNode) upfMetric(name, metric string) (float64, error) {
+	if node.upf.metrics == nil {
+		return 0, ErrNotFound("metrics source")
+	}
+
+	return node.upf.metrics.GetUPFMetric(name, metric)
+}
+
+// metricsSources asks each source in turn, until one measures the metric.
+type metricsSources []MetricsSource
+
+func (sources metricsSources) GetUPFMetric(name, metric string) (float64, error) {
+	var firstErr error
+
+	for _, s := range sources {
+		v, err := s.GetUPFMetric(name, metric)
+		if err == nil {
+			return v, nil
+		}
+
+		if firstErr == nil || errors.Is(firstErr, errUnsupported) {
+			firstErr = err
+		}
+	}
+
+	if firstErr == nil {
+		return 0, ErrUnsupported("metric", metric)
+	}
+
+	return 0, firstErr
+}
+
+// k8sMetricsSource reads the CPU usage of the pod <name>-0 of a UPF from the
+// metrics API.
+type k8sMetricsSource struct {
+	*k8sClient
+}
+
+// parseCPUQuantity returns a Kubernetes CPU quantity, e.g. "250m" or
+// "123456789n", in millicores.
+func parseCPUQuantity(q string) (int64, error) {
+	scale := map[string]float64{"n": 1e-6, "u": 1e-3, "m": 1}
+
+	if len(q) > 0 {
+		if s, ok := scale[q[len(q)-1:]]; ok {
+			v, err := strconv.ParseFloat(q[:len(q)-1], 64)
+			return int64(v * s), err
+		}
+	}
+
+	v, err := strconv.ParseFloat(q, 64)
+
+	return int64(v * 1000), err
+}
+
+func (k *k8sMetricsSource) GetUPFMetric(name, metric string) (float64, error) {
+	if metric != metricCPU {
+		return 0, ErrUnsupported("kubernetes metric", metric)
+	}
+
+	body, err := k.do(http.MethodGet, "/apis/metrics.k8s.io/v1beta1/namespaces/"+k.namespace+"/pods/"+name+"-0", "", nil)
+	if err != nil {
+		return 0, err
+	}
+
+	var podMetrics struct {
+		Containers []struct {
+			Usage struct {
+				CPU string `json:"cpu"`
+			} `json:"usage"`
+		} `json:"containers"`
+	}
+
+	if err := json.Unmarshal(body, &podMetrics); err != nil {
+		return 0, err
+	}
+
+	var milli int64
+
+	for _, c := range podMetrics.Containers {
+		cpu, err := parseCPUQuantity(c.Usage.CPU)
+		if err != nil {
+			return 0, err
+		}
+
+		milli += cpu
+	}
+
+	return float64(milli), nil
+}
+
+// promSelector picks the series of a metric by name and labels.
+type promSelector struct {
+	name   string
+	labels map[string]string
+}
+
+// parsePromSeries returns the name and labels of a series, e.g.
+// `upf_bytes_count{dir="rx",iface="Access"}`, and what follows it.
+func parsePromSeries(s string) (promSelector, string, error) {
+	sel := promSelector{labels: make(map[string]string)}
+
+	end := strings.IndexAny(s, "{ \t")
+	if end < 0 {
+		end = len(s)
+	}
+
+	sel.name, s = s[:end], s[end:]
+	if sel.name == "" {
+		return sel, s, ErrInvalidArgumentWithReason("prometheus series", s, "no metric name")
+	}
+
+	if !strings.HasPrefix(s, "{") {
+		return sel, s, nil
+	}
+
+	s = s[1:]
+
+	for {
+		s = strings.TrimLeft(s, " ,")
+		if strings.HasPrefix(s, "}") {
+			return sel, s[1:], nil
+		}
+
+		eq := strings.Index(s, "=")
+		if eq < 0 || len(s) < eq+2 || s[eq+1] != '"' {
+			return sel, s, ErrInvalidArgumentWithReason("prometheus series", sel.name, "malformed labels")
+		}
+
+		key := strings.TrimSpace(s[:eq])
+
+		value, err := strconv.QuotedPrefix(s[eq+1:])
+		if err != nil {
+			return sel, s, ErrInvalidArgumentWithReason("prometheus series", sel.name, "malformed label value")
+		}
+
+		s = s[eq+1+len(value):]
+
+		if sel.labels[key], err = strconv.Unquote(value); err != nil {
+			return sel, s, err
+		}
+	}
+}
+
+// matches reports whether the series has the name and all the labels of sel.
+func (sel promSelector) matches(series promSelector) bool {
+	if series.name != sel.name {
+		return false
+	}
+
+	for k, v := range sel.labels {
+		if series.labels[k] != v {
+			return false
+		}
+	}
+
+	return true
+}
+
+// scrapePromSeries returns the sum of the series sel picks from Prometheus
+// metrics in the text format.
+func scrapePromSeries(metrics io.Reader, sel promSelector) (float64, error) {
+	var (
+		sum   float64
+		found bool
+	)
+
+	scanner := bufio.NewScanner(metrics)
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || !strings.HasPrefix(line, sel.name) {
+			continue
+		}
+
+		series, rest, err := parsePromSeries(line)
+		if err != nil || !sel.matches(series) {
+			continue
+		}
+
+		fields := strings.Fields(rest)
+		if len(fields) == 0 {
+			continue
+		}
+
+		v, err := strconv.ParseFloat(fields[0], 64)
+		if err != nil {
+			return 0, err
+		}
+
+		sum += v
+		found = true
+	}
+
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+
+	if !found {
+		return 0, ErrNotFoundWithParam("prometheus series", "name", sel.name)
+	}
+
+	return sum, nil
+}
+
+// prometheusMetricsSource scrapes the Prometheus exporter of a UPF.
+type prometheusMetricsSource struct {
+	exporterURL string                  // formatted with the UPF name
+	series      map[string]promSelector // by metric
+	client      *http.Client
+}
+
+func newPrometheusMetricsSource(conf MetricsInfo) (*prometheusMetricsSource, error) {
+	p := &prometheusMetricsSource{
+		exporterURL: conf.ExporterURL,
+		series:      make(map[string]promSelector),
+		client:      &http.Client{Timeout: 5 * time.Second},
+	}
+
+	for metric, s := range conf.Series {
+		sel, rest, err := parsePromSeries(s)
+		if err != nil {
+			return nil, err
+		}
+
+		if strings.TrimSpace(rest) != "" {
+			return nil, ErrInvalidArgumentWithReason("conf.Metrics.Series", s, "trailing characters")
+		}
+
+		p.series[metric] = sel
+	}
+
+	return p, nil
+}
+
+func (p *prometheusMetricsSource) GetUPFMetric(name, metric string) (float64, error) {
+	sel, ok := p.series[metric]
+	if !ok {
+		return 0, ErrUnsupported("prometheus metric", metric)
+	}
+
+	resp, err := p.client.Get(fmt.Sprintf(p.exporterURL, name))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, ErrOperationFailedWithReason("scrape of "+name, resp.Status)
+	}
+
+	return scrapePromSeries(resp.Body, sel)
+}
+
+// staticMetricsSource reports the metrics it was given, by UPF.
+type staticMetricsSource struct {
+	mu     sync.Mutex
+	values map[string]map[string]float64
+}
+
+func newStaticMetricsSource(values map[string]map[string]float64) *staticMetricsSource {
+	s := &staticMetricsSource{values: make(map[string]map[string]float64)}
+
+	for name, metrics := range values {
+		for metric, v := range metrics {
+			s.set(name, metric, v)
+		}
+	}
+
+	return s
+}
+
+// set sets the value of metric for the UPF name.
+func (s *staticMetricsSource) set(name, metric string, v float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.values[name] == nil {
+		s.values[name] = make(map[string]float64)
+	}
+
+	s.values[name][metric] = v
+}
+
+func (s *staticMetricsSource) GetUPFMetric(name, metric string) (float64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	v, ok := s.values[name][metric]
+	if !ok {
+		return 0, ErrNotFoundWithParam("static metric "+metric, "UPF", name)
+	}
+
+	return v, nil
+}
@@ -0,0 +1,121 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright 2022-present Open Networking Foundation
+
+package pfcpiface
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseCPUQuantity(t *testing.T) {
+	for q, milli := range map[string]int64{
+		"250m":       250,
+		"123456789n": 123,
+		"1500u":      1,
+		"2":          2000,
+		"0.5":        500,
+	} {
+		v, err := parseCPUQuantity(q)
+		require.NoError(t, err, q)
+		require.Equal(t, milli, v, q)
+	}
+
+	_, err := parseCPUQuantity("lots")
+	require.Error(t, err)
+}
+
+func TestScrapePromSeries(t *testing.T) {
+	metrics := `# HELP upf_bytes_count Shows the number of bytes received/transmitted
+# TYPE upf_bytes_count counter
+upf_bytes_count{dir="tx",iface="Access"} 7
+upf_bytes_count{dir="rx",iface="Core"} 9
+upf_bytes_count{dir="rx",iface="Access",port="0"} 1.2345e+06
+upf_bytes_count{dir="rx",iface="Access",port="1"} 5
+upf_bytes_count_total{dir="rx",iface="Access"} 3
+`
+	sel, rest, err := parsePromSeries(defaultMetricSeries[metricRxBytes])
+	require.NoError(t, err)
+	require.Empty(t, rest)
+
+	v, err := scrapePromSeries(strings.NewReader(metrics), sel)
+	require.NoError(t, err)
+	require.Equal(t, 1234505.0, v, "the sum of the matching series")
+
+	sel, _, err = parsePromSeries(`upf_bytes_count{iface="Core", dir="rx"}`)
+	require.NoError(t, err)
+
+	v, err = scrapePromSeries(strings.NewReader(metrics), sel)
+	require.NoError(t, err)
+	require.Equal(t, 9.0, v)
+
+	_, err = scrapePromSeries(strings.NewReader("up 1\n"), sel)
+	require.ErrorIs(t, err, errNotFound)
+
+	_, _, err = parsePromSeries(`upf_bytes_count{dir=rx}`)
+	require.Error(t, err)
+}
+
+func TestMetricsSources(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/apis/metrics.k8s.io/v1beta1/namespaces/omec/pods/upf101-0", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"containers": [{"usage": {"cpu": "1500000000n"}}, {"usage": {"cpu": "20m"}}]}`))
+	})
+	mux.HandleFunc("/exporter/upf101/metrics", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`upf_bytes_count{dir="rx",iface="Access"} 4096` + "\n" +
+			`upf_jitter_ns{dir="rx",iface="Access",quantile="0.9"} 120` + "\n"))
+	})
+
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	prom, err := newPrometheusMetricsSource(MetricsInfo{
+		ExporterURL: srv.URL + "/exporter/%s/metrics",
+		Series: map[string]string{
+			metricRxBytes: defaultMetricSeries[metricRxBytes],
+			"jitter":      `upf_jitter_ns{quantile="0.9"}`,
+		},
+	})
+	require.NoError(t, err)
+
+	sources := metricsSources{
+		&k8sMetricsSource{newTestK8sClient(t, mux)},
+		prom,
+		newStaticMetricsSource(map[string]map[string]float64{"upf101": {"jitter": 1, "queue": 7}}),
+	}
+
+	for metric, want := range map[string]float64{metricCPU: 1520, metricRxBytes: 4096, "jitter": 120, "queue": 7} {
+		v, err := sources.GetUPFMetric("upf101", metric)
+		require.NoError(t, err, metric)
+		require.Equal(t, want, v, metric)
+	}
+
+	_, err = sources.GetUPFMetric("upf102", metricCPU)
+	require.ErrorIs(t, err, errNotFound, "the pod has no metrics")
+
+	_, err = sources.GetUPFMetric("upf101", "memory")
+	require.Error(t, err)
+
+	node := &PFCPNode{upf: &Upf{}}
+	_, err = node.upfMetric("upf101", metricCPU)
+	require.ErrorIs(t, err, errNotFound, "no metrics source")
+}
+
+func TestNewMetricsSource(t *testing.T) {
+	m, err := NewMetricsSource(&Conf{Metrics: MetricsInfo{Sources: []string{metricsSourceStatic}}})
+	require.NoError(t, err)
+	require.IsType(t, &staticMetricsSource{}, m)
+
+	_, err = NewMetricsSource(&Conf{Metrics: MetricsInfo{Sources: []string{"graphite"}}})
+	require.ErrorIs(t, err, errUnsupported)
+
+	t.Setenv("KUBERNETES_SERVICE_HOST", "")
+
+	m, err = NewMetricsSource(&Conf{Metrics: MetricsInfo{Sources: []string{metricsSourceKubernetes}}})
+	require.Error(t, err, "not in a cluster")
+	require.Nil(t, m)
+}
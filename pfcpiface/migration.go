@@ -0,0 +1,481 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright 2022-present Open Networking Foundation
+
+package pfcpiface
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/wmnsk/go-pfcp/ie"
+	"github.com/wmnsk/go-pfcp/message"
+)
+
+// migrationTimeout bounds how long a session waits for the destination UPF to
+// accept it before the migration is aborted, and for the source to report its
+// usage before it is deleted anyway. Both together stay well under the 10s Up
+// waits for an answer to an SMF request.
+const migrationTimeout = 3 * time.Second
+
+// migrationHoldTimeout bounds how long an SMF request is held during a
+// migration before it is rejected, so that Up gets an answer in time.
+const migrationHoldTimeout = 5 * time.Second
+
+type migrationState int
+
+const (
+	// migrationEstablishing : the session is being established on the destination,
+	// the source still owns it and SMF requests are queued.
+	migrationEstablishing migrationState = iota
+	// migrationQuerying : the destination owns the session, the source is queried for its usage.
+	migrationQuerying
+	// migrationDeleting : the usage was reported, the session is being deleted on the source.
+	migrationDeleting
+	// migrationAborted : the destination didn't answer in time, the session stays on the
+	// source. Kept until the destination answers late, or for another timeout.
+	migrationAborted
+)
+
+// migration moves a session from one UPF to another, make-before-break:
+// establish on the destination, switch ownership once accepted, collect the
+// source's usage with Query URR, then delete on the source.
+type migration struct {
+	seid   uint64
+	state  migrationState
+	source *PFCPConn
+	dest   *PFCPConn
+	srcUPF *Upf
+	dstUPF *Upf
+	// SMF modifications and deletions received while establishing, in order.
+	// Each is either a *SesModU2dMsg or a *SesDelU2dMsg.
+	queued []interface{}
+	timer  *time.Timer
+}
+
+// migrationTable holds the sessions being migrated, keyed by the LB's SEID.
+type migrationTable struct {
+	mu          sync.Mutex
+	migrations  map[uint64]*migration
+	holdTimeout time.Duration
+}
+
+func newMigrationTable() *migrationTable {
+	return &migrationTable{
+		migrations:  make(map[uint64]*migration),
+		holdTimeout: migrationHoldTimeout,
+	}
+}
+
+// start registers a migration, false if the session is already migrating.
+func (t *migrationTable) start(m *migration) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if _, ok := t.migrations[m.seid]; ok {
+		return false
+	}
+
+	t.migrations[m.seid] = m
+
+	return true
+}
+
+// queue holds an SMF request for a session being established on its
+// destination, false if the request can be processed right away.
+func (t *migrationTable) queue(seid uint64, req interface{}) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	m, ok := t.migrations[seid]
+	if !ok || m.state != migrationEstablishing {
+		return false
+	}
+
+	m.queued = append(m.queued, req)
+
+	return true
+}
+
+// unqueue drops req from the requests held for seid, false if it was released already.
+func (t *migrationTable) unqueue(seid uint64, req interface{}) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	m, ok := t.migrations[seid]
+	if !ok {
+		return false
+	}
+
+	for i, r := range m.queued {
+		if r == req {
+			m.queued = append(m.queued[:i], m.queued[i+1:]...)
+			return true
+		}
+	}
+
+	return false
+}
+
+// establishing returns the migration of seid waiting for dest to accept the session.
+func (t *migrationTable) establishing(seid uint64, dest *PFCPConn) *migration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	m, ok := t.migrations[seid]
+	if !ok || m.state != migrationEstablishing || m.dest != dest {
+		return nil
+	}
+
+	return m
+}
+
+// incoming returns the number of sessions being established on u.
+func (t *migrationTable) incoming(u *Upf) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	n := 0
+
+	for _, m := range t.migrations {
+		if m.dstUPF == u && m.state == migrationEstablishing {
+			n++
+		}
+	}
+
+	return n
+}
+
+// outgoing returns the number of sessions migrating off u, in any state.
+func (t *migrationTable) outgoing(u *Upf) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	n := 0
+
+	for _, m := range t.migrations {
+		if m.srcUPF == u {
+			n++
+		}
+	}
+
+	return n
+}
+
+// migrating reports whether seid is being migrated.
+func (t *migrationTable) migrating(seid uint64) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	_, ok := t.migrations[seid]
+
+	return ok
+}
+
+// switched moves m to the querying state and returns its queued requests.
+func (t *migrationTable) switched(m *migration) []interface{} {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	m.state = migrationQuerying
+	m.timer.Reset(migrationTimeout)
+	queued := m.queued
+	m.queued = nil
+
+	return queued
+}
+
+// querying returns the migration of seid waiting for source to report its usage.
+func (t *migrationTable) querying(seid uint64, source *PFCPConn) *migration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	m, ok := t.migrations[seid]
+	if !ok || m.state != migrationQuerying || m.source != source {
+		return nil
+	}
+
+	return m
+}
+
+// startDeleting moves the migration of seid from querying to deleting, nil if
+// it isn't querying anymore.
+func (t *migrationTable) startDeleting(seid uint64) *migration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	m, ok := t.migrations[seid]
+	if !ok || m.state != migrationQuerying {
+		return nil
+	}
+
+	m.state = migrationDeleting
+	m.timer.Stop()
+
+	return m
+}
+
+// finish forgets the migration of seid and returns its queued requests.
+func (t *migrationTable) finish(seid uint64) []interface{} {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	m, ok := t.migrations[seid]
+	if !ok {
+		return nil
+	}
+
+	delete(t.migrations, seid)
+	m.timer.Stop()
+
+	return m.queued
+}
+
+// abort moves the migration of seid, still establishing on dest, to the
+// aborted state and returns its queued requests, false if it isn't.
+func (t *migrationTable) abort(seid uint64, dest *PFCPConn) ([]interface{}, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	m, ok := t.migrations[seid]
+	if !ok || m.state != migrationEstablishing || m.dest != dest {
+		return nil, false
+	}
+
+	m.state = migrationAborted
+	m.timer.Reset(migrationTimeout)
+	queued := m.queued
+	m.queued = nil
+
+	return queued, true
+}
+
+// forgetAborted forgets the aborted migration of seid to dest, false if there is none.
+func (t *migrationTable) forgetAborted(seid uint64, dest *PFCPConn) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	m, ok := t.migrations[seid]
+	if !ok || m.state != migrationAborted || m.dest != dest {
+		return false
+	}
+
+	delete(t.migrations, seid)
+	m.timer.Stop()
+
+	return true
+}
+
+// deletingFrom reports whether seid is being deleted from source after its migration.
+func (t *migrationTable) deletingFrom(seid uint64, source *PFCPConn) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	m, ok := t.migrations[seid]
+
+	return ok && m.state == migrationDeleting && m.source == source
+}
+
+// replayQueued feeds SMF requests held during a migration back to Down, in order.
+func replayQueued(queued []interface{}, comCh CommunicationChannel) {
+	for _, req := range queued {
+		switch r := req.(type) {
+		case *SesModU2dMsg:
+			comCh.SesModU2d <- r
+		case *SesDelU2dMsg:
+			comCh.SesDelU2d <- r
+		}
+	}
+}
+
+// holdForMigration holds an SMF request for a session being established on
+// its destination, false if it can be processed right away. A request still
+// held after the hold timeout is rejected.
+func (node *PFCPNode) holdForMigration(seid uint64, req interface{}, respCh chan *SesRespD2uMsg) bool {
+	t := node.upf.migrations
+	if !t.queue(seid, req) {
+		return false
+	}
+
+	time.AfterFunc(t.holdTimeout, func() {
+		if t.unqueue(seid, req) {
+			log.Warnln("Session", seid, "is still migrating, rejecting a held SMF request")
+			sendResptoUp(ie.NewCause(ie.CauseRequestRejected), respCh, false)
+		}
+	})
+
+	return true
+}
+
+func (node *PFCPNode) upfIndex(u *Upf) int {
+	for i, p := range node.upf.peersUPF {
+		if p == u {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// migrateSession starts moving seid from the UPF of sPconn to the UPF of dPconn.
+func (node *PFCPNode) migrateSession(seid uint64, sPconn, dPconn *PFCPConn, sUPFid, dUPFid int, comCh CommunicationChannel) bool {
+	estMsg, ok := node.upf.sesEstMsgStore[seid]
+	if !ok {
+		return false
+	}
+
+	// The destination already holds the session's standby
+	if node.upf.standbys != nil && node.upf.standbys.on(seid, node.upf.peersUPF[dUPFid]) {
+		return false
+	}
+
+	if !node.fteidsValidOn(seid, node.upf.peersUPF[dUPFid]) {
+		log.Warnln("Session", seid, "can not move to", node.upf.peersUPF[dUPFid].NodeID, ", its F-TEIDs point to other N3 addresses")
+		return false
+	}
+
+	m := &migration{
+		seid:   seid,
+		state:  migrationEstablishing,
+		source: sPconn,
+		dest:   dPconn,
+		srcUPF: node.upf.peersUPF[sUPFid],
+		dstUPF: node.upf.peersUPF[dUPFid],
+	}
+	m.timer = time.AfterFunc(migrationTimeout, func() {
+		node.migrationTimedOut(seid, dPconn, comCh)
+	})
+
+	if !node.upf.migrations.start(m) {
+		m.timer.Stop()
+		return false
+	}
+
+	comCh.SesEstU2d <- &SesEstU2dMsg{
+		msg:       estMsg,
+		upSeid:    seid,
+		reforward: true,
+		pConn:     dPconn,
+	}
+
+	return true
+}
+
+// switchMigration hands the session over to the destination UPF once it accepted it.
+func (node *PFCPNode) switchMigration(m *migration) bool {
+	node.upf.placementMu.Lock()
+	defer node.upf.placementMu.Unlock()
+
+	sUPFid, dUPFid := node.upfIndex(m.srcUPF), node.upfIndex(m.dstUPF)
+	if sUPFid < 0 || dUPFid < 0 {
+		return false
+	}
+
+	sess, ok := m.source.sessionStore.GetSession(m.seid)
+	if !ok {
+		return false
+	}
+
+	if err := m.dest.sessionStore.PutSession(sess); err != nil {
+		log.Errorln("Failed to put migrated session to store:", err)
+		return false
+	}
+
+	node.upf.lbmap[m.seid] = dUPFid
+	node.upf.peersUPF[dUPFid].upfsSessions = append(node.upf.peersUPF[dUPFid].upfsSessions, m.seid)
+
+	srcSessions := node.upf.peersUPF[sUPFid].upfsSessions
+	for i := len(srcSessions) - 1; i >= 0; i-- {
+		if srcSessions[i] == m.seid {
+			node.upf.peersUPF[sUPFid].upfsSessions = append(srcSessions[:i], srcSessions[i+1:]...)
+			break
+		}
+	}
+
+	return true
+}
+
+// completeMigration releases the SMF requests held during the migration, now
+// routed to the destination, and collects the session's usage from the source.
+func (node *PFCPNode) completeMigration(m *migration, comCh CommunicationChannel) {
+	queued := node.upf.migrations.switched(m)
+
+	urrIDs := node.sessionURRIDs(m.seid)
+	if len(urrIDs) == 0 {
+		if node.upf.migrations.startDeleting(m.seid) != nil {
+			node.deleteFromSource(m, comCh)
+		}
+	} else {
+		comCh.SesModU2d <- &SesModU2dMsg{
+			msg:       newQueryURRRequest(m.seid, m.source.getSeqNum(), urrIDs),
+			upSeid:    m.seid,
+			reforward: true,
+			pConn:     m.source,
+		}
+	}
+
+	replayQueued(queued, comCh)
+}
+
+// deleteFromSource deletes a migrated session on the UPF it came from.
+func (node *PFCPNode) deleteFromSource(m *migration, comCh CommunicationChannel) {
+	sess, ok := m.source.sessionStore.GetSession(m.seid)
+	if !ok {
+		node.upf.migrations.finish(m.seid)
+		return
+	}
+
+	delMsg := message.NewSessionDeletionRequest(0, 0, m.seid, m.source.getSeqNum(), 123,
+		nil,
+	)
+	comCh.SesDelU2d <- &SesDelU2dMsg{
+		msg:       delMsg,
+		upSeid:    m.seid,
+		reforward: true,
+		upfIndex:  node.upfIndex(m.srcUPF),
+		pConn:     m.source,
+	}
+
+	m.source.RemoveSession(sess)
+}
+
+// migrationTimedOut aborts a migration the destination didn't accept in time,
+// or deletes the source session of one whose usage wasn't reported in time.
+func (node *PFCPNode) migrationTimedOut(seid uint64, dest *PFCPConn, comCh CommunicationChannel) {
+	if queued, ok := node.upf.migrations.abort(seid, dest); ok {
+		log.Warnln("Session", seid, "was not accepted by", dest.nodeID.remote, "in time, aborting its migration")
+		replayQueued(queued, comCh)
+
+		return
+	}
+
+	// The destination never answered
+	if node.upf.migrations.forgetAborted(seid, dest) {
+		return
+	}
+
+	if m := node.upf.migrations.startDeleting(seid); m != nil {
+		log.Warnln("Usage of session", seid, "was not reported by", m.source.nodeID.remote, "in time, deleting it")
+		node.deleteFromSource(m, comCh)
+	}
+}
+
+// abortMigration leaves the session on its source and releases the held SMF requests to it.
+func (node *PFCPNode) abortMigration(seid uint64, comCh CommunicationChannel) {
+	replayQueued(node.upf.migrations.finish(seid), comCh)
+}
+
+// deleteFromDest deletes the copy of seid the destination of a migration
+// accepted, but doesn't serve.
+func (node *PFCPNode) deleteFromDest(seid uint64, dest *PFCPConn, comCh CommunicationChannel) {
+	delMsg := message.NewSessionDeletionRequest(0, 0, seid, dest.getSeqNum(), 123,
+		nil,
+	)
+	comCh.SesDelU2d <- &SesDelU2dMsg{
+		msg:       delMsg,
+		upSeid:    seid,
+		reforward: true,
+		upfIndex:  node.upfIndex(node.upf.peerByNodeID(dest.nodeID.remote)),
+		pConn:     dest,
+	}
+}
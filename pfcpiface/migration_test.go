@@ -0,0 +1,170 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright 2022-present Open Networking Foundation
+
+package pfcpiface
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/wmnsk/go-pfcp/ie"
+	"github.com/wmnsk/go-pfcp/message"
+)
+
+func TestMigrationTable(t *testing.T) {
+	table := newMigrationTable()
+	source, dest := &PFCPConn{}, &PFCPConn{}
+	dstUPF := &Upf{}
+
+	m := &migration{
+		seid:   1,
+		state:  migrationEstablishing,
+		source: source,
+		dest:   dest,
+		dstUPF: dstUPF,
+		timer:  time.NewTimer(time.Hour),
+	}
+	require.True(t, table.start(m))
+	require.False(t, table.start(&migration{seid: 1}), "a session migrates once at a time")
+	require.Equal(t, 1, table.incoming(dstUPF))
+
+	mod, del := &SesModU2dMsg{upSeid: 1}, &SesDelU2dMsg{upSeid: 1}
+	require.True(t, table.queue(1, mod))
+	require.True(t, table.queue(1, del))
+	require.False(t, table.queue(2, mod), "other sessions are not held")
+
+	require.Nil(t, table.establishing(1, source))
+	require.Equal(t, m, table.establishing(1, dest))
+
+	require.Equal(t, []interface{}{mod, del}, table.switched(m))
+	require.Zero(t, table.incoming(dstUPF))
+	require.Nil(t, table.establishing(1, dest))
+	require.False(t, table.queue(1, mod), "requests go to the destination once switched")
+	require.Nil(t, table.querying(1, dest))
+	require.Equal(t, m, table.querying(1, source))
+	require.False(t, table.deletingFrom(1, source), "usage is collected before deleting")
+
+	require.Equal(t, m, table.startDeleting(1))
+	require.Nil(t, table.startDeleting(1), "the source is deleted once")
+	require.Nil(t, table.querying(1, source))
+	require.True(t, table.deletingFrom(1, source))
+	require.False(t, table.deletingFrom(1, dest))
+
+	require.Empty(t, table.finish(1))
+	require.False(t, table.deletingFrom(1, source))
+	require.Nil(t, table.finish(1))
+}
+
+func TestAbortMigrationReplaysQueued(t *testing.T) {
+	comCh := CommunicationChannel{
+		SesModU2d: make(chan *SesModU2dMsg, 1),
+		SesDelU2d: make(chan *SesDelU2dMsg, 1),
+	}
+	node := &PFCPNode{upf: &Upf{migrations: newMigrationTable()}}
+
+	m := &migration{seid: 7, state: migrationEstablishing, timer: time.NewTimer(time.Hour)}
+	require.True(t, node.upf.migrations.start(m))
+
+	mod := &SesModU2dMsg{upSeid: 7}
+	require.True(t, node.upf.migrations.queue(7, mod))
+
+	node.abortMigration(7, comCh)
+	require.Equal(t, mod, <-comCh.SesModU2d)
+	require.False(t, node.upf.migrations.queue(7, mod))
+}
+
+func TestHeldRequestRejected(t *testing.T) {
+	node := &PFCPNode{upf: &Upf{migrations: newMigrationTable()}}
+	node.upf.migrations.holdTimeout = 10 * time.Millisecond
+
+	m := &migration{seid: 7, state: migrationEstablishing, timer: time.NewTimer(time.Hour)}
+	require.True(t, node.upf.migrations.start(m))
+
+	respCh := make(chan *SesRespD2uMsg, 1)
+	mod := &SesModU2dMsg{upSeid: 7, respCh: respCh}
+	require.True(t, node.holdForMigration(7, mod, respCh))
+
+	resp := <-respCh
+	cause, err := resp.cause.Cause()
+	require.NoError(t, err)
+	require.Equal(t, ie.CauseRequestRejected, cause, "answered before Up stops waiting")
+	require.Empty(t, node.upf.migrations.finish(7), "not replayed")
+}
+
+func TestSendRespNotTaken(t *testing.T) {
+	respCh := make(chan *SesRespD2uMsg, 1)
+	sendResptoUp(ie.NewCause(ie.CauseRequestAccepted), respCh, false)
+
+	// Up stopped waiting, its buffer is full
+	done := make(chan struct{})
+	go func() {
+		sendResptoUp(ie.NewCause(ie.CauseRequestAccepted), respCh, false)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("blocked on an answer Up doesn't take")
+	}
+}
+
+func TestLateAcceptanceAfterAbort(t *testing.T) {
+	comCh := CommunicationChannel{
+		SesModU2d: make(chan *SesModU2dMsg, 1),
+		SesDelU2d: make(chan *SesDelU2dMsg, 1),
+		SesEstU2d: make(chan *SesEstU2dMsg, 1),
+	}
+	src, dst := &Upf{NodeID: "upf1"}, &Upf{NodeID: "upf2"}
+	dest := &PFCPConn{nodeID: nodeID{remote: "upf2"}}
+	node := &PFCPNode{upf: &Upf{
+		migrations:     newMigrationTable(),
+		peersUPF:       []*Upf{src, dst},
+		lbmap:          map[uint64]int{7: 0},
+		seidToRespCh:   make(map[uint64]chan *SesRespD2uMsg),
+		sesModMsgStore: make(map[uint64]*message.SessionModificationRequest),
+	}}
+
+	m := &migration{seid: 7, state: migrationEstablishing, dest: dest, srcUPF: src, dstUPF: dst, timer: time.NewTimer(time.Hour)}
+	require.True(t, node.upf.migrations.start(m))
+
+	mod := &SesModU2dMsg{upSeid: 7}
+	require.True(t, node.upf.migrations.queue(7, mod))
+
+	node.migrationTimedOut(7, dest, comCh)
+	require.Equal(t, mod, <-comCh.SesModU2d, "replayed to the source")
+	require.False(t, node.upf.migrations.queue(7, mod), "no longer held")
+
+	seres := message.NewSessionEstablishmentResponse(0, 0, 7, 1, 123, ie.NewCause(ie.CauseRequestAccepted))
+	dest.handleSessionEstablishmentResponse(seres, comCh, node)
+
+	del := <-comCh.SesDelU2d
+	require.Equal(t, uint64(7), del.upSeid)
+	require.Equal(t, dest, del.pConn, "deleted where it was accepted late")
+	require.Equal(t, 0, node.upf.lbmap[7], "stays on the source")
+	require.Empty(t, comCh.SesModU2d)
+	require.Empty(t, comCh.SesEstU2d, "no standby installed")
+	require.False(t, node.upf.migrations.migrating(7))
+}
+
+func TestHeldDeletionCountedOnce(t *testing.T) {
+	comCh := CommunicationChannel{SesDelU2d: make(chan *SesDelU2dMsg)}
+	node := &PFCPNode{upf: &Upf{
+		migrations: newMigrationTable(),
+		autoscaler: &autoscaler{forecaster: newSessionForecaster(PredictiveScalingInfo{})},
+	}}
+
+	m := &migration{seid: 7, state: migrationEstablishing, timer: time.NewTimer(time.Hour)}
+	require.True(t, node.upf.migrations.start(m))
+
+	go node.listenForSesDelReq(comCh)
+
+	del := &SesDelU2dMsg{upSeid: 7, respCh: make(chan *SesRespD2uMsg, 1)}
+	comCh.SesDelU2d <- del
+
+	require.Eventually(t, func() bool {
+		return node.upf.migrations.unqueue(7, del)
+	}, time.Second, 10*time.Millisecond, "held")
+	require.Zero(t, node.upf.autoscaler.forecaster.deleted, "counted when replayed")
+}
@@ -8,9 +8,6 @@ import (
 	"errors"
 	"fmt"
 	"net"
-	"os/exec"
-	"strconv"
-	"strings"
 	"sync"
 	"time"
 
@@ -33,6 +30,8 @@ type PFCPNode struct {
 	pConnDone chan string
 	// map of existing connections
 	pConns sync.Map
+	// UPFs to re-associate with, serialized by Serve
+	rebinds chan upfRebind
 	// upf
 	upf *Upf
 	// metrics for PFCP messages and sessions
@@ -44,6 +43,7 @@ func NewPFCPNode(pos Position, upf *Upf) *PFCPNode {
 	var conn net.PacketConn
 	var err error
 
+	// "udp" on the wildcard address is a dual-stack socket, serving both IPv4 and IPv6 peers.
 	if pos == Up {
 		//fmt.Println("parham log: calling ListenPacket for up")
 		conn, err = reuse.ListenPacket("udp", ":"+UpPFCPPort)
@@ -70,6 +70,7 @@ func NewPFCPNode(pos Position, upf *Upf) *PFCPNode {
 		PacketConn: conn,
 		done:       make(chan struct{}),
 		pConnDone:  make(chan string, 100),
+		rebinds:    make(chan upfRebind),
 		upf:        upf,
 		//metrics:    metrics,
 	}
@@ -78,7 +79,7 @@ func NewPFCPNode(pos Position, upf *Upf) *PFCPNode {
 func (node *PFCPNode) tryConnectToN4Peer(lAddrStr string, comCh CommunicationChannel, pfcpinfo PfcpInfo, pos Position) {
 	//fmt.Println("parham log : start tryConnectToN4Peers func")
 
-	conn, err := net.Dial("udp", pfcpinfo.Ip+":"+DownPFCPPort)
+	conn, err := net.Dial("udp", upfPFCPAddr(pfcpinfo.Ip))
 	if err != nil {
 		log.Warnln("Failed to establish PFCP connection to peer ", pfcpinfo.Ip)
 		return
@@ -92,7 +93,7 @@ func (node *PFCPNode) tryConnectToN4Peer(lAddrStr string, comCh CommunicationCha
 	//	"CP node":        n4DstIP.String(),
 	//}).Info("Establishing PFCP Conn with CP node")
 	//fmt.Println("parham log : call NewPFCPConn from tryConnectToN4Peers func for down")
-	pfcpConn := node.NewPFCPConn(lAddrStr, n4DstIP.String()+":"+DownPFCPPort, nil, comCh, pos)
+	pfcpConn := node.NewPFCPConn(lAddrStr, upfPFCPAddr(n4DstIP.String()), nil, comCh, pos)
 	if pfcpConn != nil {
 
 		go pfcpConn.sendAssociationRequest(pfcpinfo, comCh, node)
@@ -100,23 +101,94 @@ func (node *PFCPNode) tryConnectToN4Peer(lAddrStr string, comCh CommunicationCha
 
 }
 
-func (node *PFCPNode) pfcpMsgLBer(seid uint64) int {
+// upfEligible reports whether a session tunneling to the access side GTP-U
+// peers can be placed on the UPF at upfIndex.
+func (node *PFCPNode) upfEligible(upfIndex int, peers []string) bool {
+	u := node.upf.peersUPF[upfIndex]
+
+	if overloaded, _, _ := u.loadControl.overloaded(time.Now()); overloaded {
+		return false
+	}
+
+	if node.upf.drains != nil && node.upf.drains.draining(u) {
+		return false
+	}
+
+	for _, peer := range peers {
+		if node.upf.gtpuPaths.hasFailure(u.NodeID, peer) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// lighterUPF reports whether the UPF at index i is less loaded than the one at j,
+// by the load metric it reported and then by number of sessions.
+func (node *PFCPNode) lighterUPF(i, j int) bool {
+	ui, uj := node.upf.peersUPF[i], node.upf.peersUPF[j]
+
+	if li, lj := ui.loadControl.load(), uj.loadControl.load(); li != lj {
+		return li < lj
+	}
+
+	return len(ui.upfsSessions) < len(uj.upfsSessions)
+}
+
+// lightestUPF returns the index of the least loaded UPF among the eligible ones
+// of the set (canary or stable) the session is routed to, or among all eligible
+// ones if none is in the set, or among all UPFs if none is eligible for a
+// session tunneling to peers.
+func (node *PFCPNode) lightestUPF(peers []string) int {
+	inSet := node.upf.canary.pick(node.upf.peersUPF)
+
+	lightestUpf := -1
+	for i, u := range node.upf.peersUPF {
+		if !inSet(u) || !node.upfEligible(i, peers) {
+			continue
+		}
+		if lightestUpf < 0 || node.lighterUPF(i, lightestUpf) {
+			lightestUpf = i
+		}
+	}
+
+	if lightestUpf >= 0 {
+		return lightestUpf
+	}
+
+	for i := range node.upf.peersUPF {
+		if !node.upfEligible(i, peers) {
+			continue
+		}
+		if lightestUpf < 0 || node.lighterUPF(i, lightestUpf) {
+			lightestUpf = i
+		}
+	}
+
+	if lightestUpf >= 0 {
+		return lightestUpf
+	}
+
+	lightestUpf = 0
+	for i := 1; i < len(node.upf.peersUPF); i++ {
+		if node.lighterUPF(i, lightestUpf) {
+			lightestUpf = i
+		}
+	}
+
+	return lightestUpf
+}
+
+func (node *PFCPNode) pfcpMsgLBer(seid uint64, sereq *message.SessionEstablishmentRequest) int {
+	node.upf.placementMu.Lock()
+	defer node.upf.placementMu.Unlock()
 
 	upfIndex, ok := node.upf.lbmap[seid]
 	if ok {
 		return upfIndex
 	}
 
-	minSessions := len(node.upf.peersUPF[0].upfsSessions)
-	lightestUpf := 0
-	if len(node.upf.peersUPF) > 1 {
-		for i := 1; i < len(node.upf.peersUPF); i++ {
-			if minSessions > len(node.upf.peersUPF[i].upfsSessions) {
-				minSessions = len(node.upf.peersUPF[i].upfsSessions)
-				lightestUpf = i
-			}
-		}
-	}
+	lightestUpf := node.lightestUPF(node.sessionGTPUPeers(seid, sereq))
 	node.upf.lbmap[seid] = lightestUpf
 	node.upf.peersUPF[lightestUpf].upfsSessions = append(node.upf.peersUPF[lightestUpf].upfsSessions, seid)
 	fmt.Println("pfcpMsgLBer has been called")
@@ -130,72 +202,131 @@ func (node *PFCPNode) pfcpMsgLBer(seid uint64) int {
 	return lightestUpf
 }
 
+// allocateOnBehalf resolves the CHOOSE F-TEIDs and UE IP allocation requests of
+// createPDRs of session seid the LB answers for the pool, for the UPF of pConn.
+func (node *PFCPNode) allocateOnBehalf(seid uint64, pConn *PFCPConn, dnn string, createPDRs []*ie.IE) ([]*ie.IE, error) {
+	createPDRs, err := node.chooseFTEIDs(seid, pConn, createPDRs)
+	if err != nil {
+		return nil, err
+	}
+
+	return node.allocateUEIPs(seid, dnn, createPDRs)
+}
+
+// releaseOnBehalf frees the F-TEIDs and UE IP the LB allocated for session seid.
+func (node *PFCPNode) releaseOnBehalf(seid uint64) {
+	if node.upf.teids != nil {
+		node.upf.teids.release(seid)
+	}
+
+	if node.upf.ueIPs != nil {
+		node.upf.ueIPs.release(seid)
+	}
+}
+
+// forwardForLB sends a session request of the LB itself for seid, e.g. a
+// mirrored copy, straight to the UPF of pConn, prepared like the requests
+// reforwarded through comCh. Unlike those, it is safe to call from the
+// listeners of comCh.
+func forwardForLB(pConn *PFCPConn, seid uint64, msg message.Message, comCh CommunicationChannel) {
+	cpFSEID := newFSEID(seid, pConn.LocalAddr().(*net.UDPAddr).IP)
+
+	switch req := msg.(type) {
+	case *message.SessionEstablishmentRequest:
+		req.NodeID = pConn.nodeID.localIE
+		req.CPFSEID = cpFSEID
+		req.Header.MessagePriority = 123
+	case *message.SessionModificationRequest:
+		req.CPFSEID = cpFSEID
+		req.Header.SEID = seid
+		req.Header.MessagePriority = 123
+	case *message.SessionDeletionRequest:
+		req.Header.SEID = seid
+		req.Header.MessagePriority = 123
+	}
+
+	pConn.forwardToRealPFCP(msg, comCh)
+}
+
 func (node *PFCPNode) listenForSesEstReq(comCh CommunicationChannel) {
 	for {
 		//fmt.Println("parham log : down is waiting for new session establishment req from up ...")
 		sereqMsg := <-comCh.SesEstU2d
 
 		sereq := sereqMsg.msg
-		var respCh chan *ie.IE
+		var respCh chan *SesRespD2uMsg
 		if !sereqMsg.reforward {
 			respCh = sereqMsg.respCh
 
+			if a := node.upf.autoscaler; a != nil && a.forecaster != nil {
+				a.forecaster.recordEstablishment()
+			}
 		}
 
-		//fmt.Println("parham log: ses est recieved by down : upseid = ", sereqMsg.upSeid)
-		upfIndex := node.pfcpMsgLBer(sereqMsg.upSeid)
-		fmt.Println("ses est received by down, up seid = ", sereqMsg.upSeid, ", upfIndex = ", upfIndex, ", reforward= ", sereqMsg.reforward)
-		//fmt.Println("parham log: selected upfIndex = ", upfIndex)
-		rAddr := node.upf.peersUPF[upfIndex].peersIP + ":" + DownPFCPPort
-		v, ok := node.pConns.Load(rAddr)
-		if !ok {
-			//log.infoln("Can't find pConn to received peer IP = ", node.upf.peersIP[upfIndex])
-			if !sereqMsg.reforward {
-				respCh <- ie.NewCause(ie.CauseRequestRejected)
+		pConn := sereqMsg.pConn
+		if pConn == nil {
+			//fmt.Println("parham log: ses est recieved by down : upseid = ", sereqMsg.upSeid)
+			upfIndex := node.pfcpMsgLBer(sereqMsg.upSeid, sereq)
+			fmt.Println("ses est received by down, up seid = ", sereqMsg.upSeid, ", upfIndex = ", upfIndex, ", reforward= ", sereqMsg.reforward)
+			//fmt.Println("parham log: selected upfIndex = ", upfIndex)
+			rAddr := node.upfAddr(upfIndex)
+			v, ok := node.pConns.Load(rAddr)
+			if !ok {
+				//log.infoln("Can't find pConn to received peer IP = ", node.upf.peersIP[upfIndex])
+				if !sereqMsg.reforward {
+					respCh <- &SesRespD2uMsg{cause: ie.NewCause(ie.CauseRequestRejected)}
+				}
+				continue
 			}
-			continue
+			pConn = v.(*PFCPConn)
 		}
-		pConn := v.(*PFCPConn)
 		sereq.NodeID = pConn.nodeID.localIE
 		//fseid, err := sereq.CPFSEID.FSEID()
 		//remoteSEID := fseid.SEID
 		if !sereqMsg.reforward {
+			createPDRs, err := node.allocateOnBehalf(sereqMsg.upSeid, pConn, sessionDnn(sereq), sereq.CreatePDR)
+			if err != nil {
+				log.Errorln("can not allocate F-TEIDs or UE IP in down:", err)
+				node.releaseOnBehalf(sereqMsg.upSeid)
+				respCh <- &SesRespD2uMsg{cause: ie.NewCause(ie.CauseNoResourcesAvailable)}
+				continue
+			}
+			sereq.CreatePDR = createPDRs
+
 			session, ok := pConn.NewPFCPSessionForDown(sereqMsg.upSeid)
 			if !ok {
 				log.Errorf("can not create session in down:")
 				if !sereqMsg.reforward {
-					respCh <- ie.NewCause(ie.CauseRequestRejected)
+					respCh <- &SesRespD2uMsg{cause: ie.NewCause(ie.CauseRequestRejected)}
 				}
 				continue
 			}
 
-			err := pConn.sessionStore.PutSession(session)
+			err = pConn.sessionStore.PutSession(session)
 			if err != nil {
 				log.Errorf("Failed to put PFCP session to store: %v", err)
 				if !sereqMsg.reforward {
-					respCh <- ie.NewCause(ie.CauseRequestRejected)
+					respCh <- &SesRespD2uMsg{cause: ie.NewCause(ie.CauseRequestRejected)}
 				}
 				continue
 			}
 			//fmt.Println("parham log : session succesfully added to sessionStore, down = ", session.localSEID, " , up = ", session.remoteSEID)
 		}
-		var localFSEID *ie.IE
-
-		localIP := pConn.LocalAddr().(*net.UDPAddr).IP
-		if localIP.To4() != nil {
-			localFSEID = ie.NewFSEID(sereqMsg.upSeid, localIP, nil)
-		} else {
-			localFSEID = ie.NewFSEID(sereqMsg.upSeid, nil, localIP)
-		}
-		sereq.CPFSEID = localFSEID
+		sereq.CPFSEID = newFSEID(sereqMsg.upSeid, pConn.LocalAddr().(*net.UDPAddr).IP)
 		if sereqMsg.reforward == true {
 			sereq.Header.MessagePriority = 123
 		} else {
 			node.upf.sesEstMsgStore[sereqMsg.upSeid] = sereq
+			delete(node.upf.sesURRs, sereqMsg.upSeid)
+			node.trackURRs(sereqMsg.upSeid, sereq.CreateURR, nil)
 		}
 		if !sereqMsg.reforward {
 			pConn.upf.seidToRespCh[sereqMsg.upSeid] = respCh
 		}
+		if !sereqMsg.reforward {
+			node.mirrorToShadow(sereqMsg.upSeid, sereq, comCh)
+		}
+
 		fmt.Println("sending ses est to Real PFCP")
 		pConn.forwardToRealPFCP(sereq, comCh)
 
@@ -207,25 +338,33 @@ func (node *PFCPNode) listenForSesModReq(comCh CommunicationChannel) {
 		//fmt.Println("parham log : down is waiting for new session modification req from up ...")
 		smreqMsg := <-comCh.SesModU2d
 		smreq := smreqMsg.msg
-		var respCh chan *ie.IE
+		var respCh chan *SesRespD2uMsg
 		if !smreqMsg.reforward {
 			respCh = smreqMsg.respCh
+
+			// Held until the session's migration switches or aborts
+			if node.holdForMigration(smreqMsg.upSeid, smreqMsg, respCh) {
+				continue
+			}
 		}
 
-		//fmt.Println("parham log: ses mod recieved by down : upseid = ", smreqMsg.upSeid)
-		upfIndex := node.pfcpMsgLBer(smreqMsg.upSeid)
-		fmt.Println("ses est received by down, up seid = ", smreqMsg.upSeid, ", upfIndex = ", upfIndex, ", reforward= ", smreqMsg.reforward)
-		//fmt.Println("parham log: selected upfIndex = ", upfIndex)
-		rAddr := node.upf.peersUPF[upfIndex].peersIP + ":" + DownPFCPPort
-		v, ok := node.pConns.Load(rAddr)
-		if !ok {
-			//log.infoln("Can't find pConn to received peer IP = ", node.upf.peersIP[upfIndex])
-			if !smreqMsg.reforward {
-				respCh <- ie.NewCause(ie.CauseRequestRejected)
+		pConn := smreqMsg.pConn
+		if pConn == nil {
+			//fmt.Println("parham log: ses mod recieved by down : upseid = ", smreqMsg.upSeid)
+			upfIndex := node.pfcpMsgLBer(smreqMsg.upSeid, nil)
+			fmt.Println("ses est received by down, up seid = ", smreqMsg.upSeid, ", upfIndex = ", upfIndex, ", reforward= ", smreqMsg.reforward)
+			//fmt.Println("parham log: selected upfIndex = ", upfIndex)
+			rAddr := node.upfAddr(upfIndex)
+			v, ok := node.pConns.Load(rAddr)
+			if !ok {
+				//log.infoln("Can't find pConn to received peer IP = ", node.upf.peersIP[upfIndex])
+				if !smreqMsg.reforward {
+					respCh <- &SesRespD2uMsg{cause: ie.NewCause(ie.CauseRequestRejected)}
+				}
+				continue
 			}
-			continue
+			pConn = v.(*PFCPConn)
 		}
-		pConn := v.(*PFCPConn)
 		//smreq.NodeID = pConn.nodeID.localIE
 
 		//fseid, err := smreq.CPFSEID.FSEID()
@@ -242,29 +381,46 @@ func (node *PFCPNode) listenForSesModReq(comCh CommunicationChannel) {
 		//	continue
 		//}
 
-		var localFSEID *ie.IE
-
-		localIP := pConn.LocalAddr().(*net.UDPAddr).IP
-		if localIP.To4() != nil {
-			localFSEID = ie.NewFSEID(smreqMsg.upSeid, localIP, nil)
-		} else {
-			localFSEID = ie.NewFSEID(smreqMsg.upSeid, nil, localIP)
-		}
-		smreq.CPFSEID = localFSEID
+		smreq.CPFSEID = newFSEID(smreqMsg.upSeid, pConn.LocalAddr().(*net.UDPAddr).IP)
 
 		smreq.Header.SEID = smreqMsg.upSeid
 		//fmt.Println("parham log : send session modification req from up to real in down")
 		if smreqMsg.reforward == true {
 			smreq.Header.MessagePriority = 123
 		} else {
+			var dnn string
+			if estMsg, ok := node.upf.sesEstMsgStore[smreqMsg.upSeid]; ok {
+				dnn = sessionDnn(estMsg)
+			}
+
+			createPDRs, err := node.allocateOnBehalf(smreqMsg.upSeid, pConn, dnn, smreq.CreatePDR)
+			if err != nil {
+				log.Errorln("can not allocate F-TEIDs or UE IP in down:", err)
+				respCh <- &SesRespD2uMsg{cause: ie.NewCause(ie.CauseNoResourcesAvailable)}
+				continue
+			}
+			smreq.CreatePDR = createPDRs
+			if node.upf.teids != nil {
+				node.upf.teids.removePDRs(smreqMsg.upSeid, smreq.RemovePDR)
+			}
+
 			node.upf.sesModMsgStore[smreqMsg.upSeid] = smreq
+			node.trackURRs(smreqMsg.upSeid, smreq.CreateURR, smreq.RemoveURR)
 		}
 		if !smreqMsg.reforward {
 			pConn.upf.seidToRespCh[smreqMsg.upSeid] = respCh
 		}
+		if !smreqMsg.reforward {
+			node.mirrorToShadow(smreqMsg.upSeid, smreq, comCh)
+		}
+
 		fmt.Println("sending ses mod to Real PFCP")
 		pConn.forwardToRealPFCP(smreq, comCh)
 
+		if !smreqMsg.reforward {
+			node.mirrorToStandby(smreqMsg.upSeid, smreq, comCh)
+		}
+
 	}
 }
 
@@ -273,9 +429,19 @@ func (node *PFCPNode) listenForSesDelReq(comCh CommunicationChannel) {
 		//fmt.Println("parham log : down is waiting for new session deletion req from up ...")
 		sdreqMsg := <-comCh.SesDelU2d
 		sdreq := sdreqMsg.msg
-		var respCh chan *ie.IE
+		var respCh chan *SesRespD2uMsg
 		if !sdreqMsg.reforward {
 			respCh = sdreqMsg.respCh
+
+			// Held until the session's migration switches or aborts, and
+			// counted once replayed
+			if node.holdForMigration(sdreqMsg.upSeid, sdreqMsg, respCh) {
+				continue
+			}
+
+			if a := node.upf.autoscaler; a != nil && a.forecaster != nil {
+				a.forecaster.recordDeletion()
+			}
 		}
 
 		//fmt.Println("parham log: ses del recieved : upseid = ", sdreqMsg.upSeid)
@@ -286,14 +452,14 @@ func (node *PFCPNode) listenForSesDelReq(comCh CommunicationChannel) {
 			fmt.Println("ses est received by down, up seid = ", sdreqMsg.upSeid, ", upfIndex = ", upfIndex, ", reforward= ", sdreqMsg.reforward)
 			pConn = sdreqMsg.pConn
 		} else {
-			upfIndex = node.pfcpMsgLBer(sdreqMsg.upSeid)
+			upfIndex = node.pfcpMsgLBer(sdreqMsg.upSeid, nil)
 			fmt.Println("ses est received by down, up seid = ", sdreqMsg.upSeid, ", upfIndex = ", upfIndex, ", reforward= ", sdreqMsg.reforward)
-			rAddr := node.upf.peersUPF[upfIndex].peersIP + ":" + DownPFCPPort
+			rAddr := node.upfAddr(upfIndex)
 			v, ok := node.pConns.Load(rAddr)
 			if !ok {
 				//log.infoln("Can't find pConn to received peer IP = ", node.upf.peersIP[upfIndex])
 				if !sdreqMsg.reforward {
-					respCh <- ie.NewCause(ie.CauseRequestRejected)
+					respCh <- &SesRespD2uMsg{cause: ie.NewCause(ie.CauseRequestRejected)}
 				}
 				continue
 			}
@@ -309,6 +475,10 @@ func (node *PFCPNode) listenForSesDelReq(comCh CommunicationChannel) {
 		if !sdreqMsg.reforward {
 			pConn.upf.seidToRespCh[sdreqMsg.upSeid] = respCh
 		}
+		if !sdreqMsg.reforward {
+			node.mirrorToShadow(sdreqMsg.upSeid, sdreq, comCh)
+		}
+
 		fmt.Println("sending ses del to Real PFCP")
 		pConn.forwardToRealPFCP(sdreq, comCh)
 
@@ -320,8 +490,10 @@ func (node *PFCPNode) listenForResetSes(comCh CommunicationChannel) {
 		<-comCh.ResetSessions
 		fmt.Println("ses rst signal received by down")
 		//fmt.Println("start reseting all upfs' sessions")
+		node.upf.placementMu.Lock()
+		lbmap := make(map[uint64]int, len(node.upf.lbmap))
 		for k, v := range node.upf.lbmap {
-			node.sendDeletionReq(k, v, comCh)
+			lbmap[k] = v
 		}
 
 		for i := range node.upf.peersUPF {
@@ -331,407 +503,28 @@ func (node *PFCPNode) listenForResetSes(comCh CommunicationChannel) {
 		for key := range node.upf.lbmap {
 			delete(node.upf.lbmap, key)
 		}
-	}
-}
-
-func extractCPULoad(output string) (int, error) {
-	lines := strings.Split(output, "\n")
-	if len(lines) < 2 {
-		return 0, errors.New("Not Enough Lines")
-	}
-	// Extract the second line, which contains CPU load
-	// Example: "upf101-0   20m          149Mi"
-	fields := strings.Fields(lines[1])
-	if len(fields) >= 2 {
-		cpuLoadStr := fields[1]
-		cpuLoadTrimmed := strings.TrimRight(cpuLoadStr, "m")
-		cpuLoad, err := strconv.Atoi(cpuLoadTrimmed)
-		return cpuLoad, err
-	}
-
-	return 0, errors.New("Not Enough Arguments")
-}
-
-func getCPULoads(podName string) (int, error) {
-	namespace := "omec"
-	cmd := exec.Command("kubectl", "top", "pod", "-n", namespace, podName)
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		return 0, err
-	}
-	cpuLoad, err := extractCPULoad(string(output))
-	if err != nil {
-		return 0, err
-	}
-	return cpuLoad, nil
-}
-
-func getUPFBytes(podName string) (uint64, error) {
-	cmd := exec.Command("kubectl", "exec", "-n", "omec", "-it", podName, "--", "cat", "/proc/net/dev")
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		fmt.Println(err)
-		return 0, err
-	}
-	lines := strings.Split(string(output), "\n")
-	var receivedBytes uint64
-	for _, line := range lines {
-		if strings.Contains(line, "access:") {
-			fields := strings.Fields(line)
-			if len(fields) >= 2 {
-				receivedBytesStr := fields[1]
-				receivedBytes, err = strconv.ParseUint(receivedBytesStr, 10, 64)
-				if err != nil {
-					fmt.Println("Error parsing received bytes:", err)
-					return 0, err
-				}
-			}
-			break
-		}
-	}
-	//fmt.Printf("Received Bytes on 'access' interface: %d\n", receivedBytes)
-	return receivedBytes, nil
-}
-
-func (node *PFCPNode) ScaleByCPU(comCh CommunicationChannel) {
-	for {
-		time.Sleep(time.Duration(node.upf.ReconciliationInterval) * time.Second)
-		for i, u := range node.upf.peersUPF {
-			podName := fmt.Sprint(u.Hostname, "-0")
-			load, err := getCPULoads(podName)
-			if err != nil {
-				continue
-			}
-			if load < int(node.upf.MinCPUThreshold) && len(node.upf.peersUPF) > int(node.upf.MinUPFs) && node.upf.AutoScaleIn {
-				var addThresh int
-				if len(u.upfsSessions) == 0 {
-					addThresh = 10 // just for test
-				} else {
-					addThresh = len(u.upfsSessions) / (len(node.upf.peersUPF) - 1)
-				}
-
-				newThreshold := node.upf.MaxSessionsThreshold + uint32(addThresh)
-				fmt.Println("MaxSessionsThreshold has changed from : ", node.upf.MaxSessionsThreshold, " to ", newThreshold)
-				node.upf.MaxSessionsThreshold += uint32(addThresh)
-				//kill upf
-				makeUPFEmpty(node, i, comCh)
-				time.Sleep(2 * time.Second)
-				ScaleInUPF := node.upf.peersUPF[i].Hostname
-				upfFile := fmt.Sprint("/upfs/", ScaleInUPF, ".yaml")
-				cmd := exec.Command("kubectl", "delete", "-n", "omec", "-f", upfFile)
-				log.Traceln("executing command : ", cmd.String())
-				combinedOutput, err := cmd.CombinedOutput()
-				if err != nil {
-					fmt.Printf("Error executing command: %v\nCombined Output: %s", cmd.String(), combinedOutput)
-					continue
-				}
-				time.Sleep(time.Duration(node.upf.ReconciliationInterval) * time.Second)
-			}
-			if load > int(node.upf.MaxCPUThreshold) && len(node.upf.peersUPF) < int(node.upf.MaxUPFs) && node.upf.AutoScaleOut {
-				var ScaleOutUPF string
-				var upfSes int
-				if len(u.upfsSessions) == 0 {
-					upfSes = 10 // just for test
-				} else {
-					upfSes = len(u.upfsSessions)
-				}
-				newThreshold := uint32(upfSes - int(node.upf.MaxSessionstolerance*float32(node.upf.MaxSessionsThreshold))) // minus a constant if want to be sure that the scaleout will be triggered
-				fmt.Println("MaxSessionsThreshold has changed from : ", node.upf.MaxSessionsThreshold, " to ", newThreshold)
-				node.upf.MaxSessionsThreshold = newThreshold
-				fmt.Println("scaleOutNeeded = true, node.upf.MaxUPFs = ", node.upf.MaxUPFs)
-
-				var upfExisted bool
-				var foundUPF bool
-				for i := 1; i <= int(node.upf.MaxUPFs); i++ {
-					upfExisted = false
-					foundUPF = false
-					var upfName string
-					if i < 10 {
-						upfName = fmt.Sprint("upf10", i)
-					} else if i < 100 {
-						upfName = fmt.Sprint("upf1", i)
-					} else if i >= 100 {
-						upfName = fmt.Sprint("upf", i)
-					}
-					for _, u := range node.upf.peersUPF {
-						if upfName == u.Hostname {
-							upfExisted = true
-							break
-						}
-					}
-					if !upfExisted {
-						ScaleOutUPF = upfName
-						fmt.Println("upf to scale out = ", upfName)
-						foundUPF = true
-						break
-					}
-				}
-				if foundUPF {
-					upfFile := fmt.Sprint("/upfs/", ScaleOutUPF, ".yaml")
-					cmd := exec.Command("kubectl", "apply", "-n", "omec", "-f", upfFile)
-					log.Traceln("executing command : ", cmd.String())
-					combinedOutput, err := cmd.CombinedOutput()
-					if err != nil {
-						fmt.Printf("Error executing command: %v\nCombined Output: %s", cmd.String(), combinedOutput)
-						continue
-					}
-					time.Sleep(20 * time.Second)
-				}
-				time.Sleep(time.Duration(node.upf.ReconciliationInterval) * time.Second)
-			}
-		}
-
-	}
-}
-
-func (node *PFCPNode) ScaleBySession(comCh CommunicationChannel) {
-	for {
-		time.Sleep(time.Duration(node.upf.ReconciliationInterval) * time.Second)
-		//fmt.Println("start reconciliation")
-		var scaleOutNeeded bool
-		var scaleInNeeded bool
-		var ScaleOutUPF string
-		var ScaleInUPF string
-		var ScaleInUPFIndex int
-
-		if node.upf.AutoScaleOut && len(node.upf.peersUPF) < int(node.upf.MaxUPFs) {
-			maxSession := node.upf.MaxSessionsThreshold + uint32(node.upf.MaxSessionstolerance*float32(node.upf.MaxSessionsThreshold))
-			for i := range node.upf.peersUPF {
-				if len(node.upf.peersUPF[i].upfsSessions) > int(maxSession) {
-					scaleOutNeeded = true
-					break
-				}
-			}
-		}
-		if scaleOutNeeded {
-			fmt.Println("scaleOutNeeded = true, node.upf.MaxUPFs = ", node.upf.MaxUPFs)
-			var upfExisted bool
-			var foundUPF bool
-			for i := 1; i <= int(node.upf.MaxUPFs); i++ {
-				upfExisted = false
-				foundUPF = false
-				var upfName string
-				if i < 10 {
-					upfName = fmt.Sprint("upf10", i)
-				} else if i < 100 {
-					upfName = fmt.Sprint("upf1", i)
-				} else if i >= 100 {
-					upfName = fmt.Sprint("upf", i)
-				}
-				for _, u := range node.upf.peersUPF {
-					if upfName == u.Hostname {
-						upfExisted = true
-						break
-					}
-				}
-				if !upfExisted {
-					ScaleOutUPF = upfName
-					fmt.Println("upf to scale out = ", upfName)
-					foundUPF = true
-					break
-				}
-			}
-			if foundUPF {
-				upfFile := fmt.Sprint("/upfs/", ScaleOutUPF, ".yaml")
-				cmd := exec.Command("kubectl", "apply", "-n", "omec", "-f", upfFile)
-				log.Traceln("executing command : ", cmd.String())
-				combinedOutput, err := cmd.CombinedOutput()
-				if err != nil {
-					fmt.Printf("Error executing command: %v\nCombined Output: %s", cmd.String(), combinedOutput)
-					continue
-				}
-				time.Sleep(20 * time.Second)
-			}
-			continue
-		}
+		node.upf.placementMu.Unlock()
 
-		if node.upf.AutoScaleIn && node.upf.MinSessionsThreshold != 0 && node.upf.MinSessionstolerance != 0 && len(node.upf.peersUPF) > int(node.upf.MinUPFs) {
-			minSession := node.upf.MinSessionsThreshold - uint32(node.upf.MinSessionstolerance*float32(node.upf.MinSessionsThreshold))
-			for i := range node.upf.peersUPF {
-				if len(node.upf.peersUPF[i].upfsSessions) < int(minSession) {
-					scaleInNeeded = true
-					ScaleInUPF = node.upf.peersUPF[i].Hostname
-					ScaleInUPFIndex = i
-					break
-				}
-			}
-		}
-
-		if scaleInNeeded {
-			makeUPFEmpty(node, ScaleInUPFIndex, comCh)
-			time.Sleep(2 * time.Second)
-			upfFile := fmt.Sprint("/upfs/", ScaleInUPF, ".yaml")
-			cmd := exec.Command("kubectl", "delete", "-n", "omec", "-f", upfFile)
-			log.Traceln("executing command : ", cmd.String())
-			combinedOutput, err := cmd.CombinedOutput()
-			if err != nil {
-				fmt.Printf("Error executing command: %v\nCombined Output: %s", cmd.String(), combinedOutput)
-				continue
-			}
-			time.Sleep(time.Duration(node.upf.ReconciliationInterval) * time.Second)
-			continue
+		// The listeners place sessions too, not sent with the lock held
+		for k, v := range lbmap {
+			node.sendDeletionReq(k, v, comCh)
+			node.deleteStandby(k, comCh)
 		}
-
 	}
 }
 
-func (node *PFCPNode) ScaleByBitRate(comCh CommunicationChannel) {
-	var waited bool
-	var continued bool
-	firstLoop := true
-outerLoop:
-	for {
-		time.Sleep(time.Duration(node.upf.ReconciliationInterval) * time.Second)
-		if waited || firstLoop || continued { // if this func slept for more than ReconciliationInterval, in first loop after sleep, just update the bytes and do not compute bitrate
-			for i, u := range node.upf.peersUPF {
-				podName := fmt.Sprint(u.Hostname, "-0")
-				currentBytes, err := getUPFBytes(podName)
-				if err != nil {
-					continue
-
-				}
-				u.LastBytes = currentBytes
-				if node.upf.peersUPF[i].ScaleInDecision {
-					node.upf.peersUPF[i].ScaleInDecision = false
-					fmt.Println("set node.upf.peersUPF[i].ScaleInDecision = false for ", node.upf.peersUPF[i].Hostname, " due to waited or firstLoop")
-				}
-			}
-			waited = false
-			firstLoop = false
-			continued = false
-			continue
-		}
-		for i, u := range node.upf.peersUPF {
-			podName := fmt.Sprint(u.Hostname, "-0")
-			currentBytes, err := getUPFBytes(podName)
-			if err != nil {
-				continued = true
-				continue
-			}
-			currentBitRate := (currentBytes - u.LastBytes) / uint64(node.upf.ReconciliationInterval)
-			u.LastBytes = currentBytes
-			if currentBitRate < node.upf.MinBitRateThreshold && len(node.upf.peersUPF) > int(node.upf.MinUPFs) && currentBitRate > 10000 && node.upf.AutoScaleIn {
-				if i >= len(node.upf.peersUPF) {
-					continued = true
-					continue
-				}
-				if !node.upf.peersUPF[i].ScaleInDecision {
-					fmt.Println("set node.upf.peersUPF[i].ScaleInDecision = true for ", node.upf.peersUPF[i].Hostname, " due to first scaling decision")
-					fmt.Println("currentBitRate = ", currentBitRate)
-					node.upf.peersUPF[i].ScaleInDecision = true
-					continue outerLoop
-				}
-				node.upf.peersUPF[i].ScaleInDecision = false
-				fmt.Println("set node.upf.peersUPF[i].ScaleInDecision = false for ", node.upf.peersUPF[i].Hostname, " due to executing scaling")
-				fmt.Println("currentBitRate = ", currentBitRate)
-				fmt.Println("scale in needed")
-				fmt.Println("current bit rate = ", currentBitRate, " for ")
-				var addThresh int
-				if len(u.upfsSessions) == 0 {
-					addThresh = 10 // just for test
-				} else {
-					addThresh = len(u.upfsSessions) / (len(node.upf.peersUPF) - 1)
-				}
-
-				node.upf.MaxSessionsThreshold += uint32(addThresh)
-				//kill upf
-				makeUPFEmpty(node, i, comCh)
-				time.Sleep(2 * time.Second)
-				ScaleInUPF := node.upf.peersUPF[i].Hostname
-				upfFile := fmt.Sprint("/upfs/", ScaleInUPF, ".yaml")
-				cmd := exec.Command("kubectl", "delete", "-n", "omec", "-f", upfFile)
-				log.Traceln("executing command : ", cmd.String())
-				combinedOutput, err := cmd.CombinedOutput()
-				if err != nil {
-					fmt.Printf("Error executing command: %v\nCombined Output: %s", cmd.String(), combinedOutput)
-					continued = true
-					continue
-				}
-				time.Sleep(20 * time.Second)
-				waited = true
-
-			}
-			if i < len(node.upf.peersUPF) {
-				if node.upf.peersUPF[i].ScaleInDecision {
-					node.upf.peersUPF[i].ScaleInDecision = false
-					fmt.Println("set node.upf.peersUPF[i].ScaleInDecision = false for ", node.upf.peersUPF[i].Hostname, " due to cancelling scaling")
-					fmt.Println("currentBitRate = ", currentBitRate)
-				}
-			}
-			if currentBitRate > node.upf.MaxBitRateThreshold && len(node.upf.peersUPF) < int(node.upf.MaxUPFs) && node.upf.AutoScaleOut {
-				fmt.Println("scale out needed")
-				var ScaleOutUPF string
-				var upfSes int
-				if len(u.upfsSessions) == 0 {
-					upfSes = 10 // just for test
-				} else {
-					upfSes = len(u.upfsSessions)
-				}
-				newThreshold := uint32(upfSes - int(node.upf.MaxSessionstolerance*float32(upfSes))) // minus a constant if want to be sure that the scaleout will be triggered
-				//fmt.Println("MaxSessionsThreshold has changed from : ", node.upf.MaxSessionsThreshold, " to ", newThreshold)
-				node.upf.MaxSessionsThreshold = newThreshold
-				fmt.Println("newThreshold = ", newThreshold)
-				//fmt.Println("scaleOutNeeded = true, node.upf.MaxUPFs = ", node.upf.MaxUPFs)
-
-				var upfExisted bool
-				var foundUPF bool
-				for i := 1; i <= int(node.upf.MaxUPFs); i++ {
-					upfExisted = false
-					foundUPF = false
-					var upfName string
-					if i < 10 {
-						upfName = fmt.Sprint("upf10", i)
-					} else if i < 100 {
-						upfName = fmt.Sprint("upf1", i)
-					} else if i >= 100 {
-						upfName = fmt.Sprint("upf", i)
-					}
-					for _, u := range node.upf.peersUPF {
-						if upfName == u.Hostname {
-							upfExisted = true
-							break
-						}
-					}
-					if !upfExisted {
-						ScaleOutUPF = upfName
-						fmt.Println("upf to scale out = ", upfName)
-						foundUPF = true
-						break
-					}
-				}
-				if foundUPF {
-					upfFile := fmt.Sprint("/upfs/", ScaleOutUPF, ".yaml")
-					cmd := exec.Command("kubectl", "apply", "-n", "omec", "-f", upfFile)
-					log.Traceln("executing command : ", cmd.String())
-					combinedOutput, err := cmd.CombinedOutput()
-					if err != nil {
-						fmt.Printf("Error executing command: %v\nCombined Output: %s", cmd.String(), combinedOutput)
-						continue
-					}
-					time.Sleep(20 * time.Second)
-					waited = true
-				}
-
-			}
-		}
-
-	}
+// scaleInAllowed holds scale-in while the path to an SMF is in its grace period:
+// its sessions are still counted but may all be released when the grace period expires.
+func (node *PFCPNode) scaleInAllowed() bool {
+	return !node.upf.smfPaths.inGrace()
 }
 
 func (node *PFCPNode) reconciliation(comCh CommunicationChannel) {
-	if node.upf.ScaleByCPU {
-		go node.ScaleByCPU(comCh)
-	}
-	if node.upf.ScaleBySession {
-		go node.ScaleBySession(comCh)
-	}
-	if node.upf.ScaleByBitRate {
-		go node.ScaleByBitRate(comCh)
-	}
+	node.upf.autoscaler.run(newNodeScalingPool(node, comCh))
 }
 
 func (node *PFCPNode) sendDeletionReq(sessId uint64, upfId int, comCh CommunicationChannel) {
-	upfAddr := node.upf.peersUPF[upfId].peersIP + ":" + DownPFCPPort
+	upfAddr := upfPFCPAddr(node.upf.peersUPF[upfId].peersIP)
 	upfpconn, ok := node.pConns.Load(upfAddr)
 	if !ok {
 		//fmt.Println("parham log : can not find source Pconn in node.pConns.Load(sourceAddr)")
@@ -833,6 +626,8 @@ func (node *PFCPNode) Serve(comCh CommunicationChannel, pos Position) {
 		case rAddr := <-node.pConnDone:
 			node.pConns.Delete(rAddr)
 			//log.infoln("Removed connection to", rAddr)
+		case r := <-node.rebinds:
+			node.rebindUPF(r.u, r.ip, comCh)
 		case <-node.ctx.Done():
 			shutdown = true
 
@@ -0,0 +1,331 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright 2022-present Open Networking Foundation
+
+package pfcpiface
+
+import (
+	"net"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/wmnsk/go-pfcp/ie"
+	"github.com/wmnsk/go-pfcp/message"
+)
+
+// Node Report Type flags, 3GPP TS 29.244 section 8.2.69.
+const (
+	nodeReportTypeUPFR = 0x01 // User Plane Path Failure Report
+	nodeReportTypeUPRR = 0x02 // User Plane Path Recovery Report
+)
+
+// NodeReportD2uMsg carries pool level user plane path changes from Down to Up,
+// to be reported to the SMF.
+type NodeReportD2uMsg struct {
+	failedPeers    []*ie.IE
+	recoveredPeers []*ie.IE
+}
+
+// gtpuPathMonitor keeps track of the remote GTP-U peers each UPF reported as unreachable.
+type gtpuPathMonitor struct {
+	mu sync.Mutex
+	// failures maps a UPF NodeID to the Remote GTP-U Peer IEs it can't reach, keyed by peer address.
+	failures map[string]map[string]*ie.IE
+}
+
+func newGTPUPathMonitor() *gtpuPathMonitor {
+	return &gtpuPathMonitor{
+		failures: make(map[string]map[string]*ie.IE),
+	}
+}
+
+// failedAnywhere must be called with the lock held.
+func (m *gtpuPathMonitor) failedAnywhere(peer string) bool {
+	for _, peers := range m.failures {
+		if _, ok := peers[peer]; ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// reportFailure records peers as unreachable from upfNodeID and returns the ones
+// no other UPF of the pool had reported yet.
+func (m *gtpuPathMonitor) reportFailure(upfNodeID string, peers []*ie.IE) []*ie.IE {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	newlyFailed := make([]*ie.IE, 0)
+
+	for _, p := range peers {
+		key, err := remoteGTPUPeerKey(p)
+		if err != nil {
+			log.Warnln("Ignoring malformed Remote GTP-U Peer:", err)
+			continue
+		}
+
+		if !m.failedAnywhere(key) {
+			newlyFailed = append(newlyFailed, p)
+		}
+
+		if m.failures[upfNodeID] == nil {
+			m.failures[upfNodeID] = make(map[string]*ie.IE)
+		}
+
+		m.failures[upfNodeID][key] = p
+	}
+
+	return newlyFailed
+}
+
+// reportRecovery clears peers for upfNodeID and returns the ones that are now
+// reachable from every UPF of the pool.
+func (m *gtpuPathMonitor) reportRecovery(upfNodeID string, peers []*ie.IE) []*ie.IE {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	recovered := make([]*ie.IE, 0)
+
+	for _, p := range peers {
+		key, err := remoteGTPUPeerKey(p)
+		if err != nil {
+			log.Warnln("Ignoring malformed Remote GTP-U Peer:", err)
+			continue
+		}
+
+		if _, ok := m.failures[upfNodeID][key]; !ok {
+			continue
+		}
+
+		delete(m.failures[upfNodeID], key)
+
+		if !m.failedAnywhere(key) {
+			recovered = append(recovered, p)
+		}
+	}
+
+	return recovered
+}
+
+// removeUPF forgets everything reported by upfNodeID and returns the peers that
+// are no longer reported as unreachable by any UPF.
+func (m *gtpuPathMonitor) removeUPF(upfNodeID string) []*ie.IE {
+	m.mu.Lock()
+	peers := make([]*ie.IE, 0, len(m.failures[upfNodeID]))
+
+	for _, p := range m.failures[upfNodeID] {
+		peers = append(peers, p)
+	}
+	m.mu.Unlock()
+
+	return m.reportRecovery(upfNodeID, peers)
+}
+
+// hasFailure reports whether upfNodeID can't reach the GTP-U peer with the given address.
+func (m *gtpuPathMonitor) hasFailure(upfNodeID string, peer string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, ok := m.failures[upfNodeID][peer]
+
+	return ok
+}
+
+func remoteGTPUPeerKey(peer *ie.IE) (string, error) {
+	fields, err := peer.RemoteGTPUPeer()
+	if err != nil {
+		return "", err
+	}
+
+	if fields.IPv4Address != nil {
+		return fields.IPv4Address.String(), nil
+	}
+
+	if fields.IPv6Address != nil {
+		return fields.IPv6Address.String(), nil
+	}
+
+	return "", ErrInvalidArgument("Remote GTP-U Peer", peer)
+}
+
+// sessionGTPUPeers returns the access side GTP-U peers of session seid, from
+// sereq, nil if not known, and from the FARs its stored modification creates or
+// updates: in 5G, the gNB's F-TEID usually comes with a modification.
+func (node *PFCPNode) sessionGTPUPeers(seid uint64, sereq *message.SessionEstablishmentRequest) []string {
+	var peers []string
+
+	if sereq != nil {
+		peers = append(peers, farGTPUPeers(sereq.CreateFAR)...)
+	}
+
+	if smreq, ok := node.upf.sesModMsgStore[seid]; ok {
+		peers = append(peers, farGTPUPeers(smreq.CreateFAR)...)
+		peers = append(peers, farGTPUPeers(smreq.UpdateFAR)...)
+	}
+
+	return peers
+}
+
+// farGTPUPeers returns the addresses of the access side GTP-U peers (gNB/eNB)
+// the given Create or Update FARs tunnel traffic to. An Update FAR that only
+// changes the outer header is taken as to the access side.
+func farGTPUPeers(fars []*ie.IE) []string {
+	peers := make([]string, 0)
+
+	for _, far := range fars {
+		var (
+			fwdIEs   []*ie.IE
+			err      error
+			toAccess bool
+			peerIP   net.IP
+		)
+
+		if far.Type == ie.UpdateFAR {
+			fwdIEs, err = far.UpdateForwardingParameters()
+			toAccess = true
+		} else {
+			fwdIEs, err = far.ForwardingParameters()
+		}
+
+		if err != nil {
+			continue
+		}
+
+		for _, fwdIE := range fwdIEs {
+			switch fwdIE.Type {
+			case ie.DestinationInterface:
+				dstIntf, err := fwdIE.DestinationInterface()
+				toAccess = err == nil && dstIntf == ie.DstInterfaceAccess
+			case ie.OuterHeaderCreation:
+				ohcFields, err := fwdIE.OuterHeaderCreation()
+				if err != nil {
+					continue
+				}
+
+				if ohcFields.IPv4Address != nil {
+					peerIP = ohcFields.IPv4Address
+				} else {
+					peerIP = ohcFields.IPv6Address
+				}
+			}
+		}
+
+		if toAccess && peerIP != nil {
+			peers = append(peers, peerIP.String())
+		}
+	}
+
+	return peers
+}
+
+func newNodeReportRequest(seq uint32, nodeID *ie.IE, failed, recovered []*ie.IE) *message.NodeReportRequest {
+	var reportType uint8
+
+	ies := []*ie.IE{nodeID}
+
+	if len(failed) > 0 {
+		reportType |= nodeReportTypeUPFR
+		report := ie.NewUserPlanePathFailureReport(failed[0])
+		report.Add(failed[1:]...)
+		ies = append(ies, report)
+	}
+
+	if len(recovered) > 0 {
+		reportType |= nodeReportTypeUPRR
+		report := ie.NewUserPlanePathRecoveryReport(recovered[0])
+		report.Add(recovered[1:]...)
+		ies = append(ies, report)
+	}
+
+	return message.NewNodeReportRequest(seq, append([]*ie.IE{ie.NewNodeReportType(reportType)}, ies...)...)
+}
+
+// handleNodeReportRequest answers a Node Report Request received from a UPF and
+// forwards the pool level path changes to the SMF.
+func (pConn *PFCPConn) handleNodeReportRequest(msg message.Message, comCh CommunicationChannel) (message.Message, error) {
+	nrreq, ok := msg.(*message.NodeReportRequest)
+	if !ok {
+		return nil, errUnmarshal(errMsgUnexpectedType)
+	}
+
+	nrres := message.NewNodeReportResponse(nrreq.SequenceNumber,
+		pConn.nodeID.localIE,
+		ie.NewCause(ie.CauseRequestAccepted),
+		nil,
+	)
+
+	if nrreq.NodeReportType == nil {
+		nrres.Cause = ie.NewCause(ie.CauseMandatoryIEMissing)
+		return nrres, errUnmarshal(ErrNotFound("Node Report Type"))
+	}
+
+	var failed, recovered []*ie.IE
+
+	if nrreq.UserPlanePathFailureReport != nil {
+		peers, err := nrreq.UserPlanePathFailureReport.UserPlanePathFailureReport()
+		if err != nil {
+			nrres.Cause = ie.NewCause(ie.CauseRequestRejected)
+			return nrres, errUnmarshal(err)
+		}
+
+		failed = pConn.upf.gtpuPaths.reportFailure(pConn.nodeID.remote, peers)
+		log.Warnln("UPF", pConn.nodeID.remote, "reported user plane path failure for", len(peers), "peers")
+	}
+
+	if nrreq.UserPlanePathRecoveryReport != nil {
+		peers, err := nrreq.UserPlanePathRecoveryReport.UserPlanePathRecoveryReport()
+		if err != nil {
+			nrres.Cause = ie.NewCause(ie.CauseRequestRejected)
+			return nrres, errUnmarshal(err)
+		}
+
+		recovered = pConn.upf.gtpuPaths.reportRecovery(pConn.nodeID.remote, peers)
+		log.Infoln("UPF", pConn.nodeID.remote, "reported user plane path recovery for", len(peers), "peers")
+	}
+
+	if len(failed) > 0 || len(recovered) > 0 {
+		comCh.NodeReportD2u <- &NodeReportD2uMsg{
+			failedPeers:    failed,
+			recoveredPeers: recovered,
+		}
+	}
+
+	return nrres, nil
+}
+
+// sendNodeReport sends a Node Report Request to the SMF and waits for its response.
+func (pConn *PFCPConn) sendNodeReport(report *NodeReportD2uMsg) {
+	nrreq := newNodeReportRequest(pConn.getSeqNum(), pConn.nodeID.localIE, report.failedPeers, report.recoveredPeers)
+
+	reply, timeout := pConn.sendPFCPRequestMessage(newRequest(nrreq))
+	if timeout {
+		log.Warnln("Node Report Request to", pConn.RemoteAddr(), "timed out")
+		return
+	}
+
+	nrres, ok := reply.(*message.NodeReportResponse)
+	if !ok || nrres.Cause == nil {
+		return
+	}
+
+	if cause, err := nrres.Cause.Cause(); err == nil && cause != ie.CauseRequestAccepted {
+		log.Warnln("Node Report Request rejected by", pConn.RemoteAddr(), "with cause", cause)
+	}
+}
+
+// listenForNodeReport relays pool level Node Reports to every associated SMF.
+func (node *PFCPNode) listenForNodeReport(comCh CommunicationChannel) {
+	for {
+		report := <-comCh.NodeReportD2u
+		log.Debugln("Node report received by up, failed peers:", len(report.failedPeers), "recovered peers:", len(report.recoveredPeers))
+
+		node.pConns.Range(func(key, value interface{}) bool {
+			pConn := value.(*PFCPConn)
+			if pConn.nodeID.remote != "" {
+				go pConn.sendNodeReport(report)
+			}
+
+			return true
+		})
+	}
+}
@@ -0,0 +1,85 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright 2022-present Open Networking Foundation
+
+package pfcpiface
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/wmnsk/go-pfcp/ie"
+	"github.com/wmnsk/go-pfcp/message"
+)
+
+func newTestRemoteGTPUPeer(ip string) *ie.IE {
+	return ie.NewRemoteGTPUPeer(0x02, ip, "", 0, "")
+}
+
+func TestGTPUPathMonitor(t *testing.T) {
+	m := newGTPUPathMonitor()
+	gnb1 := newTestRemoteGTPUPeer("10.0.0.1")
+	gnb2 := newTestRemoteGTPUPeer("10.0.0.2")
+
+	failed := m.reportFailure("upf1", []*ie.IE{gnb1})
+	require.Len(t, failed, 1)
+	require.True(t, m.hasFailure("upf1", "10.0.0.1"))
+	require.False(t, m.hasFailure("upf2", "10.0.0.1"))
+
+	failed = m.reportFailure("upf2", []*ie.IE{gnb1, gnb2})
+	require.Len(t, failed, 1, "gnb1 was already reported by upf1")
+
+	recovered := m.reportRecovery("upf1", []*ie.IE{gnb1})
+	require.Empty(t, recovered, "gnb1 is still unreachable from upf2")
+
+	recovered = m.removeUPF("upf2")
+	require.Len(t, recovered, 2)
+	require.False(t, m.hasFailure("upf2", "10.0.0.2"))
+}
+
+func TestSessionGTPUPeers(t *testing.T) {
+	fars := []*ie.IE{
+		ie.NewCreateFAR(
+			ie.NewFARID(1),
+			ie.NewApplyAction(0x02),
+			ie.NewForwardingParameters(
+				ie.NewDestinationInterface(ie.DstInterfaceCore),
+			),
+		),
+		ie.NewCreateFAR(
+			ie.NewFARID(2),
+			ie.NewApplyAction(0x02),
+			ie.NewForwardingParameters(
+				ie.NewDestinationInterface(ie.DstInterfaceAccess),
+				ie.NewOuterHeaderCreation(0x100, 0x1234, "10.0.0.1", "", 0, 0, 0),
+			),
+		),
+	}
+
+	require.Equal(t, []string{net.ParseIP("10.0.0.1").String()}, farGTPUPeers(fars))
+
+	// The gNB's F-TEID arrives with a modification
+	sereq := message.NewSessionEstablishmentRequest(0, 0, 1, 1, 0, fars[0])
+	smreq := message.NewSessionModificationRequest(0, 0, 1, 2, 0,
+		ie.NewUpdateFAR(
+			ie.NewFARID(1),
+			ie.NewUpdateForwardingParameters(
+				ie.NewOuterHeaderCreation(0x100, 0x5678, "10.0.0.2", "", 0, 0, 0),
+			),
+		),
+	)
+
+	node := &PFCPNode{upf: &Upf{
+		peersUPF:       []*Upf{{NodeID: "upf1"}, {NodeID: "upf2"}},
+		gtpuPaths:      newGTPUPathMonitor(),
+		sesModMsgStore: map[uint64]*message.SessionModificationRequest{1: smreq},
+	}}
+	require.Empty(t, node.sessionGTPUPeers(2, sereq))
+
+	peers := node.sessionGTPUPeers(1, sereq)
+	require.Equal(t, []string{"10.0.0.2"}, peers)
+
+	node.upf.gtpuPaths.reportFailure("upf2", []*ie.IE{newTestRemoteGTPUPeer("10.0.0.2")})
+	require.False(t, node.upfEligible(1, peers), "upf2 can't reach the gNB")
+	require.True(t, node.upfEligible(0, peers))
+}
@@ -0,0 +1,200 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright 2022-present Open Networking Foundation
+
+package pfcpiface
+
+import (
+	"sort"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Orchestrator kinds, conf.Orchestrator.Kind.
+const (
+	orchestratorKubernetes = "kubernetes"
+	orchestratorFake       = "fake"
+	orchestratorNone       = "none" // the UPFs are run by other means, e.g. a static pool
+)
+
+// UPFMetrics is the resource usage of a UPF instance.
+type UPFMetrics struct {
+	CPUMilli int64  // CPU used, in millicores
+	RxBytes  uint64 // bytes received on its access interface so far
+}
+
+// Orchestrator creates and deletes the UPF instances of the pool, by name,
+// e.g. "upf101", and reports their resource usage. The autoscaler reads its
+// signals from conf.Metrics rather than from the orchestrator.
+type Orchestrator interface {
+	// CreateUPF creates the UPF, or updates it if it exists.
+	CreateUPF(name string) error
+	// DeleteUPF deletes the UPF, if it exists.
+	DeleteUPF(name string) error
+	ListUPFs() ([]string, error)
+	// GetUPFMetrics returns the usage of the UPF, read from the metrics
+	// source of the orchestrator.
+	GetUPFMetrics(name string) (UPFMetrics, error)
+}
+
+// NewOrchestrator returns the orchestrator of conf.Orchestrator.
+func NewOrchestrator(conf *Conf) (Orchestrator, error) {
+	switch conf.Orchestrator.Kind {
+	case orchestratorKubernetes:
+		k, err := newK8sOrchestrator(conf)
+		if err != nil {
+			return nil, err
+		}
+
+		return k, nil
+	case orchestratorFake:
+		f := newFakeOrchestrator()
+		f.metrics = newStaticMetricsSource(conf.Metrics.Static)
+
+		return f, nil
+	case orchestratorNone:
+		return nil, nil
+	default:
+		return nil, ErrUnsupported("orchestrator kind", conf.Orchestrator.Kind)
+	}
+}
+
+// createUPF creates the UPF name through the orchestrator.
+func (node *PFCPNode) createUPF(name string) error {
+	if node.upf.orchestrator == nil {
+		return ErrNotFound("orchestrator")
+	}
+
+	log.Infoln("Creating UPF", name)
+
+	return node.upf.orchestrator.CreateUPF(name)
+}
+
+// deleteUPF deletes the UPF name through the orchestrator.
+func (node *PFCPNode) deleteUPF(name string) error {
+	if node.upf.orchestrator == nil {
+		return ErrNotFound("orchestrator")
+	}
+
+	// Not while sessions are still on it, or leaving it
+	for _, u := range node.upf.peersUPF {
+		if u.Hostname == name && (len(u.upfsSessions) > 0 || node.upf.migrations.outgoing(u) > 0) {
+			return ErrOperationFailedWithReason("delete UPF "+name, "not drained")
+		}
+	}
+
+	log.Infoln("Deleting UPF", name)
+
+	if err := node.upf.orchestrator.DeleteUPF(name); err != nil {
+		return err
+	}
+
+	if node.upf.names != nil {
+		node.upf.names.release(name)
+	}
+
+	return nil
+}
+
+// upfMetricsFrom returns the resource usage of the UPF name from src. A metric
+// src can't read is left at 0, unless it reads none.
+func upfMetricsFrom(src MetricsSource, name string) (UPFMetrics, error) {
+	var m UPFMetrics
+
+	if src == nil {
+		return m, ErrNotFound("metrics source")
+	}
+
+	cpu, cpuErr := src.GetUPFMetric(name, metricCPU)
+	if cpuErr == nil {
+		m.CPUMilli = int64(cpu)
+	}
+
+	rx, rxErr := src.GetUPFMetric(name, metricRxBytes)
+	if rxErr == nil {
+		m.RxBytes = uint64(rx)
+	}
+
+	if cpuErr != nil && rxErr != nil {
+		return UPFMetrics{}, cpuErr
+	}
+
+	return m, nil
+}
+
+// fakeOrchestrator keeps the UPF instances in memory, for tests and to run
+// the LB without a cluster.
+type fakeOrchestrator struct {
+	mu      sync.Mutex
+	upfs    map[string]bool
+	created []string      // names passed to CreateUPF, in order
+	deleted []string      // names passed to DeleteUPF, in order
+	err     error         // returned by every call when set
+	metrics MetricsSource // of the UPFs, none if nil
+}
+
+func newFakeOrchestrator() *fakeOrchestrator {
+	return &fakeOrchestrator{upfs: make(map[string]bool)}
+}
+
+func (f *fakeOrchestrator) CreateUPF(name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.err != nil {
+		return f.err
+	}
+
+	f.created = append(f.created, name)
+
+	f.upfs[name] = true
+
+	return nil
+}
+
+func (f *fakeOrchestrator) DeleteUPF(name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.err != nil {
+		return f.err
+	}
+
+	f.deleted = append(f.deleted, name)
+	delete(f.upfs, name)
+
+	return nil
+}
+
+func (f *fakeOrchestrator) ListUPFs() ([]string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.err != nil {
+		return nil, f.err
+	}
+
+	names := make([]string, 0, len(f.upfs))
+	for name := range f.upfs {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names, nil
+}
+
+func (f *fakeOrchestrator) GetUPFMetrics(name string) (UPFMetrics, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.err != nil {
+		return UPFMetrics{}, f.err
+	}
+
+	if !f.upfs[name] {
+		return UPFMetrics{}, ErrNotFoundWithParam("UPF", "name", name)
+	}
+
+	return upfMetricsFrom(f.metrics, name)
+}
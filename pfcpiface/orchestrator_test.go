@@ -0,0 +1,74 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright 2022-present Open Networking Foundation
+
+package pfcpiface
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewOrchestrator(t *testing.T) {
+	o, err := NewOrchestrator(&Conf{Orchestrator: OrchestratorInfo{Kind: orchestratorFake}})
+	require.NoError(t, err)
+	require.IsType(t, &fakeOrchestrator{}, o)
+
+	_, err = NewOrchestrator(&Conf{Orchestrator: OrchestratorInfo{Kind: "nomad"}})
+	require.ErrorIs(t, err, errUnsupported)
+
+	t.Setenv("KUBERNETES_SERVICE_HOST", "")
+
+	o, err = NewOrchestrator(&Conf{
+		Orchestrator: OrchestratorInfo{Kind: orchestratorKubernetes},
+		UPFTemplate:  UPFTemplateInfo{TemplateDir: "../upfs/templates"},
+	})
+	require.Error(t, err, "not in a cluster")
+	require.Nil(t, o)
+}
+
+func TestFakeOrchestrator(t *testing.T) {
+	f := newFakeOrchestrator()
+	node := &PFCPNode{upf: &Upf{orchestrator: f}}
+
+	require.NoError(t, node.createUPF("upf102"))
+	require.NoError(t, node.createUPF("upf101"))
+
+	names, err := f.ListUPFs()
+	require.NoError(t, err)
+	require.Equal(t, []string{"upf101", "upf102"}, names)
+
+	require.NoError(t, node.deleteUPF("upf101"))
+
+	names, err = f.ListUPFs()
+	require.NoError(t, err)
+	require.Equal(t, []string{"upf102"}, names)
+	require.Equal(t, []string{"upf102", "upf101"}, f.created)
+	require.Equal(t, []string{"upf101"}, f.deleted)
+
+	f.err = errors.New("API server unreachable")
+	require.Error(t, node.createUPF("upf103"))
+
+	node.upf.orchestrator = nil
+	require.ErrorIs(t, node.deleteUPF("upf102"), errNotFound, "no orchestrator")
+}
+
+func TestFakeOrchestratorMetrics(t *testing.T) {
+	f := newFakeOrchestrator()
+	require.NoError(t, f.CreateUPF("upf101"))
+
+	_, err := f.GetUPFMetrics("upf101")
+	require.ErrorIs(t, err, errNotFound, "no metrics source")
+
+	f.metrics = newStaticMetricsSource(map[string]map[string]float64{
+		"upf101": {metricCPU: 250},
+	})
+
+	m, err := f.GetUPFMetrics("upf101")
+	require.NoError(t, err)
+	require.Equal(t, UPFMetrics{CPUMilli: 250}, m, "rx bytes not reported")
+
+	_, err = f.GetUPFMetrics("upf102")
+	require.ErrorIs(t, err, errNotFound)
+}
@@ -6,10 +6,8 @@ package pfcpiface
 import (
 	"context"
 	"flag"
-	"fmt"
 	"net"
 	"net/http"
-	"os/exec"
 	"sync"
 	"time"
 
@@ -28,27 +26,38 @@ type CommunicationChannel struct {
 	SesModU2d     chan *SesModU2dMsg
 	SesDelU2d     chan *SesDelU2dMsg
 	ResetSessions chan struct{}
+	NodeReportD2u chan *NodeReportD2uMsg
+	SMFPathU2d    chan *SMFPathU2dMsg
+	SesReportD2u  chan *SesReportD2uMsg
+}
+
+// SesRespD2uMsg is Down's answer to a session request of Up.
+type SesRespD2uMsg struct {
+	cause      *ie.IE
+	createdPDR []*ie.IE
 }
 
 type SesEstU2dMsg struct {
 	msg       *message.SessionEstablishmentRequest
 	upSeid    uint64
 	reforward bool
-	respCh    chan *ie.IE
+	respCh    chan *SesRespD2uMsg
+	pConn     *PFCPConn // destination of a migration, nil to follow lbmap
 }
 
 type SesModU2dMsg struct {
 	msg       *message.SessionModificationRequest
 	upSeid    uint64
 	reforward bool
-	respCh    chan *ie.IE
+	respCh    chan *SesRespD2uMsg
+	pConn     *PFCPConn // source of a migration being queried, nil to follow lbmap
 }
 
 type SesDelU2dMsg struct {
 	msg       *message.SessionDeletionRequest
 	upSeid    uint64
 	reforward bool
-	respCh    chan *ie.IE
+	respCh    chan *SesRespD2uMsg
 	upfIndex  int
 	pConn     *PFCPConn
 }
@@ -90,22 +99,25 @@ type PFCPIface struct {
 	mu sync.Mutex
 }
 
-func RunUPFs(conf *Conf) error {
-	var upfName string
-	for i := 1; i <= int(conf.InitUPFs); i++ {
-		if i < 10 {
-			upfName = fmt.Sprint("upf10", i)
-		} else if i < 100 {
-			upfName = fmt.Sprint("upf1", i)
-		} else if i >= 100 {
-			upfName = fmt.Sprint("upf", i)
-		}
-		upfFile := fmt.Sprint("/upfs/", upfName, ".yaml")
-		cmd := exec.Command("kubectl", "apply", "-n", "omec", "-f", upfFile)
-		log.Traceln("executing command : ", cmd.String())
-		combinedOutput, err := cmd.CombinedOutput()
-		if err != nil {
-			fmt.Printf("Error executing command: %v\nCombined Output: %s", cmd.String(), combinedOutput)
+// RunUPFs creates the initial UPFs of the pool, up to conf.InitUPFs of them.
+func (p *PFCPIface) RunUPFs() error {
+	// The external scaler runs them, or they run on their own
+	if p.conf.Autoscaler.External || p.conf.Orchestrator.Kind == orchestratorNone {
+		return nil
+	}
+
+	if p.node == nil || p.upf.orchestrator == nil {
+		return ErrNotFound("orchestrator")
+	}
+
+	// Those already run, e.g. before the LB restarted, count
+	inventory, err := p.node.upfInventory()
+	if err != nil {
+		return err
+	}
+
+	for i := len(inventory); i < int(p.conf.InitUPFs); i++ {
+		if _, err := p.node.scaleOutUPF(); err != nil {
 			return err
 		}
 		time.Sleep(2 * time.Second)
@@ -171,6 +183,8 @@ func (p *PFCPIface) mustInit(comCh CommunicationChannel, pos Position) {
 
 	if pos == Up {
 		go listenForUpf(comCh, p.node.upf)
+		go p.node.listenForNodeReport(comCh)
+		go p.node.listenForSesReport(comCh)
 	}
 
 	//var err error
@@ -212,7 +226,15 @@ func (p *PFCPIface) Run(comch CommunicationChannel, pos Position) {
 		go p.node.listenForSesModReq(comch)
 		go p.node.listenForSesDelReq(comch)
 		go p.node.listenForResetSes(comch)
-		if p.node.upf.AutoScaleIn || p.node.upf.AutoScaleOut {
+		go p.node.listenForSMFPath(comch)
+		go p.node.refreshUPFAddrs(comch)
+		if p.node.upf.staticPool != nil {
+			go p.node.runStaticPool(comch)
+		}
+		if p.node.upf.discovery != nil {
+			go p.node.runDiscovery(comch)
+		}
+		if ((p.node.upf.AutoScaleIn || p.node.upf.AutoScaleOut) && p.node.upf.orchestrator != nil) || p.node.upf.autoscaler.external {
 			go p.node.reconciliation(comch)
 		}
 		http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
@@ -224,6 +246,38 @@ func (p *PFCPIface) Run(comch CommunicationChannel, pos Position) {
 		http.HandleFunc("/del-upf", func(w http.ResponseWriter, r *http.Request) {
 			upfDelHandler(w, r, p.node, comch, pos)
 		})
+		http.HandleFunc("/smf-paths", func(w http.ResponseWriter, r *http.Request) {
+			smfPathsHandler(w, r, p.node)
+		})
+		http.HandleFunc("/shadow", func(w http.ResponseWriter, r *http.Request) {
+			shadowHandler(w, r, p.node)
+		})
+		http.HandleFunc("/canary", func(w http.ResponseWriter, r *http.Request) {
+			canaryHandler(w, r, p.node, comch)
+		})
+		http.HandleFunc("/autoscaler", func(w http.ResponseWriter, r *http.Request) {
+			autoscalerHandler(w, r, p.node)
+		})
+		http.HandleFunc("/autoscaler/decisions", func(w http.ResponseWriter, r *http.Request) {
+			decisionsHandler(w, r, p.node)
+		})
+		http.HandleFunc("/autoscaler/schedules", func(w http.ResponseWriter, r *http.Request) {
+			schedulesHandler(w, r, p.node)
+		})
+		http.HandleFunc("/drains", func(w http.ResponseWriter, r *http.Request) {
+			drainsHandler(w, r, p.node)
+		})
+		http.HandleFunc("/pre-stop", func(w http.ResponseWriter, r *http.Request) {
+			preStopHandler(w, r, p.node, comch)
+		})
+		http.HandleFunc("/scaling/signals", func(w http.ResponseWriter, r *http.Request) {
+			scalingSignalsHandler(w, r, p.node)
+		})
+		if h, err := newScalingMetricsHandler(p.node.upf.autoscaler); err != nil {
+			log.Errorln("Unable to export the scaling signals:", err)
+		} else {
+			http.Handle("/scaling/metrics", h)
+		}
 		server := http.Server{Addr: ":8081"}
 		go func() {
 			//fmt.Println("parham log : http server is serving")
@@ -285,19 +339,24 @@ func (p *PFCPIface) Stop() {
 	p.node.Done()
 }
 
-// GetLocalIP returns ip of first non loopback interface in string
+// GetLocalIP returns ip of first non loopback interface in string, preferring
+// IPv4 and falling back to a global IPv6 address on IPv6-only hosts.
 func GetLocalIP() string {
 	addrs, err := net.InterfaceAddrs()
 	if err != nil {
 		return ""
 	}
+	var ipv6 string
 	for _, address := range addrs {
 		// check the address type and if it is not a loopback the display it
 		if ipnet, ok := address.(*net.IPNet); ok && !ipnet.IP.IsLoopback() {
 			if ipnet.IP.To4() != nil {
 				return ipnet.IP.String()
 			}
+			if ipv6 == "" && ipnet.IP.IsGlobalUnicast() {
+				ipv6 = ipnet.IP.String()
+			}
 		}
 	}
-	return ""
+	return ipv6
 }
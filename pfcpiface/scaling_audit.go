@@ -0,0 +1,126 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright 2022-present Open Networking Foundation
+
+package pfcpiface
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// signalReading is the value of a scaling signal in a cycle, and its targets.
+type signalReading struct {
+	Name          string  `json:"name"`
+	Value         float64 `json:"value"`
+	ScaleOutAbove float64 `json:"scale_out_above"`
+	ScaleInBelow  float64 `json:"scale_in_below"`
+	Error         string  `json:"error,omitempty"` // why the value couldn't be read
+}
+
+// scalingRecord is a cycle of the autoscaler that called for a scaling: what it
+// decided, from which signals, and why.
+type scalingRecord struct {
+	At          time.Time        `json:"at"`
+	Recommended string           `json:"recommended"` // by the signals, forecast and bounds
+	Decision    string           `json:"decision"`    // carried out, "none" if held back
+	Reason      string           `json:"reason"`
+	Held        string           `json:"held,omitempty"` // why the decision is none
+	UPFs        int              `json:"upfs"`
+	MinUPFs     int              `json:"min_upfs"`
+	MaxUPFs     int              `json:"max_upfs"`
+	UPF         string           `json:"upf,omitempty"` // created, or drained and deleted
+	Signals     []signalReading  `json:"signals"`
+	Forecast    *sessionForecast `json:"forecast,omitempty"`
+	DryRun      bool             `json:"dry_run"` // the decision was recorded only
+	Error       string           `json:"error,omitempty"`
+}
+
+// log writes the record to the log as structured fields.
+func (r scalingRecord) log() {
+	fields := log.Fields{
+		"recommended": r.Recommended,
+		"decision":    r.Decision,
+		"reason":      r.Reason,
+		"held":        r.Held,
+		"upfs":        r.UPFs,
+		"min_upfs":    r.MinUPFs,
+		"max_upfs":    r.MaxUPFs,
+		"dry_run":     r.DryRun,
+	}
+
+	if r.UPF != "" {
+		fields["upf"] = r.UPF
+	}
+
+	for _, s := range r.Signals {
+		if s.Error != "" {
+			fields["signal."+s.Name] = s.Error
+		} else {
+			fields["signal."+s.Name] = s.Value
+		}
+	}
+
+	if r.Forecast != nil && r.Forecast.Ready {
+		fields["forecast"] = r.Forecast.Forecast
+	}
+
+	entry := log.WithFields(fields)
+
+	switch {
+	case r.Error != "":
+		entry.WithField("error", r.Error).Errorln("Autoscaler decision failed")
+	case r.Decision != scaleNone.String():
+		entry.Infoln("Autoscaler decision")
+	default:
+		entry.Debugln("Autoscaler decision held back")
+	}
+}
+
+// scalingAudit keeps the last records of the autoscaler in a ring buffer.
+type scalingAudit struct {
+	mu      sync.Mutex
+	records []scalingRecord
+	next    int // where the next record goes
+	full    bool
+}
+
+func newScalingAudit(size int) *scalingAudit {
+	return &scalingAudit{records: make([]scalingRecord, size)}
+}
+
+// add logs r and keeps it, in place of the oldest record once full.
+func (s *scalingAudit) add(r scalingRecord) {
+	r.log()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.records) == 0 {
+		return
+	}
+
+	s.records[s.next] = r
+	s.next = (s.next + 1) % len(s.records)
+	s.full = s.full || s.next == 0
+}
+
+// list returns the last limit records, oldest first, all of them if limit <= 0.
+func (s *scalingAudit) list(limit int) []scalingRecord {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var records []scalingRecord
+	if s.full {
+		records = append(records, s.records[s.next:]...)
+	}
+
+	records = append(records, s.records[:s.next]...)
+
+	if limit > 0 && len(records) > limit {
+		records = records[len(records)-limit:]
+	}
+
+	return records
+}
@@ -0,0 +1,105 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright 2022-present Open Networking Foundation
+
+package pfcpiface
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestScalingAuditRing(t *testing.T) {
+	s := newScalingAudit(3)
+	require.Empty(t, s.list(0))
+
+	for i := 0; i < 5; i++ {
+		s.add(scalingRecord{UPFs: i, Decision: scaleNone.String()})
+	}
+
+	upfs := func(records []scalingRecord) []int {
+		var n []int
+		for _, r := range records {
+			n = append(n, r.UPFs)
+		}
+
+		return n
+	}
+
+	require.Equal(t, []int{2, 3, 4}, upfs(s.list(0)), "oldest first")
+	require.Equal(t, []int{3, 4}, upfs(s.list(2)))
+}
+
+func TestAutoscalerDryRun(t *testing.T) {
+	now := time.Unix(0, 0)
+	a := newTestAutoscaler(&now, ScalingSignalInfo{Name: signalSessions, ScaleOutAbove: 100, ScaleInBelow: 20})
+	a.dryRun = true
+	pool := &fakeScalingPool{upfs: 2, values: map[string]float64{signalSessions: 150}, inAllowed: true}
+
+	require.Equal(t, scaleNone, a.step(pool))
+
+	now = now.Add(20 * time.Second)
+	require.Equal(t, scaleOut, a.step(pool))
+	require.Equal(t, 2, pool.upfs, "left as is")
+
+	for i := 0; i < 2; i++ {
+		now = now.Add(20 * time.Second)
+		require.Equal(t, scaleNone, a.step(pool), "the window, then the cooldown apply to dry runs too")
+	}
+
+	a.setDryRun(false)
+
+	now = now.Add(30 * time.Second)
+	require.Equal(t, scaleOut, a.step(pool))
+	require.Equal(t, 3, pool.upfs)
+
+	records := a.audit.list(0)
+	require.Len(t, records, 5)
+
+	require.Equal(t, "none", records[0].Decision)
+	require.Equal(t, "scale-out", records[0].Recommended)
+	require.Equal(t, "sessions 150 above 100", records[0].Reason)
+	require.Equal(t, "within the scale-out window", records[0].Held)
+	require.Equal(t, []signalReading{{Name: signalSessions, Value: 150, ScaleOutAbove: 100, ScaleInBelow: 20}}, records[0].Signals)
+
+	require.Equal(t, "scale-out", records[1].Decision)
+	require.Equal(t, "upf103", records[1].UPF, "the UPF it would add")
+	require.True(t, records[1].DryRun)
+	require.Equal(t, time.Unix(20, 0), records[1].At)
+
+	require.Equal(t, "within the scale-out window", records[2].Held)
+	require.Equal(t, "within the scale-out cooldown", records[3].Held)
+
+	require.Equal(t, "upf103", records[4].UPF)
+	require.False(t, records[4].DryRun)
+}
+
+func TestDecisionsHandler(t *testing.T) {
+	now := time.Unix(0, 0)
+	a := newTestAutoscaler(&now, ScalingSignalInfo{Name: signalSessions, ScaleOutAbove: 100, ScaleInBelow: 20})
+	node := &PFCPNode{upf: &Upf{autoscaler: a}}
+
+	a.step(&fakeScalingPool{upfs: 1, values: map[string]float64{signalSessions: 50}, inAllowed: true})
+
+	rr := httptest.NewRecorder()
+	decisionsHandler(rr, httptest.NewRequest(http.MethodGet, "/autoscaler/decisions?limit=1", nil), node)
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.Contains(t, rr.Body.String(), `"reason":"1 UPFs below min_upfs 2"`)
+
+	rr = httptest.NewRecorder()
+	decisionsHandler(rr, httptest.NewRequest(http.MethodGet, "/autoscaler/decisions?limit=all", nil), node)
+	require.Equal(t, http.StatusBadRequest, rr.Code)
+
+	rr = httptest.NewRecorder()
+	autoscalerHandler(rr, httptest.NewRequest(http.MethodPut, "/autoscaler", strings.NewReader(`{"dry_run": true}`)), node)
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.Contains(t, rr.Body.String(), `"dry_run":true`)
+
+	rr = httptest.NewRecorder()
+	autoscalerHandler(rr, httptest.NewRequest(http.MethodPut, "/autoscaler", strings.NewReader(`{}`)), node)
+	require.Equal(t, http.StatusBadRequest, rr.Code)
+}
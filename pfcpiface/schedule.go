@@ -0,0 +1,205 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright 2022-present Open Networking Foundation
+
+package pfcpiface
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// scalingProfile is what the autoscaler follows: the bounds of the pool and
+// the sessions a UPF should serve.
+type scalingProfile struct {
+	Schedule    string `json:"schedule"` // active, empty for the configured defaults
+	MinUPFs     int    `json:"min_upfs"`
+	MaxUPFs     int    `json:"max_upfs"`
+	MaxSessions uint32 `json:"max_sessions_threshold"`
+}
+
+// scalingSchedule is a schedule, active from start to end minutes past
+// midnight on its days, and past midnight on the next day if end is before
+// start.
+type scalingSchedule struct {
+	info       ScalingScheduleInfo
+	days       map[time.Weekday]bool // every day if empty
+	start, end int
+}
+
+// parseClock returns a time of day, e.g. "07:30", in minutes past midnight.
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, ErrInvalidArgumentWithReason("time of day", s, "HH:MM")
+	}
+
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func parseScalingSchedule(info ScalingScheduleInfo) (scalingSchedule, error) {
+	s := scalingSchedule{info: info, days: make(map[time.Weekday]bool)}
+
+	if info.Name == "" {
+		return s, ErrInvalidArgumentWithReason("scaling schedule", info, "no name")
+	}
+
+	for _, day := range info.Days {
+		d, ok := weekdays[strings.ToLower(day)]
+		if !ok {
+			return s, ErrInvalidArgumentWithReason("scaling schedule "+info.Name, day, "day of the week, e.g. mon")
+		}
+
+		s.days[d] = true
+	}
+
+	var err error
+
+	if s.start, err = parseClock(info.Start); err != nil {
+		return s, err
+	}
+
+	if s.end, err = parseClock(info.End); err != nil {
+		return s, err
+	}
+
+	if info.MinUPFs != 0 && info.MaxUPFs != 0 && info.MinUPFs > info.MaxUPFs {
+		return s, ErrInvalidArgumentWithReason("scaling schedule "+info.Name, info.MinUPFs, "min_upfs above max_upfs")
+	}
+
+	return s, nil
+}
+
+func (s scalingSchedule) onDay(d time.Weekday) bool {
+	return len(s.days) == 0 || s.days[d]
+}
+
+// active reports whether the schedule applies at t.
+func (s scalingSchedule) active(t time.Time) bool {
+	m := t.Hour()*60 + t.Minute()
+
+	if s.start < s.end {
+		return s.onDay(t.Weekday()) && m >= s.start && m < s.end
+	}
+
+	// Spans midnight
+	return (s.onDay(t.Weekday()) && m >= s.start) || (s.onDay(t.AddDate(0, 0, -1).Weekday()) && m < s.end)
+}
+
+// scalingScheduler returns the profile of the first schedule active, over the
+// configured defaults.
+type scalingScheduler struct {
+	mu        sync.Mutex
+	defaults  scalingProfile
+	loc       *time.Location
+	schedules []scalingSchedule
+}
+
+// newScalingScheduler returns the scheduler of conf. On error, it follows the
+// defaults from the valid parts of conf.
+func newScalingScheduler(conf *Conf) (*scalingScheduler, error) {
+	s := &scalingScheduler{
+		defaults: scalingProfile{
+			MinUPFs:     int(conf.MinUPFs),
+			MaxUPFs:     int(conf.MaxUPFs),
+			MaxSessions: conf.MaxSessionsThreshold,
+		},
+		loc: time.Local,
+	}
+
+	if conf.Autoscaler.Timezone != "" {
+		loc, err := time.LoadLocation(conf.Autoscaler.Timezone)
+		if err != nil {
+			return s, err
+		}
+
+		s.loc = loc
+	}
+
+	return s, s.set(conf.Autoscaler.Schedules)
+}
+
+// set replaces the schedules.
+func (s *scalingScheduler) set(infos []ScalingScheduleInfo) error {
+	schedules := make([]scalingSchedule, 0, len(infos))
+
+	for _, info := range infos {
+		sched, err := parseScalingSchedule(info)
+		if err != nil {
+			return err
+		}
+
+		p := s.merge(sched.info)
+		if p.MinUPFs > p.MaxUPFs {
+			return ErrInvalidArgumentWithReason("scaling schedule "+info.Name, p, "min_upfs above max_upfs")
+		}
+
+		schedules = append(schedules, sched)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.schedules = schedules
+
+	return nil
+}
+
+// list returns the schedules.
+func (s *scalingScheduler) list() []ScalingScheduleInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	infos := make([]ScalingScheduleInfo, 0, len(s.schedules))
+	for _, sched := range s.schedules {
+		infos = append(infos, sched.info)
+	}
+
+	return infos
+}
+
+// merge returns the profile of a schedule, the defaults for what it leaves unset.
+func (s *scalingScheduler) merge(info ScalingScheduleInfo) scalingProfile {
+	p := s.defaults
+	p.Schedule = info.Name
+
+	if info.MinUPFs != 0 {
+		p.MinUPFs = int(info.MinUPFs)
+	}
+
+	if info.MaxUPFs != 0 {
+		p.MaxUPFs = int(info.MaxUPFs)
+	}
+
+	if info.MaxSessionsThreshold != 0 {
+		p.MaxSessions = info.MaxSessionsThreshold
+	}
+
+	return p
+}
+
+// profile returns the profile at now.
+func (s *scalingScheduler) profile(now time.Time) scalingProfile {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now = now.In(s.loc)
+
+	for _, sched := range s.schedules {
+		if sched.active(now) {
+			return s.merge(sched.info)
+		}
+	}
+
+	return s.defaults
+}
@@ -0,0 +1,134 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright 2022-present Open Networking Foundation
+
+package pfcpiface
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestScalingScheduleActive(t *testing.T) {
+	evening, err := parseScalingSchedule(ScalingScheduleInfo{Name: "evening", Days: []string{"Fri", "sat"}, Start: "18:00", End: "02:00"})
+	require.NoError(t, err)
+
+	for at, active := range map[string]bool{
+		"2026-10-16 17:59": false, // Friday
+		"2026-10-16 18:00": true,
+		"2026-10-17 01:59": true, // Saturday, after Friday evening
+		"2026-10-17 02:00": false,
+		"2026-10-18 01:00": true, // Sunday, after Saturday evening
+		"2026-10-18 18:00": false,
+		"2026-10-19 01:00": false,
+	} {
+		tm, err := time.Parse("2006-01-02 15:04", at)
+		require.NoError(t, err)
+		require.Equal(t, active, evening.active(tm), at)
+	}
+
+	_, err = parseScalingSchedule(ScalingScheduleInfo{Name: "x", Days: []string{"someday"}, Start: "00:00", End: "01:00"})
+	require.Error(t, err)
+
+	_, err = parseScalingSchedule(ScalingScheduleInfo{Name: "x", Start: "25:00", End: "01:00"})
+	require.Error(t, err)
+}
+
+func TestScalingSchedulerProfile(t *testing.T) {
+	conf := &Conf{
+		MinUPFs:              2,
+		MaxUPFs:              10,
+		MaxSessionsThreshold: 1000,
+		Autoscaler: AutoscalerInfo{
+			Timezone: "UTC",
+			Schedules: []ScalingScheduleInfo{
+				{Name: "peak", Start: "08:00", End: "20:00", MinUPFs: 5, MaxSessionsThreshold: 800},
+				{Name: "day", Start: "06:00", End: "22:00", MinUPFs: 3},
+			},
+		},
+	}
+
+	s, err := newScalingScheduler(conf)
+	require.NoError(t, err)
+
+	at := func(clock string) time.Time {
+		tm, err := time.Parse("15:04", clock)
+		require.NoError(t, err)
+
+		return tm
+	}
+
+	require.Equal(t, scalingProfile{Schedule: "peak", MinUPFs: 5, MaxUPFs: 10, MaxSessions: 800}, s.profile(at("12:00")), "the first active")
+	require.Equal(t, scalingProfile{Schedule: "day", MinUPFs: 3, MaxUPFs: 10, MaxSessions: 1000}, s.profile(at("21:00")))
+	require.Equal(t, scalingProfile{MinUPFs: 2, MaxUPFs: 10, MaxSessions: 1000}, s.profile(at("23:00")))
+
+	require.Error(t, s.set([]ScalingScheduleInfo{{Name: "night", Start: "22:00", End: "06:00", MinUPFs: 12}}), "above the default max_upfs")
+	require.Len(t, s.list(), 2, "left unchanged")
+
+	conf.Autoscaler.Timezone = "Nowhere/Else"
+	_, err = newScalingScheduler(conf)
+	require.Error(t, err)
+}
+
+func TestAutoscalerFollowsSchedule(t *testing.T) {
+	now := time.Date(2026, 10, 19, 7, 0, 0, 0, time.Local)
+	a := newTestAutoscaler(&now, ScalingSignalInfo{Name: signalSessions, ScaleOutAbove: 100, ScaleInBelow: 20})
+	a.outWindow = 0
+
+	var followed []scalingProfile
+
+	a.onProfile = func(p scalingProfile) { followed = append(followed, p) }
+
+	require.NoError(t, a.schedules.set([]ScalingScheduleInfo{{Name: "peak", Start: "08:00", End: "20:00", MinUPFs: 3, MaxSessionsThreshold: 50}}))
+
+	pool := &fakeScalingPool{upfs: 2, values: map[string]float64{signalSessions: 40}, inAllowed: true}
+	require.Equal(t, scaleNone, a.step(pool))
+
+	now = now.Add(time.Hour)
+	require.Equal(t, scaleOut, a.step(pool), "below the schedule's min_upfs")
+	require.Equal(t, []scalingSignal{{name: signalSessions, scaleOutAbove: 50, scaleInBelow: 10}}, a.signals)
+
+	now = now.Add(time.Hour)
+	pool.values[signalSessions] = 60
+	require.Equal(t, scaleOut, a.step(pool), "live load, over the schedule's max sessions")
+	require.Equal(t, 4, pool.upfs)
+
+	now = now.Add(12 * time.Hour)
+	require.Equal(t, scaleNone, a.step(pool))
+	require.Equal(t, []scalingSignal{{name: signalSessions, scaleOutAbove: 100, scaleInBelow: 20}}, a.signals)
+	require.Equal(t, []string{"peak", ""}, []string{followed[len(followed)-2].Schedule, followed[len(followed)-1].Schedule})
+	require.Equal(t, scalingProfile{MinUPFs: 2, MaxUPFs: 4}, a.status().Profile)
+}
+
+func TestProfileKeepsTolerance(t *testing.T) {
+	now := time.Date(2026, 10, 19, 7, 0, 0, 0, time.Local)
+	a := newTestAutoscaler(&now, ScalingSignalInfo{Name: signalSessions, ScaleOutAbove: 150, ScaleInBelow: 20})
+	a.schedules.defaults.MaxSessions = 100
+
+	a.followProfile(scalingProfile{Schedule: "peak", MinUPFs: 2, MaxUPFs: 4, MaxSessions: 50})
+	require.Equal(t, []scalingSignal{{name: signalSessions, scaleOutAbove: 75, scaleInBelow: 10}}, a.signals, "50% tolerance kept")
+}
+
+func TestSchedulesHandler(t *testing.T) {
+	now := time.Unix(0, 0)
+	node := &PFCPNode{upf: &Upf{autoscaler: newTestAutoscaler(&now)}}
+
+	put := func(body string) int {
+		rr := httptest.NewRecorder()
+		schedulesHandler(rr, httptest.NewRequest(http.MethodPut, "/autoscaler/schedules", strings.NewReader(body)), node)
+
+		return rr.Code
+	}
+
+	require.Equal(t, http.StatusCreated, put(`[{"name": "weekend", "days": ["sat", "sun"], "start": "00:00", "end": "00:00", "max_upfs": 3}]`))
+	require.Equal(t, http.StatusBadRequest, put(`[{"name": "weekend", "start": "noon", "end": "00:00"}]`))
+
+	rr := httptest.NewRecorder()
+	schedulesHandler(rr, httptest.NewRequest(http.MethodGet, "/autoscaler/schedules", nil), node)
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.Contains(t, rr.Body.String(), `"name":"weekend"`)
+}
@@ -0,0 +1,360 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright 2022-present Open Networking Foundation
+
+package pfcpiface
+
+import (
+	"reflect"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/wmnsk/go-pfcp/ie"
+	"github.com/wmnsk/go-pfcp/message"
+)
+
+// shadowAnswerTimeout bounds how long an answer waits for the other side's to
+// be compared with, as long as the SMF waits for Down.
+const shadowAnswerTimeout = 10 * time.Second
+
+// shadowAnswer is what a UPF answered to a session request, as far as it is
+// expected to be the same on the primary and the shadow: its cause and the
+// IEs it carries, without their values (F-TEIDs, usage, ...).
+type shadowAnswer struct {
+	cause uint8
+	ies   map[uint16]int // number of each IE type, those within grouped IEs included
+	at    time.Time
+}
+
+type shadowKey struct {
+	seid    uint64
+	msgType uint8
+}
+
+// ShadowStats is the outcome of the comparisons returned by the /shadow API.
+type ShadowStats struct {
+	NodeID          string `json:"node_id"`
+	Associated      bool   `json:"associated"`
+	Compared        uint64 `json:"compared"`
+	CauseMismatches uint64 `json:"cause_mismatches"`
+	IEMismatches    uint64 `json:"ie_mismatches"`
+	Unanswered      uint64 `json:"unanswered"` // answers the other side never matched
+}
+
+// shadowMirror duplicates the SMF's session requests to a shadow UPF, e.g. a
+// new implementation, and compares its answers with the primary's. The shadow
+// isn't part of the pool: it gets no session of its own and its answers never
+// reach the SMF.
+type shadowMirror struct {
+	mu      sync.Mutex
+	nodeID  string
+	pConn   *PFCPConn
+	primary map[shadowKey][]*shadowAnswer
+	shadow  map[shadowKey][]*shadowAnswer
+	stats   ShadowStats
+	// sessions established on the shadow since it associated, the only ones
+	// whose modifications and deletions are mirrored
+	sessions map[uint64]bool
+	// answers of the primary to the requests mirrored, not recorded yet
+	awaited map[shadowKey]int
+}
+
+func newShadowMirror(nodeID string) *shadowMirror {
+	return &shadowMirror{
+		nodeID:   canonicalNodeID(nodeID),
+		primary:  make(map[shadowKey][]*shadowAnswer),
+		shadow:   make(map[shadowKey][]*shadowAnswer),
+		sessions: make(map[uint64]bool),
+		awaited:  make(map[shadowKey]int),
+	}
+}
+
+// isShadow reports whether the UPF registering with pfcpInfo is the shadow,
+// and makes it the shadow if it registers as one.
+func (s *shadowMirror) isShadow(pfcpInfo *PfcpInfo) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	nodeID := canonicalNodeID(pfcpInfo.Upf.NodeID)
+
+	if pfcpInfo.Shadow {
+		s.nodeID = nodeID
+	}
+
+	return s.nodeID != "" && s.nodeID == nodeID
+}
+
+// associated starts mirroring to the shadow UPF of pConn.
+func (s *shadowMirror) associated(pConn *PFCPConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.pConn = pConn
+	s.sessions = make(map[uint64]bool)
+	s.awaited = make(map[shadowKey]int)
+	log.Infoln("Mirroring session requests to shadow UPF", s.nodeID)
+}
+
+// lost stops mirroring if pConn is the shadow's.
+func (s *shadowMirror) lost(pConn *PFCPConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.pConn == pConn {
+		s.pConn = nil
+	}
+}
+
+// conn returns the connection to the shadow UPF, nil if there is none.
+func (s *shadowMirror) conn() *PFCPConn {
+	if s == nil {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.pConn
+}
+
+func (s *shadowMirror) snapshot() ShadowStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stats := s.stats
+	stats.NodeID = s.nodeID
+	stats.Associated = s.pConn != nil
+
+	return stats
+}
+
+// mirror reports whether a request of type msgType for seid is to be mirrored:
+// any establishment, and the modifications and deletions of the sessions
+// established on the shadow. The primary's answer to it is then awaited.
+func (s *shadowMirror) mirror(seid uint64, msgType uint8) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var resType uint8
+
+	switch msgType {
+	case message.MsgTypeSessionEstablishmentRequest:
+		s.sessions[seid] = true
+		resType = message.MsgTypeSessionEstablishmentResponse
+	case message.MsgTypeSessionModificationRequest:
+		if !s.sessions[seid] {
+			return false
+		}
+
+		resType = message.MsgTypeSessionModificationResponse
+	case message.MsgTypeSessionDeletionRequest:
+		if !s.sessions[seid] {
+			return false
+		}
+
+		delete(s.sessions, seid)
+		resType = message.MsgTypeSessionDeletionResponse
+	default:
+		return false
+	}
+
+	s.awaited[shadowKey{seid: seid, msgType: resType}]++
+
+	return true
+}
+
+// awaits reports whether the primary's answer to a request was awaited, the
+// request having been mirrored, and stops awaiting it.
+func (s *shadowMirror) awaits(seid uint64, msgType uint8) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := shadowKey{seid: seid, msgType: msgType}
+
+	switch s.awaited[key] {
+	case 0:
+		return false
+	case 1:
+		delete(s.awaited, key)
+	default:
+		s.awaited[key]--
+	}
+
+	return true
+}
+
+// countIEs adds the types of ies, and of the IEs they group, to counts.
+func countIEs(counts map[uint16]int, ies ...*ie.IE) {
+	for _, i := range ies {
+		if i == nil {
+			continue
+		}
+
+		counts[i.Type]++
+
+		if i.IsGrouped() {
+			if children, err := ie.ParseMultiIEs(i.Payload); err == nil {
+				countIEs(counts, children...)
+			}
+		}
+	}
+}
+
+// newShadowAnswer summarizes a session establishment, modification or deletion response.
+func newShadowAnswer(msg message.Message) *shadowAnswer {
+	var causeIE *ie.IE
+
+	a := &shadowAnswer{ies: make(map[uint16]int), at: time.Now()}
+
+	switch res := msg.(type) {
+	case *message.SessionEstablishmentResponse:
+		causeIE = res.Cause
+		countIEs(a.ies, res.OffendingIE, res.FailedRuleID)
+		countIEs(a.ies, res.CreatedPDR...)
+		countIEs(a.ies, res.CreatedTrafficEndpoint...)
+	case *message.SessionModificationResponse:
+		causeIE = res.Cause
+		countIEs(a.ies, res.OffendingIE, res.FailedRuleID)
+		countIEs(a.ies, res.CreatedPDR...)
+		countIEs(a.ies, res.UsageReport...)
+		countIEs(a.ies, res.UpdatedPDR...)
+		countIEs(a.ies, res.CreatedUpdatedTrafficEndpoint...)
+	case *message.SessionDeletionResponse:
+		causeIE = res.Cause
+		countIEs(a.ies, res.OffendingIE)
+		countIEs(a.ies, res.UsageReport...)
+	}
+
+	if causeIE != nil {
+		a.cause, _ = causeIE.Cause()
+	}
+
+	return a
+}
+
+// expire drops the answers the other side didn't match in time. Must be called with the lock held.
+func (s *shadowMirror) expire(now time.Time) {
+	for _, answers := range []map[shadowKey][]*shadowAnswer{s.primary, s.shadow} {
+		for key, pending := range answers {
+			for len(pending) > 0 && now.Sub(pending[0].at) > shadowAnswerTimeout {
+				pending = pending[1:]
+				s.stats.Unanswered++
+			}
+
+			if len(pending) == 0 {
+				delete(answers, key)
+			} else {
+				answers[key] = pending
+			}
+		}
+	}
+}
+
+// record keeps the answer of the primary or of the shadow to a session request
+// and compares it with the other side's, in the order of the requests.
+func (s *shadowMirror) record(fromShadow bool, seid uint64, msg message.Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	answer := newShadowAnswer(msg)
+	key := shadowKey{seid: seid, msgType: msg.MessageType()}
+
+	s.expire(answer.at)
+
+	own, other := s.primary, s.shadow
+	if fromShadow {
+		own, other = s.shadow, s.primary
+
+		// Not established on the shadow, nothing to mirror
+		if key.msgType == message.MsgTypeSessionEstablishmentResponse && answer.cause != ie.CauseRequestAccepted {
+			delete(s.sessions, seid)
+		}
+	}
+
+	pending := other[key]
+	if len(pending) == 0 {
+		own[key] = append(own[key], answer)
+		return
+	}
+
+	peer := pending[0]
+	if len(pending) == 1 {
+		delete(other, key)
+	} else {
+		other[key] = pending[1:]
+	}
+
+	primary, shadow := peer, answer
+	if !fromShadow {
+		primary, shadow = answer, peer
+	}
+
+	s.stats.Compared++
+
+	if primary.cause != shadow.cause {
+		s.stats.CauseMismatches++
+		log.Warnln("Shadow UPF", s.nodeID, "answered", msg.MessageTypeName(), "of session", seid,
+			"with cause", shadow.cause, "instead of", primary.cause)
+
+		return
+	}
+
+	if !reflect.DeepEqual(primary.ies, shadow.ies) {
+		s.stats.IEMismatches++
+		log.Warnln("Shadow UPF", s.nodeID, "answered", msg.MessageTypeName(), "of session", seid,
+			"with IEs", shadow.ies, "instead of", primary.ies)
+	}
+}
+
+// observe compares a session response received from pConn with the other
+// side's and reports whether it came from the shadow, and must go no further.
+func (node *PFCPNode) observe(pConn *PFCPConn, reforward bool, seid uint64, msg message.Message) bool {
+	shadow := node.upf.shadow.conn()
+	if shadow == nil {
+		return false
+	}
+
+	if pConn == shadow {
+		if reforward {
+			node.upf.shadow.record(true, seid, msg)
+		}
+
+		return true
+	}
+
+	// Only the SMF's requests are mirrored, not those of the LB itself
+	if !reforward && node.upf.shadow.awaits(seid, msg.MessageType()) {
+		node.upf.shadow.record(false, seid, msg)
+	}
+
+	return false
+}
+
+// mirrorToShadow sends a copy of an SMF session request to the shadow UPF,
+// unless it is about a session the shadow doesn't have. It is called from the
+// session listeners before the request goes to the primary, so the copy
+// bypasses comCh and the primary's answer is awaited when it arrives.
+func (node *PFCPNode) mirrorToShadow(seid uint64, msg message.Message, comCh CommunicationChannel) {
+	pConn := node.upf.shadow.conn()
+	if pConn == nil || !node.upf.shadow.mirror(seid, msg.MessageType()) {
+		return
+	}
+
+	switch req := msg.(type) {
+	case *message.SessionEstablishmentRequest:
+		mirrored := *req
+		header := *req.Header
+		mirrored.Header = &header
+		forwardForLB(pConn, seid, &mirrored, comCh)
+	case *message.SessionModificationRequest:
+		mirrored := *req
+		header := *req.Header
+		mirrored.Header = &header
+		forwardForLB(pConn, seid, &mirrored, comCh)
+	case *message.SessionDeletionRequest:
+		mirrored := *req
+		header := *req.Header
+		mirrored.Header = &header
+		forwardForLB(pConn, seid, &mirrored, comCh)
+	}
+}
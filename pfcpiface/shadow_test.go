@@ -0,0 +1,139 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright 2022-present Open Networking Foundation
+
+package pfcpiface
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/wmnsk/go-pfcp/ie"
+	"github.com/wmnsk/go-pfcp/message"
+)
+
+func newTestEstResponse(cause uint8, teid uint32, createdPDRs int) *message.SessionEstablishmentResponse {
+	res := message.NewSessionEstablishmentResponse(0, 0, 1, 1, 0, ie.NewCause(cause))
+
+	for i := 0; i < createdPDRs; i++ {
+		res.CreatedPDR = append(res.CreatedPDR, ie.NewCreatedPDR(ie.NewPDRID(uint16(i+1)),
+			ie.NewFTEID(fteidFlagV4, teid+uint32(i), net.ParseIP("10.0.0.1"), nil, 0)))
+	}
+
+	return res
+}
+
+func TestShadowMirrorCompare(t *testing.T) {
+	s := newShadowMirror("shadow")
+
+	// F-TEID values differ between UPFs, only the IEs present are compared
+	s.record(false, 1, newTestEstResponse(ie.CauseRequestAccepted, 100, 2))
+	s.record(true, 1, newTestEstResponse(ie.CauseRequestAccepted, 200, 2))
+
+	s.record(true, 2, newTestEstResponse(ie.CauseRequestRejected, 0, 0))
+	s.record(false, 2, newTestEstResponse(ie.CauseRequestAccepted, 100, 2))
+
+	s.record(false, 3, newTestEstResponse(ie.CauseRequestAccepted, 100, 2))
+	s.record(true, 3, newTestEstResponse(ie.CauseRequestAccepted, 200, 1))
+
+	// Answers to other messages of the session are not paired with it
+	s.record(false, 3, message.NewSessionDeletionResponse(0, 0, 3, 2, 0, ie.NewCause(ie.CauseRequestAccepted)))
+
+	require.Equal(t, ShadowStats{
+		NodeID:          "shadow",
+		Compared:        3,
+		CauseMismatches: 1,
+		IEMismatches:    1,
+	}, s.snapshot())
+
+	s.primary[shadowKey{seid: 3, msgType: message.MsgTypeSessionDeletionResponse}][0].at = time.Now().Add(-time.Minute)
+	s.record(true, 4, message.NewSessionDeletionResponse(0, 0, 4, 2, 0, ie.NewCause(ie.CauseRequestAccepted)))
+
+	require.Equal(t, uint64(1), s.snapshot().Unanswered)
+	require.Empty(t, s.primary)
+	require.Len(t, s.shadow, 1)
+}
+
+func TestShadowMirrorRegistration(t *testing.T) {
+	s := newShadowMirror("")
+	require.False(t, s.isShadow(&PfcpInfo{Upf: &Upf{NodeID: "upf1"}}))
+	require.True(t, s.isShadow(&PfcpInfo{Upf: &Upf{NodeID: "upf2"}, Shadow: true}))
+	require.True(t, s.isShadow(&PfcpInfo{Upf: &Upf{NodeID: "upf2"}}), "the shadow registering again")
+
+	shadow, primary := &PFCPConn{}, &PFCPConn{}
+	node := &PFCPNode{upf: &Upf{shadow: s}}
+	res := newTestEstResponse(ie.CauseRequestAccepted, 100, 1)
+
+	require.False(t, node.observe(shadow, true, 1, res), "nothing is compared before the shadow is associated")
+
+	s.associated(shadow)
+	require.True(t, s.snapshot().Associated)
+	require.True(t, s.mirror(1, message.MsgTypeSessionEstablishmentRequest))
+	require.True(t, node.observe(shadow, true, 1, res))
+	require.False(t, node.observe(primary, false, 1, res))
+	require.False(t, node.observe(primary, true, 2, res), "requests of the LB itself are not mirrored")
+	require.Equal(t, uint64(1), s.snapshot().Compared)
+
+	require.False(t, node.observe(primary, false, 3, res), "not mirrored")
+	require.Equal(t, uint64(1), s.snapshot().Compared)
+	require.Empty(t, s.primary, "not awaited")
+
+	s.lost(primary)
+	require.NotNil(t, s.conn())
+	s.lost(shadow)
+	require.Nil(t, s.conn())
+}
+
+func TestMirrorOnlyShadowSessions(t *testing.T) {
+	s := newShadowMirror("shadow")
+	s.associated(&PFCPConn{})
+
+	// Session 1 was established before the shadow associated
+	require.False(t, s.mirror(1, message.MsgTypeSessionModificationRequest))
+	require.False(t, s.mirror(1, message.MsgTypeSessionDeletionRequest))
+
+	require.True(t, s.mirror(2, message.MsgTypeSessionEstablishmentRequest))
+	require.True(t, s.mirror(2, message.MsgTypeSessionModificationRequest))
+	require.True(t, s.mirror(2, message.MsgTypeSessionDeletionRequest))
+	require.False(t, s.mirror(2, message.MsgTypeSessionModificationRequest), "deleted")
+
+	require.True(t, s.mirror(3, message.MsgTypeSessionEstablishmentRequest))
+	s.record(true, 3, newTestEstResponse(ie.CauseRequestRejected, 0, 0))
+	require.False(t, s.mirror(3, message.MsgTypeSessionModificationRequest), "the shadow rejected it")
+
+	require.True(t, s.awaits(2, message.MsgTypeSessionModificationResponse))
+	require.False(t, s.awaits(2, message.MsgTypeSessionModificationResponse), "awaited once")
+	require.False(t, s.awaits(1, message.MsgTypeSessionModificationResponse))
+}
+
+func TestMirrorToShadowBypassesComCh(t *testing.T) {
+	upf, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	defer upf.Close()
+
+	conn, err := net.DialUDP("udp", nil, upf.LocalAddr().(*net.UDPAddr))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	s := newShadowMirror("shadow")
+	s.associated(&PFCPConn{Conn: conn})
+	node := &PFCPNode{upf: &Upf{shadow: s}}
+
+	smreq := message.NewSessionModificationRequest(0, 0, 99, 5, 0)
+	s.mirror(7, message.MsgTypeSessionEstablishmentRequest) // established on the shadow
+
+	// Unbuffered with no reader, like a listener whose channel is full
+	node.mirrorToShadow(7, smreq, CommunicationChannel{SesModU2d: make(chan *SesModU2dMsg)})
+	require.Equal(t, uint64(99), smreq.Header.SEID, "the SMF's request is left as is")
+
+	buf := make([]byte, 1500)
+	require.NoError(t, upf.SetReadDeadline(time.Now().Add(time.Second)))
+	n, err := upf.Read(buf)
+	require.NoError(t, err)
+
+	msg, err := message.Parse(buf[:n])
+	require.NoError(t, err)
+	require.Equal(t, uint64(7), msg.SEID())
+	require.Equal(t, uint32(5), msg.Sequence())
+}
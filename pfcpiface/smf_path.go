@@ -0,0 +1,290 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright 2022-present Open Networking Foundation
+
+package pfcpiface
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/wmnsk/go-pfcp/ie"
+	"github.com/wmnsk/go-pfcp/message"
+)
+
+var errSMFRestarted = errors.New("SMF restarted")
+
+// SMFPathState is the state of the PFCP path towards an SMF.
+type SMFPathState int
+
+const (
+	// SMFPathUp : the SMF answers heartbeats.
+	SMFPathUp SMFPathState = iota
+	// SMFPathGrace : the SMF stopped answering, its sessions are kept until the grace period expires.
+	SMFPathGrace
+	// SMFPathDown : the grace period expired or the SMF restarted, its sessions were released.
+	SMFPathDown
+)
+
+func (s SMFPathState) String() string {
+	switch s {
+	case SMFPathUp:
+		return "up"
+	case SMFPathGrace:
+		return "grace"
+	case SMFPathDown:
+		return "down"
+	default:
+		return "unknown"
+	}
+}
+
+// SMFPathU2dMsg notifies Down of a change of the path towards an SMF.
+type SMFPathU2dMsg struct {
+	nodeID string
+	state  SMFPathState
+}
+
+// smfPath supervises the path towards a single SMF.
+type smfPath struct {
+	mu          sync.Mutex
+	state       SMFPathState
+	grace       *time.Timer
+	gracePeriod time.Duration
+	// onChange is called on every state change, onExpiry when the grace period expires.
+	onChange func(SMFPathState)
+	onExpiry func()
+}
+
+func newSMFPath(gracePeriod time.Duration, onChange func(SMFPathState), onExpiry func()) *smfPath {
+	return &smfPath{
+		state:       SMFPathUp,
+		gracePeriod: gracePeriod,
+		onChange:    onChange,
+		onExpiry:    onExpiry,
+	}
+}
+
+// lost starts the grace period of a path that was up.
+func (p *smfPath) lost() {
+	p.mu.Lock()
+	if p.state != SMFPathUp {
+		p.mu.Unlock()
+		return
+	}
+
+	p.state = SMFPathGrace
+	p.grace = time.AfterFunc(p.gracePeriod, p.expire)
+	p.mu.Unlock()
+
+	p.onChange(SMFPathGrace)
+}
+
+// alive brings a path in its grace period back up.
+func (p *smfPath) alive() {
+	p.mu.Lock()
+	if p.state != SMFPathGrace {
+		p.mu.Unlock()
+		return
+	}
+
+	p.grace.Stop()
+	p.state = SMFPathUp
+	p.mu.Unlock()
+
+	p.onChange(SMFPathUp)
+}
+
+func (p *smfPath) expire() {
+	p.mu.Lock()
+	if p.state != SMFPathGrace {
+		p.mu.Unlock()
+		return
+	}
+
+	p.state = SMFPathDown
+	p.mu.Unlock()
+
+	p.onChange(SMFPathDown)
+	p.onExpiry()
+}
+
+// stop marks the path down without running the expiry callback.
+func (p *smfPath) stop() {
+	p.mu.Lock()
+	if p.state == SMFPathDown {
+		p.mu.Unlock()
+		return
+	}
+
+	if p.grace != nil {
+		p.grace.Stop()
+	}
+
+	p.state = SMFPathDown
+	p.mu.Unlock()
+
+	p.onChange(SMFPathDown)
+}
+
+func (p *smfPath) getState() SMFPathState {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.state
+}
+
+// smfPathTable is the state of the path towards each SMF, keyed by SMF NodeID.
+type smfPathTable struct {
+	mu     sync.RWMutex
+	states map[string]SMFPathState
+}
+
+func newSMFPathTable() *smfPathTable {
+	return &smfPathTable{
+		states: make(map[string]SMFPathState),
+	}
+}
+
+func (t *smfPathTable) set(nodeID string, state SMFPathState) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if state == SMFPathDown {
+		delete(t.states, nodeID)
+		return
+	}
+
+	t.states[nodeID] = state
+}
+
+// inGrace reports whether the path towards any SMF is in its grace period.
+func (t *smfPathTable) inGrace() bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	for _, state := range t.states {
+		if state == SMFPathGrace {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (t *smfPathTable) snapshot() map[string]string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	states := make(map[string]string, len(t.states))
+	for nodeID, state := range t.states {
+		states[nodeID] = state.String()
+	}
+
+	return states
+}
+
+// superviseSMFPath starts heartbeats towards the SMF that just associated,
+// replacing the supervision of a previous association if any.
+func (pConn *PFCPConn) superviseSMFPath(comCh CommunicationChannel) {
+	if pConn.hbCtxCancel != nil {
+		pConn.hbCtxCancel()
+		pConn.hbCtxCancel = nil
+	}
+
+	if pConn.smfPath != nil {
+		pConn.smfPath.stop()
+	}
+
+	nodeID := pConn.nodeID.remote
+
+	path := newSMFPath(pConn.upf.smfGracePeriod,
+		func(state SMFPathState) {
+			log.Infoln("Path to SMF", nodeID, "is", state)
+			pConn.upf.smfPaths.set(nodeID, state)
+			comCh.SMFPathU2d <- &SMFPathU2dMsg{nodeID: nodeID, state: state}
+		},
+		func() {
+			log.Warnln("SMF", nodeID, "did not come back within", pConn.upf.smfGracePeriod, ", releasing its sessions")
+			pConn.Shutdown(comCh)
+		},
+	)
+	pConn.smfPath = path
+	pConn.upf.smfPaths.set(nodeID, SMFPathUp)
+	comCh.SMFPathU2d <- &SMFPathU2dMsg{nodeID: nodeID, state: SMFPathUp}
+
+	hbCtx, hbCancel := context.WithCancel(pConn.ctx)
+	pConn.hbCtxCancel = hbCancel
+
+	go pConn.sendSMFHeartBeats(hbCtx, path, comCh)
+}
+
+// sendSMFHeartBeats sends a Heartbeat Request every smfHBInterval, retransmitted
+// up to N1 times every T1. An unanswered heartbeat starts the grace period.
+func (pConn *PFCPConn) sendSMFHeartBeats(ctx context.Context, path *smfPath, comCh CommunicationChannel) {
+	ticker := time.NewTicker(pConn.upf.smfHBInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			reply, timeout := pConn.sendPFCPRequestMessageWithRetries(pConn.getHeartBeatRequest(),
+				pConn.upf.smfN1, pConn.upf.smfT1)
+			if timeout {
+				path.lost()
+				continue
+			}
+
+			hbres, ok := reply.(*message.HeartbeatResponse)
+			if !ok {
+				// connection shut down
+				return
+			}
+
+			if pConn.remoteRestarted(hbres.RecoveryTimeStamp) {
+				pConn.shutdownRestartedSMF(comCh)
+				return
+			}
+
+			path.alive()
+		}
+	}
+}
+
+// remoteRestarted records the peer's recovery timestamp and reports whether it
+// is newer than the known one, i.e. the peer restarted and lost its sessions.
+func (pConn *PFCPConn) remoteRestarted(recoveryTS *ie.IE) bool {
+	if recoveryTS == nil {
+		return false
+	}
+
+	ts, err := recoveryTS.RecoveryTimeStamp()
+	if err != nil {
+		return false
+	}
+
+	return pConn.ts.learnRemote(ts)
+}
+
+// shutdownRestartedSMF releases the sessions of an SMF that restarted, without grace period.
+func (pConn *PFCPConn) shutdownRestartedSMF(comCh CommunicationChannel) {
+	log.Warnln("SMF", pConn.nodeID.remote, "restarted, releasing its sessions")
+
+	if pConn.smfPath != nil {
+		pConn.smfPath.stop()
+	}
+
+	pConn.Shutdown(comCh)
+}
+
+// listenForSMFPath keeps Down's view of the SMF paths in sync with Up.
+func (node *PFCPNode) listenForSMFPath(comCh CommunicationChannel) {
+	for {
+		msg := <-comCh.SMFPathU2d
+		node.upf.smfPaths.set(msg.nodeID, msg.state)
+	}
+}
@@ -0,0 +1,81 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright 2022-present Open Networking Foundation
+
+package pfcpiface
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/wmnsk/go-pfcp/ie"
+)
+
+func TestSMFPathGracePeriod(t *testing.T) {
+	table := newSMFPathTable()
+	expired := make(chan struct{}, 1)
+
+	path := newSMFPath(50*time.Millisecond,
+		func(state SMFPathState) { table.set("smf1", state) },
+		func() { expired <- struct{}{} },
+	)
+	table.set("smf1", SMFPathUp)
+
+	path.lost()
+	require.Equal(t, SMFPathGrace, path.getState())
+	require.True(t, table.inGrace())
+
+	path.alive()
+	require.Equal(t, SMFPathUp, path.getState())
+	require.False(t, table.inGrace())
+
+	path.lost()
+	select {
+	case <-expired:
+	case <-time.After(time.Second):
+		t.Fatal("grace period did not expire")
+	}
+
+	require.Equal(t, SMFPathDown, path.getState())
+	require.Empty(t, table.snapshot())
+
+	path.alive()
+	require.Equal(t, SMFPathDown, path.getState(), "an expired path doesn't come back")
+}
+
+func TestSMFPathStopCancelsExpiry(t *testing.T) {
+	expired := make(chan struct{}, 1)
+	path := newSMFPath(20*time.Millisecond, func(SMFPathState) {}, func() { expired <- struct{}{} })
+
+	path.lost()
+	path.stop()
+
+	select {
+	case <-expired:
+		t.Fatal("expiry callback must not run after stop")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestRemoteRestarted(t *testing.T) {
+	pConn := &PFCPConn{}
+	now := time.Now()
+
+	require.False(t, pConn.remoteRestarted(ie.NewRecoveryTimeStamp(now)), "first timestamp is learnt")
+	require.False(t, pConn.remoteRestarted(ie.NewRecoveryTimeStamp(now)))
+	require.True(t, pConn.remoteRestarted(ie.NewRecoveryTimeStamp(now.Add(time.Minute))))
+	require.False(t, pConn.remoteRestarted(nil))
+
+	// Learnt from the Serve and heartbeat goroutines at once
+	var wg sync.WaitGroup
+	for i := 1; i <= 2; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			pConn.remoteRestarted(ie.NewRecoveryTimeStamp(now.Add(time.Duration(i) * time.Hour)))
+		}(i)
+	}
+	wg.Wait()
+	require.Equal(t, now.Add(2*time.Hour).Unix(), pConn.ts.getRemote().Unix())
+}
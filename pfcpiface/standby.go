@@ -0,0 +1,301 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright 2022-present Open Networking Foundation
+
+package pfcpiface
+
+import (
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/wmnsk/go-pfcp/message"
+)
+
+// standby is the copy of a session kept on a second UPF, ready to take over
+// when the primary fails. Only the primary's F-TEIDs are known to the SMF.
+type standby struct {
+	seid  uint64
+	pConn *PFCPConn
+	upf   *Upf
+	ready bool // the standby UPF accepted the session
+}
+
+// standbyTable holds the hot standbys of sessions, keyed by the LB's SEID.
+type standbyTable struct {
+	mu       sync.Mutex
+	dnns     map[string]bool // DNNs whose sessions get a standby, all if empty
+	standbys map[uint64]*standby
+}
+
+func newStandbyTable(dnns []string) *standbyTable {
+	t := &standbyTable{
+		dnns:     make(map[string]bool),
+		standbys: make(map[uint64]*standby),
+	}
+
+	for _, dnn := range dnns {
+		t.dnns[dnn] = true
+	}
+
+	return t
+}
+
+// wanted reports whether sessions of dnn get a standby.
+func (t *standbyTable) wanted(dnn string) bool {
+	return len(t.dnns) == 0 || t.dnns[dnn]
+}
+
+// add registers a standby being installed, false if the session already has one.
+func (t *standbyTable) add(s *standby) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if _, ok := t.standbys[s.seid]; ok {
+		return false
+	}
+
+	t.standbys[s.seid] = s
+
+	return true
+}
+
+// installing returns the standby of seid being installed on the UPF of pConn.
+func (t *standbyTable) installing(seid uint64, pConn *PFCPConn) *standby {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	s, ok := t.standbys[seid]
+	if !ok || s.ready || s.pConn != pConn {
+		return nil
+	}
+
+	return s
+}
+
+// accepted marks the standby of seid on the UPF of pConn ready, false if
+// seid has no standby being installed there.
+func (t *standbyTable) accepted(seid uint64, pConn *PFCPConn) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	s, ok := t.standbys[seid]
+	if !ok || s.ready || s.pConn != pConn {
+		return false
+	}
+
+	s.ready = true
+
+	return true
+}
+
+// get returns the standby of seid, nil if it has none.
+func (t *standbyTable) get(seid uint64) *standby {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.standbys[seid]
+}
+
+// remove forgets the standby of seid and returns it, nil if it had none.
+func (t *standbyTable) remove(seid uint64) *standby {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	s, ok := t.standbys[seid]
+	if !ok {
+		return nil
+	}
+
+	delete(t.standbys, seid)
+
+	return s
+}
+
+// removeOn forgets the standbys placed on u and returns their sessions.
+func (t *standbyTable) removeOn(u *Upf) []uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var seids []uint64
+
+	for seid, s := range t.standbys {
+		if s.upf == u {
+			seids = append(seids, seid)
+			delete(t.standbys, seid)
+		}
+	}
+
+	return seids
+}
+
+// on reports whether the standby of seid is placed on u.
+func (t *standbyTable) on(seid uint64, u *Upf) bool {
+	s := t.get(seid)
+
+	return s != nil && s.upf == u
+}
+
+// standbyUPF returns the UPF to hold the standby of seid served by primary,
+// -1 if there is none: the lightest other one its F-TEIDs stay valid on, as
+// the SMF keeps sending to them after a failover.
+func (node *PFCPNode) standbyUPF(seid uint64, primary int) int {
+	standby := -1
+
+	for i, u := range node.upf.peersUPF {
+		if i == primary || !node.fteidsValidOn(seid, u) {
+			continue
+		}
+
+		if standby < 0 || node.lighterUPF(i, standby) {
+			standby = i
+		}
+	}
+
+	return standby
+}
+
+// installStandby installs a copy of seid on another UPF than the one serving it,
+// if its DNN is configured for hot standby.
+func (node *PFCPNode) installStandby(seid uint64, comCh CommunicationChannel) {
+	if node.upf.standbys == nil {
+		return
+	}
+
+	estMsg, ok := node.upf.sesEstMsgStore[seid]
+	if !ok || !node.upf.standbys.wanted(sessionDnn(estMsg)) {
+		return
+	}
+
+	node.upf.placementMu.Lock()
+	primary, ok := node.upf.lbmap[seid]
+	upfIndex := -1
+	if ok {
+		upfIndex = node.standbyUPF(seid, primary)
+	}
+	node.upf.placementMu.Unlock()
+
+	if !ok {
+		return
+	}
+
+	if upfIndex < 0 {
+		log.Warnln("No UPF to hold the standby of session", seid)
+		return
+	}
+
+	u := node.upf.peersUPF[upfIndex]
+
+	v, ok := node.pConns.Load(upfPFCPAddr(u.peersIP))
+	if !ok {
+		return
+	}
+
+	pConn := v.(*PFCPConn)
+
+	if !node.upf.standbys.add(&standby{seid: seid, pConn: pConn, upf: u}) {
+		return
+	}
+
+	standbyMsg := *estMsg
+	header := *estMsg.Header
+	standbyMsg.Header = &header
+
+	comCh.SesEstU2d <- &SesEstU2dMsg{
+		msg:       &standbyMsg,
+		upSeid:    seid,
+		reforward: true,
+		pConn:     pConn,
+	}
+}
+
+// mirrorToStandby applies a modification of seid to its standby too.
+func (node *PFCPNode) mirrorToStandby(seid uint64, smreq *message.SessionModificationRequest, comCh CommunicationChannel) {
+	if node.upf.standbys == nil || smreq == nil {
+		return
+	}
+
+	s := node.upf.standbys.get(seid)
+	if s == nil || !s.ready {
+		return
+	}
+
+	mirrored := *smreq
+	header := *smreq.Header
+	mirrored.Header = &header
+
+	// Called from the listener of comCh.SesModU2d, so not sent through it
+	forwardForLB(s.pConn, seid, &mirrored, comCh)
+}
+
+// deleteStandby deletes the standby of seid from its UPF.
+func (node *PFCPNode) deleteStandby(seid uint64, comCh CommunicationChannel) {
+	if node.upf.standbys == nil {
+		return
+	}
+
+	s := node.upf.standbys.remove(seid)
+	if s == nil {
+		return
+	}
+
+	delMsg := message.NewSessionDeletionRequest(0, 0, seid, s.pConn.getSeqNum(), 123,
+		nil,
+	)
+	comCh.SesDelU2d <- &SesDelU2dMsg{
+		msg:       delMsg,
+		upSeid:    seid,
+		reforward: true,
+		upfIndex:  node.upfIndex(s.upf),
+		pConn:     s.pConn,
+	}
+}
+
+// failoverToStandbys hands the sessions of the failed UPF of pConn that have a
+// ready standby over to it, and returns them. Their F-TEIDs stay valid on the
+// standby, so the SMF isn't told.
+func (node *PFCPNode) failoverToStandbys(pConn *PFCPConn, deadUpf int, comCh CommunicationChannel) map[uint64]bool {
+	failedOver := make(map[uint64]bool)
+
+	if node.upf.standbys == nil {
+		return failedOver
+	}
+
+	node.upf.placementMu.Lock()
+	defer node.upf.placementMu.Unlock()
+
+	dead := node.upf.peersUPF[deadUpf]
+	remaining := make([]uint64, 0, len(dead.upfsSessions))
+
+	for _, seid := range dead.upfsSessions {
+		s := node.upf.standbys.get(seid)
+		standbyIndex := -1
+
+		if s != nil && s.ready {
+			standbyIndex = node.upfIndex(s.upf)
+		}
+
+		sess, ok := pConn.sessionStore.GetSession(seid)
+		if standbyIndex < 0 || !ok {
+			remaining = append(remaining, seid)
+			continue
+		}
+
+		if err := s.pConn.sessionStore.PutSession(sess); err != nil {
+			log.Errorln("Failed to put session", seid, "to the store of its standby:", err)
+			remaining = append(remaining, seid)
+
+			continue
+		}
+
+		node.upf.standbys.remove(seid)
+
+		node.upf.lbmap[seid] = standbyIndex
+		node.upf.peersUPF[standbyIndex].upfsSessions = append(node.upf.peersUPF[standbyIndex].upfsSessions, seid)
+		failedOver[seid] = true
+
+		log.Infoln("Session", seid, "failed over from", dead.NodeID, "to its standby on", s.upf.NodeID)
+	}
+
+	dead.upfsSessions = remaining
+
+	return failedOver
+}
@@ -0,0 +1,127 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright 2022-present Open Networking Foundation
+
+package pfcpiface
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/wmnsk/go-pfcp/ie"
+	"github.com/wmnsk/go-pfcp/message"
+)
+
+func TestStandbyTable(t *testing.T) {
+	table := newStandbyTable([]string{"internet"})
+	require.True(t, table.wanted("internet"))
+	require.False(t, table.wanted("ims"))
+	require.True(t, newStandbyTable(nil).wanted("ims"), "all DNNs if none is listed")
+
+	primary, backup := &PFCPConn{}, &PFCPConn{}
+	upf := &Upf{NodeID: "upf2"}
+
+	require.True(t, table.add(&standby{seid: 1, pConn: backup, upf: upf}))
+	require.False(t, table.add(&standby{seid: 1, pConn: primary}), "a session has one standby")
+
+	require.Nil(t, table.installing(1, primary))
+	require.NotNil(t, table.installing(1, backup))
+	require.False(t, table.accepted(1, primary))
+	require.True(t, table.accepted(1, backup))
+	require.False(t, table.accepted(1, backup), "accepted once")
+	require.Nil(t, table.installing(1, backup))
+	require.True(t, table.get(1).ready)
+	require.True(t, table.on(1, upf))
+	require.False(t, table.on(2, upf))
+
+	require.True(t, table.add(&standby{seid: 2, pConn: backup, upf: &Upf{}}))
+	require.Equal(t, []uint64{1}, table.removeOn(upf))
+	require.Nil(t, table.get(1))
+	require.NotNil(t, table.remove(2))
+	require.Nil(t, table.remove(2))
+}
+
+func TestFailoverToStandbys(t *testing.T) {
+	dead, backup := &Upf{NodeID: "upf1", upfsSessions: []uint64{1, 2}}, &Upf{NodeID: "upf2"}
+	deadConn := &PFCPConn{sessionStore: NewInMemoryStore()}
+	backupConn := &PFCPConn{sessionStore: NewInMemoryStore()}
+
+	node := &PFCPNode{upf: &Upf{
+		peersUPF: []*Upf{dead, backup},
+		lbmap:    map[uint64]int{1: 0, 2: 0},
+		standbys: newStandbyTable(nil),
+	}}
+
+	for _, seid := range []uint64{1, 2} {
+		require.NoError(t, deadConn.sessionStore.PutSession(PFCPSession{localSEID: seid}))
+	}
+
+	require.True(t, node.upf.standbys.add(&standby{seid: 1, pConn: backupConn, upf: backup}))
+	require.True(t, node.upf.standbys.accepted(1, backupConn))
+	require.True(t, node.upf.standbys.add(&standby{seid: 2, pConn: backupConn, upf: backup}))
+
+	comCh := CommunicationChannel{SesReportD2u: make(chan *SesReportD2uMsg, 1)}
+	failedOver := node.failoverToStandbys(deadConn, 0, comCh)
+
+	require.Equal(t, map[uint64]bool{1: true}, failedOver, "only ready standbys take over")
+	require.Equal(t, 1, node.upf.lbmap[1])
+	require.Equal(t, 0, node.upf.lbmap[2])
+	require.Equal(t, []uint64{2}, dead.upfsSessions)
+	require.Equal(t, []uint64{1}, backup.upfsSessions)
+	require.Nil(t, node.upf.standbys.get(1))
+
+	_, ok := backupConn.sessionStore.GetSession(1)
+	require.True(t, ok)
+
+	require.Empty(t, comCh.SesReportD2u, "the SMF keeps the F-TEIDs it knows")
+}
+
+func TestMirrorToStandbyBypassesComCh(t *testing.T) {
+	upf, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	defer upf.Close()
+
+	conn, err := net.DialUDP("udp", nil, upf.LocalAddr().(*net.UDPAddr))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	node := &PFCPNode{upf: &Upf{standbys: newStandbyTable(nil)}}
+	backupConn := &PFCPConn{Conn: conn}
+	require.True(t, node.upf.standbys.add(&standby{seid: 1, pConn: backupConn, upf: &Upf{}}))
+	require.True(t, node.upf.standbys.accepted(1, backupConn))
+
+	// Called from the only reader of SesModU2d
+	smreq := message.NewSessionModificationRequest(0, 0, 99, 5, 0)
+	node.mirrorToStandby(1, smreq, CommunicationChannel{SesModU2d: make(chan *SesModU2dMsg)})
+
+	buf := make([]byte, 1500)
+	require.NoError(t, upf.SetReadDeadline(time.Now().Add(time.Second)))
+	n, err := upf.Read(buf)
+	require.NoError(t, err)
+
+	msg, err := message.Parse(buf[:n])
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), msg.SEID())
+}
+
+func TestStandbyUPFKeepsFTEIDs(t *testing.T) {
+	upf1 := &Upf{NodeID: "upf1", AccessIP: net.ParseIP("10.0.0.1")}
+	upf2 := &Upf{NodeID: "upf2", AccessIP: net.ParseIP("10.0.0.2")}
+	upf3 := &Upf{NodeID: "upf3", AccessIP: net.ParseIP("10.0.0.1"), upfsSessions: []uint64{5, 6}}
+
+	node := &PFCPNode{upf: &Upf{
+		peersUPF:             []*Upf{upf1, upf2, upf3},
+		teids:                newTEIDAllocator(16),
+		MaxSessionsThreshold: 100,
+	}}
+
+	_, err := node.upf.teids.choose(1, upf1, upf1.AccessIP.To4(), nil, []*ie.IE{chooseFTEIDPDR(1, 0)})
+	require.NoError(t, err)
+
+	require.Equal(t, 2, node.standbyUPF(1, 0), "the lighter upf2 has another N3 address")
+	require.Equal(t, 1, node.standbyUPF(2, 0), "no F-TEID chosen")
+
+	node.upf.peersUPF = node.upf.peersUPF[:2]
+	require.Equal(t, -1, node.standbyUPF(1, 0))
+}
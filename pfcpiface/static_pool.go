@@ -0,0 +1,251 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright 2022-present Open Networking Foundation
+
+package pfcpiface
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// staticPeer is a UPF of the static pool and the state of its association.
+type staticPeer struct {
+	info       StaticUPFInfo
+	up         bool      // associated when last checked
+	associated bool      // ever, so it is known to Up
+	discovered bool      // found by discovery rather than configured
+	pending    bool      // an association was started and has until nextTry to complete
+	failures   int       // attempts in a row that didn't associate
+	nextTry    time.Time // of the next attempt, zero for right away
+}
+
+// pfcpInfo returns what the UPF would register with, found at ip.
+func (p *staticPeer) pfcpInfo(ip string) PfcpInfo {
+	info := PfcpInfo{
+		Ip:     ip,
+		Labels: p.info.Labels,
+		Upf: &Upf{
+			Hostname: p.info.Hostname,
+			NodeID:   p.info.NodeID,
+			AccessIP: net.ParseIP(p.info.AccessIP),
+			CoreIP:   net.ParseIP(p.info.CoreIP),
+			Dnn:      p.info.Dnn,
+		},
+	}
+
+	// Re-resolved periodically, like a UPF registered by FQDN
+	if net.ParseIP(p.info.Address) == nil {
+		info.Fqdn = p.info.Address
+	}
+
+	return info
+}
+
+// staticPool keeps the LB associated with the UPFs of the configuration, and
+// those discovered: it associates with each once known, and again after the association failed or
+// was lost, waiting a backoff doubling from minBackoff to maxBackoff after
+// each failure.
+type staticPool struct {
+	mu             sync.Mutex
+	peers          []*staticPeer
+	minBackoff     time.Duration
+	maxBackoff     time.Duration
+	attemptTimeout time.Duration // an association has to complete
+	now            func() time.Time
+	// connect starts associating with the UPF of p at ip, by default as if
+	// it had registered over HTTP.
+	connect func(p *staticPeer, ip string)
+	// associated reports whether the LB is associated with u.
+	associated func(u *Upf) bool
+}
+
+func newStaticPool(conf *Conf) *staticPool {
+	s := &staticPool{
+		minBackoff: durationOrDefault(conf.StaticPool.RetryInterval, staticRetryIntervalDefault),
+		maxBackoff: durationOrDefault(conf.StaticPool.MaxRetryInterval, staticMaxRetryIntervalDefault),
+		now:        time.Now,
+	}
+
+	// All the retransmissions of an Association Setup Request
+	s.attemptTimeout = durationOrDefault(conf.RespTimeout, respTimeoutDefault) * time.Duration(conf.MaxReqRetries+1)
+	if s.attemptTimeout < s.minBackoff {
+		s.attemptTimeout = s.minBackoff
+	}
+
+	for _, info := range conf.StaticPool.UPFs {
+		s.peers = append(s.peers, &staticPeer{info: info})
+	}
+
+	return s
+}
+
+// sync sets the discovered UPFs to found, and returns the names of those
+// added and of those no longer found. Configured UPFs are kept as they are.
+func (s *staticPool) sync(found []StaticUPFInfo) (added, vanished []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	seen := make(map[string]bool, len(found))
+	for _, info := range found {
+		seen[info.Hostname] = true
+	}
+
+	known := make(map[string]bool, len(s.peers))
+	peers := make([]*staticPeer, 0, len(s.peers))
+
+	for _, p := range s.peers {
+		if p.discovered && !seen[p.info.Hostname] {
+			vanished = append(vanished, p.info.Hostname)
+			continue
+		}
+
+		known[p.info.Hostname] = true
+		peers = append(peers, p)
+	}
+
+	for _, info := range found {
+		if !known[info.Hostname] {
+			known[info.Hostname] = true
+			added = append(added, info.Hostname)
+			peers = append(peers, &staticPeer{info: info, discovered: true})
+		}
+	}
+
+	s.peers = peers
+
+	return added, vanished
+}
+
+// backoff returns the wait after failures failed attempts in a row.
+func (s *staticPool) backoff(failures int) time.Duration {
+	d := s.minBackoff
+	for i := 1; i < failures && d < s.maxBackoff; i++ {
+		d *= 2
+	}
+
+	if d > s.maxBackoff {
+		d = s.maxBackoff
+	}
+
+	return d
+}
+
+// check associates with the UPFs of the pool that are due an attempt.
+func (s *staticPool) check(node *PFCPNode) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+
+	for _, p := range s.peers {
+		name := p.info.Hostname
+
+		u := node.upf.peerByHostname(name)
+		if u != nil && s.associated(u) {
+			if !p.up {
+				log.Infoln("Static UPF", name, "associated at", u.peersIP)
+			}
+
+			p.up, p.associated, p.pending, p.failures = true, true, false, 0
+
+			continue
+		}
+
+		if p.up {
+			log.Warnln("Static UPF", name, "lost, associating again")
+
+			p.up, p.nextTry = false, time.Time{}
+		}
+
+		if now.Before(p.nextTry) {
+			continue
+		}
+
+		if p.pending {
+			p.pending = false
+			s.failed(p, now, "no association within "+s.attemptTimeout.String())
+
+			continue
+		}
+
+		ip := p.info.Address
+		if net.ParseIP(ip) == nil {
+			var err error
+			if ip, err = resolveUPFAddr(ip); err != nil {
+				s.failed(p, now, err.Error())
+				continue
+			}
+		}
+
+		log.Infoln("Associating with static UPF", name, "at", ip)
+
+		s.connect(p, ip)
+		p.pending, p.nextTry = true, now.Add(s.attemptTimeout)
+	}
+}
+
+// failed backs off after a failed attempt for p.
+func (s *staticPool) failed(p *staticPeer, now time.Time, reason string) {
+	p.failures++
+	wait := s.backoff(p.failures)
+	p.nextTry = now.Add(wait)
+
+	log.Warnln("Association with static UPF", p.info.Hostname, "failed", p.failures, "times:", reason, ", retrying in", wait)
+}
+
+// upfAssociated reports whether the LB is associated with u.
+func (node *PFCPNode) upfAssociated(u *Upf) bool {
+	v, ok := node.pConns.Load(upfPFCPAddr(u.peersIP))
+
+	return ok && v.(*PFCPConn).nodeID.remote != ""
+}
+
+// associateStaticUPF starts associating with the UPF of p at ip. A UPF still
+// registered, e.g. its association failed, is associated with again under the
+// same entry, keeping its sessions.
+func (node *PFCPNode) associateStaticUPF(p *staticPeer, ip string, comCh CommunicationChannel) {
+	info := p.pfcpInfo(ip)
+
+	if u := node.upf.peerByHostname(p.info.Hostname); u != nil {
+		node.upf.placementMu.Lock()
+		u.peersIP = canonicalIP(ip)
+		node.upf.placementMu.Unlock()
+
+		info.Ip, info.Upf = canonicalIP(ip), u
+		// Up already knows it, unless it never associated
+		info.rebind = p.associated
+	} else {
+		handlePFCPConfig(&info, node.upf)
+	}
+
+	go node.tryConnectToN4Peer(node.LocalAddr().String(), comCh, info, Down)
+}
+
+// runStaticPool keeps the LB associated with the static UPFs, until the node stops.
+func (node *PFCPNode) runStaticPool(comCh CommunicationChannel) {
+	s := node.upf.staticPool
+
+	if s.connect == nil {
+		s.connect = func(p *staticPeer, ip string) { node.associateStaticUPF(p, ip, comCh) }
+	}
+
+	if s.associated == nil {
+		s.associated = node.upfAssociated
+	}
+
+	ticker := time.NewTicker(s.minBackoff)
+	defer ticker.Stop()
+
+	for {
+		s.check(node)
+
+		select {
+		case <-node.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,135 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright 2022-present Open Networking Foundation
+
+package pfcpiface
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStaticPoolBackoff(t *testing.T) {
+	s := newStaticPool(&Conf{StaticPool: StaticPoolInfo{RetryInterval: "1s", MaxRetryInterval: "10s"}})
+
+	var waits []time.Duration
+	for failures := 1; failures <= 6; failures++ {
+		waits = append(waits, s.backoff(failures))
+	}
+
+	require.Equal(t, []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second}, waits)
+}
+
+func TestStaticPoolCheck(t *testing.T) {
+	defer func(orig func(string) ([]string, error)) { lookupHost = orig }(lookupHost)
+
+	resolvable := false
+	lookupHost = func(host string) ([]string, error) {
+		if !resolvable {
+			return nil, ErrNotFound(host)
+		}
+
+		return []string{"10.0.0.2"}, nil
+	}
+
+	now := time.Unix(0, 0)
+	s := newStaticPool(&Conf{
+		RespTimeout:   "1s",
+		MaxReqRetries: 3,
+		StaticPool: StaticPoolInfo{
+			RetryInterval:    "1s",
+			MaxRetryInterval: "1m",
+			UPFs: []StaticUPFInfo{
+				{Address: "10.0.0.1", Hostname: "upf1", AccessIP: "192.168.252.3"},
+				{Address: "upf2.example", Hostname: "upf2"},
+			},
+		},
+	})
+	s.now = func() time.Time { return now }
+
+	node := &PFCPNode{upf: &Upf{}}
+	associated := make(map[string]bool)
+	s.associated = func(u *Upf) bool { return associated[u.Hostname] }
+
+	var attempts []PfcpInfo
+
+	s.connect = func(p *staticPeer, ip string) {
+		info := p.pfcpInfo(ip)
+		attempts = append(attempts, info)
+
+		if node.upf.peerByHostname(p.info.Hostname) == nil {
+			node.upf.peersUPF = append(node.upf.peersUPF, info.Upf)
+		}
+	}
+
+	s.check(node)
+	require.Len(t, attempts, 1, "upf2 doesn't resolve")
+	require.Equal(t, "10.0.0.1", attempts[0].Ip)
+	require.Equal(t, "192.168.252.3", attempts[0].Upf.AccessIP.String())
+	require.Equal(t, 1, s.peers[1].failures)
+
+	resolvable = true
+	now = now.Add(time.Second)
+	s.check(node)
+	require.Len(t, attempts, 2, "upf1 still has time to associate")
+	require.Equal(t, PfcpInfo{Ip: "10.0.0.2", Fqdn: "upf2.example", Upf: &Upf{Hostname: "upf2"}}, attempts[1])
+
+	associated["upf2"] = true
+	now = now.Add(3 * time.Second)
+	s.check(node)
+	require.Len(t, attempts, 2)
+	require.Equal(t, 1, s.peers[0].failures, "upf1 didn't associate within 4s")
+	require.True(t, s.peers[1].up)
+	require.Zero(t, s.peers[1].failures)
+
+	now = now.Add(time.Second)
+	s.check(node)
+	require.Len(t, attempts, 3, "upf1 again, after a backoff of 1s")
+
+	now = now.Add(4 * time.Second)
+	s.check(node)
+	require.Equal(t, 2, s.peers[0].failures)
+
+	now = now.Add(time.Second)
+	s.check(node)
+	require.Len(t, attempts, 3, "backoff of 2s")
+
+	now = now.Add(time.Second)
+	s.check(node)
+	require.Len(t, attempts, 4)
+
+	associated["upf1"] = true
+	s.check(node)
+	require.True(t, s.peers[0].up)
+	require.Zero(t, s.peers[0].failures)
+
+	// Lost, e.g. its heartbeats failed
+	associated["upf2"] = false
+	node.upf.peersUPF = node.upf.peersUPF[:1]
+	s.check(node)
+	require.Len(t, attempts, 5, "upf2 right away")
+	require.Equal(t, "upf2", attempts[4].Upf.Hostname)
+}
+
+func TestRunUPFsStaticPool(t *testing.T) {
+	confPath := t.TempDir() + "/conf.json"
+	mustWriteStringToDisk(`{
+		"mode": "dpdk",
+		"init_upfs": 2,
+		"static_pool": {
+			"upfs": [{"address": "10.0.0.1", "hostname": "upf1"}]
+		}
+	}`, confPath)
+
+	conf, err := LoadConfigFile(confPath)
+	require.NoError(t, err)
+
+	o, err := NewOrchestrator(&conf)
+	require.NoError(t, err)
+	require.Nil(t, o)
+
+	upf := &Upf{orchestrator: o}
+	p := &PFCPIface{conf: conf, upf: upf, node: &PFCPNode{upf: upf}}
+	require.NoError(t, p.RunUPFs(), "static UPFs run on their own")
+}
@@ -0,0 +1,463 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright 2022-present Open Networking Foundation
+
+package pfcpiface
+
+import (
+	"net"
+	"sync"
+
+	"github.com/wmnsk/go-pfcp/ie"
+)
+
+// F-TEID flags, 3GPP TS 29.244 section 8.2.3.
+const (
+	fteidFlagV4 = 0x01
+	fteidFlagV6 = 0x02
+)
+
+// teidRange is the block of TEIDs the LB hands out on behalf of one UPF.
+// Ranges don't overlap, so a TEID stays unique in the pool when its session moves.
+type teidRange struct {
+	slot    uint32
+	base    uint32
+	size    uint32
+	next    uint32 // offset tried first by the next allocation
+	used    map[uint32]struct{}
+	retired bool // its UPF left the pool, the slot is freed once no TEID is used
+}
+
+func (r *teidRange) allocate() (uint32, bool) {
+	for i := uint32(0); i < r.size; i++ {
+		teid := r.base + (r.next+i)%r.size
+		if _, ok := r.used[teid]; ok {
+			continue
+		}
+
+		r.used[teid] = struct{}{}
+		r.next = (r.next + i + 1) % r.size
+
+		return teid, true
+	}
+
+	return 0, false
+}
+
+func (r *teidRange) release(teid uint32) {
+	delete(r.used, teid)
+}
+
+// chosenFTEID is an F-TEID the LB chose for a PDR in place of its UPF.
+type chosenFTEID struct {
+	teid  uint32
+	flags uint8 // address families requested by the SMF
+	chid  uint8
+}
+
+// sessionTEIDs holds the F-TEIDs chosen for the PDRs of a session.
+type sessionTEIDs struct {
+	fteids  map[uint16]*chosenFTEID // by PDR ID
+	owners  map[uint32]*teidRange   // range each TEID was taken from
+	chids   map[uint8]uint32        // TEID shared by the PDRs of a CHOOSE ID
+	v4, v6  net.IP                  // N3 addresses the F-TEIDs currently point to
+	created []*ie.IE                // Created PDRs not yet sent to the SMF
+}
+
+// teidAllocator chooses the F-TEIDs the SMF asks the UP function to choose
+// (CH flag), so that a session keeps them whichever UPF it is placed on.
+type teidAllocator struct {
+	mu        sync.Mutex
+	rangeSize uint32
+	nextSlot  uint32
+	freeSlots []uint32 // slots of retired ranges, reused first
+	ranges    map[*Upf]*teidRange
+	sessions  map[uint64]*sessionTEIDs
+}
+
+func newTEIDAllocator(rangeSize uint32) *teidAllocator {
+	return &teidAllocator{
+		rangeSize: rangeSize,
+		nextSlot:  1, // TEID 0 is reserved
+		ranges:    make(map[*Upf]*teidRange),
+		sessions:  make(map[uint64]*sessionTEIDs),
+	}
+}
+
+// rangeOf returns the TEID range of u, reserving one on first use.
+// Must be called with the lock held.
+func (a *teidAllocator) rangeOf(u *Upf) *teidRange {
+	if r, ok := a.ranges[u]; ok {
+		return r
+	}
+
+	var slot uint32
+
+	switch {
+	case len(a.freeSlots) > 0:
+		slot = a.freeSlots[len(a.freeSlots)-1]
+		a.freeSlots = a.freeSlots[:len(a.freeSlots)-1]
+	case uint64(a.nextSlot+1)*uint64(a.rangeSize) <= 1<<32:
+		slot = a.nextSlot
+		a.nextSlot++
+	default:
+		return nil
+	}
+
+	r := &teidRange{
+		slot: slot,
+		base: slot * a.rangeSize,
+		size: a.rangeSize,
+		used: make(map[uint32]struct{}),
+	}
+	a.ranges[u] = r
+
+	return r
+}
+
+// releaseTEID frees teid of r, and the slot of r once retired and unused.
+// Must be called with the lock held.
+func (a *teidAllocator) releaseTEID(r *teidRange, teid uint32) {
+	r.release(teid)
+
+	if r.retired && len(r.used) == 0 {
+		a.freeSlots = append(a.freeSlots, r.slot)
+		r.retired = false
+	}
+}
+
+// retire gives the range of u, which left the pool, back. Its slot is reused
+// once the sessions moved off u stop using its TEIDs.
+func (a *teidAllocator) retire(u *Upf) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	r, ok := a.ranges[u]
+	if !ok {
+		return
+	}
+
+	delete(a.ranges, u)
+
+	if len(r.used) == 0 {
+		a.freeSlots = append(a.freeSlots, r.slot)
+		return
+	}
+
+	r.retired = true
+}
+
+// choose rewrites the CHOOSE F-TEIDs of createPDRs, placed on u reachable at
+// the N3 addresses v4/v6, into F-TEIDs taken from the range of u.
+func (a *teidAllocator) choose(seid uint64, u *Upf, v4, v6 net.IP, createPDRs []*ie.IE) ([]*ie.IE, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	s, ok := a.sessions[seid]
+	if !ok {
+		s = &sessionTEIDs{
+			fteids: make(map[uint16]*chosenFTEID),
+			owners: make(map[uint32]*teidRange),
+			chids:  make(map[uint8]uint32),
+			v4:     v4,
+			v6:     v6,
+		}
+		a.sessions[seid] = s
+	}
+
+	rewritten := make([]*ie.IE, 0, len(createPDRs))
+
+	for _, c := range createPDRs {
+		fteid, err := createPDRFTEID(c)
+		if err != nil || !fteid.HasCh() {
+			rewritten = append(rewritten, c)
+			continue
+		}
+
+		pdrID, err := c.PDRID()
+		if err != nil {
+			return nil, err
+		}
+
+		teid, ok := s.chids[fteid.ChooseID]
+		if !ok || !fteid.HasChID() {
+			r := a.rangeOf(u)
+			if r == nil {
+				return nil, ErrOperationFailedWithReason("choose F-TEID", "no TEID range left for "+u.NodeID)
+			}
+
+			if teid, ok = r.allocate(); !ok {
+				return nil, ErrOperationFailedWithReason("choose F-TEID", "TEID range of "+u.NodeID+" exhausted")
+			}
+
+			s.owners[teid] = r
+
+			if fteid.HasChID() {
+				s.chids[fteid.ChooseID] = teid
+			}
+		}
+
+		chosen := &chosenFTEID{teid: teid, flags: fteid.Flags & (fteidFlagV4 | fteidFlagV6), chid: fteid.ChooseID}
+
+		fteidIE, err := chosen.build(s.v4, s.v6)
+		if err != nil {
+			return nil, err
+		}
+
+		pdr, err := replacePDIIE(c, fteidIE)
+		if err != nil {
+			return nil, err
+		}
+
+		s.fteids[pdrID] = chosen
+		s.created = append(s.created, ie.NewCreatedPDR(ie.NewPDRID(pdrID), fteidIE))
+		rewritten = append(rewritten, pdr)
+	}
+
+	return rewritten, nil
+}
+
+// takeCreated returns the Created PDRs of seid not yet sent to the SMF.
+func (a *teidAllocator) takeCreated(seid uint64) []*ie.IE {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	s, ok := a.sessions[seid]
+	if !ok {
+		return nil
+	}
+
+	created := s.created
+	s.created = nil
+
+	return created
+}
+
+// pointsTo reports whether the F-TEIDs chosen for seid, if any, point to the
+// N3 addresses v4/v6.
+func (a *teidAllocator) pointsTo(seid uint64, v4, v6 net.IP) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	s, ok := a.sessions[seid]
+
+	return !ok || len(s.fteids) == 0 || (s.v4.Equal(v4) && s.v6.Equal(v6))
+}
+
+// removePDRs releases the TEIDs no PDR of seid uses anymore once removePDRs are gone.
+func (a *teidAllocator) removePDRs(seid uint64, removePDRs []*ie.IE) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	s, ok := a.sessions[seid]
+	if !ok {
+		return
+	}
+
+	for _, r := range removePDRs {
+		pdrID, err := r.PDRID()
+		if err != nil {
+			continue
+		}
+
+		chosen, ok := s.fteids[pdrID]
+		if !ok {
+			continue
+		}
+
+		delete(s.fteids, pdrID)
+
+		if !s.inUse(chosen.teid) {
+			a.releaseTEID(s.owners[chosen.teid], chosen.teid)
+			delete(s.owners, chosen.teid)
+			delete(s.chids, chosen.chid)
+		}
+	}
+}
+
+// release frees the TEIDs of a deleted session.
+func (a *teidAllocator) release(seid uint64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	s, ok := a.sessions[seid]
+	if !ok {
+		return
+	}
+
+	for teid, r := range s.owners {
+		a.releaseTEID(r, teid)
+	}
+
+	delete(a.sessions, seid)
+}
+
+func (s *sessionTEIDs) inUse(teid uint32) bool {
+	for _, f := range s.fteids {
+		if f.teid == teid {
+			return true
+		}
+	}
+
+	return false
+}
+
+// build returns the concrete F-TEID IE for the N3 addresses v4/v6.
+func (f *chosenFTEID) build(v4, v6 net.IP) (*ie.IE, error) {
+	var flags uint8
+
+	if f.flags&fteidFlagV4 != 0 {
+		if v4 == nil {
+			return nil, ErrOperationFailedWithReason("choose F-TEID", "no IPv4 N3 address")
+		}
+
+		flags |= fteidFlagV4
+	} else {
+		v4 = nil
+	}
+
+	if f.flags&fteidFlagV6 != 0 {
+		if v6 == nil {
+			return nil, ErrOperationFailedWithReason("choose F-TEID", "no IPv6 N3 address")
+		}
+
+		flags |= fteidFlagV6
+	} else {
+		v6 = nil
+	}
+
+	return ie.NewFTEID(flags, f.teid, v4, v6, 0), nil
+}
+
+// createPDRFTEID returns the F-TEID of the PDI of the Create PDR c.
+func createPDRFTEID(c *ie.IE) (*ie.FTEIDFields, error) {
+	fteid, err := pdiIE(c, ie.FTEID)
+	if err != nil {
+		return nil, err
+	}
+
+	return fteid.FTEID()
+}
+
+// pdiIE returns the IE of type typ in the PDI of the Create PDR c.
+func pdiIE(c *ie.IE, typ uint16) (*ie.IE, error) {
+	children, err := c.CreatePDR()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, child := range children {
+		if child.Type != ie.PDI {
+			continue
+		}
+
+		pdiChildren, err := child.PDI()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, p := range pdiChildren {
+			if p.Type == typ {
+				return p, nil
+			}
+		}
+	}
+
+	return nil, ie.ErrIENotFound
+}
+
+// replacePDIIE returns a copy of the Create PDR c with the IE of the type of
+// replacement in its PDI replaced.
+func replacePDIIE(c *ie.IE, replacement *ie.IE) (*ie.IE, error) {
+	children, err := c.CreatePDR()
+	if err != nil {
+		return nil, err
+	}
+
+	pdr := make([]*ie.IE, 0, len(children))
+
+	for _, child := range children {
+		if child.Type != ie.PDI {
+			pdr = append(pdr, child)
+			continue
+		}
+
+		pdiChildren, err := child.PDI()
+		if err != nil {
+			return nil, err
+		}
+
+		pdi := make([]*ie.IE, 0, len(pdiChildren))
+
+		for _, p := range pdiChildren {
+			if p.Type == replacement.Type {
+				p = replacement
+			}
+
+			pdi = append(pdi, p)
+		}
+
+		pdr = append(pdr, ie.NewPDI(pdi...))
+	}
+
+	return ie.NewCreatePDR(pdr...), nil
+}
+
+// n3Addrs returns the N3 addresses F-TEIDs of sessions placed on u point to:
+// the pool's virtual access addresses if configured, those of u otherwise.
+func (u *Upf) n3Addrs(upf *Upf) (v4, v6 net.IP) {
+	if u.virtualUPF != nil {
+		v4, v6 = u.virtualUPF.accessIPs()
+		if v4 != nil || v6 != nil {
+			return v4, v6
+		}
+	}
+
+	return upf.accessIPs()
+}
+
+// chooseFTEIDs rewrites the CHOOSE F-TEIDs of createPDRs of a session placed on the UPF of pConn.
+func (node *PFCPNode) chooseFTEIDs(seid uint64, pConn *PFCPConn, createPDRs []*ie.IE) ([]*ie.IE, error) {
+	if node.upf.teids == nil || len(createPDRs) == 0 {
+		return createPDRs, nil
+	}
+
+	u := node.upf.peerByNodeID(pConn.nodeID.remote)
+	if u == nil {
+		return nil, ErrNotFoundWithParam("UPF", "nodeID", pConn.nodeID.remote)
+	}
+
+	v4, v6 := node.upf.n3Addrs(u)
+
+	return node.upf.teids.choose(seid, u, v4, v6, createPDRs)
+}
+
+// createdPDRs returns the Created PDRs to report to the SMF for seid: the ones
+// the UPF reported and the ones of the F-TEIDs and UE IPs the LB chose.
+func (node *PFCPNode) createdPDRs(seid uint64, fromUPF []*ie.IE) []*ie.IE {
+	created := fromUPF
+
+	if node.upf.teids != nil {
+		created = append(created, node.upf.teids.takeCreated(seid)...)
+	}
+
+	if node.upf.ueIPs != nil {
+		created = append(created, node.upf.ueIPs.takeCreated(seid)...)
+	}
+
+	return mergeCreatedPDRs(created)
+}
+
+// fteidsValidOn reports whether the F-TEIDs the LB chose for seid, if any, stay
+// valid on u. There is no way to tell the SMF of new ones, so they are never
+// moved to other N3 addresses: a session only moves to the UPFs sharing its N3
+// addresses. The LB only chooses F-TEIDs with a virtual UPF access IP shared
+// by the pool, so that holds for all of them.
+func (node *PFCPNode) fteidsValidOn(seid uint64, u *Upf) bool {
+	if node.upf.teids == nil {
+		return true
+	}
+
+	v4, v6 := node.upf.n3Addrs(u)
+
+	return node.upf.teids.pointsTo(seid, v4, v6)
+}
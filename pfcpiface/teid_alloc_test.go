@@ -0,0 +1,162 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright 2022-present Open Networking Foundation
+
+package pfcpiface
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/wmnsk/go-pfcp/ie"
+	"github.com/wmnsk/go-pfcp/message"
+)
+
+func chooseFTEIDPDR(pdrID uint16, chid uint8) *ie.IE {
+	flags := uint8(fteidFlagV4 | 0x04)
+	if chid != 0 {
+		flags |= 0x08
+	}
+
+	return ie.NewCreatePDR(
+		ie.NewPDRID(pdrID),
+		ie.NewPDI(
+			ie.NewSourceInterface(ie.SrcInterfaceAccess),
+			ie.NewFTEID(flags, 0, nil, nil, chid),
+		),
+	)
+}
+
+func pdrFTEID(t *testing.T, pdr *ie.IE) *ie.FTEIDFields {
+	fteid, err := createPDRFTEID(pdr)
+	require.NoError(t, err)
+
+	return fteid
+}
+
+func TestTEIDAllocatorChoose(t *testing.T) {
+	a := newTEIDAllocator(4)
+	upf1, upf2 := &Upf{NodeID: "upf1"}, &Upf{NodeID: "upf2"}
+	n3 := net.ParseIP("10.0.0.1").To4()
+
+	pdrs, err := a.choose(1, upf1, n3, nil, []*ie.IE{
+		chooseFTEIDPDR(1, 7),
+		chooseFTEIDPDR(2, 7),
+		chooseFTEIDPDR(3, 0),
+	})
+	require.NoError(t, err)
+
+	first, second, third := pdrFTEID(t, pdrs[0]), pdrFTEID(t, pdrs[1]), pdrFTEID(t, pdrs[2])
+	require.False(t, first.HasCh())
+	require.Equal(t, uint32(4), first.TEID, "first range starts after the reserved TEID 0")
+	require.Equal(t, first.TEID, second.TEID, "PDRs of a CHOOSE ID share their F-TEID")
+	require.Equal(t, uint32(5), third.TEID)
+	require.True(t, n3.Equal(first.IPv4Address))
+
+	created := a.takeCreated(1)
+	require.Len(t, created, 3)
+	require.Empty(t, a.takeCreated(1))
+
+	pdrs, err = a.choose(2, upf2, n3, nil, []*ie.IE{chooseFTEIDPDR(1, 0)})
+	require.NoError(t, err)
+	require.Equal(t, uint32(8), pdrFTEID(t, pdrs[0]).TEID, "each UPF has its own range")
+
+	a.removePDRs(1, []*ie.IE{ie.NewRemovePDR(ie.NewPDRID(1))})
+	require.Len(t, a.ranges[upf1].used, 2, "the CHOOSE ID's TEID is still used by PDR 2")
+
+	a.release(1)
+	require.Empty(t, a.ranges[upf1].used)
+}
+
+func TestTEIDAllocatorExhausted(t *testing.T) {
+	a := newTEIDAllocator(1)
+	upf := &Upf{NodeID: "upf1"}
+	n3 := net.ParseIP("10.0.0.1").To4()
+
+	_, err := a.choose(1, upf, n3, nil, []*ie.IE{chooseFTEIDPDR(1, 0)})
+	require.NoError(t, err)
+
+	_, err = a.choose(2, upf, n3, nil, []*ie.IE{chooseFTEIDPDR(1, 0)})
+	require.Error(t, err)
+
+	_, err = a.choose(3, &Upf{NodeID: "upf2"}, nil, nil, []*ie.IE{chooseFTEIDPDR(1, 0)})
+	require.Error(t, err, "no IPv4 N3 address to point to")
+}
+
+func TestFTEIDsValidOn(t *testing.T) {
+	upf1 := &Upf{NodeID: "upf1", AccessIP: net.ParseIP("10.0.0.1")}
+	upf2 := &Upf{NodeID: "upf2", AccessIP: net.ParseIP("10.0.0.2")}
+	upf3 := &Upf{NodeID: "upf3", AccessIP: net.ParseIP("10.0.0.1")}
+
+	node := &PFCPNode{upf: &Upf{teids: newTEIDAllocator(16)}}
+	require.True(t, node.fteidsValidOn(1, upf2), "no F-TEID chosen")
+
+	_, err := node.upf.teids.choose(1, upf1, upf1.AccessIP.To4(), nil, []*ie.IE{chooseFTEIDPDR(1, 0)})
+	require.NoError(t, err)
+
+	require.True(t, node.fteidsValidOn(1, upf1))
+	require.False(t, node.fteidsValidOn(1, upf2), "the SMF can't be told of other F-TEIDs")
+	require.True(t, node.fteidsValidOn(1, upf3), "same N3 address")
+
+	node.upf.virtualUPF = &Upf{AccessIP: net.ParseIP("10.0.0.9")}
+	_, err = node.upf.teids.choose(2, upf1, net.ParseIP("10.0.0.9").To4(), nil, []*ie.IE{chooseFTEIDPDR(1, 0)})
+	require.NoError(t, err)
+	require.True(t, node.fteidsValidOn(2, upf2), "the pool's N3 address")
+}
+
+func TestTEIDAllocatorRetire(t *testing.T) {
+	a := newTEIDAllocator(4)
+	upf1, upf2, upf3 := &Upf{NodeID: "upf1"}, &Upf{NodeID: "upf2"}, &Upf{NodeID: "upf3"}
+	n3 := net.ParseIP("10.0.0.1").To4()
+
+	_, err := a.choose(1, upf1, n3, nil, []*ie.IE{chooseFTEIDPDR(1, 0)})
+	require.NoError(t, err)
+
+	a.retire(upf1)
+
+	pdrs, err := a.choose(2, upf2, n3, nil, []*ie.IE{chooseFTEIDPDR(1, 0)})
+	require.NoError(t, err)
+	require.Equal(t, uint32(8), pdrFTEID(t, pdrs[0]).TEID, "session 1 still uses a TEID of upf1's range")
+
+	a.release(1)
+	a.retire(upf2)
+
+	pdrs, err = a.choose(3, upf3, n3, nil, []*ie.IE{chooseFTEIDPDR(1, 0)})
+	require.NoError(t, err)
+	require.Equal(t, uint32(4), pdrFTEID(t, pdrs[0]).TEID, "upf1's slot is free again")
+	require.Equal(t, uint32(3), a.nextSlot)
+}
+
+func TestHandleDeadUpfKeepsFTEIDs(t *testing.T) {
+	dead := &Upf{NodeID: "upf1", AccessIP: net.ParseIP("10.0.0.1"), upfsSessions: []uint64{1, 2, 3}}
+	upf2 := &Upf{NodeID: "upf2", AccessIP: net.ParseIP("10.0.0.2")}
+	upf3 := &Upf{NodeID: "upf3", AccessIP: net.ParseIP("10.0.0.1"), upfsSessions: []uint64{5, 6}}
+
+	node := &PFCPNode{upf: &Upf{
+		peersUPF:       []*Upf{dead, upf2, upf3},
+		lbmap:          map[uint64]int{1: 0, 2: 0, 3: 0, 5: 2, 6: 2},
+		sesEstMsgStore: make(map[uint64]*message.SessionEstablishmentRequest),
+		sesModMsgStore: make(map[uint64]*message.SessionModificationRequest),
+		teids:          newTEIDAllocator(16),
+	}}
+
+	for _, seid := range []uint64{1, 2, 3} {
+		node.upf.sesEstMsgStore[seid] = &message.SessionEstablishmentRequest{}
+	}
+
+	_, err := node.upf.teids.choose(1, dead, dead.AccessIP.To4(), nil, []*ie.IE{chooseFTEIDPDR(1, 0)})
+	require.NoError(t, err)
+	_, err = node.upf.teids.choose(3, dead, net.ParseIP("10.0.0.5").To4(), nil, []*ie.IE{chooseFTEIDPDR(1, 0)})
+	require.NoError(t, err)
+
+	placed := node.handleDeadUpf(0)
+
+	require.Equal(t, map[uint64]bool{1: true, 2: true}, placed)
+	require.Equal(t, []*Upf{upf2, upf3}, node.upf.peersUPF)
+	require.Equal(t, 1, node.upf.lbmap[1], "upf3 shares its N3 address")
+	require.Equal(t, 0, node.upf.lbmap[2], "no F-TEID chosen, the lighter upf2")
+
+	_, ok := node.upf.lbmap[3]
+	require.False(t, ok, "no UPF has its N3 address")
+	require.NotContains(t, node.upf.sesEstMsgStore, uint64(3))
+}
@@ -0,0 +1,216 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright 2022-present Open Networking Foundation
+
+package pfcpiface
+
+import (
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/wmnsk/go-pfcp/ie"
+	"github.com/wmnsk/go-pfcp/message"
+)
+
+// UE IP Address flags, 3GPP TS 29.244 section 8.2.62.
+const (
+	ueIPFlagV4 = 0x02
+	ueIPFlagSD = 0x04
+)
+
+// ueIPAllocator answers the UE IP allocation requests of the SMF on behalf of
+// the pool, from one IPPool per DNN, so that a UE keeps its address whichever
+// UPF serves its session.
+type ueIPAllocator struct {
+	mu         sync.Mutex
+	pools      map[string]*IPPool
+	defaultDnn string
+	sessions   map[uint64]*IPPool  // pool each session got its address from
+	created    map[uint64][]*ie.IE // Created PDRs not yet sent to the SMF
+}
+
+// newUEIPAllocator creates the pools of UE subnets by DNN. Sessions of a DNN
+// without pool get addresses from the one of defaultDnn.
+func newUEIPAllocator(subnets map[string]string, defaultDnn string) (*ueIPAllocator, error) {
+	a := &ueIPAllocator{
+		pools:      make(map[string]*IPPool),
+		defaultDnn: defaultDnn,
+		sessions:   make(map[uint64]*IPPool),
+		created:    make(map[uint64][]*ie.IE),
+	}
+
+	for dnn, subnet := range subnets {
+		pool, err := NewIPPool(subnet)
+		if err != nil {
+			return nil, err
+		}
+
+		a.pools[dnn] = pool
+	}
+
+	return a, nil
+}
+
+// pool returns the pool of dnn. Must be called with the lock held.
+func (a *ueIPAllocator) pool(dnn string) *IPPool {
+	if pool, ok := a.pools[dnn]; ok {
+		return pool
+	}
+
+	return a.pools[a.defaultDnn]
+}
+
+// allocate rewrites the UE IP Address IEs of createPDRs asking the UP function
+// to allocate an address into the address of session seid, taken from the
+// pool of dnn.
+func (a *ueIPAllocator) allocate(seid uint64, dnn string, createPDRs []*ie.IE) ([]*ie.IE, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	rewritten := make([]*ie.IE, 0, len(createPDRs))
+
+	for _, c := range createPDRs {
+		ueIPIE, err := pdiIE(c, ie.UEIPAddress)
+		if err != nil {
+			rewritten = append(rewritten, c)
+			continue
+		}
+
+		ueIP, err := ueIPIE.UEIPAddress()
+		if err != nil || !needAllocIP(ueIP) {
+			rewritten = append(rewritten, c)
+			continue
+		}
+
+		pdrID, err := c.PDRID()
+		if err != nil {
+			return nil, err
+		}
+
+		pool, ok := a.sessions[seid]
+		if !ok {
+			if pool = a.pool(dnn); pool == nil {
+				return nil, ErrNotFoundWithParam("UE IP pool", "dnn", dnn)
+			}
+		}
+
+		ip, err := pool.LookupOrAllocIP(seid)
+		if err != nil {
+			return nil, err
+		}
+
+		a.sessions[seid] = pool
+
+		allocated := ie.NewUEIPAddress(ueIPFlagV4|(ueIP.Flags&ueIPFlagSD), ip.String(), "", 0, 0)
+
+		pdr, err := replacePDIIE(c, allocated)
+		if err != nil {
+			return nil, err
+		}
+
+		rewritten = append(rewritten, pdr)
+		a.created[seid] = append(a.created[seid],
+			ie.NewCreatedPDR(ie.NewPDRID(pdrID), ie.NewUEIPAddress(ueIPFlagV4, ip.String(), "", 0, 0)))
+	}
+
+	return rewritten, nil
+}
+
+// takeCreated returns the Created PDRs of seid not yet sent to the SMF.
+func (a *ueIPAllocator) takeCreated(seid uint64) []*ie.IE {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	created := a.created[seid]
+	delete(a.created, seid)
+
+	return created
+}
+
+// release returns the address of a deleted session to its pool.
+func (a *ueIPAllocator) release(seid uint64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	delete(a.created, seid)
+
+	pool, ok := a.sessions[seid]
+	if !ok {
+		return
+	}
+
+	delete(a.sessions, seid)
+
+	if err := pool.DeallocIP(seid); err != nil {
+		log.Errorln("Failed to release UE IP of session", seid, err)
+	}
+}
+
+// sessionDnn returns the DNN of a session: its APN/DNN, or else the Network
+// Instance of its PDRs.
+func sessionDnn(sereq *message.SessionEstablishmentRequest) string {
+	if sereq.APNDNN != nil {
+		if dnn, err := sereq.APNDNN.APNDNN(); err == nil && dnn != "" {
+			return dnn
+		}
+	}
+
+	for _, c := range sereq.CreatePDR {
+		if ni, err := pdiIE(c, ie.NetworkInstance); err == nil {
+			if dnn, err := ni.NetworkInstance(); err == nil && dnn != "" {
+				return dnn
+			}
+		}
+	}
+
+	return ""
+}
+
+// allocateUEIPs rewrites the UE IP allocation requests of createPDRs of session seid.
+func (node *PFCPNode) allocateUEIPs(seid uint64, dnn string, createPDRs []*ie.IE) ([]*ie.IE, error) {
+	if node.upf.ueIPs == nil || len(createPDRs) == 0 {
+		return createPDRs, nil
+	}
+
+	return node.upf.ueIPs.allocate(seid, dnn, createPDRs)
+}
+
+// mergeCreatedPDRs groups the Created PDRs reported for the same PDR, e.g. for
+// its F-TEID and UE IP chosen separately, into one.
+func mergeCreatedPDRs(created []*ie.IE) []*ie.IE {
+	merged := make([]*ie.IE, 0, len(created))
+	order := make([]uint16, 0, len(created))
+	children := make(map[uint16][]*ie.IE)
+
+	for _, c := range created {
+		pdrID, err := c.PDRID()
+		if err != nil {
+			merged = append(merged, c)
+			continue
+		}
+
+		ies, err := c.CreatedPDR()
+		if err != nil {
+			merged = append(merged, c)
+			continue
+		}
+
+		if _, ok := children[pdrID]; !ok {
+			order = append(order, pdrID)
+			children[pdrID] = ies
+
+			continue
+		}
+
+		for _, i := range ies {
+			if i.Type != ie.PDRID {
+				children[pdrID] = append(children[pdrID], i)
+			}
+		}
+	}
+
+	for _, pdrID := range order {
+		merged = append(merged, ie.NewCreatedPDR(children[pdrID]...))
+	}
+
+	return merged
+}
@@ -0,0 +1,99 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright 2022-present Open Networking Foundation
+
+package pfcpiface
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/wmnsk/go-pfcp/ie"
+)
+
+func allocUEIPPDR(pdrID uint16) *ie.IE {
+	return ie.NewCreatePDR(
+		ie.NewPDRID(pdrID),
+		ie.NewPDI(
+			ie.NewSourceInterface(ie.SrcInterfaceCore),
+			ie.NewUEIPAddress(0x10|ueIPFlagSD, "", "", 0, 0),
+		),
+	)
+}
+
+func pdrUEIP(t *testing.T, pdr *ie.IE) *ie.UEIPAddressFields {
+	ueIPIE, err := pdiIE(pdr, ie.UEIPAddress)
+	require.NoError(t, err)
+
+	ueIP, err := ueIPIE.UEIPAddress()
+	require.NoError(t, err)
+
+	return ueIP
+}
+
+func TestUEIPAllocatorAllocate(t *testing.T) {
+	a, err := newUEIPAllocator(map[string]string{
+		"internet": "10.250.0.0/24",
+		"ims":      "10.251.0.0/24",
+	}, "internet")
+	require.NoError(t, err)
+
+	pdrs, err := a.allocate(1, "ims", []*ie.IE{allocUEIPPDR(1), chooseFTEIDPDR(2, 0)})
+	require.NoError(t, err)
+	require.Len(t, pdrs, 2)
+
+	ueIP := pdrUEIP(t, pdrs[0])
+	require.False(t, needAllocIP(ueIP))
+	require.Equal(t, uint8(ueIPFlagSD), ueIP.Flags&ueIPFlagSD, "SD flag is kept")
+	require.True(t, net.ParseIP("10.251.0.0").Mask(net.CIDRMask(24, 32)).Equal(ueIP.IPv4Address.Mask(net.CIDRMask(24, 32))))
+	require.Equal(t, chooseFTEIDPDR(2, 0), pdrs[1], "PDRs without allocation request are left as is")
+
+	created := a.takeCreated(1)
+	require.Len(t, created, 1)
+	require.Empty(t, a.takeCreated(1))
+
+	// Later requests of the session get the same address
+	pdrs, err = a.allocate(1, "ims", []*ie.IE{allocUEIPPDR(3)})
+	require.NoError(t, err)
+	require.True(t, ueIP.IPv4Address.Equal(pdrUEIP(t, pdrs[0]).IPv4Address))
+
+	// Unknown DNNs fall back to the default pool
+	pdrs, err = a.allocate(2, "unknown", []*ie.IE{allocUEIPPDR(1)})
+	require.NoError(t, err)
+
+	other := pdrUEIP(t, pdrs[0]).IPv4Address
+	require.True(t, net.ParseIP("10.250.0.0").Equal(other.Mask(net.CIDRMask(24, 32))))
+
+	a.release(1)
+	a.release(1)
+	require.Empty(t, a.sessions[1])
+	require.Empty(t, a.takeCreated(1))
+}
+
+func TestUEIPAllocatorNoPool(t *testing.T) {
+	a, err := newUEIPAllocator(map[string]string{"ims": "10.251.0.0/24"}, "internet")
+	require.NoError(t, err)
+
+	_, err = a.allocate(1, "internet", []*ie.IE{allocUEIPPDR(1)})
+	require.Error(t, err)
+
+	_, err = newUEIPAllocator(map[string]string{"ims": "not a subnet"}, "ims")
+	require.Error(t, err)
+}
+
+func TestMergeCreatedPDRs(t *testing.T) {
+	merged := mergeCreatedPDRs([]*ie.IE{
+		ie.NewCreatedPDR(ie.NewPDRID(1), ie.NewFTEID(fteidFlagV4, 4, net.ParseIP("10.0.0.1"), nil, 0)),
+		ie.NewCreatedPDR(ie.NewPDRID(2), ie.NewFTEID(fteidFlagV4, 5, net.ParseIP("10.0.0.1"), nil, 0)),
+		ie.NewCreatedPDR(ie.NewPDRID(1), ie.NewUEIPAddress(ueIPFlagV4, "10.250.0.1", "", 0, 0)),
+	})
+	require.Len(t, merged, 2)
+
+	ies, err := merged[0].CreatedPDR()
+	require.NoError(t, err)
+	require.Len(t, ies, 3)
+
+	pdrID, err := merged[1].PDRID()
+	require.NoError(t, err)
+	require.Equal(t, uint16(2), pdrID)
+}
@@ -6,11 +6,12 @@ package pfcpiface
 import (
 	"errors"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Showmax/go-fqdn"
 	log "github.com/sirupsen/logrus"
-	"github.com/wmnsk/go-pfcp/ie"
 	"github.com/wmnsk/go-pfcp/message"
 )
 
@@ -37,42 +38,49 @@ type UeResource struct {
 	dnn  string
 }
 type Upf struct {
-	EnableUeIPAlloc        bool `json:"enableueipalloc"`
-	EnableEndMarker        bool `json:"enableendmarker"`
-	enableFlowMeasure      bool
-	accessIface            string
-	coreIface              string
-	ippoolCidr             string
-	AccessIP               net.IP `json:"accessip"`
-	CoreIP                 net.IP `json:"coreip"`
-	NodeID                 string `json:"nodeid"`
-	ippool                 *IPPool
-	peersIP                string
-	peersUPF               []*Upf
-	upfsSessions           []uint64       // each upf handles which sessions
-	lbmap                  map[uint64]int // each session is handled by which upf
-	sesEstMsgStore         map[uint64]*message.SessionEstablishmentRequest
-	sesModMsgStore         map[uint64]*message.SessionModificationRequest
-	seidToRespCh           map[uint64]chan *ie.IE
-	MaxSessionsThreshold   uint32
-	MinSessionsThreshold   uint32
-	MaxCPUThreshold        uint32
-	MinCPUThreshold        uint32
-	MaxBitRateThreshold    uint64
-	MinBitRateThreshold    uint64
-	MaxSessionstolerance   float32
-	MinSessionstolerance   float32
-	ReconciliationInterval uint32
-	AutoScaleOut           bool
-	AutoScaleIn            bool
-	ScaleByCPU             bool
-	ScaleBySession         bool
-	ScaleByBitRate         bool
-	MaxUPFs                uint32
-	MinUPFs                uint32
-	Hostname               string `json:"hostname"`
-	LastBytes              uint64
-	ScaleInDecision        bool
+	EnableUeIPAlloc      bool `json:"enableueipalloc"`
+	EnableEndMarker      bool `json:"enableendmarker"`
+	enableFlowMeasure    bool
+	accessIface          string
+	coreIface            string
+	ippoolCidr           string
+	AccessIP             net.IP `json:"accessip"`
+	AccessIPv6           net.IP `json:"accessipv6"` // optional, for dual-stack N3
+	CoreIP               net.IP `json:"coreip"`
+	NodeID               string `json:"nodeid"`
+	ippool               *IPPool
+	peersIP              string
+	fqdn                 string            // DNS name the UPF is re-resolved from, empty if registered by IP
+	labels               map[string]string // from its registration, e.g. its version
+	peersUPF             []*Upf
+	virtualUPF           *Upf           // identity advertised to the SMF while peersUPF is empty
+	upfsSessions         []uint64       // each upf handles which sessions
+	lbmap                map[uint64]int // each session is handled by which upf
+	placementMu          sync.Mutex     // guards lbmap, and the upfsSessions and peersIP of peersUPF
+	sesEstMsgStore       map[uint64]*message.SessionEstablishmentRequest
+	sesModMsgStore       map[uint64]*message.SessionModificationRequest
+	sesURRs              map[uint64]map[uint32]bool // URRs each session has, as its requests created and removed them
+	seidToRespCh         map[uint64]chan *SesRespD2uMsg
+	gtpuPaths            *gtpuPathMonitor  // remote GTP-U peers each UPF can't reach
+	migrations           *migrationTable   // sessions moving between UPFs
+	teids                *teidAllocator    // nil unless the LB chooses F-TEIDs
+	ueIPs                *ueIPAllocator    // nil unless the LB allocates UE IPs
+	standbys             *standbyTable     // nil unless sessions get a hot standby
+	canary               *canaryRouter     // share of new sessions sent to canary UPFs
+	shadow               *shadowMirror     // UPF mirrored the session requests, outside of the pool
+	orchestrator         Orchestrator      // nil if the UPFs can't be created or deleted
+	metrics              MetricsSource     // nil if the usage of the UPFs can't be read
+	names                *upfNameAllocator // of the UPFs created on scale-out
+	autoscaler           *autoscaler       // resizes the pool, nil unless on Down
+	drains               *drainer          // moving the sessions off UPFs, nil unless on Down
+	staticPool           *staticPool       // UPFs associated with by the LB, nil unless configured
+	discovery            *upfDiscovery     // finds UPFs for the static pool, nil unless configured
+	lbUEIPAlloc          bool              // UE IPs are allocated by the LB, not the UPFs
+	loadControl          loadControl       // last LCI/OCI reported by this UPF
+	MaxSessionsThreshold uint32            // of the active scaling profile, read with maxSessions
+	AutoScaleOut         bool
+	AutoScaleIn          bool
+	Hostname             string `json:"hostname"`
 	//peersSessions     []SessionMap
 	Dnn              string `json:"dnn"`
 	reportNotifyChan chan uint64
@@ -84,6 +92,14 @@ type Upf struct {
 	respTimeout   time.Duration
 	enableHBTimer bool
 	hbInterval    time.Duration
+
+	smfHBInterval  time.Duration
+	smfN1          uint8
+	smfT1          time.Duration
+	smfGracePeriod time.Duration
+	smfPaths       *smfPathTable // state of the path towards each SMF, as seen by Up
+
+	upfResolveInterval time.Duration
 }
 
 // to be replaced with go-pfcp structs
@@ -106,6 +122,11 @@ func (u *Upf) isConnected() bool {
 	return u.datapath.IsConnected(&u.AccessIP)
 }
 
+// maxSessions returns the most sessions a UPF should serve.
+func (u *Upf) maxSessions() int {
+	return int(atomic.LoadUint32(&u.MaxSessionsThreshold))
+}
+
 func (u *Upf) addSliceInfo(sliceInfo *SliceInfo) error {
 	if sliceInfo == nil {
 		return ErrInvalidArgument("sliceInfo", sliceInfo)
@@ -126,7 +147,12 @@ func (u *Upf) addPFCPPeer(pfcpInfo *PfcpInfo) error {
 	//fmt.Println("accessIP = ", pfcpInfo.Upf.AccessIP)
 	//fmt.Println("coreIP = ", pfcpInfo.Upf.CoreIP)
 	//fmt.Println("nodeID = ", pfcpInfo.Upf.NodeID)
+	// Same form as the remote address of the PFCPConn, pConns lookups depend on it
+	pfcpInfo.Ip = canonicalIP(pfcpInfo.Ip)
+	pfcpInfo.Upf.NodeID = canonicalNodeID(pfcpInfo.Upf.NodeID)
 	pfcpInfo.Upf.peersIP = pfcpInfo.Ip
+	pfcpInfo.Upf.fqdn = pfcpInfo.Fqdn
+	pfcpInfo.Upf.labels = pfcpInfo.Labels
 	pfcpInfo.Upf.upfsSessions = make([]uint64, 0)
 	u.peersUPF = append(u.peersUPF, pfcpInfo.Upf)
 
@@ -152,8 +178,9 @@ func NewUPF(conf *Conf, pos Position,
 		}
 	}
 
+	// FQDN Node IDs are advertised as such, other hostnames are resolved.
 	// TODO: Delete this once CI config is fixed
-	if nodeID != "" {
+	if nodeID != "" && !conf.CPIface.UseFQDN {
 		hosts, err := net.LookupHost(nodeID)
 		if err != nil {
 			log.Fatalln("Unable to resolve hostname", nodeID, err)
@@ -179,39 +206,91 @@ func NewUPF(conf *Conf, pos Position,
 		//datapath:          fp,
 		Dnn:            conf.CPIface.Dnn,
 		peersUPF:       make([]*Upf, 0),
+		virtualUPF:     newVirtualUPF(conf),
 		upfsSessions:   make([]uint64, 0),
 		lbmap:          make(map[uint64]int, 0),
 		sesEstMsgStore: make(map[uint64]*message.SessionEstablishmentRequest, 0),
 		sesModMsgStore: make(map[uint64]*message.SessionModificationRequest, 0),
-		seidToRespCh:   make(map[uint64]chan *ie.IE),
+		sesURRs:        make(map[uint64]map[uint32]bool),
+		seidToRespCh:   make(map[uint64]chan *SesRespD2uMsg),
+		gtpuPaths:      newGTPUPathMonitor(),
+		migrations:     newMigrationTable(),
+		canary:         newCanaryRouter(conf.Canary),
+		shadow:         newShadowMirror(conf.ShadowUPF.NodeID),
 		//peersSessions: make([]SessionMap, 0),
 		//reportNotifyChan:  make(chan uint64, 1024),
-		maxReqRetries:          conf.MaxReqRetries,
-		enableHBTimer:          conf.EnableHBTimer,
-		readTimeout:            time.Second * time.Duration(conf.ReadTimeout),
-		respTimeout:            time.Second * resptime,
-		MaxSessionsThreshold:   conf.MaxSessionsThreshold,
-		MinSessionsThreshold:   conf.MinSessionsThreshold,
-		MaxCPUThreshold:        conf.MaxCPUThreshold,
-		MinCPUThreshold:        conf.MinCPUThreshold,
-		MaxBitRateThreshold:    conf.MaxBitRateThreshold,
-		MinBitRateThreshold:    conf.MinBitRateThreshold,
-		MaxSessionstolerance:   conf.MaxSessionstolerance,
-		MinSessionstolerance:   conf.MinSessionstolerance,
-		ReconciliationInterval: conf.ReconciliationInterval,
-		AutoScaleOut:           conf.AutoScaleOut,
-		AutoScaleIn:            conf.AutoScaleIn,
-		ScaleByCPU:             conf.ScaleByCPU,
-		ScaleBySession:         conf.ScaleBySession,
-		ScaleByBitRate:         conf.ScaleByBitRate,
-		MaxUPFs:                conf.MaxUPFs,
-		MinUPFs:                conf.MinUPFs,
+		maxReqRetries:        conf.MaxReqRetries,
+		enableHBTimer:        conf.EnableHBTimer,
+		readTimeout:          time.Second * time.Duration(conf.ReadTimeout),
+		respTimeout:          time.Second * resptime,
+		MaxSessionsThreshold: conf.MaxSessionsThreshold,
+		AutoScaleOut:         conf.AutoScaleOut,
+		AutoScaleIn:          conf.AutoScaleIn,
+		smfHBInterval:        durationOrDefault(conf.SMFPath.HeartBeatInterval, smfHBIntervalDefault),
+		smfN1:                smfN1Default,
+		smfT1:                durationOrDefault(conf.SMFPath.T1, smfT1Default),
+		smfGracePeriod:       smfGracePeriodDefault,
+		smfPaths:             newSMFPathTable(),
+		upfResolveInterval:   durationOrDefault(conf.UPFResolveInterval, upfResolveIntervalDefault),
+		lbUEIPAlloc:          conf.UEIPAlloc.Enable,
 		//readTimeout: 15 * time.Second,
 	}
 
+	if conf.SMFPath.N1 != nil {
+		u.smfN1 = *conf.SMFPath.N1
+	}
+
+	// Unlike other durations, 0s is meaningful: sessions of a lost SMF are released at once
+	if d, err := time.ParseDuration(conf.SMFPath.GracePeriod); err == nil && d >= 0 {
+		u.smfGracePeriod = d
+	}
+
 	if pos == Down {
 		u.enableHBTimer = true
 		u.hbInterval = 5 * time.Second
+
+		if conf.TEIDAlloc.Enable {
+			u.teids = newTEIDAllocator(conf.TEIDAlloc.RangeSize)
+		}
+
+		if conf.HotStandby.Enable {
+			u.standbys = newStandbyTable(conf.HotStandby.Dnns)
+		}
+
+		u.names = newUPFNameAllocator(conf.UPFNames)
+		u.drains = newDrainer(conf.Drain)
+
+		if conf.Discovery.SRV != "" || conf.Discovery.Service != "" {
+			u.discovery = newUPFDiscovery(conf)
+		}
+
+		if len(conf.StaticPool.UPFs) > 0 || u.discovery != nil {
+			u.staticPool = newStaticPool(conf)
+		}
+		u.autoscaler = newAutoscaler(conf)
+		u.autoscaler.onProfile = func(p scalingProfile) {
+			atomic.StoreUint32(&u.MaxSessionsThreshold, p.MaxSessions)
+		}
+		// The profile of a schedule active at startup is already followed
+		u.autoscaler.onProfile(u.autoscaler.profile)
+
+		u.orchestrator, err = NewOrchestrator(conf)
+		if err != nil {
+			log.Warnln("UPFs will not be scaled, no orchestrator:", err)
+		}
+
+		u.metrics, err = NewMetricsSource(conf)
+		if err != nil {
+			log.Warnln("UPFs will be scaled by sessions only, no metrics source:", err)
+		}
+
+		if conf.UEIPAlloc.Enable {
+			u.ueIPs, err = newUEIPAllocator(conf.UEIPAlloc.Pools, conf.CPIface.Dnn)
+			if err != nil {
+				log.Errorln("Unable to create UE IP pools", err)
+				return nil
+			}
+		}
 	}
 
 	//if len(conf.CPIface.Peers) > 0 {
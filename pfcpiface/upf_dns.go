@@ -0,0 +1,186 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright 2022-present Open Networking Foundation
+
+package pfcpiface
+
+import (
+	"net"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// lookupHost is replaced in tests.
+var lookupHost = net.LookupHost
+
+// canonicalNodeID returns the form Node IDs are compared in: canonical text for
+// IP addresses, lower case without trailing dot for FQDNs.
+func canonicalNodeID(nodeID string) string {
+	if ip := net.ParseIP(nodeID); ip != nil {
+		return ip.String()
+	}
+
+	return strings.ToLower(strings.TrimSuffix(nodeID, "."))
+}
+
+// resolveUPFAddr returns the IP a UPF registered by FQDN is currently reachable at.
+func resolveUPFAddr(fqdn string) (string, error) {
+	addrs, err := lookupHost(fqdn)
+	if err != nil {
+		return "", err
+	}
+
+	if len(addrs) == 0 {
+		return "", ErrNotFoundWithParam("address", "fqdn", fqdn)
+	}
+
+	return canonicalIP(addrs[0]), nil
+}
+
+// upfAddrChanges re-resolves the UPFs registered by FQDN and returns the ones
+// whose address changed, with their new address.
+func (node *PFCPNode) upfAddrChanges() map[*Upf]string {
+	changes := make(map[*Upf]string)
+	addrs := make(map[*Upf]string)
+
+	node.upf.placementMu.Lock()
+	for _, u := range node.upf.peersUPF {
+		if u.fqdn != "" {
+			addrs[u] = u.peersIP
+		}
+	}
+	node.upf.placementMu.Unlock()
+
+	for u, addr := range addrs {
+		ip, err := resolveUPFAddr(u.fqdn)
+		if err != nil {
+			log.Warnln("Unable to resolve UPF", u.NodeID, "at", u.fqdn, err)
+			continue
+		}
+
+		if ip != addr {
+			changes[u] = ip
+		}
+	}
+
+	return changes
+}
+
+// upfAddr returns the PFCP address of the UPF at upfIndex.
+func (node *PFCPNode) upfAddr(upfIndex int) string {
+	node.upf.placementMu.Lock()
+	defer node.upf.placementMu.Unlock()
+
+	return upfPFCPAddr(node.upf.peersUPF[upfIndex].peersIP)
+}
+
+// upfRebind is a known UPF to re-associate with, found at ip.
+type upfRebind struct {
+	u  *Upf
+	ip string
+}
+
+// requestRebind has the node's goroutine rebind u to ip, one rebind at a time.
+func (node *PFCPNode) requestRebind(u *Upf, ip string) {
+	select {
+	case node.rebinds <- upfRebind{u: u, ip: ip}:
+	case <-node.ctx.Done():
+	}
+}
+
+// refreshUPFAddrs periodically re-resolves the UPFs registered by FQDN, so that a
+// UPF coming back with a new IP keeps its identity and sessions.
+func (node *PFCPNode) refreshUPFAddrs(comCh CommunicationChannel) {
+	ticker := time.NewTicker(node.upf.upfResolveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-node.ctx.Done():
+			return
+		case <-ticker.C:
+			for u, ip := range node.upfAddrChanges() {
+				node.requestRebind(u, ip)
+			}
+		}
+	}
+}
+
+// rebindUPF re-associates with an already known UPF found at ip. If the address
+// changed, its PFCPConn and sessions are moved to a connection to the new address.
+// It runs on the node's goroutine, see requestRebind.
+func (node *PFCPNode) rebindUPF(u *Upf, ip string, comCh CommunicationChannel) {
+	pfcpInfo := PfcpInfo{Ip: ip, Fqdn: u.fqdn, Upf: u, rebind: true}
+	oldAddr := upfPFCPAddr(u.peersIP)
+
+	v, ok := node.pConns.Load(oldAddr)
+	if ip == u.peersIP {
+		if ok {
+			log.Infoln("UPF", u.NodeID, "registered again at", ip, ", re-associating")
+			go v.(*PFCPConn).sendAssociationRequest(pfcpInfo, comCh, node)
+		}
+
+		return
+	}
+
+	log.Infoln("UPF", u.NodeID, "moved from", u.peersIP, "to", ip)
+
+	node.upf.placementMu.Lock()
+	u.peersIP = ip
+	node.upf.placementMu.Unlock()
+
+	pConn := node.NewPFCPConn(node.LocalAddr().String(), upfPFCPAddr(ip), nil, comCh, Down)
+	if pConn == nil {
+		return
+	}
+
+	if ok {
+		old := v.(*PFCPConn)
+		pConn.sessionStore = old.sessionStore
+		pConn.ts.learnRemote(old.ts.getRemote())
+		old.detach()
+		node.pConns.Delete(oldAddr)
+	}
+
+	go pConn.sendAssociationRequest(pfcpInfo, comCh, node)
+}
+
+// detach closes a connection to a UPF that moved, without handling the UPF as
+// dead: its sessions now belong to the connection to its new address. Unlike
+// Shutdown, it doesn't report the connection done, the node's goroutine running
+// the rebind removes it.
+func (pConn *PFCPConn) detach() {
+	select {
+	case <-pConn.shutdown:
+		return
+	default:
+	}
+
+	close(pConn.shutdown)
+
+	if pConn.hbCtxCancel != nil {
+		pConn.hbCtxCancel()
+		pConn.hbCtxCancel = nil
+	}
+
+	if err := pConn.Close(); err != nil {
+		log.Errorln("Failed to close PFCP connection to", pConn.RemoteAddr(), err)
+	}
+}
+
+// reestablishSessions replays the sessions of a UPF that restarted and lost them.
+func (pConn *PFCPConn) reestablishSessions(node *PFCPNode, comCh CommunicationChannel) {
+	for _, sess := range pConn.sessionStore.GetAllSessions() {
+		estMsg, ok := node.upf.sesEstMsgStore[sess.localSEID]
+		if !ok {
+			continue
+		}
+
+		comCh.SesEstU2d <- &SesEstU2dMsg{
+			msg:       estMsg,
+			upSeid:    sess.localSEID,
+			reforward: true,
+		}
+	}
+}
@@ -0,0 +1,71 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright 2022-present Open Networking Foundation
+
+package pfcpiface
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCanonicalNodeID(t *testing.T) {
+	require.Equal(t, "upf101.omec.svc.cluster.local", canonicalNodeID("UPF101.omec.svc.cluster.local."))
+	require.Equal(t, "2001:db8::1", canonicalNodeID("2001:DB8::1"))
+	require.Equal(t, "10.0.0.1", canonicalNodeID("10.0.0.1"))
+}
+
+func TestUPFAddrChanges(t *testing.T) {
+	defer func(orig func(string) ([]string, error)) { lookupHost = orig }(lookupHost)
+
+	lookupHost = func(host string) ([]string, error) {
+		switch host {
+		case "upf101.omec":
+			return []string{"10.0.0.11"}, nil
+		case "upf102.omec":
+			return []string{"10.0.0.2"}, nil
+		default:
+			return nil, errors.New("no such host")
+		}
+	}
+
+	moved := &Upf{NodeID: "upf101.omec", fqdn: "upf101.omec", peersIP: "10.0.0.1"}
+	same := &Upf{NodeID: "upf102.omec", fqdn: "upf102.omec", peersIP: "10.0.0.2"}
+	unresolvable := &Upf{NodeID: "upf103.omec", fqdn: "upf103.omec", peersIP: "10.0.0.3"}
+	byIP := &Upf{NodeID: "10.0.0.4", peersIP: "10.0.0.4"}
+
+	node := &PFCPNode{upf: &Upf{peersUPF: []*Upf{moved, same, unresolvable, byIP}}}
+
+	require.Equal(t, map[*Upf]string{moved: "10.0.0.11"}, node.upfAddrChanges())
+}
+
+func TestRebindSerialized(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	node := &PFCPNode{ctx: ctx, rebinds: make(chan upfRebind)}
+	u := &Upf{NodeID: "upf101.omec"}
+
+	done := make(chan struct{})
+	go func() {
+		node.requestRebind(u, "10.0.0.11")
+		close(done)
+	}()
+
+	require.Equal(t, upfRebind{u: u, ip: "10.0.0.11"}, <-node.rebinds, "handed to the node's goroutine")
+	<-done
+
+	cancel()
+	node.requestRebind(u, "10.0.0.12")
+}
+
+func TestDetachDoesNotBlock(t *testing.T) {
+	conn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 8805})
+	require.NoError(t, err)
+
+	// Nobody reads done, as while the node's goroutine runs the rebind
+	pConn := &PFCPConn{Conn: conn, done: make(chan string), shutdown: make(chan struct{})}
+	pConn.detach()
+	pConn.detach()
+}
@@ -0,0 +1,166 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright 2022-present Open Networking Foundation
+
+package pfcpiface
+
+import (
+	"bytes"
+	"encoding/json"
+	"path/filepath"
+	"sort"
+	"text/template"
+	"time"
+)
+
+// preStopGraceMargin is left to a UPF pod after the drain deadline, for the
+// pre-stop hook to get its answer and the containers to stop.
+const preStopGraceMargin = 30 * time.Second
+
+// UPFResources are the CPU and memory of a UPF's datapath container, e.g.
+// "2" and "4Gi", unbounded if empty.
+type UPFResources struct {
+	CPU    string `json:"cpu,omitempty"`
+	Memory string `json:"memory,omitempty"`
+}
+
+// UPFManifestValues are the values the manifest templates of a UPF are
+// rendered with.
+type UPFManifestValues struct {
+	Name       string // e.g. "upf101", of its objects, pod and PFCP agent
+	Namespace  string
+	Image      string // of the datapath
+	AgentImage string // of the PFCP agent
+	Resources  UPFResources
+	AccessIP   string // CIDR of its access interface
+	CoreIP     string // CIDR of its core interface
+	// Next hops of its routes towards the gNBs and the core, no route if empty
+	AccessGateway string
+	CoreGateway   string
+	// Called by the pre-stop hook of the pod, no hook if empty, which is given
+	// TerminationGracePeriod seconds to drain the UPF
+	PreStopURL             string
+	TerminationGracePeriod int64
+	Ueransim               bool
+	SliceMeter             SliceMeterConfig
+	QoS                    []QciQosConfig
+}
+
+// manifestRenderer renders the manifest of each UPF from the templates of a
+// directory, leaving them untouched.
+type manifestRenderer struct {
+	tmpl     *template.Template
+	names    []string // of the templates, in the order they are rendered
+	defaults UPFManifestValues
+	upfs     map[string]UPFValuesInfo
+}
+
+func newManifestRenderer(conf *Conf) (*manifestRenderer, error) {
+	files, err := filepath.Glob(filepath.Join(conf.UPFTemplate.TemplateDir, "*.yaml"))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(files) == 0 {
+		return nil, ErrNotFound("UPF templates in " + conf.UPFTemplate.TemplateDir)
+	}
+
+	tmpl, err := template.New("upf").Option("missingkey=error").Funcs(template.FuncMap{
+		"json": func(v interface{}) (string, error) {
+			b, err := json.Marshal(v)
+			return string(b), err
+		},
+	}).ParseFiles(files...)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(files))
+	for _, f := range files {
+		names = append(names, filepath.Base(f))
+	}
+
+	sort.Strings(names)
+
+	t := conf.UPFTemplate
+
+	return &manifestRenderer{
+		tmpl:  tmpl,
+		names: names,
+		defaults: UPFManifestValues{
+			Namespace:     conf.Orchestrator.Namespace,
+			Image:         t.Image,
+			AgentImage:    t.AgentImage,
+			Resources:     t.Resources,
+			AccessIP:      t.AccessIP,
+			CoreIP:        t.CoreIP,
+			AccessGateway: t.AccessGateway,
+			CoreGateway:   t.CoreGateway,
+			PreStopURL:    t.PreStopURL,
+			TerminationGracePeriod: int64((durationOrDefault(conf.Drain.Deadline, drainDeadlineDefault) +
+				preStopGraceMargin) / time.Second),
+			Ueransim:   conf.Ueransim,
+			SliceMeter: conf.SliceMeterConfig,
+			QoS:        conf.QciQosConfig,
+		},
+		upfs: t.UPFs,
+	}, nil
+}
+
+// values returns the values of the UPF name: the defaults, overridden by its own.
+func (r *manifestRenderer) values(name string) UPFManifestValues {
+	v := r.defaults
+	v.Name = name
+
+	own, ok := r.upfs[name]
+	if !ok {
+		return v
+	}
+
+	if own.Image != "" {
+		v.Image = own.Image
+	}
+
+	if own.AgentImage != "" {
+		v.AgentImage = own.AgentImage
+	}
+
+	if own.Resources != (UPFResources{}) {
+		v.Resources = own.Resources
+	}
+
+	if own.AccessIP != "" {
+		v.AccessIP = own.AccessIP
+	}
+
+	if own.CoreIP != "" {
+		v.CoreIP = own.CoreIP
+	}
+
+	if own.AccessGateway != "" {
+		v.AccessGateway = own.AccessGateway
+	}
+
+	if own.CoreGateway != "" {
+		v.CoreGateway = own.CoreGateway
+	}
+
+	return v
+}
+
+// render returns the manifest of the UPF name, its templates rendered one
+// after the other as a multi-document YAML.
+func (r *manifestRenderer) render(name string) ([]byte, error) {
+	var buf bytes.Buffer
+
+	values := r.values(name)
+
+	for _, t := range r.names {
+		buf.WriteString("\n---\n")
+
+		if err := r.tmpl.ExecuteTemplate(&buf, t, values); err != nil {
+			return nil, err
+		}
+	}
+
+	return buf.Bytes(), nil
+}
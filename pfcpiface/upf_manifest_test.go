@@ -0,0 +1,165 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright 2022-present Open Networking Foundation
+
+package pfcpiface
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRenderUPFManifest(t *testing.T) {
+	const templateDir = "../upfs/templates"
+
+	before, err := os.ReadFile(templateDir + "/upf.yaml")
+	require.NoError(t, err)
+
+	r, err := newManifestRenderer(&Conf{
+		Ueransim:         true,
+		SliceMeterConfig: SliceMeterConfig{N3RateBps: 1000, N3BurstBytes: 10, N6RateBps: 2000, N6BurstBytes: 20},
+		QciQosConfig:     []QciQosConfig{{QCI: 9, CBS: 2048, SchedulingPriority: 6}},
+		UPFTemplate: UPFTemplateInfo{
+			TemplateDir: templateDir,
+			Image:       "bess:1.0",
+			AgentImage:  "pfcpiface:1.0",
+			AccessIP:    "192.168.252.3/24",
+			CoreIP:      "192.168.250.3/24",
+			UPFs: map[string]UPFValuesInfo{
+				"upf205": {Image: "bess:2.0", Resources: UPFResources{CPU: "2", Memory: "4Gi"}},
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	manifest, err := r.render("upf205")
+	require.NoError(t, err)
+
+	objects, err := parseManifest(manifest)
+	require.NoError(t, err)
+	require.Len(t, objects, 4)
+
+	var conf struct {
+		Data map[string]string `json:"data"`
+	}
+
+	require.NoError(t, json.Unmarshal(objects[0].body, &conf))
+
+	var upfConf struct {
+		Ueransim bool `json:"ueransim"`
+		CPIface  struct {
+			Hostname string `json:"hostname"`
+		} `json:"cpiface"`
+		QciQosConfig     []QciQosConfig   `json:"qci_qos_config"`
+		SliceMeterConfig SliceMeterConfig `json:"slice_rate_limit_config"`
+	}
+
+	require.NoError(t, json.Unmarshal([]byte(conf.Data["upf.json"]), &upfConf), "upf.json is rendered as JSON")
+	require.True(t, upfConf.Ueransim)
+	require.Equal(t, "upf205", upfConf.CPIface.Hostname)
+	require.Equal(t, []QciQosConfig{{QCI: 9, CBS: 2048, SchedulingPriority: 6}}, upfConf.QciQosConfig)
+	require.Equal(t, SliceMeterConfig{N3RateBps: 1000, N3BurstBytes: 10, N6RateBps: 2000, N6BurstBytes: 20}, upfConf.SliceMeterConfig)
+
+	require.Equal(t, "StatefulSet", objects[3].kind)
+	require.Equal(t, "upf205", objects[3].name)
+
+	statefulSet := string(objects[3].body)
+	require.Contains(t, statefulSet, `"image":"bess:2.0"`, "the UPF's own image")
+	require.Contains(t, statefulSet, `"image":"pfcpiface:1.0"`, "the pool's agent image")
+	require.Contains(t, statefulSet, `"limits":{"cpu":"2","memory":"4Gi"}`)
+	require.Contains(t, statefulSet, `\"ips\": [\"192.168.252.3/24\"]`)
+
+	manifest, err = r.render("upf206")
+	require.NoError(t, err)
+	require.Contains(t, string(manifest), `image: "bess:1.0"`)
+	require.True(t, strings.Contains(string(manifest), "requests: {}"), "unbounded resources")
+
+	after, err := os.ReadFile(templateDir + "/upf.yaml")
+	require.NoError(t, err)
+	require.Equal(t, before, after, "templates are left untouched")
+}
+
+func TestRenderUPFRoutes(t *testing.T) {
+	r, err := newManifestRenderer(&Conf{
+		UPFTemplate: UPFTemplateInfo{
+			TemplateDir: "../upfs/templates",
+			AccessIP:    "192.168.252.3/24",
+			CoreIP:      "192.168.250.3/24",
+			UPFs: map[string]UPFValuesInfo{
+				"upf101": {AccessGateway: "192.168.252.101", CoreGateway: "192.168.250.101"},
+				"upf102": {AccessGateway: "192.168.252.102", CoreGateway: "192.168.250.102"},
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	routes := func(name string) string {
+		manifest, err := r.render(name)
+		require.NoError(t, err)
+
+		objects, err := parseManifest(manifest)
+		require.NoError(t, err)
+
+		var statefulSet struct {
+			Spec struct {
+				Template struct {
+					Spec struct {
+						InitContainers []struct {
+							Args []string `json:"args"`
+						} `json:"initContainers"`
+					} `json:"spec"`
+				} `json:"template"`
+			} `json:"spec"`
+		}
+
+		require.NoError(t, json.Unmarshal(objects[3].body, &statefulSet))
+
+		return statefulSet.Spec.Template.Spec.InitContainers[0].Args[0]
+	}
+
+	upf101, upf102 := routes("upf101"), routes("upf102")
+	require.Contains(t, upf101, "192.168.251.0/24 via 192.168.252.101;")
+	require.Contains(t, upf101, "default via 192.168.250.101 metric 110;")
+	require.Contains(t, upf102, "192.168.251.0/24 via 192.168.252.102;")
+	require.Contains(t, upf102, "192.168.254.0/24 via 192.168.250.102;")
+	require.NotContains(t, upf102, ".101")
+
+	require.NotContains(t, routes("upf105"), "via 192.168.25", "no gateway, no route")
+}
+
+func TestRenderUPFPreStop(t *testing.T) {
+	conf := &Conf{
+		Drain: DrainInfo{Deadline: "10m"},
+		UPFTemplate: UPFTemplateInfo{
+			TemplateDir: "../upfs/templates",
+			AccessIP:    "192.168.252.3/24",
+			CoreIP:      "192.168.250.3/24",
+			PreStopURL:  "http://upf-lb.omec:8081/pre-stop",
+		},
+	}
+
+	r, err := newManifestRenderer(conf)
+	require.NoError(t, err)
+
+	manifest, err := r.render("upf101")
+	require.NoError(t, err)
+
+	objects, err := parseManifest(manifest)
+	require.NoError(t, err)
+
+	statefulSet := string(objects[3].body)
+	require.Contains(t, statefulSet, `"terminationGracePeriodSeconds":630`, "the drain deadline and a margin")
+	require.Equal(t, 2, strings.Count(statefulSet, "http://upf-lb.omec:8081/pre-stop?upf=upf101"),
+		"the datapath and the agent wait for the drain")
+
+	conf.UPFTemplate.PreStopURL = ""
+	r, err = newManifestRenderer(conf)
+	require.NoError(t, err)
+
+	manifest, err = r.render("upf101")
+	require.NoError(t, err)
+	require.NotContains(t, string(manifest), "preStop")
+}
@@ -0,0 +1,196 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright 2022-present Open Networking Foundation
+
+package pfcpiface
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Reuse rules of UPF names, conf.UPFNames.Reuse.
+const (
+	upfNameReuseLowest = "lowest" // the lowest free ID
+	upfNameReuseNext   = "next"   // the free ID after the last allocated, wrapping around
+)
+
+// upfNameCreatingTTL bounds how long a name is held for a UPF being created
+// that never shows up in the inventory.
+const upfNameCreatingTTL = 10 * time.Minute
+
+// upfNameAllocator hands out the names of the UPFs created on scale-out, e.g.
+// "upf101", from a template and a range of IDs. A name is free when the UPF is
+// neither run by the orchestrator nor registered, nor being created, and was
+// released long enough ago for the old instance to be gone.
+type upfNameAllocator struct {
+	mu          sync.Mutex
+	template    string
+	firstID     uint32
+	lastID      uint32
+	reuse       string
+	reuseAfter  time.Duration
+	prevID      uint32               // ID allocated last
+	creating    map[string]time.Time // names allocated, not yet seen in the inventory
+	creatingTTL time.Duration
+	released    map[string]time.Time // names of the UPFs deleted, and when
+	now         func() time.Time
+}
+
+func newUPFNameAllocator(conf UPFNamesInfo) *upfNameAllocator {
+	return &upfNameAllocator{
+		template:    conf.Template,
+		firstID:     conf.FirstID,
+		lastID:      conf.LastID,
+		reuse:       conf.Reuse,
+		reuseAfter:  durationOrDefault(conf.ReuseAfter, 0),
+		prevID:      conf.LastID,
+		creating:    make(map[string]time.Time),
+		creatingTTL: upfNameCreatingTTL,
+		released:    make(map[string]time.Time),
+		now:         time.Now,
+	}
+}
+
+// name returns the name of the UPF with id.
+func (a *upfNameAllocator) name(id uint32) string {
+	return fmt.Sprintf(a.template, id)
+}
+
+// allocate returns a free name, given the names of the UPFs in use, and holds
+// it until it shows up in use or is released.
+func (a *upfNameAllocator) allocate(inUse []string) (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	id, name, err := a.free(inUse)
+	if err != nil {
+		return "", err
+	}
+
+	delete(a.released, name)
+	a.creating[name] = a.now()
+	a.prevID = id
+
+	return name, nil
+}
+
+// peek returns the name allocate would return, without holding it.
+func (a *upfNameAllocator) peek(inUse []string) (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	_, name, err := a.free(inUse)
+
+	return name, err
+}
+
+// free returns the next free ID and its name. a.mu must be held.
+func (a *upfNameAllocator) free(inUse []string) (uint32, string, error) {
+	now := a.now()
+	taken := make(map[string]bool, len(inUse))
+
+	for _, name := range inUse {
+		taken[name] = true
+		delete(a.creating, name)
+	}
+
+	for name, at := range a.creating {
+		if now.Sub(at) >= a.creatingTTL {
+			log.Warnln("UPF", name, "never showed up, its name is free again")
+			delete(a.creating, name)
+		}
+	}
+
+	start := a.firstID
+	if a.reuse == upfNameReuseNext && a.prevID < a.lastID {
+		start = a.prevID + 1
+	}
+
+	size := a.lastID - a.firstID + 1
+
+	for i := uint32(0); i < size; i++ {
+		id := a.firstID + (start-a.firstID+i)%size
+		name := a.name(id)
+
+		if taken[name] {
+			continue
+		}
+
+		if _, ok := a.creating[name]; ok {
+			continue
+		}
+
+		if at, ok := a.released[name]; ok && now.Sub(at) < a.reuseAfter {
+			continue
+		}
+
+		return id, name, nil
+	}
+
+	return 0, "", ErrNotFound(fmt.Sprintf("free UPF name in %s with IDs %d to %d", a.template, a.firstID, a.lastID))
+}
+
+// release frees name, for reuse once reuseAfter has passed.
+func (a *upfNameAllocator) release(name string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	delete(a.creating, name)
+	a.released[name] = a.now()
+}
+
+// upfInventory returns the names of the UPFs of the pool, each once: those the
+// orchestrator runs and those registered with the LB. It fails if the
+// orchestrator can't list its UPFs, as some may not have registered yet.
+func (node *PFCPNode) upfInventory() ([]string, error) {
+	var names []string
+
+	seen := make(map[string]bool)
+	add := func(name string) {
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+
+	if node.upf.orchestrator != nil {
+		listed, err := node.upf.orchestrator.ListUPFs()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, name := range listed {
+			add(name)
+		}
+	}
+
+	for _, u := range node.upf.peersUPF {
+		add(u.Hostname)
+	}
+
+	return names, nil
+}
+
+// scaleOutUPF creates a UPF under the next free name and returns it.
+func (node *PFCPNode) scaleOutUPF() (string, error) {
+	// A UPF run but not registered yet would be overwritten under its name
+	inventory, err := node.upfInventory()
+	if err != nil {
+		return "", err
+	}
+
+	name, err := node.upf.names.allocate(inventory)
+	if err != nil {
+		return "", err
+	}
+
+	if err := node.createUPF(name); err != nil {
+		node.upf.names.release(name)
+		return "", err
+	}
+
+	return name, nil
+}
@@ -0,0 +1,147 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright 2022-present Open Networking Foundation
+
+package pfcpiface
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestUPFNameAllocatorLowest(t *testing.T) {
+	now := time.Unix(0, 0)
+	a := newUPFNameAllocator(UPFNamesInfo{Template: "upf%d", FirstID: 998, LastID: 1001, Reuse: upfNameReuseLowest, ReuseAfter: "30s"})
+	a.now = func() time.Time { return now }
+
+	name, err := a.allocate([]string{"upf998"})
+	require.NoError(t, err)
+	require.Equal(t, "upf999", name)
+
+	name, err = a.allocate([]string{"upf998"})
+	require.NoError(t, err)
+	require.Equal(t, "upf1000", name, "upf999 is being created, past 999 is fine")
+
+	a.release("upf999")
+
+	name, err = a.allocate([]string{"upf998", "upf1000"})
+	require.NoError(t, err)
+	require.Equal(t, "upf1001", name, "upf999 was deleted too recently")
+
+	_, err = a.allocate([]string{"upf998", "upf1000", "upf1001"})
+	require.ErrorIs(t, err, errNotFound)
+
+	now = now.Add(time.Minute)
+
+	name, err = a.allocate([]string{"upf998", "upf1000", "upf1001"})
+	require.NoError(t, err)
+	require.Equal(t, "upf999", name)
+}
+
+func TestUPFNameAllocatorNext(t *testing.T) {
+	a := newUPFNameAllocator(UPFNamesInfo{Template: "edge-upf-%03d", FirstID: 1, LastID: 3, Reuse: upfNameReuseNext})
+
+	var names []string
+
+	for i := 0; i < 3; i++ {
+		name, err := a.allocate(nil)
+		require.NoError(t, err)
+
+		names = append(names, name)
+	}
+
+	require.Equal(t, []string{"edge-upf-001", "edge-upf-002", "edge-upf-003"}, names)
+
+	a.release("edge-upf-001")
+	a.release("edge-upf-002")
+
+	name, err := a.allocate([]string{"edge-upf-003"})
+	require.NoError(t, err)
+	require.Equal(t, "edge-upf-001", name, "wraps around")
+
+	name, err = a.allocate([]string{"edge-upf-001", "edge-upf-003"})
+	require.NoError(t, err)
+	require.Equal(t, "edge-upf-002", name, "the one after the last allocated")
+}
+
+func TestScaleOutUPF(t *testing.T) {
+	f := newFakeOrchestrator()
+	node := &PFCPNode{upf: &Upf{
+		orchestrator: f,
+		names:        newUPFNameAllocator(UPFNamesInfo{Template: "upf%d", FirstID: 101, LastID: 999, Reuse: upfNameReuseLowest}),
+		peersUPF:     []*Upf{{Hostname: "upf102"}},
+	}}
+
+	// Run by the orchestrator but not registered yet
+	require.NoError(t, f.CreateUPF("upf101"))
+
+	name, err := node.scaleOutUPF()
+	require.NoError(t, err)
+	require.Equal(t, "upf103", name)
+
+	f.err = errors.New("quota exceeded")
+	_, err = node.scaleOutUPF()
+	require.Error(t, err)
+
+	f.err = nil
+
+	name, err = node.scaleOutUPF()
+	require.NoError(t, err)
+	require.Equal(t, "upf104", name, "the name of the failed creation is free again")
+
+	require.NoError(t, node.deleteUPF("upf101"))
+
+	name, err = node.scaleOutUPF()
+	require.NoError(t, err)
+	require.Equal(t, "upf101", name)
+}
+
+func TestUPFInventory(t *testing.T) {
+	f := newFakeOrchestrator()
+	node := &PFCPNode{upf: &Upf{
+		orchestrator: f,
+		peersUPF:     []*Upf{{Hostname: "upf101"}, {Hostname: "upf103"}},
+	}}
+
+	require.NoError(t, f.CreateUPF("upf101"))
+	require.NoError(t, f.CreateUPF("upf102"))
+
+	names, err := node.upfInventory()
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"upf101", "upf102", "upf103"}, names,
+		"a UPF both run and registered counts once")
+
+	f.err = errors.New("API unreachable")
+	_, err = node.upfInventory()
+	require.Error(t, err)
+
+	node.upf.names = newUPFNameAllocator(UPFNamesInfo{Template: "upf%d", FirstID: 101, LastID: 999, Reuse: upfNameReuseLowest})
+	_, err = node.scaleOutUPF()
+	require.Error(t, err, "upf102 runs, not registered yet")
+	require.Len(t, f.created, 2, "nothing created blind")
+}
+
+func TestUPFNameCreatingExpires(t *testing.T) {
+	now := time.Unix(0, 0)
+	a := newUPFNameAllocator(UPFNamesInfo{Template: "upf%d", FirstID: 1, LastID: 2, Reuse: upfNameReuseLowest})
+	a.now = func() time.Time { return now }
+
+	name, err := a.allocate(nil)
+	require.NoError(t, err)
+	require.Equal(t, "upf1", name)
+
+	name, err = a.allocate(nil)
+	require.NoError(t, err)
+	require.Equal(t, "upf2", name)
+
+	_, err = a.allocate([]string{"upf2"})
+	require.Error(t, err, "upf1 is still being created")
+
+	now = now.Add(upfNameCreatingTTL)
+
+	name, err = a.allocate([]string{"upf2"})
+	require.NoError(t, err)
+	require.Equal(t, "upf1", name, "upf1 never showed up")
+}
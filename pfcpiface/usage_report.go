@@ -0,0 +1,132 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright 2022-present Open Networking Foundation
+
+package pfcpiface
+
+import (
+	log "github.com/sirupsen/logrus"
+	"github.com/wmnsk/go-pfcp/ie"
+	"github.com/wmnsk/go-pfcp/message"
+)
+
+// SesReportD2uMsg carries usage a UPF reported outside of any SMF request, from
+// Down to Up to be reported to the SMF.
+type SesReportD2uMsg struct {
+	upSeid       uint64
+	usageReports []*ie.IE
+}
+
+// trackURRs updates the URRs seid has with those a request of the SMF creates
+// and removes, as they arrive.
+func (node *PFCPNode) trackURRs(seid uint64, createURRs, removeURRs []*ie.IE) {
+	urrs, ok := node.upf.sesURRs[seid]
+	if !ok {
+		urrs = make(map[uint32]bool)
+		node.upf.sesURRs[seid] = urrs
+	}
+
+	for _, c := range createURRs {
+		if id, err := c.URRID(); err == nil {
+			urrs[id] = true
+		}
+	}
+
+	for _, r := range removeURRs {
+		if id, err := r.URRID(); err == nil {
+			delete(urrs, id)
+		}
+	}
+}
+
+// sessionURRIDs returns the URRs seid has, from all its requests so far.
+func (node *PFCPNode) sessionURRIDs(seid uint64) []uint32 {
+	urrs := node.upf.sesURRs[seid]
+
+	ids := make([]uint32, 0, len(urrs))
+	for id := range urrs {
+		ids = append(ids, id)
+	}
+
+	return ids
+}
+
+// newQueryURRRequest builds a Session Modification Request asking a UPF for an
+// immediate usage report of urrIDs.
+func newQueryURRRequest(seid uint64, seq uint32, urrIDs []uint32) *message.SessionModificationRequest {
+	smreq := message.NewSessionModificationRequest(0, 0, seid, seq, 123)
+
+	for _, id := range urrIDs {
+		smreq.QueryURR = append(smreq.QueryURR, ie.NewQueryURR(ie.NewURRID(id)))
+	}
+
+	return smreq
+}
+
+// sessionReportUsage turns the Usage Report IEs of a modification or deletion
+// response into the ones of a Session Report Request.
+func sessionReportUsage(reports []*ie.IE) []*ie.IE {
+	usage := make([]*ie.IE, 0, len(reports))
+
+	for _, r := range reports {
+		ies, err := r.UsageReport()
+		if err != nil {
+			log.Errorln("Ignoring undecodable usage report:", err)
+			continue
+		}
+
+		usage = append(usage, ie.NewUsageReportWithinSessionReportRequest(ies...))
+	}
+
+	return usage
+}
+
+// reportMigratedUsage forwards the usage a source UPF reported for a migrated session.
+func reportMigratedUsage(seid uint64, reports []*ie.IE, comCh CommunicationChannel) {
+	if len(reports) == 0 {
+		return
+	}
+
+	comCh.SesReportD2u <- &SesReportD2uMsg{
+		upSeid:       seid,
+		usageReports: sessionReportUsage(reports),
+	}
+}
+
+// sendSessionReport sends a Session Report Request to the SMF owning session.
+// The response is handled by handleSessionReportResponse.
+func (pConn *PFCPConn) sendSessionReport(session PFCPSession, report *SesReportD2uMsg) {
+	srreq := message.NewSessionReportRequest(0, 0, session.remoteSEID, pConn.getSeqNum(), 0,
+		ie.NewReportType(0, 0, 1, 0),
+	)
+	srreq.UsageReport = report.usageReports
+
+	pConn.SendPFCPMsg(srreq)
+}
+
+// listenForSesReport relays session reports of Down to the SMF owning the session.
+func (node *PFCPNode) listenForSesReport(comCh CommunicationChannel) {
+	for {
+		report := <-comCh.SesReportD2u
+		log.Debugln("Session report received by up, up seid:", report.upSeid, "usage reports:", len(report.usageReports))
+
+		found := false
+
+		node.pConns.Range(func(key, value interface{}) bool {
+			pConn := value.(*PFCPConn)
+
+			session, ok := pConn.sessionStore.GetSession(report.upSeid)
+			if !ok {
+				return true
+			}
+
+			pConn.sendSessionReport(session, report)
+			found = true
+
+			return false
+		})
+
+		if !found {
+			log.Warnln("No SMF session found to report", report.upSeid, "to")
+		}
+	}
+}
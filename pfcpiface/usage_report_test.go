@@ -0,0 +1,104 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright 2022-present Open Networking Foundation
+
+package pfcpiface
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/wmnsk/go-pfcp/ie"
+	"github.com/wmnsk/go-pfcp/message"
+)
+
+func TestSessionURRIDs(t *testing.T) {
+	node := &PFCPNode{upf: &Upf{sesURRs: make(map[uint64]map[uint32]bool)}}
+
+	sereq := message.NewSessionEstablishmentRequest(0, 0, 1, 1, 0,
+		ie.NewCreateURR(ie.NewURRID(10)),
+		ie.NewCreateURR(ie.NewURRID(11)),
+	)
+	node.trackURRs(1, sereq.CreateURR, nil)
+
+	smreq := message.NewSessionModificationRequest(0, 0, 1, 2, 0,
+		ie.NewCreateURR(ie.NewURRID(12)),
+		ie.NewRemoveURR(ie.NewURRID(10)),
+	)
+	node.trackURRs(1, smreq.CreateURR, smreq.RemoveURR)
+
+	smreq = message.NewSessionModificationRequest(0, 0, 1, 3, 0,
+		ie.NewCreateURR(ie.NewURRID(13)),
+	)
+	node.trackURRs(1, smreq.CreateURR, smreq.RemoveURR)
+
+	require.ElementsMatch(t, []uint32{11, 12, 13}, node.sessionURRIDs(1), "12 is kept after a later modification")
+	require.Empty(t, node.sessionURRIDs(2))
+}
+
+func TestNewQueryURRRequest(t *testing.T) {
+	smreq := newQueryURRRequest(7, 3, []uint32{11, 12})
+
+	require.Equal(t, uint64(7), smreq.SEID())
+	require.Equal(t, uint8(123), smreq.Header.MessagePriority)
+	require.Len(t, smreq.QueryURR, 2)
+
+	id, err := smreq.QueryURR[1].URRID()
+	require.NoError(t, err)
+	require.Equal(t, uint32(12), id)
+}
+
+func TestSessionReportUsage(t *testing.T) {
+	reports := []*ie.IE{
+		ie.NewUsageReportWithinSessionModificationResponse(
+			ie.NewURRID(11),
+			ie.NewURSEQN(1),
+			ie.NewVolumeMeasurement(0x07, 3000, 1000, 2000, 0, 0, 0),
+		),
+	}
+
+	usage := sessionReportUsage(reports)
+	require.Len(t, usage, 1)
+	require.Equal(t, ie.UsageReportWithinSessionReportRequest, usage[0].Type)
+	require.Equal(t, reports[0].Payload, usage[0].Payload)
+}
+
+func TestSendSessionReport(t *testing.T) {
+	smf, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	defer smf.Close()
+
+	conn, err := net.DialUDP("udp", nil, smf.LocalAddr().(*net.UDPAddr))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	usage := sessionReportUsage([]*ie.IE{
+		ie.NewUsageReportWithinSessionDeletionResponse(ie.NewURRID(11), ie.NewURSEQN(1)),
+	})
+
+	pConn := &PFCPConn{Conn: conn}
+	pConn.sendSessionReport(PFCPSession{remoteSEID: 42}, &SesReportD2uMsg{upSeid: 7, usageReports: usage})
+
+	buf := make([]byte, 1500)
+	require.NoError(t, smf.SetReadDeadline(time.Now().Add(time.Second)))
+	n, err := smf.Read(buf)
+	require.NoError(t, err)
+
+	msg, err := message.Parse(buf[:n])
+	require.NoError(t, err)
+
+	srreq, ok := msg.(*message.SessionReportRequest)
+	require.True(t, ok)
+	require.Equal(t, uint64(42), srreq.SEID())
+	require.Empty(t, srreq.IEs, "only IEs of a Session Report Request")
+
+	reportType, err := srreq.ReportType.ReportType()
+	require.NoError(t, err)
+	require.Equal(t, uint8(0x02), reportType, "USAR")
+
+	require.Len(t, srreq.UsageReport, 1)
+	id, err := srreq.UsageReport[0].URRID()
+	require.NoError(t, err)
+	require.Equal(t, uint32(11), id)
+}
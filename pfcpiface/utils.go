@@ -13,6 +13,7 @@ import (
 	"github.com/omec-project/upf-epc/internal/p4constants"
 
 	log "github.com/sirupsen/logrus"
+	"github.com/wmnsk/go-pfcp/ie"
 )
 
 // Bits type.
@@ -100,6 +101,26 @@ func calcBurstSizeFromRate(kbps uint64, ms uint64) uint64 {
 	return uint64((float64(kbps) * 1000 / 8) * (float64(ms) / 1000))
 }
 
+// canonicalIP returns the canonical text form of an IP literal, which may be
+// bracketed. Anything else, e.g. a hostname, is returned unchanged.
+func canonicalIP(s string) string {
+	ip := net.ParseIP(strings.TrimSuffix(strings.TrimPrefix(s, "["), "]"))
+	if ip == nil {
+		return s
+	}
+
+	return ip.String()
+}
+
+// newFSEID builds an F-SEID IE carrying ip in the field matching its family.
+func newFSEID(seid uint64, ip net.IP) *ie.IE {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ie.NewFSEID(seid, ip4, nil)
+	}
+
+	return ie.NewFSEID(seid, nil, ip)
+}
+
 // MustParseStrIP : parse IP address from config and fail on error.
 func MustParseStrIP(address string) *net.IPNet {
 	_, ipNet, err := net.ParseCIDR(address)
@@ -91,3 +91,28 @@ func TestGetSliceTcMeterIndex(t *testing.T) {
 		)
 	}
 }
+
+func TestCanonicalIP(t *testing.T) {
+	require.Equal(t, "10.0.0.1", canonicalIP("10.0.0.1"))
+	require.Equal(t, "2001:db8::1", canonicalIP("2001:DB8:0::1"))
+	require.Equal(t, "2001:db8::1", canonicalIP("[2001:db8::1]"))
+	require.Equal(t, "upf101.omec.svc", canonicalIP("upf101.omec.svc"))
+}
+
+func TestUpfPFCPAddr(t *testing.T) {
+	require.Equal(t, "10.0.0.1:"+DownPFCPPort, upfPFCPAddr("10.0.0.1"))
+	require.Equal(t, "[2001:db8::1]:"+DownPFCPPort, upfPFCPAddr("2001:db8::1"))
+}
+
+func TestNewFSEID(t *testing.T) {
+	fseid, err := newFSEID(1, net.ParseIP("10.0.0.1")).FSEID()
+	require.NoError(t, err)
+	require.Equal(t, "10.0.0.1", fseid.IPv4Address.String())
+	require.Nil(t, fseid.IPv6Address)
+
+	fseid, err = newFSEID(2, net.ParseIP("2001:db8::1")).FSEID()
+	require.NoError(t, err)
+	require.Nil(t, fseid.IPv4Address)
+	require.Equal(t, "2001:db8::1", fseid.IPv6Address.String())
+	require.Equal(t, uint64(2), fseid.SEID)
+}
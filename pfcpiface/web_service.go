@@ -9,8 +9,7 @@ import (
 	"io"
 	"math"
 	"net/http"
-	"os/exec"
-	"time"
+	"strconv"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -23,8 +22,15 @@ type NetworkSlice struct {
 }
 
 type PfcpInfo struct {
-	Ip  string `json:"ip"`
-	Upf *Upf   `json:"upf"`
+	Ip   string `json:"ip"`
+	Fqdn string `json:"fqdn"` // resolved when Ip is empty, then periodically
+	Upf  *Upf   `json:"upf"`
+	// e.g. {"version": "1.4.0"}, used to route a canary share of sessions to it
+	Labels map[string]string `json:"labels"`
+	// registers the UPF as the shadow, mirrored the session requests but not part of the pool
+	Shadow bool `json:"shadow"`
+
+	rebind bool // association with an already known UPF
 }
 
 type SesTransReq struct {
@@ -36,6 +42,13 @@ type upfDelReq struct {
 	UpfId int `json:"upfid"`
 }
 
+// canaryReq starts, promotes or aborts the canary.
+type canaryReq struct {
+	Action  string            `json:"action"` // "start", "promote" or "abort"
+	Labels  map[string]string `json:"labels"`
+	Percent uint32            `json:"percent"`
+}
+
 // SliceQos ... Slice level QOS rates.
 type SliceQos struct {
 	UplinkMbr    uint64 `json:"uplinkMbr"`
@@ -79,9 +92,44 @@ func newPFCPHandler(w http.ResponseWriter, r *http.Request, node *PFCPNode, comC
 		var pfcpInfo PfcpInfo
 		//fmt.Println("parham log : http body = ", body)
 		err = json.Unmarshal(body, &pfcpInfo)
-		if err != nil {
+		if err != nil || pfcpInfo.Upf == nil {
 			log.Errorln("Json unmarshal failed for http request")
 			sendHTTPResp(http.StatusBadRequest, w)
+			return
+		}
+
+		if pfcpInfo.Ip == "" && pfcpInfo.Fqdn != "" {
+			pfcpInfo.Ip, err = resolveUPFAddr(pfcpInfo.Fqdn)
+			if err != nil {
+				log.Errorln("Unable to resolve UPF", pfcpInfo.Fqdn, err)
+				sendHTTPResp(http.StatusBadRequest, w)
+				return
+			}
+		}
+
+		if node.upf.shadow.isShadow(&pfcpInfo) {
+			pfcpInfo.Shadow = true
+			pfcpInfo.Ip = canonicalIP(pfcpInfo.Ip)
+			go node.tryConnectToN4Peer(node.LocalAddr().String(), comCh, pfcpInfo, pos)
+			sendHTTPResp(http.StatusCreated, w)
+
+			return
+		}
+
+		// A known UPF registering again, e.g. after a restart, keeps its identity and sessions
+		if u := node.upf.peerByNodeID(canonicalNodeID(pfcpInfo.Upf.NodeID)); u != nil {
+			if pfcpInfo.Fqdn != "" {
+				u.fqdn = pfcpInfo.Fqdn
+			}
+
+			if pfcpInfo.Labels != nil {
+				u.labels = pfcpInfo.Labels
+			}
+
+			node.requestRebind(u, canonicalIP(pfcpInfo.Ip))
+			sendHTTPResp(http.StatusCreated, w)
+
+			return
 		}
 
 		//handleSliceConfig(&nwSlice, c.upf)
@@ -153,23 +201,259 @@ func upfDelHandler(w http.ResponseWriter, r *http.Request, node *PFCPNode, comCh
 		if err != nil {
 			log.Errorln("Json unmarshal failed for http request")
 			sendHTTPResp(http.StatusBadRequest, w)
+
+			return
+		}
+
+		if upfDelReq.UpfId < 0 || upfDelReq.UpfId >= len(node.upf.peersUPF) {
+			sendHTTPResp(http.StatusBadRequest, w)
+			return
+		}
+
+		// Deleted once its sessions were moved off, kept if they couldn't be
+		u := node.upf.peersUPF[upfDelReq.UpfId]
+		job := node.retireUPF(u, comCh)
+
+		go func() {
+			if err := node.drainAndDelete(u, comCh); err != nil {
+				log.Errorln("Unable to delete UPF", u.Hostname, err)
+			}
+		}()
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+
+		if err := json.NewEncoder(w).Encode(job.snapshot()); err != nil {
+			log.Errorln("http response write failed : ", err)
+		}
+	default:
+		//log.infoln(w, "Sorry, only PUT and POST methods are supported.")
+		sendHTTPResp(http.StatusMethodNotAllowed, w)
+	}
+}
+
+// drainsHandler returns the drain jobs, or aborts the drain of the UPF named
+// by the upf query parameter.
+func drainsHandler(w http.ResponseWriter, r *http.Request, node *PFCPNode) {
+	if node.upf.drains == nil {
+		sendHTTPResp(http.StatusNotFound, w)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		w.Header().Set("Content-Type", "application/json")
+
+		if err := json.NewEncoder(w).Encode(node.upf.drains.list()); err != nil {
+			log.Errorln("http response write failed : ", err)
+		}
+	case "DELETE":
+		if !node.upf.drains.stop(r.URL.Query().Get("upf")) {
+			sendHTTPResp(http.StatusNotFound, w)
+			return
+		}
+
+		sendHTTPResp(http.StatusOK, w)
+	default:
+		sendHTTPResp(http.StatusMethodNotAllowed, w)
+	}
+}
+
+// smfPathsHandler returns the state of the path towards each associated SMF.
+func smfPathsHandler(w http.ResponseWriter, r *http.Request, node *PFCPNode) {
+	switch r.Method {
+	case "GET":
+		w.Header().Set("Content-Type", "application/json")
+
+		if err := json.NewEncoder(w).Encode(node.upf.smfPaths.snapshot()); err != nil {
+			log.Errorln("http response write failed : ", err)
+		}
+	default:
+		sendHTTPResp(http.StatusMethodNotAllowed, w)
+	}
+}
+
+// shadowHandler returns the outcome of the comparisons with the shadow UPF.
+func shadowHandler(w http.ResponseWriter, r *http.Request, node *PFCPNode) {
+	switch r.Method {
+	case "GET":
+		w.Header().Set("Content-Type", "application/json")
+
+		if err := json.NewEncoder(w).Encode(node.upf.shadow.snapshot()); err != nil {
+			log.Errorln("http response write failed : ", err)
+		}
+	default:
+		sendHTTPResp(http.StatusMethodNotAllowed, w)
+	}
+}
+
+// autoscalerHandler returns the last decision of the autoscaler and, if
+// scale-out is predictive, the sessions forecast. PUT {"dry_run": true}
+// switches the dry run on, and returns them too.
+func autoscalerHandler(w http.ResponseWriter, r *http.Request, node *PFCPNode) {
+	if node.upf.autoscaler == nil {
+		sendHTTPResp(http.StatusNotFound, w)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		w.Header().Set("Content-Type", "application/json")
+
+		if err := json.NewEncoder(w).Encode(node.upf.autoscaler.status()); err != nil {
+			log.Errorln("http response write failed : ", err)
+		}
+	case "PUT":
+		var req struct {
+			DryRun *bool `json:"dry_run"`
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err == nil {
+			err = json.Unmarshal(body, &req)
+		}
+
+		if err != nil || req.DryRun == nil {
+			log.Errorln("Invalid autoscaler request:", string(body), err)
+			sendHTTPResp(http.StatusBadRequest, w)
+
+			return
+		}
+
+		node.upf.autoscaler.setDryRun(*req.DryRun)
+		w.Header().Set("Content-Type", "application/json")
+
+		if err := json.NewEncoder(w).Encode(node.upf.autoscaler.status()); err != nil {
+			log.Errorln("http response write failed : ", err)
+		}
+	default:
+		sendHTTPResp(http.StatusMethodNotAllowed, w)
+	}
+}
+
+// decisionsHandler returns the last decisions of the autoscaler, oldest first,
+// at most ?limit= of them.
+func decisionsHandler(w http.ResponseWriter, r *http.Request, node *PFCPNode) {
+	if node.upf.autoscaler == nil {
+		sendHTTPResp(http.StatusNotFound, w)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		limit := 0
+
+		if l := r.URL.Query().Get("limit"); l != "" {
+			var err error
+			if limit, err = strconv.Atoi(l); err != nil {
+				sendHTTPResp(http.StatusBadRequest, w)
+				return
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+
+		if err := json.NewEncoder(w).Encode(node.upf.autoscaler.audit.list(limit)); err != nil {
+			log.Errorln("http response write failed : ", err)
+		}
+	default:
+		sendHTTPResp(http.StatusMethodNotAllowed, w)
+	}
+}
+
+// schedulesHandler returns the scaling schedules, or replaces them.
+func schedulesHandler(w http.ResponseWriter, r *http.Request, node *PFCPNode) {
+	if node.upf.autoscaler == nil {
+		sendHTTPResp(http.StatusNotFound, w)
+		return
+	}
+
+	schedules := node.upf.autoscaler.schedules
+
+	switch r.Method {
+	case "GET":
+		w.Header().Set("Content-Type", "application/json")
+
+		if err := json.NewEncoder(w).Encode(schedules.list()); err != nil {
+			log.Errorln("http response write failed : ", err)
+		}
+	case "PUT":
+		var req []ScalingScheduleInfo
+
+		body, err := io.ReadAll(r.Body)
+		if err == nil {
+			err = json.Unmarshal(body, &req)
+		}
+
+		if err == nil {
+			err = schedules.set(req)
 		}
 
-		//handleSliceConfig(&nwSlice, c.upf)
-		makeUPFEmpty(node, upfDelReq.UpfId, comCh)
-		time.Sleep(2 * time.Second)
-		upfName := node.upf.peersUPF[upfDelReq.UpfId].Hostname
-		upfFile := fmt.Sprint("/upfs/", upfName, ".yaml")
-		cmd := exec.Command("kubectl", "delete", "-n", "omec", "-f", upfFile)
-		log.Traceln("executing command : ", cmd.String())
-		combinedOutput, err := cmd.CombinedOutput()
 		if err != nil {
-			fmt.Printf("Error executing command: %v\nCombined Output: %s", cmd.String(), combinedOutput)
+			log.Errorln("Invalid scaling schedules:", err)
 			sendHTTPResp(http.StatusBadRequest, w)
+
+			return
 		}
+
+		log.Infoln("Scaling schedules replaced:", req)
+		sendHTTPResp(http.StatusCreated, w)
+	default:
+		sendHTTPResp(http.StatusMethodNotAllowed, w)
+	}
+}
+
+// canaryHandler returns the state of the canary, or starts, promotes or aborts it.
+// Aborting moves the canary's sessions back to the stable UPFs.
+func canaryHandler(w http.ResponseWriter, r *http.Request, node *PFCPNode, comCh CommunicationChannel) {
+	switch r.Method {
+	case "GET":
+		w.Header().Set("Content-Type", "application/json")
+
+		if err := json.NewEncoder(w).Encode(node.upf.canary.status()); err != nil {
+			log.Errorln("http response write failed : ", err)
+		}
+	case "PUT":
+		fallthrough
+	case "POST":
+		var req canaryReq
+
+		body, err := io.ReadAll(r.Body)
+		if err == nil {
+			err = json.Unmarshal(body, &req)
+		}
+
+		if err != nil {
+			log.Errorln("Json unmarshal failed for http request")
+			sendHTTPResp(http.StatusBadRequest, w)
+
+			return
+		}
+
+		switch req.Action {
+		case "start":
+			if len(req.Labels) == 0 || req.Percent > 100 {
+				err = ErrInvalidArgument("canary", req)
+			} else {
+				node.upf.canary.start(req.Labels, req.Percent)
+			}
+		case "promote":
+			err = node.upf.canary.promote()
+		case "abort":
+			err = node.abortCanary(comCh)
+		default:
+			err = ErrInvalidArgument("canary action", req.Action)
+		}
+
+		if err != nil {
+			log.Errorln("canary", req.Action, "failed:", err)
+			sendHTTPResp(http.StatusBadRequest, w)
+
+			return
+		}
+
 		sendHTTPResp(http.StatusCreated, w)
 	default:
-		//log.infoln(w, "Sorry, only PUT and POST methods are supported.")
 		sendHTTPResp(http.StatusMethodNotAllowed, w)
 	}
 }